@@ -4,12 +4,14 @@ import (
 	"context"
 	"crypto/sha256"
 	"crypto/sha512"
+	"embed"
 	"encoding/base64"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"text/template"
@@ -18,7 +20,16 @@ import (
 	"github.com/yuin/gopher-lua"
 )
 
-// Removed embed for now - we'll generate everything at build time
+// runtimeSources holds the module implementations shared by "hype run" and
+// built executables. They are copied next to the generated main.go at build time.
+//
+//go:embed *_functions.go
+var runtimeSources embed.FS
+
+// runtimeBuildTags maps the build tags hype was built with to the module
+// their runtime sources require. Tagged files such as builder_lmdb.go add
+// themselves, so built executables get the same optional engines.
+var runtimeBuildTags = map[string]string{}
 
 type BuildConfig struct {
 	ScriptPath               string
@@ -32,6 +43,7 @@ type BuildConfig struct {
 	PluginDependencies       []string
 	PluginSourceFiles        []string
 	HasPlugins               bool
+	BuildTags                []string
 }
 
 
@@ -55,6 +67,7 @@ func buildExecutableWithPlugins(scriptPath, outputName, target string, pluginSpe
 	if config.Target == "current" {
 		config.Target = runtime.GOOS
 	}
+	config.BuildTags = runtimeTagsFor(config.Target)
 
 	// Load plugins first if specified
 	var availableModules map[string]bool
@@ -106,6 +119,11 @@ func buildExecutableWithPlugins(scriptPath, outputName, target string, pluginSpe
 		return fmt.Errorf("failed to generate runtime code: %w", err)
 	}
 	
+	// Copy shared module sources to build directory
+	if err := copyRuntimeSourceFiles(tempDir, config.BuildTags); err != nil {
+		return fmt.Errorf("failed to copy runtime sources: %w", err)
+	}
+	
 	// Copy plugin source files to build directory
 	if err := copyPluginSourceFiles(tempDir, config); err != nil {
 		return fmt.Errorf("failed to copy plugin source files: %w", err)
@@ -239,6 +257,63 @@ func copyPluginSourceFiles(tempDir string, config *BuildConfig) error {
 	return nil
 }
 
+// runtimeTagsFor returns the build tags to compile an executable for target
+// with. Tagged sources use cgo, so they are left out when cross-compiling.
+func runtimeTagsFor(target string) []string {
+	for env, host := range map[string]string{"GOOS": runtime.GOOS, "GOARCH": runtime.GOARCH} {
+		if value := os.Getenv(env); value != "" && value != host {
+			return nil
+		}
+	}
+	if target != runtime.GOOS {
+		return nil
+	}
+	
+	var tags []string
+	for tag := range runtimeBuildTags {
+		tags = append(tags, tag)
+	}
+	slices.Sort(tags)
+	return tags
+}
+
+// runtimeSourceTag returns the tag of a source behind a //go:build line
+func runtimeSourceTag(content []byte) string {
+	line, _, _ := strings.Cut(string(content), "\n")
+	if tag, ok := strings.CutPrefix(line, "//go:build "); ok {
+		return strings.TrimSpace(tag)
+	}
+	return ""
+}
+
+// copyRuntimeSourceFiles writes the embedded module sources to the build directory
+func copyRuntimeSourceFiles(tempDir string, tags []string) error {
+	entries, err := runtimeSources.ReadDir(".")
+	if err != nil {
+		return err
+	}
+	
+	for _, entry := range entries {
+		content, err := runtimeSources.ReadFile(entry.Name())
+		if err != nil {
+			return fmt.Errorf("failed to read runtime source %s: %w", entry.Name(), err)
+		}
+		
+		// Files behind a build tag need a module the generated go.mod only
+		// requires when the executable is built with that tag
+		if tag := runtimeSourceTag(content); tag != "" && !slices.Contains(tags, tag) {
+			continue
+		}
+		
+		destPath := filepath.Join(tempDir, entry.Name())
+		if err := os.WriteFile(destPath, content, 0644); err != nil {
+			return fmt.Errorf("failed to write runtime source to %s: %w", destPath, err)
+		}
+	}
+	
+	return nil
+}
+
 // removeHypePluginInterface removes the HypePlugin interface definition from plugin code
 func removeHypePluginInterface(content string) string {
 	// Remove the interface definition
@@ -267,32 +342,18 @@ func generateRuntimeCode(tempDir string, config *BuildConfig) error {
 	runtimeTemplate := `package main
 
 import (
-	"bytes"
 	"context"
-	"crypto"
-	"crypto/ecdsa"
-	"crypto/ed25519"
-	"crypto/elliptic"
-	"crypto/rand"
-	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/base64"
-	"encoding/hex"
-	"encoding/json"
 	"fmt"
-	"math/big"
 	"os"
-	"sort"
 	{{if .HasPlugins}}"reflect"{{end}}
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 	"github.com/yuin/gopher-lua"
-	"github.com/gdamore/tcell/v2"
-	"github.com/rivo/tview"
-	"go.etcd.io/bbolt"
 	"io"
 	"log"
 	"net/http"
@@ -305,6 +366,7 @@ const luaScript = {{.ScriptContent}}
 func main() {
 	L := lua.NewState()
 	defer L.Close()
+	defer kvCloseAll()
 
 	// Open standard libraries
 	L.PreloadModule("_G", lua.OpenBase)
@@ -338,10 +400,26 @@ func main() {
 	// Register WebSocket module
 	registerWebSocketModule(L)
 
+	// Register JSON module
+	registerJSONModule(L)
+
+	// Register data format modules
+	registerYAMLModule(L)
+	registerTOMLModule(L)
+	registerCSVModule(L)
+	registerMsgPackModule(L)
+
+	// Register encoding module
+	registerEncodingModule(L)
+
+	// Register queue module
+	registerQueueModule(L)
+
 {{.PluginRegistrationCode}}
 
 	if err := L.DoString(luaScript); err != nil {
 		fmt.Fprintf(os.Stderr, "Error running Lua script: %v\n", err)
+		kvCloseAll()
 		os.Exit(1)
 	}
 }
@@ -367,2603 +445,632 @@ func setupCommandLineArgs(L *lua.LState) {
 	L.SetGlobal("arg", argTable)
 }
 
-func registerTUIFunctions(L *lua.LState) {
-	// Create TUI module
-	tuiModule := L.NewTable()
+func registerHTTPModule(L *lua.LState) {
+	L.PreloadModule("http", func(L *lua.LState) int {
+		httpModule := L.NewTable()
+		L.SetField(httpModule, "get", L.NewFunction(httpGet))
+		L.SetField(httpModule, "newServer", L.NewFunction(httpNewServer))
+		L.Push(httpModule)
+		return 1
+	})
+	
+	// Set up server metatable
+	serverMT := L.NewTypeMetatable("HTTPServer")
+	L.SetField(serverMT, "__index", L.NewFunction(serverIndex))
+}
+
+func httpGet(L *lua.LState) int {
+	url := L.CheckString(1)
+	
+	// Optional options table
+	var timeout time.Duration = 30 * time.Second
+	var userAgent string = "LuaX/1.0"
+	
+	if L.GetTop() >= 2 {
+		options := L.CheckTable(2)
+		if timeoutVal := L.GetField(options, "timeout"); timeoutVal != lua.LNil {
+			if timeoutNum, ok := timeoutVal.(lua.LNumber); ok {
+				timeout = time.Duration(float64(timeoutNum)) * time.Second
+			}
+		}
+		if headers := L.GetField(options, "headers"); headers != lua.LNil {
+			if headersTable, ok := headers.(*lua.LTable); ok {
+				if ua := L.GetField(headersTable, "User-Agent"); ua != lua.LNil {
+					if uaStr, ok := ua.(lua.LString); ok {
+						userAgent = string(uaStr)
+					}
+				}
+			}
+		}
+	}
+	
+	client := &http.Client{Timeout: timeout}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
 	
-	// Basic TUI functions
-	L.SetField(tuiModule, "newApp", L.NewFunction(luaNewApp))
-	L.SetField(tuiModule, "newTextView", L.NewFunction(luaNewTextView))
-	L.SetField(tuiModule, "newInputField", L.NewFunction(luaNewInputField))
-	L.SetField(tuiModule, "newButton", L.NewFunction(luaNewButton))
-	L.SetField(tuiModule, "newFlex", L.NewFunction(luaNewFlex))
+	req.Header.Set("User-Agent", userAgent)
+	
+	resp, err := client.Do(req)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	defer resp.Body.Close()
+	
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
 	
-	L.SetGlobal("tui", tuiModule)
+	result := L.NewTable()
+	L.SetField(result, "status", lua.LNumber(resp.StatusCode))
+	L.SetField(result, "body", lua.LString(string(body)))
+	L.SetField(result, "json", newJSONBodyFunction(L, string(body)))
 	
-	// Set up metatables for TUI objects
-	setupTUIMetatables(L)
+	L.Push(result)
+	L.Push(lua.LNil)
+	return 2
 }
 
-func setupTUIMetatables(L *lua.LState) {
-	// App metatable
-	appMT := L.NewTypeMetatable("App")
-	L.SetField(appMT, "__index", L.NewFunction(appIndex))
-	
-	// TextView metatable  
-	textViewMT := L.NewTypeMetatable("TextView")
-	L.SetField(textViewMT, "__index", L.NewFunction(textViewIndex))
-	
-	// InputField metatable
-	inputFieldMT := L.NewTypeMetatable("InputField")
-	L.SetField(inputFieldMT, "__index", L.NewFunction(inputFieldIndex))
-	
-	// Button metatable
-	buttonMT := L.NewTypeMetatable("Button")
-	L.SetField(buttonMT, "__index", L.NewFunction(buttonIndex))
-	
-	// Flex metatable
-	flexMT := L.NewTypeMetatable("Flex")
-	L.SetField(flexMT, "__index", L.NewFunction(flexIndex))
+type HTTPServer struct {
+	server   *http.Server
+	mux      *http.ServeMux
+	handlers map[string]*lua.LFunction
+	L        *lua.LState  // Main Lua state for registration  
+	mu       sync.RWMutex
 }
 
-func appIndex(L *lua.LState) int {
-	ud := L.CheckUserData(1)
-	app := ud.Value.(*tview.Application)
-	method := L.CheckString(2)
-	
-	switch method {
-	case "SetRoot":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			// Skip the first argument (self)
-			rootUD := L.CheckUserData(2)
-			fullscreen := L.OptBool(3, true)
-			app.SetRoot(rootUD.Value.(tview.Primitive), fullscreen)
-			return 0
-		}))
-	case "Run":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			if err := app.Run(); err != nil {
-				L.Push(lua.LString(err.Error()))
-				return 1
-			}
-			return 0
-		}))
-	case "Stop":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			app.Stop()
-			return 0
-		}))
-	case "SetFocus":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			primitiveUD := L.CheckUserData(2)
-			app.SetFocus(primitiveUD.Value.(tview.Primitive))
-			return 0
-		}))
-	case "SetInputCapture":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			fn := L.CheckFunction(2)
-			app.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
-				// Create a simple event object for Lua
-				eventObj := L.NewTable()
-				L.SetField(eventObj, "Key", L.NewFunction(func(L *lua.LState) int {
-					L.Push(lua.LNumber(int(event.Key())))
-					return 1
-				}))
-				
-				L.Push(fn)
-				L.Push(eventObj)
-				L.Call(1, 1)
-				
-				// Check return value - if nil, consume event
-				ret := L.Get(-1)
-				L.Pop(1)
-				if ret == lua.LNil {
-					return nil
-				}
-				return event
-			})
-			L.Push(ud)
-			return 1
-		}))
-	case "Draw":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			app.QueueUpdateDraw(func() {
-				// This safely queues a redraw
-			})
-			return 0
-		}))
+func httpNewServer(L *lua.LState) int {
+	server := &HTTPServer{
+		mux:      http.NewServeMux(),
+		handlers: make(map[string]*lua.LFunction),
+		L:        L,
 	}
+	
+	ud := L.NewUserData()
+	ud.Value = server
+	L.SetMetatable(ud, L.GetTypeMetatable("HTTPServer"))
+	L.Push(ud)
 	return 1
 }
 
-func textViewIndex(L *lua.LState) int {
+func serverIndex(L *lua.LState) int {
 	ud := L.CheckUserData(1)
-	textView := ud.Value.(*tview.TextView)
+	server := ud.Value.(*HTTPServer)
 	method := L.CheckString(2)
 	
 	switch method {
-	case "SetText":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			text := L.CheckString(2)
-			textView.SetText(text)
-			L.Push(ud)
-			return 1
-		}))
-	case "SetWrap":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			wrap := L.CheckBool(2)
-			textView.SetWrap(wrap)
-			L.Push(ud)
-			return 1
-		}))
-	case "SetWordWrap":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			wordWrap := L.CheckBool(2)
-			textView.SetWordWrap(wordWrap)
-			L.Push(ud)
-			return 1
-		}))
-	case "SetTitle":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			title := L.CheckString(2)
-			textView.SetTitle(title)
-			L.Push(ud)
-			return 1
-		}))
-	case "SetTextColor":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			color := L.CheckInt(2)
-			textView.SetTextColor(tcell.Color(color))
-			L.Push(ud)
-			return 1
-		}))
-	case "SetDynamicColors":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			enable := L.CheckBool(2)
-			textView.SetDynamicColors(enable)
-			L.Push(ud)
-			return 1
-		}))
-	case "SetBorder":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			enable := L.CheckBool(2)
-			textView.SetBorder(enable)
-			L.Push(ud)
-			return 1
-		}))
-	case "SetBorderColor":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			color := L.CheckInt(2)
-			textView.SetBorderColor(tcell.Color(color))
-			L.Push(ud)
-			return 1
-		}))
-	case "SetBackgroundColor":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			color := L.CheckInt(2)
-			textView.SetBackgroundColor(tcell.Color(color))
-			L.Push(ud)
-			return 1
-		}))
-	case "SetRegions":
+	case "handle":
 		L.Push(L.NewFunction(func(L *lua.LState) int {
-			enable := L.CheckBool(2)
-			textView.SetRegions(enable)
+			path := L.CheckString(2)
+			handler := L.CheckFunction(3)
+			
+			server.mu.Lock()
+			server.handlers[path] = handler
+			server.mu.Unlock()
+			
+			// Register the handler with the mux
+			server.mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+				tuiEnter(L, func() {
+					server.handleRequest(w, r, path)
+				})
+			})
+			
 			L.Push(ud)
 			return 1
 		}))
-	case "SetScrollable":
+	case "listen":
 		L.Push(L.NewFunction(func(L *lua.LState) int {
-			enable := L.CheckBool(2)
-			textView.SetScrollable(enable)
-			L.Push(ud)
-			return 1
+			port := L.CheckInt(2)
+			addr := fmt.Sprintf(":%d", port)
+			
+			server.server = &http.Server{
+				Addr:         addr,
+				Handler:      server.mux,
+				ReadTimeout:  30 * time.Second,
+				WriteTimeout: 30 * time.Second,
+				IdleTimeout:  120 * time.Second,
+			}
+			
+			// Start server in goroutine
+			go func() {
+				if err := server.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+					fmt.Printf("Server error: %v\n", err)
+				}
+			}()
+			
+			return 0
 		}))
-	case "GetText":
+	case "stop":
 		L.Push(L.NewFunction(func(L *lua.LState) int {
-			text := textView.GetText(false)
-			L.Push(lua.LString(text))
-			return 1
+			if server.server != nil {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				server.server.Shutdown(ctx)
+			}
+			return 0
 		}))
 	}
 	return 1
 }
 
-func inputFieldIndex(L *lua.LState) int {
-	ud := L.CheckUserData(1)
-	inputField := ud.Value.(*tview.InputField)
-	method := L.CheckString(2)
+func (s *HTTPServer) handleRequest(w http.ResponseWriter, r *http.Request, path string) {
+	s.mu.RLock()
+	handler, exists := s.handlers[path]
+	s.mu.RUnlock()
 	
-	switch method {
-	case "GetText":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			text := inputField.GetText()
-			L.Push(lua.LString(text))
-			return 1
-		}))
-	case "SetText":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			text := L.CheckString(2)
-			inputField.SetText(text)
-			L.Push(ud)
-			return 1
-		}))
-	case "SetLabel":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			label := L.CheckString(2)
-			inputField.SetLabel(label)
-			L.Push(ud)
-			return 1
-		}))
-	case "SetPlaceholder":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			placeholder := L.CheckString(2)
-			inputField.SetPlaceholder(placeholder)
-			L.Push(ud)
-			return 1
-		}))
-	case "SetDoneFunc":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			fn := L.CheckFunction(2)
-			inputField.SetDoneFunc(func(key tcell.Key) {
-				L.Push(fn)
-				L.Push(lua.LNumber(int(key)))
-				L.Call(1, 0)
-			})
-			L.Push(ud)
-			return 1
-		}))
-	case "SetBorder":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			enable := L.CheckBool(2)
-			inputField.SetBorder(enable)
-			L.Push(ud)
-			return 1
-		}))
-	case "SetBorderColor":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			color := L.CheckInt(2)
-			inputField.SetBorderColor(tcell.Color(color))
-			L.Push(ud)
-			return 1
-		}))
-	case "SetFieldBackgroundColor":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			color := L.CheckInt(2)
-			inputField.SetFieldBackgroundColor(tcell.Color(color))
-			L.Push(ud)
-			return 1
-		}))
-	case "SetFieldTextColor":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			color := L.CheckInt(2)
-			inputField.SetFieldTextColor(tcell.Color(color))
-			L.Push(ud)
-			return 1
-		}))
-	case "SetTitle":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			title := L.CheckString(2)
-			inputField.SetTitle(title)
-			L.Push(ud)
-			return 1
-		}))
-	}
-	return 1
-}
-
-func buttonIndex(L *lua.LState) int {
-	ud := L.CheckUserData(1)
-	button := ud.Value.(*tview.Button)
-	method := L.CheckString(2)
-	
-	switch method {
-	case "SetSelectedFunc":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			fn := L.CheckFunction(2)
-			button.SetSelectedFunc(func() {
-				L.Push(fn)
-				L.Call(0, 0)
-			})
-			L.Push(ud)
-			return 1
-		}))
-	case "SetBorder":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			enable := L.CheckBool(2)
-			button.SetBorder(enable)
-			L.Push(ud)
-			return 1
-		}))
-	case "SetBorderColor":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			color := L.CheckInt(2)
-			button.SetBorderColor(tcell.Color(color))
-			L.Push(ud)
-			return 1
-		}))
-	case "SetBackgroundColor":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			color := L.CheckInt(2)
-			button.SetBackgroundColor(tcell.Color(color))
-			L.Push(ud)
-			return 1
-		}))
-	case "SetLabelColor":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			color := L.CheckInt(2)
-			button.SetLabelColor(tcell.Color(color))
-			L.Push(ud)
-			return 1
-		}))
-	case "SetTitle":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			title := L.CheckString(2)
-			button.SetTitle(title)
-			L.Push(ud)
-			return 1
-		}))
-	}
-	return 1
-}
-
-func flexIndex(L *lua.LState) int {
-	ud := L.CheckUserData(1)
-	flex := ud.Value.(*tview.Flex)
-	method := L.CheckString(2)
-	
-	switch method {
-	case "SetDirection":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			direction := L.CheckInt(2)
-			flex.SetDirection(direction)
-			L.Push(ud)
-			return 1
-		}))
-	case "AddItem":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			itemUD := L.CheckUserData(2)
-			fixedSize := L.CheckInt(3)
-			proportion := L.CheckInt(4)
-			focus := L.CheckBool(5)
-			flex.AddItem(itemUD.Value.(tview.Primitive), fixedSize, proportion, focus)
-			L.Push(ud)
-			return 1
-		}))
-	case "SetBorder":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			enable := L.CheckBool(2)
-			flex.SetBorder(enable)
-			L.Push(ud)
-			return 1
-		}))
-	case "SetBorderColor":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			color := L.CheckInt(2)
-			flex.SetBorderColor(tcell.Color(color))
-			L.Push(ud)
-			return 1
-		}))
-	case "SetTitle":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			title := L.CheckString(2)
-			flex.SetTitle(title)
-			L.Push(ud)
-			return 1
-		}))
-	case "SetBackgroundColor":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			color := L.CheckInt(2)
-			flex.SetBackgroundColor(tcell.Color(color))
-			L.Push(ud)
-			return 1
-		}))
-	}
-	return 1
-}
-
-func luaNewApp(L *lua.LState) int {
-	app := tview.NewApplication()
-	ud := L.NewUserData()
-	ud.Value = app
-	L.SetMetatable(ud, L.GetTypeMetatable("App"))
-	L.Push(ud)
-	return 1
-}
-
-func luaNewTextView(L *lua.LState) int {
-	text := L.OptString(1, "")
-	textView := tview.NewTextView().SetText(text).SetDynamicColors(true).SetWrap(true)
-	ud := L.NewUserData()
-	ud.Value = textView
-	L.SetMetatable(ud, L.GetTypeMetatable("TextView"))
-	L.Push(ud)
-	return 1
-}
-
-func luaNewInputField(L *lua.LState) int {
-	inputField := tview.NewInputField()
-	ud := L.NewUserData()
-	ud.Value = inputField
-	L.SetMetatable(ud, L.GetTypeMetatable("InputField"))
-	L.Push(ud)
-	return 1
-}
-
-func luaNewButton(L *lua.LState) int {
-	label := L.OptString(1, "Button")
-	button := tview.NewButton(label)
-	ud := L.NewUserData()
-	ud.Value = button
-	L.SetMetatable(ud, L.GetTypeMetatable("Button"))
-	L.Push(ud)
-	return 1
-}
-
-func luaNewFlex(L *lua.LState) int {
-	flex := tview.NewFlex()
-	ud := L.NewUserData()
-	ud.Value = flex
-	L.SetMetatable(ud, L.GetTypeMetatable("Flex"))
-	L.Push(ud)
-	return 1
-}
-
-func registerHTTPModule(L *lua.LState) {
-	L.PreloadModule("http", func(L *lua.LState) int {
-		httpModule := L.NewTable()
-		L.SetField(httpModule, "get", L.NewFunction(httpGet))
-		L.SetField(httpModule, "newServer", L.NewFunction(httpNewServer))
-		L.Push(httpModule)
-		return 1
-	})
-	
-	// Set up server metatable
-	serverMT := L.NewTypeMetatable("HTTPServer")
-	L.SetField(serverMT, "__index", L.NewFunction(serverIndex))
-}
-
-func httpGet(L *lua.LState) int {
-	url := L.CheckString(1)
-	
-	// Optional options table
-	var timeout time.Duration = 30 * time.Second
-	var userAgent string = "LuaX/1.0"
-	
-	if L.GetTop() >= 2 {
-		options := L.CheckTable(2)
-		if timeoutVal := L.GetField(options, "timeout"); timeoutVal != lua.LNil {
-			if timeoutNum, ok := timeoutVal.(lua.LNumber); ok {
-				timeout = time.Duration(float64(timeoutNum)) * time.Second
-			}
-		}
-		if headers := L.GetField(options, "headers"); headers != lua.LNil {
-			if headersTable, ok := headers.(*lua.LTable); ok {
-				if ua := L.GetField(headersTable, "User-Agent"); ua != lua.LNil {
-					if uaStr, ok := ua.(lua.LString); ok {
-						userAgent = string(uaStr)
-					}
-				}
-			}
-		}
-	}
-	
-	client := &http.Client{Timeout: timeout}
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		L.Push(lua.LNil)
-		L.Push(lua.LString(err.Error()))
-		return 2
-	}
-	
-	req.Header.Set("User-Agent", userAgent)
-	
-	resp, err := client.Do(req)
-	if err != nil {
-		L.Push(lua.LNil)
-		L.Push(lua.LString(err.Error()))
-		return 2
-	}
-	defer resp.Body.Close()
-	
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		L.Push(lua.LNil)
-		L.Push(lua.LString(err.Error()))
-		return 2
-	}
-	
-	result := L.NewTable()
-	L.SetField(result, "status", lua.LNumber(resp.StatusCode))
-	L.SetField(result, "body", lua.LString(string(body)))
-	
-	L.Push(result)
-	L.Push(lua.LNil)
-	return 2
-}
-
-type HTTPServer struct {
-	server   *http.Server
-	mux      *http.ServeMux
-	handlers map[string]*lua.LFunction
-	L        *lua.LState  // Main Lua state for registration  
-	mu       sync.RWMutex
-}
-
-func httpNewServer(L *lua.LState) int {
-	server := &HTTPServer{
-		mux:      http.NewServeMux(),
-		handlers: make(map[string]*lua.LFunction),
-		L:        L,
-	}
-	
-	ud := L.NewUserData()
-	ud.Value = server
-	L.SetMetatable(ud, L.GetTypeMetatable("HTTPServer"))
-	L.Push(ud)
-	return 1
-}
-
-func serverIndex(L *lua.LState) int {
-	ud := L.CheckUserData(1)
-	server := ud.Value.(*HTTPServer)
-	method := L.CheckString(2)
-	
-	switch method {
-	case "handle":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			path := L.CheckString(2)
-			handler := L.CheckFunction(3)
-			
-			server.mu.Lock()
-			server.handlers[path] = handler
-			server.mu.Unlock()
-			
-			// Register the handler with the mux
-			server.mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
-				server.handleRequest(w, r, path)
-			})
-			
-			L.Push(ud)
-			return 1
-		}))
-	case "listen":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			port := L.CheckInt(2)
-			addr := fmt.Sprintf(":%d", port)
-			
-			server.server = &http.Server{
-				Addr:         addr,
-				Handler:      server.mux,
-				ReadTimeout:  30 * time.Second,
-				WriteTimeout: 30 * time.Second,
-				IdleTimeout:  120 * time.Second,
-			}
-			
-			// Start server in goroutine
-			go func() {
-				if err := server.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-					fmt.Printf("Server error: %v\n", err)
-				}
-			}()
-			
-			return 0
-		}))
-	case "stop":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			if server.server != nil {
-				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-				defer cancel()
-				server.server.Shutdown(ctx)
-			}
-			return 0
-		}))
-	}
-	return 1
-}
-
-func (s *HTTPServer) handleRequest(w http.ResponseWriter, r *http.Request, path string) {
-	s.mu.RLock()
-	handler, exists := s.handlers[path]
-	s.mu.RUnlock()
-	
-	if !exists {
-		http.NotFound(w, r)
-		return
-	}
-	
-	// Use a mutex to protect the Lua state from concurrent access
-	// This ensures thread-safety for the shared Lua interpreter
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	
-	// Create request object for Lua
-	reqObj := s.L.NewTable()
-	s.L.SetField(reqObj, "method", lua.LString(r.Method))
-	s.L.SetField(reqObj, "url", lua.LString(r.URL.String()))
-	s.L.SetField(reqObj, "path", lua.LString(r.URL.Path))
-	
-	// Add headers
-	headers := s.L.NewTable()
-	for key, values := range r.Header {
-		s.L.SetField(headers, key, lua.LString(values[0]))
-	}
-	s.L.SetField(reqObj, "headers", headers)
-	
-	// Add query parameters
-	query := s.L.NewTable()
-	for key, values := range r.URL.Query() {
-		s.L.SetField(query, key, lua.LString(values[0]))
-	}
-	s.L.SetField(reqObj, "query", query)
-	
-	// Read body
-	if r.Body != nil {
-		body, _ := io.ReadAll(r.Body)
-		s.L.SetField(reqObj, "body", lua.LString(string(body)))
-	}
-	
-	// Create response object for Lua
-	resObj := s.L.NewTable()
-	responseData := &ResponseWriter{w: w, written: false}
-	
-	s.L.SetField(resObj, "write", s.L.NewFunction(func(L *lua.LState) int {
-		content := L.CheckString(2) // Skip self parameter
-		responseData.w.Write([]byte(content))
-		responseData.written = true
-		return 0
-	}))
-	
-	s.L.SetField(resObj, "json", s.L.NewFunction(func(L *lua.LState) int {
-		data := L.CheckAny(2) // Skip self parameter
-		
-		// Convert Lua value to Go interface
-		var goData interface{}
-		goData = luaValueToGo(L, data)
-		
-		jsonBytes, err := json.Marshal(goData)
-		if err != nil {
-			http.Error(responseData.w, "JSON encoding error", http.StatusInternalServerError)
-			return 0
-		}
-		
-		responseData.w.Header().Set("Content-Type", "application/json")
-		responseData.w.Write(jsonBytes)
-		responseData.written = true
-		return 0
-	}))
-	
-	s.L.SetField(resObj, "status", s.L.NewFunction(func(L *lua.LState) int {
-		code := L.CheckInt(2) // Skip self parameter
-		responseData.w.WriteHeader(code)
-		return 0
-	}))
-	
-	s.L.SetField(resObj, "header", s.L.NewFunction(func(L *lua.LState) int {
-		key := L.CheckString(2) // Skip self parameter
-		value := L.CheckString(3)
-		responseData.w.Header().Set(key, value)
-		return 0
-	}))
-	
-	// Call the Lua handler
-	s.L.Push(handler)
-	s.L.Push(reqObj)
-	s.L.Push(resObj)
-	
-	if err := s.L.PCall(2, 0, nil); err != nil {
-		if !responseData.written {
-			http.Error(w, "Handler error: "+err.Error(), http.StatusInternalServerError)
-		}
-	}
-	
-	// If no response was written, send empty 200
-	if !responseData.written {
-		w.WriteHeader(http.StatusOK)
-	}
-}
-
-type ResponseWriter struct {
-	w       http.ResponseWriter
-	written bool
-}
-
-func luaValueToGo(L *lua.LState, value lua.LValue) interface{} {
-	if value == lua.LNil {
-		return nil
-	}
-	
-	switch v := value.(type) {
-	case lua.LString:
-		return string(v)
-	case lua.LNumber:
-		return float64(v)
-	case lua.LBool:
-		return bool(v)
-	case *lua.LTable:
-		// Check if it's an array or object
-		result := make(map[string]interface{})
-		v.ForEach(func(key, val lua.LValue) {
-			if keyStr, ok := key.(lua.LString); ok {
-				result[string(keyStr)] = luaValueToGo(L, val)
-			}
-		})
-		return result
-	default:
-		return value.String()
-	}
-}
-
-// WebSocket Module
-func registerWebSocketModule(L *lua.LState) {
-	L.PreloadModule("websocket", func(L *lua.LState) int {
-		wsModule := L.NewTable()
-		L.SetField(wsModule, "newServer", L.NewFunction(wsNewServer))
-		L.SetField(wsModule, "connect", L.NewFunction(wsConnect))
-		L.Push(wsModule)
-		return 1
-	})
-	
-	// Set up WebSocket server metatable
-	serverMT := L.NewTypeMetatable("WSServer")
-	L.SetField(serverMT, "__index", L.NewFunction(wsServerIndex))
-	
-	// Set up WebSocket connection metatable
-	connMT := L.NewTypeMetatable("WSConnection")
-	L.SetField(connMT, "__index", L.NewFunction(wsConnectionIndex))
-}
-
-type WSServer struct {
-	server   *http.Server
-	mux      *http.ServeMux
-	upgrader websocket.Upgrader
-}
-
-type WSConnection struct {
-	conn          *websocket.Conn
-	messageHandler *lua.LFunction
-	closeHandler   *lua.LFunction
-	errorHandler   *lua.LFunction
-	mutex         sync.RWMutex
-	L             *lua.LState
-}
-
-func wsNewServer(L *lua.LState) int {
-	server := &WSServer{
-		mux: http.NewServeMux(),
-		upgrader: websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool {
-				return true // Allow connections from any origin
-			},
-		},
-	}
-	
-	ud := L.NewUserData()
-	ud.Value = server
-	L.SetMetatable(ud, L.GetTypeMetatable("WSServer"))
-	L.Push(ud)
-	return 1
-}
-
-func wsConnect(L *lua.LState) int {
-	urlStr := L.CheckString(1)
-	
-	// Parse URL
-	u, err := url.Parse(urlStr)
-	if err != nil {
-		L.Push(lua.LNil)
-		L.Push(lua.LString("Invalid URL: " + err.Error()))
-		return 2
-	}
-	
-	// Connect to WebSocket
-	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
-	if err != nil {
-		L.Push(lua.LNil)
-		L.Push(lua.LString("Connection failed: " + err.Error()))
-		return 2
-	}
-	
-	wsConn := &WSConnection{
-		conn: conn,
-		L:    L,
-	}
-	
-	ud := L.NewUserData()
-	ud.Value = wsConn
-	L.SetMetatable(ud, L.GetTypeMetatable("WSConnection"))
-	
-	// Start reading messages
-	go wsConn.readMessages()
-	
-	L.Push(ud)
-	L.Push(lua.LNil)
-	return 2
-}
-
-func wsServerIndex(L *lua.LState) int {
-	ud := L.CheckUserData(1)
-	server := ud.Value.(*WSServer)
-	method := L.CheckString(2)
-	
-	switch method {
-	case "handle":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			pattern := L.CheckString(2)
-			handlerFunc := L.CheckFunction(3)
-			
-			server.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
-				conn, err := server.upgrader.Upgrade(w, r, nil)
-				if err != nil {
-					log.Printf("WebSocket upgrade failed: %v", err)
-					return
-				}
-				
-				wsConn := &WSConnection{
-					conn: conn,
-					L:    L,
-				}
-				
-				connUD := L.NewUserData()
-				connUD.Value = wsConn
-				L.SetMetatable(connUD, L.GetTypeMetatable("WSConnection"))
-				
-				// Start reading messages
-				go wsConn.readMessages()
-				
-				// Call the handler with the connection
-				if err := L.CallByParam(lua.P{
-					Fn:      handlerFunc,
-					NRet:    0,
-					Protect: true,
-				}, connUD); err != nil {
-					log.Printf("WebSocket handler error: %v", err)
-				}
-			})
-			
-			return 0
-		}))
-	case "listen":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			port := L.CheckInt(2)
-			
-			server.server = &http.Server{
-				Addr:    fmt.Sprintf(":%d", port),
-				Handler: server.mux,
-			}
-			
-			// Start server in goroutine
-			go func() {
-				if err := server.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-					log.Printf("WebSocket server error: %v", err)
-				}
-			}()
-			
-			return 0
-		}))
-	case "stop":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			if server.server != nil {
-				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-				defer cancel()
-				server.server.Shutdown(ctx)
-			}
-			return 0
-		}))
-	}
-	
-	return 1
-}
-
-func wsConnectionIndex(L *lua.LState) int {
-	ud := L.CheckUserData(1)
-	conn := ud.Value.(*WSConnection)
-	method := L.CheckString(2)
-	
-	switch method {
-	case "send":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			message := L.CheckString(2)
-			
-			conn.mutex.Lock()
-			err := conn.conn.WriteMessage(websocket.TextMessage, []byte(message))
-			conn.mutex.Unlock()
-			
-			if err != nil {
-				L.Push(lua.LFalse)
-				L.Push(lua.LString("Send failed: " + err.Error()))
-				return 2
-			}
-			
-			L.Push(lua.LTrue)
-			L.Push(lua.LNil)
-			return 2
-		}))
-	case "sendBinary":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			message := L.CheckString(2)
-			
-			conn.mutex.Lock()
-			err := conn.conn.WriteMessage(websocket.BinaryMessage, []byte(message))
-			conn.mutex.Unlock()
-			
-			if err != nil {
-				L.Push(lua.LFalse)
-				L.Push(lua.LString("Send failed: " + err.Error()))
-				return 2
-			}
-			
-			L.Push(lua.LTrue)
-			L.Push(lua.LNil)
-			return 2
-		}))
-	case "onMessage":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			handler := L.CheckFunction(2)
-			conn.mutex.Lock()
-			conn.messageHandler = handler
-			conn.mutex.Unlock()
-			return 0
-		}))
-	case "onClose":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			handler := L.CheckFunction(2)
-			conn.mutex.Lock()
-			conn.closeHandler = handler
-			conn.mutex.Unlock()
-			return 0
-		}))
-	case "onError":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			handler := L.CheckFunction(2)
-			conn.mutex.Lock()
-			conn.errorHandler = handler
-			conn.mutex.Unlock()
-			return 0
-		}))
-	case "close":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			conn.mutex.Lock()
-			err := conn.conn.Close()
-			conn.mutex.Unlock()
-			
-			if err != nil {
-				L.Push(lua.LFalse)
-				L.Push(lua.LString("Close failed: " + err.Error()))
-				return 2
-			}
-			
-			L.Push(lua.LTrue)
-			L.Push(lua.LNil)
-			return 2
-		}))
-	case "ping":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			conn.mutex.Lock()
-			err := conn.conn.WriteMessage(websocket.PingMessage, nil)
-			conn.mutex.Unlock()
-			
-			if err != nil {
-				L.Push(lua.LFalse)
-				L.Push(lua.LString("Ping failed: " + err.Error()))
-				return 2
-			}
-			
-			L.Push(lua.LTrue)
-			L.Push(lua.LNil)
-			return 2
-		}))
-	}
-	
-	return 1
-}
-
-func (wsConn *WSConnection) readMessages() {
-	defer func() {
-		if wsConn.closeHandler != nil {
-			wsConn.mutex.RLock()
-			handler := wsConn.closeHandler
-			wsConn.mutex.RUnlock()
-			
-			if handler != nil {
-				if err := wsConn.L.CallByParam(lua.P{
-					Fn:      handler,
-					NRet:    0,
-					Protect: true,
-				}); err != nil {
-					log.Printf("WebSocket close handler error: %v", err)
-				}
-			}
-		}
-		wsConn.conn.Close()
-	}()
-	
-	for {
-		messageType, message, err := wsConn.conn.ReadMessage()
-		if err != nil {
-			if wsConn.errorHandler != nil {
-				wsConn.mutex.RLock()
-				handler := wsConn.errorHandler
-				wsConn.mutex.RUnlock()
-				
-				if handler != nil {
-					if err := wsConn.L.CallByParam(lua.P{
-						Fn:      handler,
-						NRet:    0,
-						Protect: true,
-					}, lua.LString(err.Error())); err != nil {
-						log.Printf("WebSocket error handler error: %v", err)
-					}
-				}
-			}
-			break
-		}
-		
-		if messageType == websocket.TextMessage || messageType == websocket.BinaryMessage {
-			if wsConn.messageHandler != nil {
-				wsConn.mutex.RLock()
-				handler := wsConn.messageHandler
-				wsConn.mutex.RUnlock()
-				
-				if handler != nil {
-					messageTable := wsConn.L.NewTable()
-					wsConn.L.SetField(messageTable, "data", lua.LString(string(message)))
-					wsConn.L.SetField(messageTable, "type", lua.LString(func() string {
-						if messageType == websocket.TextMessage {
-							return "text"
-						}
-						return "binary"
-					}()))
-					
-					if err := wsConn.L.CallByParam(lua.P{
-						Fn:      handler,
-						NRet:    0,
-						Protect: true,
-					}, messageTable); err != nil {
-						log.Printf("WebSocket message handler error: %v", err)
-					}
-				}
-			}
-		}
-	}
-}
-
-func registerKVModule(L *lua.LState) {
-	L.PreloadModule("kv", func(L *lua.LState) int {
-		kvModule := L.NewTable()
-		L.SetField(kvModule, "open", L.NewFunction(kvOpen))
-		L.Push(kvModule)
-		return 1
-	})
-	
-	// Set up database metatable
-	dbMT := L.NewTypeMetatable("KVDB")
-	L.SetField(dbMT, "__index", L.NewFunction(kvIndex))
-	L.SetField(dbMT, "__gc", L.NewFunction(kvGC))
-	
-	// Set up transaction metatable
-	txnMT := L.NewTypeMetatable("KVTxn")
-	L.SetField(txnMT, "__index", L.NewFunction(kvTxnIndex))
-	L.SetField(txnMT, "__gc", L.NewFunction(kvTxnGC))
-	
-	// Set up cursor metatable
-	cursorMT := L.NewTypeMetatable("KVCursor")
-	L.SetField(cursorMT, "__index", L.NewFunction(kvCursorIndex))
-	L.SetField(cursorMT, "__gc", L.NewFunction(kvCursorGC))
-}
-
-type KVDB struct {
-	db   *bbolt.DB
-	path string
-}
-
-type KVTxn struct {
-	tx     *bbolt.Tx
-	db     *KVDB
-	bucket *bbolt.Bucket
-}
-
-type KVCursor struct {
-	cursor *bbolt.Cursor
-	tx     *bbolt.Tx
-	db     *KVDB
-}
-
-func kvOpen(L *lua.LState) int {
-	path := L.CheckString(1)
-	
-	// Optional options table (for compatibility)
-	var readonly bool = false
-	
-	if L.GetTop() >= 2 {
-		options := L.CheckTable(2)
-		if readonlyVal := L.GetField(options, "readonly"); readonlyVal != lua.LNil {
-			if readonlyBool, ok := readonlyVal.(lua.LBool); ok {
-				readonly = bool(readonlyBool)
-			}
-		}
-	}
-	
-	options := &bbolt.Options{
-		ReadOnly: readonly,
-	}
-	
-	db, err := bbolt.Open(path, 0644, options)
-	if err != nil {
-		L.Push(lua.LNil)
-		L.Push(lua.LString(err.Error()))
-		return 2
-	}
-	
-	kvdb := &KVDB{
-		db:   db,
-		path: path,
-	}
-	
-	ud := L.NewUserData()
-	ud.Value = kvdb
-	L.SetMetatable(ud, L.GetTypeMetatable("KVDB"))
-	L.Push(ud)
-	L.Push(lua.LNil)
-	return 2
-}
-
-func kvIndex(L *lua.LState) int {
-	ud := L.CheckUserData(1)
-	db := ud.Value.(*KVDB)
-	method := L.CheckString(2)
-	
-	switch method {
-	case "open_db":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			bucketName := L.OptString(2, "default")
-			
-			// Create bucket if it doesn't exist
-			err := db.db.Update(func(tx *bbolt.Tx) error {
-				_, err := tx.CreateBucketIfNotExists([]byte(bucketName))
-				return err
-			})
-			
-			if err != nil {
-				L.Push(lua.LString(err.Error()))
-				return 1
-			}
-			
-			L.Push(lua.LNil) // No error
-			return 1
-		}))
-	case "begin_txn":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			readonly := L.OptBool(2, false)
-			
-			var tx *bbolt.Tx
-			var err error
-			
-			if readonly {
-				tx, err = db.db.Begin(false)
-			} else {
-				tx, err = db.db.Begin(true)
-			}
-			
-			if err != nil {
-				L.Push(lua.LNil)
-				L.Push(lua.LString(err.Error()))
-				return 2
-			}
-			
-			kvTxn := &KVTxn{tx: tx, db: db}
-			
-			ud := L.NewUserData()
-			ud.Value = kvTxn
-			L.SetMetatable(ud, L.GetTypeMetatable("KVTxn"))
-			L.Push(ud)
-			L.Push(lua.LNil)
-			return 2
-		}))
-	case "get":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			bucketName := L.OptString(2, "default")
-			key := L.CheckString(3)
-			
-			var val []byte
-			err := db.db.View(func(tx *bbolt.Tx) error {
-				bucket := tx.Bucket([]byte(bucketName))
-				if bucket == nil {
-					return fmt.Errorf("bucket not found: %s", bucketName)
-				}
-				val = bucket.Get([]byte(key))
-				return nil
-			})
-			
-			if err != nil {
-				L.Push(lua.LNil)
-				L.Push(lua.LString(err.Error()))
-				return 2
-			}
-			
-			if val == nil {
-				L.Push(lua.LNil)
-				L.Push(lua.LNil)
-				return 2
-			}
-			
-			L.Push(lua.LString(string(val)))
-			L.Push(lua.LNil)
-			return 2
-		}))
-	case "put":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			bucketName := L.OptString(2, "default")
-			key := L.CheckString(3)
-			value := L.CheckString(4)
-			
-			err := db.db.Update(func(tx *bbolt.Tx) error {
-				bucket := tx.Bucket([]byte(bucketName))
-				if bucket == nil {
-					return fmt.Errorf("bucket not found: %s", bucketName)
-				}
-				return bucket.Put([]byte(key), []byte(value))
-			})
-			
-			if err != nil {
-				L.Push(lua.LString(err.Error()))
-				return 1
-			}
-			
-			L.Push(lua.LNil)
-			return 1
-		}))
-	case "delete":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			bucketName := L.OptString(2, "default")
-			key := L.CheckString(3)
-			
-			err := db.db.Update(func(tx *bbolt.Tx) error {
-				bucket := tx.Bucket([]byte(bucketName))
-				if bucket == nil {
-					return fmt.Errorf("bucket not found: %s", bucketName)
-				}
-				return bucket.Delete([]byte(key))
-			})
-			
-			if err != nil {
-				L.Push(lua.LString(err.Error()))
-				return 1
-			}
-			
-			L.Push(lua.LNil)
-			return 1
-		}))
-	case "keys":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			bucketName := L.OptString(2, "default")
-			prefix := L.OptString(3, "")
-			
-			var keys []string
-			err := db.db.View(func(tx *bbolt.Tx) error {
-				bucket := tx.Bucket([]byte(bucketName))
-				if bucket == nil {
-					return fmt.Errorf("bucket not found: %s", bucketName)
-				}
-				
-				c := bucket.Cursor()
-				if prefix != "" {
-					// Prefix search
-					prefixBytes := []byte(prefix)
-					for k, _ := c.Seek(prefixBytes); k != nil && bytes.HasPrefix(k, prefixBytes); k, _ = c.Next() {
-						keys = append(keys, string(k))
-					}
-				} else {
-					// All keys
-					for k, _ := c.First(); k != nil; k, _ = c.Next() {
-						keys = append(keys, string(k))
-					}
-				}
-				return nil
-			})
-			
-			if err != nil {
-				L.Push(lua.LNil)
-				L.Push(lua.LString(err.Error()))
-				return 2
-			}
-			
-			// Create Lua table with keys
-			table := L.NewTable()
-			for i, key := range keys {
-				table.RawSetInt(i+1, lua.LString(key))
-			}
-			L.Push(table)
-			L.Push(lua.LNil)
-			return 2
-		}))
-	case "foreach":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			bucketName := L.OptString(2, "default")
-			callback := L.CheckFunction(3)
-			
-			err := db.db.View(func(tx *bbolt.Tx) error {
-				bucket := tx.Bucket([]byte(bucketName))
-				if bucket == nil {
-					return fmt.Errorf("bucket not found: %s", bucketName)
-				}
-				
-				c := bucket.Cursor()
-				for k, v := c.First(); k != nil; k, v = c.Next() {
-					L.Push(callback)
-					L.Push(lua.LString(string(k)))
-					L.Push(lua.LString(string(v)))
-					if err := L.PCall(2, 1, nil); err != nil {
-						return fmt.Errorf("callback error: %v", err)
-					}
-					
-					// Check if callback returned false to break
-					result := L.Get(-1)
-					L.Pop(1)
-					if result == lua.LFalse {
-						break
-					}
-				}
-				return nil
-			})
-			
-			if err != nil {
-				L.Push(lua.LString(err.Error()))
-				return 1
-			}
-			
-			L.Push(lua.LNil)
-			return 1
-		}))
-	case "close":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			db.db.Close()
-			return 0
-		}))
-	}
-	return 1
-}
-
-func kvGC(L *lua.LState) int {
-	ud := L.CheckUserData(1)
-	if db, ok := ud.Value.(*KVDB); ok {
-		db.db.Close()
-	}
-	return 0
-}
-
-func kvTxnIndex(L *lua.LState) int {
-	ud := L.CheckUserData(1)
-	txn := ud.Value.(*KVTxn)
-	method := L.CheckString(2)
-	
-	switch method {
-	case "get":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			bucketName := L.OptString(2, "default")
-			key := L.CheckString(3)
-			
-			bucket := txn.tx.Bucket([]byte(bucketName))
-			if bucket == nil {
-				L.Push(lua.LNil)
-				L.Push(lua.LString("bucket not found"))
-				return 2
-			}
-			
-			val := bucket.Get([]byte(key))
-			if val == nil {
-				L.Push(lua.LNil)
-				L.Push(lua.LNil)
-				return 2
-			}
-			
-			L.Push(lua.LString(string(val)))
-			L.Push(lua.LNil)
-			return 2
-		}))
-	case "put":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			bucketName := L.OptString(2, "default")
-			key := L.CheckString(3)
-			value := L.CheckString(4)
-			
-			bucket := txn.tx.Bucket([]byte(bucketName))
-			if bucket == nil {
-				L.Push(lua.LString("bucket not found"))
-				return 1
-			}
-			
-			err := bucket.Put([]byte(key), []byte(value))
-			if err != nil {
-				L.Push(lua.LString(err.Error()))
-				return 1
-			}
-			
-			L.Push(lua.LNil)
-			return 1
-		}))
-	case "delete":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			bucketName := L.OptString(2, "default")
-			key := L.CheckString(3)
-			
-			bucket := txn.tx.Bucket([]byte(bucketName))
-			if bucket == nil {
-				L.Push(lua.LString("bucket not found"))
-				return 1
-			}
-			
-			err := bucket.Delete([]byte(key))
-			if err != nil {
-				L.Push(lua.LString(err.Error()))
-				return 1
-			}
-			
-			L.Push(lua.LNil)
-			return 1
-		}))
-	case "commit":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			err := txn.tx.Commit()
-			if err != nil {
-				L.Push(lua.LString(err.Error()))
-				return 1
-			}
-			L.Push(lua.LNil)
-			return 1
-		}))
-	case "abort":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			txn.tx.Rollback()
-			return 0
-		}))
-	}
-	return 1
-}
-
-func kvTxnGC(L *lua.LState) int {
-	ud := L.CheckUserData(1)
-	if txn, ok := ud.Value.(*KVTxn); ok {
-		txn.tx.Rollback()
-	}
-	return 0
-}
-
-func kvCursorIndex(L *lua.LState) int {
-	ud := L.CheckUserData(1)
-	cursor := ud.Value.(*KVCursor)
-	method := L.CheckString(2)
-	
-	switch method {
-	case "first":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			var key, value []byte
-			err := cursor.db.db.View(func(tx *bbolt.Tx) error {
-				c := tx.Bucket([]byte("default")).Cursor() // TODO: make bucket configurable
-				key, value = c.First()
-				return nil
-			})
-			
-			if err != nil {
-				L.Push(lua.LNil)
-				L.Push(lua.LNil)
-				L.Push(lua.LString(err.Error()))
-				return 3
-			}
-			
-			if key == nil {
-				L.Push(lua.LNil)
-				L.Push(lua.LNil)
-				L.Push(lua.LNil)
-				return 3
-			}
-			
-			L.Push(lua.LString(string(key)))
-			L.Push(lua.LString(string(value)))
-			L.Push(lua.LNil)
-			return 3
-		}))
-	case "last":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			var key, value []byte
-			err := cursor.db.db.View(func(tx *bbolt.Tx) error {
-				c := tx.Bucket([]byte("default")).Cursor()
-				key, value = c.Last()
-				return nil
-			})
-			
-			if err != nil {
-				L.Push(lua.LNil)
-				L.Push(lua.LNil)
-				L.Push(lua.LString(err.Error()))
-				return 3
-			}
-			
-			if key == nil {
-				L.Push(lua.LNil)
-				L.Push(lua.LNil)
-				L.Push(lua.LNil)
-				return 3
-			}
-			
-			L.Push(lua.LString(string(key)))
-			L.Push(lua.LString(string(value)))
-			L.Push(lua.LNil)
-			return 3
-		}))
-	case "seek":
-		L.Push(L.NewFunction(func(L *lua.LState) int {
-			seekKey := L.CheckString(2)
-			
-			var key, value []byte
-			err := cursor.db.db.View(func(tx *bbolt.Tx) error {
-				c := tx.Bucket([]byte("default")).Cursor()
-				key, value = c.Seek([]byte(seekKey))
-				return nil
-			})
-			
-			if err != nil {
-				L.Push(lua.LNil)
-				L.Push(lua.LNil)
-				L.Push(lua.LString(err.Error()))
-				return 3
-			}
-			
-			if key == nil {
-				L.Push(lua.LNil)
-				L.Push(lua.LNil)
-				L.Push(lua.LNil)
-				return 3
-			}
-			
-			L.Push(lua.LString(string(key)))
-			L.Push(lua.LString(string(value)))
-			L.Push(lua.LNil)
-			return 3
-		}))
-	}
-	return 1
-}
-
-func kvCursorGC(L *lua.LState) int {
-	// Cursors are automatically cleaned up when transaction ends
-	return 0
-}
-
-// JWK represents a JSON Web Key
-type JWK struct {
-	Kty string ` + "`json:\"kty\"`" + `           // Key Type
-	Alg string ` + "`json:\"alg,omitempty\"`" + ` // Algorithm
-	Use string ` + "`json:\"use,omitempty\"`" + ` // Public Key Use
-	Kid string ` + "`json:\"kid,omitempty\"`" + ` // Key ID
-	
-	// RSA keys
-	N string ` + "`json:\"n,omitempty\"`" + ` // Modulus
-	E string ` + "`json:\"e,omitempty\"`" + ` // Exponent
-	D string ` + "`json:\"d,omitempty\"`" + ` // Private Exponent
-	P string ` + "`json:\"p,omitempty\"`" + ` // First Prime Factor
-	Q string ` + "`json:\"q,omitempty\"`" + ` // Second Prime Factor
-	Dp string ` + "`json:\"dp,omitempty\"`" + ` // First Factor CRT Exponent
-	Dq string ` + "`json:\"dq,omitempty\"`" + ` // Second Factor CRT Exponent
-	Qi string ` + "`json:\"qi,omitempty\"`" + ` // First CRT Coefficient
-	
-	// ECDSA keys
-	Crv string ` + "`json:\"crv,omitempty\"`" + ` // Curve
-	X   string ` + "`json:\"x,omitempty\"`" + `   // X Coordinate
-	Y   string ` + "`json:\"y,omitempty\"`" + `   // Y Coordinate
-	
-	// EdDSA keys (same as ECDSA for Ed25519)
-}
-
-// registerCryptoModule adds crypto functionality to Lua
-func registerCryptoModule(L *lua.LState) {
-	L.PreloadModule("crypto", func(L *lua.LState) int {
-		cryptoModule := L.NewTable()
-		
-		L.SetField(cryptoModule, "generate_jwk", L.NewFunction(cryptoGenerateJWK))
-		L.SetField(cryptoModule, "sign", L.NewFunction(cryptoSign))
-		L.SetField(cryptoModule, "verify", L.NewFunction(cryptoVerify))
-		L.SetField(cryptoModule, "jwk_to_public", L.NewFunction(cryptoJWKToPublic))
-		L.SetField(cryptoModule, "jwk_thumbprint", L.NewFunction(cryptoJWKThumbprint))
-		L.SetField(cryptoModule, "jwk_to_json", L.NewFunction(cryptoJWKToJSON))
-		L.SetField(cryptoModule, "jwk_from_json", L.NewFunction(cryptoJWKFromJSON))
-		
-		// Hashing functions
-		L.SetField(cryptoModule, "sha256", L.NewFunction(cryptoSHA256))
-		L.SetField(cryptoModule, "sha384", L.NewFunction(cryptoSHA384))
-		L.SetField(cryptoModule, "sha512", L.NewFunction(cryptoSHA512))
-		L.SetField(cryptoModule, "hash", L.NewFunction(cryptoHash))
-		L.SetField(cryptoModule, "deep_hash", L.NewFunction(cryptoDeepHash))
-		
-		L.Push(cryptoModule)
-		return 1
-	})
-}
-
-// cryptoGenerateJWK generates a new JWK keypair
-func cryptoGenerateJWK(L *lua.LState) int {
-	algorithm := L.ToString(1)
-	if algorithm == "" {
-		algorithm = "RS256" // default
-	}
-	
-	// Optional second parameter for key size (RSA only)
-	keySize := 0
-	if L.GetTop() >= 2 {
-		keySize = L.ToInt(2)
-	}
-	
-	var jwk *JWK
-	var err error
-	
-	switch algorithm {
-	case "RS256", "RS384", "RS512", "PS256", "PS384", "PS512":
-		jwk, err = generateRSAJWK(algorithm, keySize)
-	case "ES256", "ES384", "ES512":
-		jwk, err = generateECDSAJWK(algorithm)
-	case "EdDSA":
-		jwk, err = generateEd25519JWK()
-	default:
-		L.Push(lua.LNil)
-		L.Push(lua.LString("unsupported algorithm: " + algorithm))
-		return 2
-	}
-	
-	if err != nil {
-		L.Push(lua.LNil)
-		L.Push(lua.LString("failed to generate key: " + err.Error()))
-		return 2
-	}
-	
-	// Convert JWK to Lua table
-	jwkTable := jwkToLuaTable(L, jwk)
-	L.Push(jwkTable)
-	return 1
-}
-
-// generateRSAJWK creates an RSA JWK
-func generateRSAJWK(algorithm string, requestedKeySize int) (*JWK, error) {
-	keySize := 2048  // default
-	
-	// If a specific key size was requested, validate and use it
-	if requestedKeySize > 0 {
-		if requestedKeySize == 2048 || requestedKeySize == 3072 || requestedKeySize == 4096 {
-			keySize = requestedKeySize
-		} else {
-			return nil, fmt.Errorf("unsupported RSA key size: %d (supported: 2048, 3072, 4096)", requestedKeySize)
-		}
-	} else {
-		// Use default key sizes based on algorithm
-		if algorithm == "RS384" || algorithm == "RS512" || algorithm == "PS384" || algorithm == "PS512" {
-			keySize = 3072
-		}
-	}
-	
-	privateKey, err := rsa.GenerateKey(rand.Reader, keySize)
-	if err != nil {
-		return nil, err
-	}
-	
-	jwk := &JWK{
-		Kty: "RSA",
-		Alg: algorithm,
-		Use: "sig",
-		Kid: fmt.Sprintf("%d", time.Now().Unix()),
-		N:   base64.RawURLEncoding.EncodeToString(privateKey.N.Bytes()),
-		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(privateKey.E)).Bytes()),
-		D:   base64.RawURLEncoding.EncodeToString(privateKey.D.Bytes()),
-		P:   base64.RawURLEncoding.EncodeToString(privateKey.Primes[0].Bytes()),
-		Q:   base64.RawURLEncoding.EncodeToString(privateKey.Primes[1].Bytes()),
-	}
-	
-	// Calculate CRT values
-	dp := new(big.Int).Mod(privateKey.D, new(big.Int).Sub(privateKey.Primes[0], big.NewInt(1)))
-	dq := new(big.Int).Mod(privateKey.D, new(big.Int).Sub(privateKey.Primes[1], big.NewInt(1)))
-	qi := new(big.Int).ModInverse(privateKey.Primes[1], privateKey.Primes[0])
-	
-	jwk.Dp = base64.RawURLEncoding.EncodeToString(dp.Bytes())
-	jwk.Dq = base64.RawURLEncoding.EncodeToString(dq.Bytes())
-	jwk.Qi = base64.RawURLEncoding.EncodeToString(qi.Bytes())
-	
-	return jwk, nil
-}
-
-// generateECDSAJWK creates an ECDSA JWK
-func generateECDSAJWK(algorithm string) (*JWK, error) {
-	var curve elliptic.Curve
-	var crvName string
-	
-	switch algorithm {
-	case "ES256":
-		curve = elliptic.P256()
-		crvName = "P-256"
-	case "ES384":
-		curve = elliptic.P384()
-		crvName = "P-384"
-	case "ES512":
-		curve = elliptic.P521()
-		crvName = "P-521"
-	default:
-		return nil, fmt.Errorf("unsupported ECDSA algorithm: %s", algorithm)
-	}
-	
-	privateKey, err := ecdsa.GenerateKey(curve, rand.Reader)
-	if err != nil {
-		return nil, err
-	}
-	
-	// Get curve size for padding
-	keySize := (curve.Params().BitSize + 7) / 8
-	
-	xBytes := privateKey.X.Bytes()
-	yBytes := privateKey.Y.Bytes()
-	dBytes := privateKey.D.Bytes()
-	
-	// Pad to correct length
-	if len(xBytes) < keySize {
-		padded := make([]byte, keySize)
-		copy(padded[keySize-len(xBytes):], xBytes)
-		xBytes = padded
-	}
-	if len(yBytes) < keySize {
-		padded := make([]byte, keySize)
-		copy(padded[keySize-len(yBytes):], yBytes)
-		yBytes = padded
-	}
-	if len(dBytes) < keySize {
-		padded := make([]byte, keySize)
-		copy(padded[keySize-len(dBytes):], dBytes)
-		dBytes = padded
-	}
-	
-	jwk := &JWK{
-		Kty: "EC",
-		Alg: algorithm,
-		Use: "sig",
-		Kid: fmt.Sprintf("%d", time.Now().Unix()),
-		Crv: crvName,
-		X:   base64.RawURLEncoding.EncodeToString(xBytes),
-		Y:   base64.RawURLEncoding.EncodeToString(yBytes),
-		D:   base64.RawURLEncoding.EncodeToString(dBytes),
-	}
-	
-	return jwk, nil
-}
-
-// generateEd25519JWK creates an Ed25519 JWK
-func generateEd25519JWK() (*JWK, error) {
-	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
-	if err != nil {
-		return nil, err
-	}
-	
-	jwk := &JWK{
-		Kty: "OKP",
-		Alg: "EdDSA",
-		Use: "sig",
-		Kid: fmt.Sprintf("%d", time.Now().Unix()),
-		Crv: "Ed25519",
-		X:   base64.RawURLEncoding.EncodeToString(publicKey),
-		D:   base64.RawURLEncoding.EncodeToString(privateKey[:32]), // Ed25519 private key is 32 bytes
-	}
-	
-	return jwk, nil
-}
-
-// cryptoSign signs data with a JWK
-func cryptoSign(L *lua.LState) int {
-	jwkTable := L.ToTable(1)
-	data := L.ToString(2)
-	
-	if jwkTable == nil || data == "" {
-		L.Push(lua.LNil)
-		L.Push(lua.LString("missing jwk or data"))
-		return 2
-	}
-	
-	jwk, err := luaTableToJWK(jwkTable)
-	if err != nil {
-		L.Push(lua.LNil)
-		L.Push(lua.LString("invalid jwk: " + err.Error()))
-		return 2
-	}
-	
-	signature, err := signWithJWK(jwk, []byte(data))
-	if err != nil {
-		L.Push(lua.LNil)
-		L.Push(lua.LString("signing failed: " + err.Error()))
-		return 2
-	}
-	
-	L.Push(lua.LString(base64.RawURLEncoding.EncodeToString(signature)))
-	return 1
-}
-
-// cryptoVerify verifies a signature with a JWK
-func cryptoVerify(L *lua.LState) int {
-	jwkTable := L.ToTable(1)
-	data := L.ToString(2)
-	signatureB64 := L.ToString(3)
-	
-	if jwkTable == nil || data == "" || signatureB64 == "" {
-		L.Push(lua.LBool(false))
-		L.Push(lua.LString("missing jwk, data, or signature"))
-		return 2
-	}
-	
-	jwk, err := luaTableToJWK(jwkTable)
-	if err != nil {
-		L.Push(lua.LBool(false))
-		L.Push(lua.LString("invalid jwk: " + err.Error()))
-		return 2
-	}
-	
-	signature, err := base64.RawURLEncoding.DecodeString(signatureB64)
-	if err != nil {
-		L.Push(lua.LBool(false))
-		L.Push(lua.LString("invalid signature encoding: " + err.Error()))
-		return 2
-	}
-	
-	valid, err := verifyWithJWK(jwk, []byte(data), signature)
-	if err != nil {
-		L.Push(lua.LBool(false))
-		L.Push(lua.LString("verification failed: " + err.Error()))
-		return 2
-	}
-	
-	L.Push(lua.LBool(valid))
-	return 1
-}
-
-// signWithJWK signs data using a JWK
-func signWithJWK(jwk *JWK, data []byte) ([]byte, error) {
-	switch jwk.Kty {
-	case "RSA":
-		return signRSA(jwk, data)
-	case "EC":
-		return signECDSA(jwk, data)
-	case "OKP":
-		if jwk.Crv == "Ed25519" {
-			return signEd25519(jwk, data)
-		}
-		return nil, fmt.Errorf("unsupported OKP curve: %s", jwk.Crv)
-	default:
-		return nil, fmt.Errorf("unsupported key type: %s", jwk.Kty)
-	}
-}
-
-// verifyWithJWK verifies a signature using a JWK
-func verifyWithJWK(jwk *JWK, data []byte, signature []byte) (bool, error) {
-	switch jwk.Kty {
-	case "RSA":
-		return verifyRSA(jwk, data, signature)
-	case "EC":
-		return verifyECDSA(jwk, data, signature)
-	case "OKP":
-		if jwk.Crv == "Ed25519" {
-			return verifyEd25519(jwk, data, signature)
-		}
-		return false, fmt.Errorf("unsupported OKP curve: %s", jwk.Crv)
-	default:
-		return false, fmt.Errorf("unsupported key type: %s", jwk.Kty)
-	}
-}
-
-// signRSA signs data with RSA
-func signRSA(jwk *JWK, data []byte) ([]byte, error) {
-	privateKey, err := jwkToRSAPrivateKey(jwk)
-	if err != nil {
-		return nil, err
-	}
-	
-	var hash crypto.Hash
-	switch jwk.Alg {
-	case "RS256", "PS256":
-		hash = crypto.SHA256
-	case "RS384", "PS384":
-		hash = crypto.SHA384
-	case "RS512", "PS512":
-		hash = crypto.SHA512
-	default:
-		return nil, fmt.Errorf("unsupported RSA algorithm: %s", jwk.Alg)
-	}
-	
-	hasher := hash.New()
-	hasher.Write(data)
-	hashed := hasher.Sum(nil)
-	
-	// Use PSS for PS algorithms
-	switch jwk.Alg {
-	case "PS256", "PS384", "PS512":
-		opts := &rsa.PSSOptions{
-			SaltLength: rsa.PSSSaltLengthEqualsHash,
-			Hash:       hash,
-		}
-		return rsa.SignPSS(rand.Reader, privateKey, hash, hashed, opts)
-	default:
-		return rsa.SignPKCS1v15(rand.Reader, privateKey, hash, hashed)
-	}
-}
-
-// verifyRSA verifies an RSA signature
-func verifyRSA(jwk *JWK, data []byte, signature []byte) (bool, error) {
-	publicKey, err := jwkToRSAPublicKey(jwk)
-	if err != nil {
-		return false, err
-	}
-	
-	var hash crypto.Hash
-	switch jwk.Alg {
-	case "RS256", "PS256":
-		hash = crypto.SHA256
-	case "RS384", "PS384":
-		hash = crypto.SHA384
-	case "RS512", "PS512":
-		hash = crypto.SHA512
-	default:
-		return false, fmt.Errorf("unsupported RSA algorithm: %s", jwk.Alg)
-	}
-	
-	hasher := hash.New()
-	hasher.Write(data)
-	hashed := hasher.Sum(nil)
-	
-	// Use PSS for PS algorithms
-	switch jwk.Alg {
-	case "PS256", "PS384", "PS512":
-		opts := &rsa.PSSOptions{
-			SaltLength: rsa.PSSSaltLengthEqualsHash,
-			Hash:       hash,
-		}
-		err = rsa.VerifyPSS(publicKey, hash, hashed, signature, opts)
-	default:
-		err = rsa.VerifyPKCS1v15(publicKey, hash, hashed, signature)
-	}
-	return err == nil, nil
-}
-
-// signECDSA signs data with ECDSA
-func signECDSA(jwk *JWK, data []byte) ([]byte, error) {
-	privateKey, err := jwkToECDSAPrivateKey(jwk)
-	if err != nil {
-		return nil, err
-	}
-	
-	var hasher crypto.Hash
-	switch jwk.Alg {
-	case "ES256":
-		hasher = crypto.SHA256
-	case "ES384":
-		hasher = crypto.SHA384
-	case "ES512":
-		hasher = crypto.SHA512
-	default:
-		return nil, fmt.Errorf("unsupported ECDSA algorithm: %s", jwk.Alg)
-	}
-	
-	hash := hasher.New()
-	hash.Write(data)
-	hashed := hash.Sum(nil)
-	
-	r, s, err := ecdsa.Sign(rand.Reader, privateKey, hashed)
-	if err != nil {
-		return nil, err
-	}
-	
-	// Get curve size for signature formatting
-	keySize := (privateKey.Curve.Params().BitSize + 7) / 8
-	
-	rBytes := r.Bytes()
-	sBytes := s.Bytes()
-	
-	// Pad to correct length
-	signature := make([]byte, 2*keySize)
-	copy(signature[keySize-len(rBytes):keySize], rBytes)
-	copy(signature[2*keySize-len(sBytes):], sBytes)
-	
-	return signature, nil
-}
-
-// verifyECDSA verifies an ECDSA signature
-func verifyECDSA(jwk *JWK, data []byte, signature []byte) (bool, error) {
-	publicKey, err := jwkToECDSAPublicKey(jwk)
-	if err != nil {
-		return false, err
-	}
-	
-	var hasher crypto.Hash
-	switch jwk.Alg {
-	case "ES256":
-		hasher = crypto.SHA256
-	case "ES384":
-		hasher = crypto.SHA384
-	case "ES512":
-		hasher = crypto.SHA512
-	default:
-		return false, fmt.Errorf("unsupported ECDSA algorithm: %s", jwk.Alg)
-	}
-	
-	hash := hasher.New()
-	hash.Write(data)
-	hashed := hash.Sum(nil)
-	
-	// Parse signature (r, s values)
-	keySize := len(signature) / 2
-	r := new(big.Int).SetBytes(signature[:keySize])
-	s := new(big.Int).SetBytes(signature[keySize:])
-	
-	return ecdsa.Verify(publicKey, hashed, r, s), nil
-}
-
-// signEd25519 signs data with Ed25519
-func signEd25519(jwk *JWK, data []byte) ([]byte, error) {
-	privateKey, err := jwkToEd25519PrivateKey(jwk)
-	if err != nil {
-		return nil, err
-	}
-	
-	return ed25519.Sign(privateKey, data), nil
-}
-
-// verifyEd25519 verifies an Ed25519 signature
-func verifyEd25519(jwk *JWK, data []byte, signature []byte) (bool, error) {
-	publicKey, err := jwkToEd25519PublicKey(jwk)
-	if err != nil {
-		return false, err
+	if !exists {
+		http.NotFound(w, r)
+		return
 	}
 	
-	return ed25519.Verify(publicKey, data, signature), nil
-}
-
-// Helper functions for JWK conversion
-func jwkToRSAPrivateKey(jwk *JWK) (*rsa.PrivateKey, error) {
-	nBytes, err := base64.RawURLEncoding.DecodeString(jwk.N)
-	if err != nil {
-		return nil, err
-	}
-	eBytes, err := base64.RawURLEncoding.DecodeString(jwk.E)
-	if err != nil {
-		return nil, err
-	}
-	dBytes, err := base64.RawURLEncoding.DecodeString(jwk.D)
-	if err != nil {
-		return nil, err
-	}
-	pBytes, err := base64.RawURLEncoding.DecodeString(jwk.P)
-	if err != nil {
-		return nil, err
-	}
-	qBytes, err := base64.RawURLEncoding.DecodeString(jwk.Q)
-	if err != nil {
-		return nil, err
-	}
+	// Use a mutex to protect the Lua state from concurrent access
+	// This ensures thread-safety for the shared Lua interpreter
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	
-	return &rsa.PrivateKey{
-		PublicKey: rsa.PublicKey{
-			N: new(big.Int).SetBytes(nBytes),
-			E: int(new(big.Int).SetBytes(eBytes).Int64()),
-		},
-		D:      new(big.Int).SetBytes(dBytes),
-		Primes: []*big.Int{new(big.Int).SetBytes(pBytes), new(big.Int).SetBytes(qBytes)},
-	}, nil
-}
-
-func jwkToRSAPublicKey(jwk *JWK) (*rsa.PublicKey, error) {
-	nBytes, err := base64.RawURLEncoding.DecodeString(jwk.N)
-	if err != nil {
-		return nil, err
-	}
-	eBytes, err := base64.RawURLEncoding.DecodeString(jwk.E)
-	if err != nil {
-		return nil, err
-	}
+	// Create request object for Lua
+	reqObj := s.L.NewTable()
+	s.L.SetField(reqObj, "method", lua.LString(r.Method))
+	s.L.SetField(reqObj, "url", lua.LString(r.URL.String()))
+	s.L.SetField(reqObj, "path", lua.LString(r.URL.Path))
 	
-	return &rsa.PublicKey{
-		N: new(big.Int).SetBytes(nBytes),
-		E: int(new(big.Int).SetBytes(eBytes).Int64()),
-	}, nil
-}
-
-func jwkToECDSAPrivateKey(jwk *JWK) (*ecdsa.PrivateKey, error) {
-	var curve elliptic.Curve
-	switch jwk.Crv {
-	case "P-256":
-		curve = elliptic.P256()
-	case "P-384":
-		curve = elliptic.P384()
-	case "P-521":
-		curve = elliptic.P521()
-	default:
-		return nil, fmt.Errorf("unsupported curve: %s", jwk.Crv)
+	// Add headers
+	headers := s.L.NewTable()
+	for key, values := range r.Header {
+		s.L.SetField(headers, key, lua.LString(values[0]))
 	}
+	s.L.SetField(reqObj, "headers", headers)
 	
-	xBytes, err := base64.RawURLEncoding.DecodeString(jwk.X)
-	if err != nil {
-		return nil, err
-	}
-	yBytes, err := base64.RawURLEncoding.DecodeString(jwk.Y)
-	if err != nil {
-		return nil, err
-	}
-	dBytes, err := base64.RawURLEncoding.DecodeString(jwk.D)
-	if err != nil {
-		return nil, err
+	// Add query parameters
+	query := s.L.NewTable()
+	for key, values := range r.URL.Query() {
+		s.L.SetField(query, key, lua.LString(values[0]))
 	}
+	s.L.SetField(reqObj, "query", query)
 	
-	return &ecdsa.PrivateKey{
-		PublicKey: ecdsa.PublicKey{
-			Curve: curve,
-			X:     new(big.Int).SetBytes(xBytes),
-			Y:     new(big.Int).SetBytes(yBytes),
-		},
-		D: new(big.Int).SetBytes(dBytes),
-	}, nil
-}
-
-func jwkToECDSAPublicKey(jwk *JWK) (*ecdsa.PublicKey, error) {
-	var curve elliptic.Curve
-	switch jwk.Crv {
-	case "P-256":
-		curve = elliptic.P256()
-	case "P-384":
-		curve = elliptic.P384()
-	case "P-521":
-		curve = elliptic.P521()
-	default:
-		return nil, fmt.Errorf("unsupported curve: %s", jwk.Crv)
+	// Read body
+	if r.Body != nil {
+		body, _ := io.ReadAll(r.Body)
+		s.L.SetField(reqObj, "body", lua.LString(string(body)))
+		s.L.SetField(reqObj, "json", newJSONBodyFunction(s.L, string(body)))
 	}
 	
-	xBytes, err := base64.RawURLEncoding.DecodeString(jwk.X)
-	if err != nil {
-		return nil, err
-	}
-	yBytes, err := base64.RawURLEncoding.DecodeString(jwk.Y)
-	if err != nil {
-		return nil, err
-	}
+	// Create response object for Lua
+	resObj := s.L.NewTable()
+	responseData := &ResponseWriter{w: w, written: false}
 	
-	return &ecdsa.PublicKey{
-		Curve: curve,
-		X:     new(big.Int).SetBytes(xBytes),
-		Y:     new(big.Int).SetBytes(yBytes),
-	}, nil
-}
-
-func jwkToEd25519PrivateKey(jwk *JWK) (ed25519.PrivateKey, error) {
-	xBytes, err := base64.RawURLEncoding.DecodeString(jwk.X)
-	if err != nil {
-		return nil, err
-	}
-	dBytes, err := base64.RawURLEncoding.DecodeString(jwk.D)
-	if err != nil {
-		return nil, err
-	}
+	s.L.SetField(resObj, "write", s.L.NewFunction(func(L *lua.LState) int {
+		content := L.CheckString(2) // Skip self parameter
+		responseData.w.Write([]byte(content))
+		responseData.written = true
+		return 0
+	}))
 	
-	// Ed25519 private key is 64 bytes: 32 bytes private + 32 bytes public
-	privateKey := make(ed25519.PrivateKey, ed25519.PrivateKeySize)
-	copy(privateKey[:32], dBytes)
-	copy(privateKey[32:], xBytes)
+	s.L.SetField(resObj, "json", s.L.NewFunction(func(L *lua.LState) int {
+		data := L.CheckAny(2) // Skip self parameter
+		options := jsonEncodeOptionsFromTable(L.OptTable(3, nil))
+		
+		jsonBytes, err := marshalLuaJSON(L, data, options)
+		if err != nil {
+			http.Error(responseData.w, "JSON encoding error: "+err.Error(), http.StatusInternalServerError)
+			return 0
+		}
+		
+		responseData.w.Header().Set("Content-Type", "application/json")
+		responseData.w.Write(jsonBytes)
+		responseData.written = true
+		return 0
+	}))
 	
-	return privateKey, nil
-}
-
-func jwkToEd25519PublicKey(jwk *JWK) (ed25519.PublicKey, error) {
-	xBytes, err := base64.RawURLEncoding.DecodeString(jwk.X)
-	if err != nil {
-		return nil, err
-	}
+	s.L.SetField(resObj, "status", s.L.NewFunction(func(L *lua.LState) int {
+		code := L.CheckInt(2) // Skip self parameter
+		responseData.w.WriteHeader(code)
+		return 0
+	}))
 	
-	return ed25519.PublicKey(xBytes), nil
-}
-
-// Helper functions for Lua table conversion
-func jwkToLuaTable(L *lua.LState, jwk *JWK) *lua.LTable {
-	table := L.NewTable()
+	s.L.SetField(resObj, "header", s.L.NewFunction(func(L *lua.LState) int {
+		key := L.CheckString(2) // Skip self parameter
+		value := L.CheckString(3)
+		responseData.w.Header().Set(key, value)
+		return 0
+	}))
 	
-	L.SetField(table, "kty", lua.LString(jwk.Kty))
-	if jwk.Alg != "" {
-		L.SetField(table, "alg", lua.LString(jwk.Alg))
-	}
-	if jwk.Use != "" {
-		L.SetField(table, "use", lua.LString(jwk.Use))
-	}
-	if jwk.Kid != "" {
-		L.SetField(table, "kid", lua.LString(jwk.Kid))
-	}
+	// Call the Lua handler
+	s.L.Push(handler)
+	s.L.Push(reqObj)
+	s.L.Push(resObj)
 	
-	// RSA fields
-	if jwk.N != "" {
-		L.SetField(table, "n", lua.LString(jwk.N))
-	}
-	if jwk.E != "" {
-		L.SetField(table, "e", lua.LString(jwk.E))
-	}
-	if jwk.D != "" {
-		L.SetField(table, "d", lua.LString(jwk.D))
-	}
-	if jwk.P != "" {
-		L.SetField(table, "p", lua.LString(jwk.P))
-	}
-	if jwk.Q != "" {
-		L.SetField(table, "q", lua.LString(jwk.Q))
-	}
-	if jwk.Dp != "" {
-		L.SetField(table, "dp", lua.LString(jwk.Dp))
-	}
-	if jwk.Dq != "" {
-		L.SetField(table, "dq", lua.LString(jwk.Dq))
-	}
-	if jwk.Qi != "" {
-		L.SetField(table, "qi", lua.LString(jwk.Qi))
+	if err := s.L.PCall(2, 0, nil); err != nil {
+		if !responseData.written {
+			http.Error(w, "Handler error: "+err.Error(), http.StatusInternalServerError)
+		}
 	}
 	
-	// ECDSA/EdDSA fields
-	if jwk.Crv != "" {
-		L.SetField(table, "crv", lua.LString(jwk.Crv))
-	}
-	if jwk.X != "" {
-		L.SetField(table, "x", lua.LString(jwk.X))
-	}
-	if jwk.Y != "" {
-		L.SetField(table, "y", lua.LString(jwk.Y))
+	// If no response was written, send empty 200
+	if !responseData.written {
+		w.WriteHeader(http.StatusOK)
 	}
-	
-	return table
 }
 
-func luaTableToJWK(table *lua.LTable) (*JWK, error) {
-	jwk := &JWK{}
-	
-	table.ForEach(func(key, value lua.LValue) {
-		keyStr := key.String()
-		valueStr := value.String()
-		
-		switch keyStr {
-		case "kty":
-			jwk.Kty = valueStr
-		case "alg":
-			jwk.Alg = valueStr
-		case "use":
-			jwk.Use = valueStr
-		case "kid":
-			jwk.Kid = valueStr
-		case "n":
-			jwk.N = valueStr
-		case "e":
-			jwk.E = valueStr
-		case "d":
-			jwk.D = valueStr
-		case "p":
-			jwk.P = valueStr
-		case "q":
-			jwk.Q = valueStr
-		case "dp":
-			jwk.Dp = valueStr
-		case "dq":
-			jwk.Dq = valueStr
-		case "qi":
-			jwk.Qi = valueStr
-		case "crv":
-			jwk.Crv = valueStr
-		case "x":
-			jwk.X = valueStr
-		case "y":
-			jwk.Y = valueStr
-		}
+type ResponseWriter struct {
+	w       http.ResponseWriter
+	written bool
+}
+
+// WebSocket Module
+func registerWebSocketModule(L *lua.LState) {
+	L.PreloadModule("websocket", func(L *lua.LState) int {
+		wsModule := L.NewTable()
+		L.SetField(wsModule, "newServer", L.NewFunction(wsNewServer))
+		L.SetField(wsModule, "connect", L.NewFunction(wsConnect))
+		L.Push(wsModule)
+		return 1
 	})
 	
-	if jwk.Kty == "" {
-		return nil, fmt.Errorf("missing required field: kty")
-	}
+	// Set up WebSocket server metatable
+	serverMT := L.NewTypeMetatable("WSServer")
+	L.SetField(serverMT, "__index", L.NewFunction(wsServerIndex))
 	
-	return jwk, nil
+	// Set up WebSocket connection metatable
+	connMT := L.NewTypeMetatable("WSConnection")
+	L.SetField(connMT, "__index", L.NewFunction(wsConnectionIndex))
 }
 
-// cryptoJWKToPublic extracts public key from JWK
-func cryptoJWKToPublic(L *lua.LState) int {
-	jwkTable := L.ToTable(1)
-	if jwkTable == nil {
-		L.Push(lua.LNil)
-		L.Push(lua.LString("missing jwk"))
-		return 2
-	}
-	
-	jwk, err := luaTableToJWK(jwkTable)
-	if err != nil {
-		L.Push(lua.LNil)
-		L.Push(lua.LString("invalid jwk: " + err.Error()))
-		return 2
-	}
-	
-	publicJWK := &JWK{
-		Kty: jwk.Kty,
-		Alg: jwk.Alg,
-		Use: jwk.Use,
-		Kid: jwk.Kid,
-		N:   jwk.N,
-		E:   jwk.E,
-		Crv: jwk.Crv,
-		X:   jwk.X,
-		Y:   jwk.Y,
-	}
-	
-	publicTable := jwkToLuaTable(L, publicJWK)
-	L.Push(publicTable)
-	return 1
+type WSServer struct {
+	server   *http.Server
+	mux      *http.ServeMux
+	upgrader websocket.Upgrader
 }
 
-// cryptoJWKThumbprint generates a thumbprint for a JWK
-func cryptoJWKThumbprint(L *lua.LState) int {
-	jwkTable := L.ToTable(1)
-	if jwkTable == nil {
-		L.Push(lua.LNil)
-		L.Push(lua.LString("missing jwk"))
-		return 2
-	}
-	
-	jwk, err := luaTableToJWK(jwkTable)
-	if err != nil {
-		L.Push(lua.LNil)
-		L.Push(lua.LString("invalid jwk: " + err.Error()))
-		return 2
-	}
-	
-	// Create canonical JSON for thumbprint (RFC 7638)
-	var canonical map[string]interface{}
-	switch jwk.Kty {
-	case "RSA":
-		canonical = map[string]interface{}{
-			"e":   jwk.E,
-			"kty": jwk.Kty,
-			"n":   jwk.N,
-		}
-	case "EC":
-		canonical = map[string]interface{}{
-			"crv": jwk.Crv,
-			"kty": jwk.Kty,
-			"x":   jwk.X,
-			"y":   jwk.Y,
-		}
-	case "OKP":
-		canonical = map[string]interface{}{
-			"crv": jwk.Crv,
-			"kty": jwk.Kty,
-			"x":   jwk.X,
-		}
-	default:
-		L.Push(lua.LNil)
-		L.Push(lua.LString("unsupported key type for thumbprint: " + jwk.Kty))
-		return 2
-	}
-	
-	canonicalJSON, err := json.Marshal(canonical)
-	if err != nil {
-		L.Push(lua.LNil)
-		L.Push(lua.LString("failed to create canonical JSON: " + err.Error()))
-		return 2
+type WSConnection struct {
+	conn          *websocket.Conn
+	messageHandler *lua.LFunction
+	closeHandler   *lua.LFunction
+	errorHandler   *lua.LFunction
+	mutex         sync.RWMutex
+	L             *lua.LState
+}
+
+func wsNewServer(L *lua.LState) int {
+	server := &WSServer{
+		mux: http.NewServeMux(),
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool {
+				return true // Allow connections from any origin
+			},
+		},
 	}
 	
-	hash := sha256.Sum256(canonicalJSON)
-	thumbprint := base64.RawURLEncoding.EncodeToString(hash[:])
-	
-	L.Push(lua.LString(thumbprint))
+	ud := L.NewUserData()
+	ud.Value = server
+	L.SetMetatable(ud, L.GetTypeMetatable("WSServer"))
+	L.Push(ud)
 	return 1
 }
 
-// cryptoJWKToJSON converts JWK to JSON string
-func cryptoJWKToJSON(L *lua.LState) int {
-	jwkTable := L.ToTable(1)
-	if jwkTable == nil {
-		L.Push(lua.LNil)
-		L.Push(lua.LString("missing jwk"))
-		return 2
-	}
+func wsConnect(L *lua.LState) int {
+	urlStr := L.CheckString(1)
 	
-	jwk, err := luaTableToJWK(jwkTable)
+	// Parse URL
+	u, err := url.Parse(urlStr)
 	if err != nil {
 		L.Push(lua.LNil)
-		L.Push(lua.LString("invalid jwk: " + err.Error()))
+		L.Push(lua.LString("Invalid URL: " + err.Error()))
 		return 2
 	}
 	
-	jsonData, err := json.Marshal(jwk)
+	// Connect to WebSocket
+	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
 	if err != nil {
 		L.Push(lua.LNil)
-		L.Push(lua.LString("failed to marshal JSON: " + err.Error()))
+		L.Push(lua.LString("Connection failed: " + err.Error()))
 		return 2
 	}
 	
-	L.Push(lua.LString(string(jsonData)))
-	return 1
-}
-
-// cryptoJWKFromJSON parses JWK from JSON string
-func cryptoJWKFromJSON(L *lua.LState) int {
-	jsonStr := L.ToString(1)
-	if jsonStr == "" {
-		L.Push(lua.LNil)
-		L.Push(lua.LString("missing json string"))
-		return 2
+	wsConn := &WSConnection{
+		conn: conn,
+		L:    L,
 	}
 	
-	var jwk JWK
-	if err := json.Unmarshal([]byte(jsonStr), &jwk); err != nil {
-		L.Push(lua.LNil)
-		L.Push(lua.LString("invalid JSON: " + err.Error()))
-		return 2
-	}
+	ud := L.NewUserData()
+	ud.Value = wsConn
+	L.SetMetatable(ud, L.GetTypeMetatable("WSConnection"))
 	
-	jwkTable := jwkToLuaTable(L, &jwk)
-	L.Push(jwkTable)
-	return 1
-}
-
-// cryptoSHA256 computes SHA-256 hash of input
-func cryptoSHA256(L *lua.LState) int {
-	data := L.ToString(1)
-	hash := sha256.Sum256([]byte(data))
-	L.Push(lua.LString(hex.EncodeToString(hash[:])))
-	return 1
-}
-
-// cryptoSHA384 computes SHA-384 hash of input
-func cryptoSHA384(L *lua.LState) int {
-	data := L.ToString(1)
-	hash := sha512.Sum384([]byte(data))
-	L.Push(lua.LString(hex.EncodeToString(hash[:])))
-	return 1
-}
-
-// cryptoSHA512 computes SHA-512 hash of input
-func cryptoSHA512(L *lua.LState) int {
-	data := L.ToString(1)
-	hash := sha512.Sum512([]byte(data))
-	L.Push(lua.LString(hex.EncodeToString(hash[:])))
-	return 1
+	// Start reading messages
+	go wsConn.readMessages()
+	
+	L.Push(ud)
+	L.Push(lua.LNil)
+	return 2
 }
 
-// cryptoHash computes hash with specified algorithm
-func cryptoHash(L *lua.LState) int {
-	algorithm := L.ToString(1)
-	data := L.ToString(2)
+func wsServerIndex(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	server := ud.Value.(*WSServer)
+	method := L.CheckString(2)
 	
-	var result string
-	switch strings.ToLower(algorithm) {
-	case "sha256":
-		hash := sha256.Sum256([]byte(data))
-		result = hex.EncodeToString(hash[:])
-	case "sha384":
-		hash := sha512.Sum384([]byte(data))
-		result = hex.EncodeToString(hash[:])
-	case "sha512":
-		hash := sha512.Sum512([]byte(data))
-		result = hex.EncodeToString(hash[:])
-	default:
-		L.Push(lua.LNil)
-		L.Push(lua.LString("unsupported algorithm: " + algorithm))
-		return 2
+	switch method {
+	case "handle":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			pattern := L.CheckString(2)
+			handlerFunc := L.CheckFunction(3)
+			
+			server.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+				conn, err := server.upgrader.Upgrade(w, r, nil)
+				if err != nil {
+					log.Printf("WebSocket upgrade failed: %v", err)
+					return
+				}
+				
+				wsConn := &WSConnection{
+					conn: conn,
+					L:    L,
+				}
+				
+				connUD := L.NewUserData()
+				connUD.Value = wsConn
+				L.SetMetatable(connUD, L.GetTypeMetatable("WSConnection"))
+				
+				// Start reading messages
+				go wsConn.readMessages()
+				
+				// Call the handler with the connection
+				tuiEnter(L, func() {
+					if err := L.CallByParam(lua.P{
+						Fn:      handlerFunc,
+						NRet:    0,
+						Protect: true,
+					}, connUD); err != nil {
+						log.Printf("WebSocket handler error: %v", err)
+					}
+				})
+			})
+			
+			return 0
+		}))
+	case "listen":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			port := L.CheckInt(2)
+			
+			server.server = &http.Server{
+				Addr:    fmt.Sprintf(":%d", port),
+				Handler: server.mux,
+			}
+			
+			// Start server in goroutine
+			go func() {
+				if err := server.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+					log.Printf("WebSocket server error: %v", err)
+				}
+			}()
+			
+			return 0
+		}))
+	case "stop":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			if server.server != nil {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				server.server.Shutdown(ctx)
+			}
+			return 0
+		}))
 	}
 	
-	L.Push(lua.LString(result))
 	return 1
 }
 
-// cryptoDeepHash computes SHA-384 hash of nested data structures
-func cryptoDeepHash(L *lua.LState) int {
-	value := L.Get(1)
-	algorithm := L.OptString(2, "sha384")
-	
-	// Serialize the value to a canonical string representation
-	serialized, err := serializeForHashing(value)
-	if err != nil {
-		L.Push(lua.LNil)
-		L.Push(lua.LString("failed to serialize: " + err.Error()))
-		return 2
-	}
+func wsConnectionIndex(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	conn := ud.Value.(*WSConnection)
+	method := L.CheckString(2)
 	
-	var result string
-	switch strings.ToLower(algorithm) {
-	case "sha256":
-		hash := sha256.Sum256([]byte(serialized))
-		result = hex.EncodeToString(hash[:])
-	case "sha384":
-		hash := sha512.Sum384([]byte(serialized))
-		result = hex.EncodeToString(hash[:])
-	case "sha512":
-		hash := sha512.Sum512([]byte(serialized))
-		result = hex.EncodeToString(hash[:])
-	default:
-		L.Push(lua.LNil)
-		L.Push(lua.LString("unsupported algorithm: " + algorithm))
-		return 2
+	switch method {
+	case "send":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			message := L.CheckString(2)
+			
+			conn.mutex.Lock()
+			err := conn.conn.WriteMessage(websocket.TextMessage, []byte(message))
+			conn.mutex.Unlock()
+			
+			if err != nil {
+				L.Push(lua.LFalse)
+				L.Push(lua.LString("Send failed: " + err.Error()))
+				return 2
+			}
+			
+			L.Push(lua.LTrue)
+			L.Push(lua.LNil)
+			return 2
+		}))
+	case "sendBinary":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			message := L.CheckString(2)
+			
+			conn.mutex.Lock()
+			err := conn.conn.WriteMessage(websocket.BinaryMessage, []byte(message))
+			conn.mutex.Unlock()
+			
+			if err != nil {
+				L.Push(lua.LFalse)
+				L.Push(lua.LString("Send failed: " + err.Error()))
+				return 2
+			}
+			
+			L.Push(lua.LTrue)
+			L.Push(lua.LNil)
+			return 2
+		}))
+	case "sendJSON":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			value := L.CheckAny(2)
+			options := jsonEncodeOptionsFromTable(L.OptTable(3, nil))
+			
+			message, err := marshalLuaJSON(L, value, options)
+			if err != nil {
+				L.Push(lua.LFalse)
+				L.Push(lua.LString("Send failed: " + err.Error()))
+				return 2
+			}
+			
+			conn.mutex.Lock()
+			err = conn.conn.WriteMessage(websocket.TextMessage, message)
+			conn.mutex.Unlock()
+			
+			if err != nil {
+				L.Push(lua.LFalse)
+				L.Push(lua.LString("Send failed: " + err.Error()))
+				return 2
+			}
+			
+			L.Push(lua.LTrue)
+			L.Push(lua.LNil)
+			return 2
+		}))
+	case "onMessage":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			handler := L.CheckFunction(2)
+			conn.mutex.Lock()
+			conn.messageHandler = handler
+			conn.mutex.Unlock()
+			return 0
+		}))
+	case "onClose":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			handler := L.CheckFunction(2)
+			conn.mutex.Lock()
+			conn.closeHandler = handler
+			conn.mutex.Unlock()
+			return 0
+		}))
+	case "onError":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			handler := L.CheckFunction(2)
+			conn.mutex.Lock()
+			conn.errorHandler = handler
+			conn.mutex.Unlock()
+			return 0
+		}))
+	case "close":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			conn.mutex.Lock()
+			err := conn.conn.Close()
+			conn.mutex.Unlock()
+			
+			if err != nil {
+				L.Push(lua.LFalse)
+				L.Push(lua.LString("Close failed: " + err.Error()))
+				return 2
+			}
+			
+			L.Push(lua.LTrue)
+			L.Push(lua.LNil)
+			return 2
+		}))
+	case "ping":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			conn.mutex.Lock()
+			err := conn.conn.WriteMessage(websocket.PingMessage, nil)
+			conn.mutex.Unlock()
+			
+			if err != nil {
+				L.Push(lua.LFalse)
+				L.Push(lua.LString("Ping failed: " + err.Error()))
+				return 2
+			}
+			
+			L.Push(lua.LTrue)
+			L.Push(lua.LNil)
+			return 2
+		}))
 	}
 	
-	L.Push(lua.LString(result))
 	return 1
 }
 
-// serializeForHashing converts Lua value to canonical string for consistent hashing
-func serializeForHashing(lv lua.LValue) (string, error) {
-	switch v := lv.(type) {
-	case lua.LString:
-		return string(v), nil
-	case lua.LNumber:
-		return fmt.Sprintf("%g", float64(v)), nil
-	case lua.LBool:
-		if bool(v) {
-			return "true", nil
+func (wsConn *WSConnection) readMessages() {
+	defer func() {
+		if wsConn.closeHandler != nil {
+			wsConn.mutex.RLock()
+			handler := wsConn.closeHandler
+			wsConn.mutex.RUnlock()
+			
+			if handler != nil {
+				tuiEnter(wsConn.L, func() {
+					if err := wsConn.L.CallByParam(lua.P{
+						Fn:      handler,
+						NRet:    0,
+						Protect: true,
+					}); err != nil {
+						log.Printf("WebSocket close handler error: %v", err)
+					}
+				})
+			}
 		}
-		return "false", nil
-	case *lua.LNilType:
-		return "null", nil
-	case *lua.LTable:
-		// Check if it's an array or object
-		isArray := true
-		maxIndex := 0
-		count := 0
-		
-		v.ForEach(func(k, val lua.LValue) {
-			count++
-			if num, ok := k.(lua.LNumber); ok {
-				if int(num) > maxIndex {
-					maxIndex = int(num)
+		wsConn.conn.Close()
+	}()
+	
+	for {
+		messageType, message, err := wsConn.conn.ReadMessage()
+		if err != nil {
+			if wsConn.errorHandler != nil {
+				wsConn.mutex.RLock()
+				handler := wsConn.errorHandler
+				wsConn.mutex.RUnlock()
+				
+				if handler != nil {
+					tuiEnter(wsConn.L, func() {
+						if err := wsConn.L.CallByParam(lua.P{
+							Fn:      handler,
+							NRet:    0,
+							Protect: true,
+						}, lua.LString(err.Error())); err != nil {
+							log.Printf("WebSocket error handler error: %v", err)
+						}
+					})
 				}
-			} else {
-				isArray = false
 			}
-		})
+			break
+		}
 		
-		if isArray && count > 0 && maxIndex == count {
-			// Serialize as array
-			var items []string
-			for i := 1; i <= maxIndex; i++ {
-				val := v.RawGetInt(i)
-				serialized, err := serializeForHashing(val)
-				if err != nil {
-					return "", err
-				}
-				items = append(items, serialized)
-			}
-			return "[" + strings.Join(items, ",") + "]", nil
-		} else {
-			// Serialize as object with sorted keys
-			var pairs []string
-			keys := []string{}
-			
-			// Collect all keys
-			v.ForEach(func(k, val lua.LValue) {
-				if str, ok := k.(lua.LString); ok {
-					keys = append(keys, string(str))
-				} else if num, ok := k.(lua.LNumber); ok {
-					keys = append(keys, fmt.Sprintf("%g", float64(num)))
-				}
-			})
-			
-			// Sort keys for consistent ordering
-			sort.Strings(keys)
-			
-			// Build key-value pairs
-			for _, key := range keys {
-				val := v.RawGetString(key)
-				if val == lua.LNil {
-					// Try as number
-					if num, err := strconv.ParseFloat(key, 64); err == nil {
-						val = v.RawGetInt(int(num))
-					}
-				}
+		if messageType == websocket.TextMessage || messageType == websocket.BinaryMessage {
+			if wsConn.messageHandler != nil {
+				wsConn.mutex.RLock()
+				handler := wsConn.messageHandler
+				wsConn.mutex.RUnlock()
 				
-				serialized, err := serializeForHashing(val)
-				if err != nil {
-					return "", err
+				if handler != nil {
+					tuiEnter(wsConn.L, func() {
+						messageTable := wsConn.L.NewTable()
+						wsConn.L.SetField(messageTable, "data", lua.LString(string(message)))
+						wsConn.L.SetField(messageTable, "type", lua.LString(func() string {
+							if messageType == websocket.TextMessage {
+								return "text"
+							}
+							return "binary"
+						}()))
+						wsConn.L.SetField(messageTable, "json", newJSONBodyFunction(wsConn.L, string(message)))
+					
+						if err := wsConn.L.CallByParam(lua.P{
+							Fn:      handler,
+							NRet:    0,
+							Protect: true,
+						}, messageTable); err != nil {
+							log.Printf("WebSocket message handler error: %v", err)
+						}
+					})
 				}
-				pairs = append(pairs, fmt.Sprintf("\"%s\":%s", key, serialized))
 			}
-			
-			return "{" + strings.Join(pairs, ",") + "}", nil
 		}
-	default:
-		return "", fmt.Errorf("unsupported type: %T", lv)
 	}
 }
 
@@ -3578,11 +1685,18 @@ go 1.21
 
 require (
 	github.com/yuin/gopher-lua v1.1.1
-	github.com/gdamore/tcell/v2 v2.7.0
-	github.com/rivo/tview v0.0.0-20240101144852-b3bd1aa5e9f2
+	github.com/gdamore/tcell/v2 v2.8.1
+	github.com/rivo/tview v0.0.0-20250501113434-0c592cd31026
 	go.etcd.io/bbolt v1.4.1
-)
+	gopkg.in/yaml.v2 v2.4.0
+	github.com/BurntSushi/toml v1.5.0
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+	github.com/gorilla/websocket v1.5.3
 `
+	for _, tag := range config.BuildTags {
+		goModContent += "\t" + runtimeBuildTags[tag] + "\n"
+	}
+	goModContent += ")\n"
 
 	goModPath := filepath.Join(tempDir, "go.mod")
 	if err := os.WriteFile(goModPath, []byte(goModContent), 0644); err != nil {
@@ -3601,7 +1715,11 @@ require (
 		outputPath += ".exe"
 	}
 
-	cmd := exec.Command("go", "build", "-o", outputPath, ".")
+	args := []string{"build", "-o", outputPath}
+	if len(config.BuildTags) > 0 {
+		args = append(args, "-tags", strings.Join(config.BuildTags, ","))
+	}
+	cmd := exec.Command("go", append(args, ".")...)
 	cmd.Dir = tempDir
 	
 	// Use environment variables if set, otherwise use current architecture
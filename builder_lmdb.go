@@ -0,0 +1,8 @@
+//go:build lmdb
+
+package main
+
+func init() {
+	// Built executables compile kv_lmdb_functions.go against the same binding
+	runtimeBuildTags["lmdb"] = "github.com/bmatsuo/lmdb-go v1.8.0"
+}
@@ -118,6 +118,27 @@ func TestBuildExecutableInvalidScript(t *testing.T) {
 	}
 }
 
+func TestCopyRuntimeSourceFilesBuildTags(t *testing.T) {
+	// Tagged sources are copied only for executables built with the tag
+	for _, tags := range [][]string{nil, {"lmdb"}} {
+		dir := t.TempDir()
+		if err := copyRuntimeSourceFiles(dir, tags); err != nil {
+			t.Fatalf("copyRuntimeSourceFiles(%v) failed: %v", tags, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "kv_functions.go")); err != nil {
+			t.Fatalf("kv_functions.go was not copied with tags %v: %v", tags, err)
+		}
+		_, err := os.Stat(filepath.Join(dir, "kv_lmdb_functions.go"))
+		if copied := err == nil; copied != (tags != nil) {
+			t.Fatalf("kv_lmdb_functions.go copied = %v with tags %v", copied, tags)
+		}
+	}
+
+	if tags := runtimeTagsFor("plan9"); tags != nil {
+		t.Fatalf("Expected no build tags when cross-compiling, got %v", tags)
+	}
+}
+
 func TestIntegrationCLI(t *testing.T) {
 	// First build the luax binary
 	cmd := exec.Command("go", "build", "-o", "luax-test", ".")
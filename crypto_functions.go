@@ -11,7 +11,6 @@ import (
 	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/base64"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"math/big"
@@ -253,16 +252,19 @@ func cryptoSign(L *lua.LState) int {
 	var algorithm string
 	var jwkTable *lua.LTable
 	var data string
+	outputEncoding := encodingBase64URLRaw
 	
 	if L.GetTop() >= 3 && L.Get(1).Type() == lua.LTString {
-		// New format: sign(algorithm, data, jwk)
+		// New format: sign(algorithm, data, jwk[, encoding])
 		algorithm = L.ToString(1)
 		data = L.ToString(2)
 		jwkTable = L.ToTable(3)
+		outputEncoding = L.OptString(4, outputEncoding)
 	} else {
-		// Old format: sign(jwk, data) - for backward compatibility
+		// Old format: sign(jwk, data[, encoding]) - for backward compatibility
 		jwkTable = L.ToTable(1)
 		data = L.ToString(2)
+		outputEncoding = L.OptString(3, outputEncoding)
 	}
 	
 	if jwkTable == nil || data == "" {
@@ -299,8 +301,7 @@ func cryptoSign(L *lua.LState) int {
 		return 2
 	}
 	
-	L.Push(lua.LString(base64.RawURLEncoding.EncodeToString(signature)))
-	return 1
+	return pushEncoded(L, signature, outputEncoding)
 }
 
 // cryptoVerify verifies a signature with a JWK
@@ -322,7 +323,7 @@ func cryptoVerify(L *lua.LState) int {
 		return 2
 	}
 	
-	signature, err := base64.RawURLEncoding.DecodeString(signatureB64)
+	signature, err := decodeString(signatureB64, L.OptString(4, encodingBase64URLRaw))
 	if err != nil {
 		L.Push(lua.LBool(false))
 		L.Push(lua.LString("invalid signature encoding: " + err.Error()))
@@ -875,7 +876,7 @@ func cryptoJWKThumbprint(L *lua.LState) int {
 	return 1
 }
 
-// cryptoJWKToJSON converts JWK to JSON string
+// cryptoJWKToJSON converts JWK to JSON string, accepting json.encode options
 func cryptoJWKToJSON(L *lua.LState) int {
 	jwkTable := L.ToTable(1)
 	if jwkTable == nil {
@@ -891,7 +892,8 @@ func cryptoJWKToJSON(L *lua.LState) int {
 		return 2
 	}
 	
-	jsonData, err := json.Marshal(jwk)
+	options := jsonEncodeOptionsFromTable(L.OptTable(2, nil))
+	jsonData, err := marshalLuaJSON(L, jwkToLuaTable(L, jwk), options)
 	if err != nil {
 		L.Push(lua.LNil)
 		L.Push(lua.LString("failed to marshal JSON: " + err.Error()))
@@ -911,14 +913,28 @@ func cryptoJWKFromJSON(L *lua.LState) int {
 		return 2
 	}
 	
-	var jwk JWK
-	if err := json.Unmarshal([]byte(jsonStr), &jwk); err != nil {
+	value, err := unmarshalLuaJSON(L, jsonStr)
+	if err != nil {
 		L.Push(lua.LNil)
 		L.Push(lua.LString("invalid JSON: " + err.Error()))
 		return 2
 	}
 	
-	jwkTable := jwkToLuaTable(L, &jwk)
+	table, ok := value.(*lua.LTable)
+	if !ok {
+		L.Push(lua.LNil)
+		L.Push(lua.LString("invalid JSON: expected an object"))
+		return 2
+	}
+	
+	jwk, err := luaTableToJWK(table)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString("invalid jwk: " + err.Error()))
+		return 2
+	}
+	
+	jwkTable := jwkToLuaTable(L, jwk)
 	L.Push(jwkTable)
 	return 1
 }
@@ -927,24 +943,21 @@ func cryptoJWKFromJSON(L *lua.LState) int {
 func cryptoSHA256(L *lua.LState) int {
 	data := L.ToString(1)
 	hash := sha256.Sum256([]byte(data))
-	L.Push(lua.LString(hex.EncodeToString(hash[:])))
-	return 1
+	return pushEncoded(L, hash[:], L.OptString(2, encodingHex))
 }
 
 // cryptoSHA384 computes SHA-384 hash of input
 func cryptoSHA384(L *lua.LState) int {
 	data := L.ToString(1)
 	hash := sha512.Sum384([]byte(data))
-	L.Push(lua.LString(hex.EncodeToString(hash[:])))
-	return 1
+	return pushEncoded(L, hash[:], L.OptString(2, encodingHex))
 }
 
 // cryptoSHA512 computes SHA-512 hash of input
 func cryptoSHA512(L *lua.LState) int {
 	data := L.ToString(1)
 	hash := sha512.Sum512([]byte(data))
-	L.Push(lua.LString(hex.EncodeToString(hash[:])))
-	return 1
+	return pushEncoded(L, hash[:], L.OptString(2, encodingHex))
 }
 
 // cryptoHash computes hash with specified algorithm
@@ -952,25 +965,14 @@ func cryptoHash(L *lua.LState) int {
 	algorithm := L.ToString(1)
 	data := L.ToString(2)
 	
-	var result string
-	switch strings.ToLower(algorithm) {
-	case "sha256":
-		hash := sha256.Sum256([]byte(data))
-		result = hex.EncodeToString(hash[:])
-	case "sha384":
-		hash := sha512.Sum384([]byte(data))
-		result = hex.EncodeToString(hash[:])
-	case "sha512":
-		hash := sha512.Sum512([]byte(data))
-		result = hex.EncodeToString(hash[:])
-	default:
+	result, err := hashBytes(algorithm, []byte(data))
+	if err != nil {
 		L.Push(lua.LNil)
-		L.Push(lua.LString("unsupported algorithm: " + algorithm))
+		L.Push(lua.LString(err.Error()))
 		return 2
 	}
 	
-	L.Push(lua.LString(result))
-	return 1
+	return pushEncoded(L, result, L.OptString(3, encodingHex))
 }
 
 // cryptoDeepHash computes SHA-384 hash of nested data structures
@@ -986,25 +988,14 @@ func cryptoDeepHash(L *lua.LState) int {
 		return 2
 	}
 	
-	var result string
-	switch strings.ToLower(algorithm) {
-	case "sha256":
-		hash := sha256.Sum256([]byte(serialized))
-		result = hex.EncodeToString(hash[:])
-	case "sha384":
-		hash := sha512.Sum384([]byte(serialized))
-		result = hex.EncodeToString(hash[:])
-	case "sha512":
-		hash := sha512.Sum512([]byte(serialized))
-		result = hex.EncodeToString(hash[:])
-	default:
+	result, err := hashBytes(algorithm, []byte(serialized))
+	if err != nil {
 		L.Push(lua.LNil)
-		L.Push(lua.LString("unsupported algorithm: " + algorithm))
+		L.Push(lua.LString(err.Error()))
 		return 2
 	}
 	
-	L.Push(lua.LString(result))
-	return 1
+	return pushEncoded(L, result, L.OptString(3, encodingHex))
 }
 
 // serializeForHashing converts Lua value to canonical string for consistent hashing
@@ -1021,6 +1012,11 @@ func serializeForHashing(lv lua.LValue) (string, error) {
 		return "false", nil
 	case *lua.LNilType:
 		return "null", nil
+	case *lua.LUserData:
+		if isJSONNull(v) {
+			return "null", nil
+		}
+		return "", fmt.Errorf("unsupported type: %T", lv)
 	case *lua.LTable:
 		// Check if it's an array or object
 		isArray := true
@@ -1102,26 +1098,31 @@ func cryptoDigest(L *lua.LState) int {
 		return 2
 	}
 	
-	var result []byte
+	result, err := hashBytes(algorithm, []byte(data))
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	
+	// Return as hex string unless another encoding is requested
+	return pushEncoded(L, result, L.OptString(3, encodingHex))
+}
+
+// hashBytes computes the raw digest of data with the named algorithm
+func hashBytes(algorithm string, data []byte) ([]byte, error) {
 	switch strings.ToLower(algorithm) {
 	case "sha256":
-		hash := sha256.Sum256([]byte(data))
-		result = hash[:]
+		hash := sha256.Sum256(data)
+		return hash[:], nil
 	case "sha384":
-		hash := sha512.Sum384([]byte(data))
-		result = hash[:]
+		hash := sha512.Sum384(data)
+		return hash[:], nil
 	case "sha512":
-		hash := sha512.Sum512([]byte(data))
-		result = hash[:]
-	default:
-		L.Push(lua.LNil)
-		L.Push(lua.LString("unsupported algorithm: " + algorithm))
-		return 2
+		hash := sha512.Sum512(data)
+		return hash[:], nil
 	}
-	
-	// Return as hex string (similar to existing hash functions)
-	L.Push(lua.LString(hex.EncodeToString(result)))
-	return 1
+	return nil, fmt.Errorf("unsupported algorithm: %s", algorithm)
 }
 
 // cryptoBase64URLDecode decodes a base64url encoded string
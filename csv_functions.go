@@ -0,0 +1,473 @@
+// csv_functions.go - CSV module implementation for Hype
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// CSVOptions configures CSV parsing and writing
+type CSVOptions struct {
+	Delimiter        rune
+	Comment          rune
+	Header           bool     // First record holds column names
+	Columns          []string // Explicit column names for writing keyed rows
+	LazyQuotes       bool
+	TrimLeadingSpace bool
+	UseCRLF          bool
+}
+
+// CSVReader streams records from a CSV file
+type CSVReader struct {
+	file   *os.File
+	reader *csv.Reader
+	header []string
+}
+
+// CSVWriter streams records to a CSV file
+type CSVWriter struct {
+	file          *os.File
+	writer        *csv.Writer
+	options       CSVOptions
+	headerWritten bool
+}
+
+// registerCSVModule adds CSV encoding, decoding and streaming to Lua
+func registerCSVModule(L *lua.LState) {
+	L.PreloadModule("csv", func(L *lua.LState) int {
+		csvModule := L.NewTable()
+
+		L.SetField(csvModule, "encode", L.NewFunction(csvEncode))
+		L.SetField(csvModule, "decode", L.NewFunction(csvDecode))
+		L.SetField(csvModule, "reader", L.NewFunction(csvNewReader))
+		L.SetField(csvModule, "writer", L.NewFunction(csvNewWriter))
+
+		L.Push(csvModule)
+		return 1
+	})
+
+	// Set up reader and writer metatables. gopher-lua never calls __gc,
+	// so scripts close readers and writers themselves.
+	readerMT := L.NewTypeMetatable("CSVReader")
+	L.SetField(readerMT, "__index", L.NewFunction(csvReaderIndex))
+
+	writerMT := L.NewTypeMetatable("CSVWriter")
+	L.SetField(writerMT, "__index", L.NewFunction(csvWriterIndex))
+}
+
+// csvOptionsFromTable reads CSV options from an optional Lua table
+func csvOptionsFromTable(table *lua.LTable) (CSVOptions, error) {
+	options := CSVOptions{Delimiter: ','}
+	if table == nil {
+		return options, nil
+	}
+
+	if delimiter, ok := table.RawGetString("delimiter").(lua.LString); ok {
+		r, size := utf8.DecodeRuneInString(string(delimiter))
+		if size == 0 || size != len(delimiter) {
+			return options, fmt.Errorf("delimiter must be a single character")
+		}
+		options.Delimiter = r
+	}
+	if comment, ok := table.RawGetString("comment").(lua.LString); ok && comment != "" {
+		r, _ := utf8.DecodeRuneInString(string(comment))
+		options.Comment = r
+	}
+
+	switch header := table.RawGetString("header").(type) {
+	case lua.LBool:
+		options.Header = bool(header)
+	case *lua.LTable:
+		options.Header = true
+		for i := 1; i <= header.Len(); i++ {
+			options.Columns = append(options.Columns, header.RawGetInt(i).String())
+		}
+	}
+
+	options.LazyQuotes = lua.LVAsBool(table.RawGetString("lazy_quotes"))
+	options.TrimLeadingSpace = lua.LVAsBool(table.RawGetString("trim_leading_space"))
+	options.UseCRLF = lua.LVAsBool(table.RawGetString("crlf"))
+
+	return options, nil
+}
+
+func newCSVReader(r io.Reader, options CSVOptions) *csv.Reader {
+	reader := csv.NewReader(r)
+	reader.Comma = options.Delimiter
+	reader.Comment = options.Comment
+	reader.LazyQuotes = options.LazyQuotes
+	reader.TrimLeadingSpace = options.TrimLeadingSpace
+	reader.FieldsPerRecord = -1
+	return reader
+}
+
+func newCSVWriter(w io.Writer, options CSVOptions) *csv.Writer {
+	writer := csv.NewWriter(w)
+	writer.Comma = options.Delimiter
+	writer.UseCRLF = options.UseCRLF
+	return writer
+}
+
+// csvRecordToLua converts a record to an array, or to a keyed table when a header is known
+func csvRecordToLua(L *lua.LState, record []string, header []string) *lua.LTable {
+	row := L.NewTable()
+	for i, field := range record {
+		if header != nil && i < len(header) {
+			row.RawSetString(header[i], lua.LString(field))
+		} else {
+			row.RawSetInt(i+1, lua.LString(field))
+		}
+	}
+	return row
+}
+
+// csvFieldString renders a Lua scalar as a CSV field
+func csvFieldString(value lua.LValue) (string, error) {
+	switch v := value.(type) {
+	case *lua.LNilType:
+		return "", nil
+	case lua.LString:
+		return string(v), nil
+	case lua.LNumber, lua.LBool:
+		return v.String(), nil
+	case *lua.LUserData:
+		if isJSONNull(v) {
+			return "", nil
+		}
+	}
+	return "", fmt.Errorf("cannot write %s as a CSV field", value.Type().String())
+}
+
+// csvRowToRecord converts an array row, or a keyed row using column names, to a record
+func csvRowToRecord(row *lua.LTable, columns []string) ([]string, error) {
+	var record []string
+	if columns != nil && row.RawGetInt(1) == lua.LNil {
+		for _, column := range columns {
+			field, err := csvFieldString(row.RawGetString(column))
+			if err != nil {
+				return nil, fmt.Errorf("column %s: %w", column, err)
+			}
+			record = append(record, field)
+		}
+		return record, nil
+	}
+
+	for i := 1; i <= row.Len(); i++ {
+		field, err := csvFieldString(row.RawGetInt(i))
+		if err != nil {
+			return nil, fmt.Errorf("column %d: %w", i, err)
+		}
+		record = append(record, field)
+	}
+	return record, nil
+}
+
+// csvColumnsFromRow derives sorted column names from a keyed row
+func csvColumnsFromRow(row *lua.LTable) []string {
+	var columns []string
+	row.ForEach(func(key, _ lua.LValue) {
+		if k, ok := key.(lua.LString); ok {
+			columns = append(columns, string(k))
+		}
+	})
+	sort.Strings(columns)
+	return columns
+}
+
+// csvEncode converts a list of rows to CSV text
+func csvEncode(L *lua.LState) int {
+	rows := L.CheckTable(1)
+	options, err := csvOptionsFromTable(L.OptTable(2, nil))
+	if err != nil {
+		L.ArgError(2, err.Error())
+		return 0
+	}
+
+	var buf bytes.Buffer
+	writer := newCSVWriter(&buf, options)
+
+	columns := options.Columns
+	if options.Header && columns == nil {
+		if first, ok := rows.RawGetInt(1).(*lua.LTable); ok && first.RawGetInt(1) == lua.LNil {
+			columns = csvColumnsFromRow(first)
+		}
+	}
+	if columns != nil {
+		if err := writer.Write(columns); err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+	}
+
+	for i := 1; i <= rows.Len(); i++ {
+		row, ok := rows.RawGetInt(i).(*lua.LTable)
+		if !ok {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(fmt.Sprintf("row %d is not a table", i)))
+			return 2
+		}
+
+		record, err := csvRowToRecord(row, columns)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(fmt.Sprintf("row %d: %s", i, err.Error())))
+			return 2
+		}
+		if err := writer.Write(record); err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(fmt.Sprintf("row %d: %s", i, err.Error())))
+			return 2
+		}
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	L.Push(lua.LString(buf.String()))
+	return 1
+}
+
+// csvDecode parses CSV text into a list of rows
+func csvDecode(L *lua.LState) int {
+	data := L.CheckString(1)
+	options, err := csvOptionsFromTable(L.OptTable(2, nil))
+	if err != nil {
+		L.ArgError(2, err.Error())
+		return 0
+	}
+
+	reader := newCSVReader(strings.NewReader(data), options)
+	records, err := reader.ReadAll()
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	var header []string
+	if options.Header && len(records) > 0 {
+		header = records[0]
+		records = records[1:]
+	}
+
+	rows := L.NewTable()
+	for i, record := range records {
+		rows.RawSetInt(i+1, csvRecordToLua(L, record, header))
+	}
+
+	L.Push(rows)
+	return 1
+}
+
+// csvNewReader opens a CSV file for streaming reads
+func csvNewReader(L *lua.LState) int {
+	path := L.CheckString(1)
+	options, err := csvOptionsFromTable(L.OptTable(2, nil))
+	if err != nil {
+		L.ArgError(2, err.Error())
+		return 0
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	csvReader := &CSVReader{
+		file:   file,
+		reader: newCSVReader(file, options),
+	}
+
+	if options.Header {
+		header, err := csvReader.reader.Read()
+		if err != nil && err != io.EOF {
+			file.Close()
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		csvReader.header = header
+	}
+
+	ud := L.NewUserData()
+	ud.Value = csvReader
+	L.SetMetatable(ud, L.GetTypeMetatable("CSVReader"))
+	L.Push(ud)
+	L.Push(lua.LNil)
+	return 2
+}
+
+// csvNewWriter creates a CSV file for streaming writes
+func csvNewWriter(L *lua.LState) int {
+	path := L.CheckString(1)
+	options, err := csvOptionsFromTable(L.OptTable(2, nil))
+	if err != nil {
+		L.ArgError(2, err.Error())
+		return 0
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	csvWriter := &CSVWriter{
+		file:    file,
+		writer:  newCSVWriter(file, options),
+		options: options,
+	}
+
+	ud := L.NewUserData()
+	ud.Value = csvWriter
+	L.SetMetatable(ud, L.GetTypeMetatable("CSVWriter"))
+	L.Push(ud)
+	L.Push(lua.LNil)
+	return 2
+}
+
+func csvReaderIndex(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	reader := ud.Value.(*CSVReader)
+	method := L.CheckString(2)
+
+	switch method {
+	case "read":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			record, err := reader.reader.Read()
+			if err == io.EOF {
+				L.Push(lua.LNil)
+				L.Push(lua.LNil)
+				return 2
+			}
+			if err != nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LString(err.Error()))
+				return 2
+			}
+
+			L.Push(csvRecordToLua(L, record, reader.header))
+			L.Push(lua.LNil)
+			return 2
+		}))
+	case "rows":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(L.NewFunction(func(L *lua.LState) int {
+				record, err := reader.reader.Read()
+				if err == io.EOF {
+					L.Push(lua.LNil)
+					return 1
+				}
+				if err != nil {
+					L.RaiseError("csv: %s", err.Error())
+					return 0
+				}
+
+				L.Push(csvRecordToLua(L, record, reader.header))
+				return 1
+			}))
+			return 1
+		}))
+	case "headers":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			headers := L.NewTable()
+			for i, name := range reader.header {
+				headers.RawSetInt(i+1, lua.LString(name))
+			}
+			L.Push(headers)
+			return 1
+		}))
+	case "close":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			if err := reader.file.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+				L.Push(lua.LString(err.Error()))
+				return 1
+			}
+			return 0
+		}))
+	default:
+		L.Push(lua.LNil)
+	}
+
+	return 1
+}
+
+func csvWriterIndex(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	writer := ud.Value.(*CSVWriter)
+	method := L.CheckString(2)
+
+	switch method {
+	case "write":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			row := L.CheckTable(2)
+
+			// Keyed rows without explicit columns fix the header on first write
+			if writer.options.Header && writer.options.Columns == nil && row.RawGetInt(1) == lua.LNil {
+				writer.options.Columns = csvColumnsFromRow(row)
+			}
+			if !writer.headerWritten && writer.options.Columns != nil {
+				if err := writer.writer.Write(writer.options.Columns); err != nil {
+					L.Push(lua.LString(err.Error()))
+					return 1
+				}
+				writer.headerWritten = true
+			}
+
+			record, err := csvRowToRecord(row, writer.options.Columns)
+			if err != nil {
+				L.Push(lua.LString(err.Error()))
+				return 1
+			}
+			if err := writer.writer.Write(record); err != nil {
+				L.Push(lua.LString(err.Error()))
+				return 1
+			}
+			return 0
+		}))
+	case "flush":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			writer.writer.Flush()
+			if err := writer.writer.Error(); err != nil {
+				L.Push(lua.LString(err.Error()))
+				return 1
+			}
+			return 0
+		}))
+	case "close":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			writer.writer.Flush()
+			if err := writer.writer.Error(); err != nil {
+				writer.file.Close()
+				L.Push(lua.LString(err.Error()))
+				return 1
+			}
+			if err := writer.file.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+				L.Push(lua.LString(err.Error()))
+				return 1
+			}
+			return 0
+		}))
+	default:
+		L.Push(lua.LNil)
+	}
+
+	return 1
+}
@@ -0,0 +1,180 @@
+// encoding_functions.go - Binary-to-text encoding module implementation for Hype
+package main
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// Encoding names accepted by the encoding module and by crypto functions
+// that take an output encoding argument.
+const (
+	encodingRaw          = "raw"
+	encodingHex          = "hex"
+	encodingBase64       = "base64"
+	encodingBase64Raw    = "base64_raw"
+	encodingBase64URL    = "base64url"
+	encodingBase64URLRaw = "base64url_raw"
+	encodingBase32       = "base32"
+	encodingBase32Raw    = "base32_raw"
+)
+
+// registerEncodingModule adds base64, base64url, hex and base32 helpers to Lua
+func registerEncodingModule(L *lua.LState) {
+	L.PreloadModule("encoding", func(L *lua.LState) int {
+		encodingModule := L.NewTable()
+
+		L.SetField(encodingModule, "encode", L.NewFunction(encodingEncode))
+		L.SetField(encodingModule, "decode", L.NewFunction(encodingDecode))
+
+		// Shorthand functions
+		L.SetField(encodingModule, "base64_encode", newEncodeFunction(L, encodingBase64, encodingBase64Raw))
+		L.SetField(encodingModule, "base64_decode", newDecodeFunction(L, encodingBase64))
+		L.SetField(encodingModule, "base64url_encode", newEncodeFunction(L, encodingBase64URL, encodingBase64URLRaw))
+		L.SetField(encodingModule, "base64url_decode", newDecodeFunction(L, encodingBase64URL))
+		L.SetField(encodingModule, "base32_encode", newEncodeFunction(L, encodingBase32, encodingBase32Raw))
+		L.SetField(encodingModule, "base32_decode", newDecodeFunction(L, encodingBase32))
+		L.SetField(encodingModule, "hex_encode", newEncodeFunction(L, encodingHex, encodingHex))
+		L.SetField(encodingModule, "hex_decode", newDecodeFunction(L, encodingHex))
+
+		L.Push(encodingModule)
+		return 1
+	})
+}
+
+// normalizeEncodingName lowercases an encoding name and resolves aliases
+func normalizeEncodingName(name string) (string, error) {
+	normalized := strings.ReplaceAll(strings.ToLower(strings.TrimSpace(name)), "-", "_")
+	switch normalized {
+	case encodingRaw, "binary", "bytes":
+		return encodingRaw, nil
+	case encodingHex, "base16":
+		return encodingHex, nil
+	case encodingBase64, "std", "base64_std":
+		return encodingBase64, nil
+	case encodingBase64Raw, "base64_nopad":
+		return encodingBase64Raw, nil
+	case encodingBase64URL, "base64_url":
+		return encodingBase64URL, nil
+	case encodingBase64URLRaw, "base64_url_raw", "base64url_nopad":
+		return encodingBase64URLRaw, nil
+	case encodingBase32:
+		return encodingBase32, nil
+	case encodingBase32Raw, "base32_nopad":
+		return encodingBase32Raw, nil
+	}
+	return "", fmt.Errorf("unsupported encoding: %s", name)
+}
+
+// encodeBytes converts data to text using the named encoding
+func encodeBytes(data []byte, name string) (string, error) {
+	format, err := normalizeEncodingName(name)
+	if err != nil {
+		return "", err
+	}
+
+	switch format {
+	case encodingHex:
+		return hex.EncodeToString(data), nil
+	case encodingBase64:
+		return base64.StdEncoding.EncodeToString(data), nil
+	case encodingBase64Raw:
+		return base64.RawStdEncoding.EncodeToString(data), nil
+	case encodingBase64URL:
+		return base64.URLEncoding.EncodeToString(data), nil
+	case encodingBase64URLRaw:
+		return base64.RawURLEncoding.EncodeToString(data), nil
+	case encodingBase32:
+		return base32.StdEncoding.EncodeToString(data), nil
+	case encodingBase32Raw:
+		return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(data), nil
+	}
+	return string(data), nil
+}
+
+// decodeString converts text back to bytes using the named encoding.
+// Padding is optional for the base64 and base32 variants, so padded and raw
+// input decode the same way.
+func decodeString(data string, name string) ([]byte, error) {
+	format, err := normalizeEncodingName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case encodingHex:
+		return hex.DecodeString(data)
+	case encodingBase64, encodingBase64Raw:
+		return base64.RawStdEncoding.DecodeString(strings.TrimRight(data, "="))
+	case encodingBase64URL, encodingBase64URLRaw:
+		return base64.RawURLEncoding.DecodeString(strings.TrimRight(data, "="))
+	case encodingBase32, encodingBase32Raw:
+		return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(data, "="))
+	}
+	return []byte(data), nil
+}
+
+// pushEncoded pushes data in the named encoding, or nil and an error message
+func pushEncoded(L *lua.LState, data []byte, name string) int {
+	encoded, err := encodeBytes(data, name)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	L.Push(lua.LString(encoded))
+	return 1
+}
+
+// encodingEncode encodes a string with the named encoding
+func encodingEncode(L *lua.LState) int {
+	data := L.CheckString(1)
+	name := L.OptString(2, encodingBase64)
+	return pushEncoded(L, []byte(data), name)
+}
+
+// encodingDecode decodes a string with the named encoding
+func encodingDecode(L *lua.LState) int {
+	data := L.CheckString(1)
+	name := L.OptString(2, encodingBase64)
+
+	decoded, err := decodeString(data, name)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString("failed to decode: " + err.Error()))
+		return 2
+	}
+
+	L.Push(lua.LString(string(decoded)))
+	return 1
+}
+
+// newEncodeFunction creates a shorthand encoder. An options table with
+// padding = false selects the unpadded variant.
+func newEncodeFunction(L *lua.LState, padded string, unpadded string) *lua.LFunction {
+	return L.NewFunction(func(L *lua.LState) int {
+		data := L.CheckString(1)
+		name := padded
+		if opts := L.OptTable(2, nil); opts != nil {
+			if padding := opts.RawGetString("padding"); padding != lua.LNil && !lua.LVAsBool(padding) {
+				name = unpadded
+			}
+		}
+		return pushEncoded(L, []byte(data), name)
+	})
+}
+
+// newDecodeFunction creates a shorthand decoder for one encoding
+func newDecodeFunction(L *lua.LState, name string) *lua.LFunction {
+	return L.NewFunction(func(L *lua.LState) int {
+		L.SetTop(1)
+		L.Push(lua.LString(name))
+		return encodingDecode(L)
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/yuin/gopher-lua"
+)
+
+func TestEncodeBytes(t *testing.T) {
+	data := []byte{0xfb, 0xff, 0xfe, 'h', 'i'}
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"hex", "fbfffe6869"},
+		{"base64", "+//+aGk="},
+		{"base64_raw", "+//+aGk"},
+		{"base64url", "-__-aGk="},
+		{"base64url_raw", "-__-aGk"},
+		{"BASE64-URL", "-__-aGk="},
+		{"base32", "7P7742DJ"},
+		{"raw", string(data)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := encodeBytes(data, tt.name)
+			if err != nil {
+				t.Fatalf("encodeBytes(%q) error: %v", tt.name, err)
+			}
+			if encoded != tt.expected {
+				t.Errorf("encodeBytes(%q) = %q, want %q", tt.name, encoded, tt.expected)
+			}
+
+			decoded, err := decodeString(encoded, tt.name)
+			if err != nil {
+				t.Fatalf("decodeString(%q) error: %v", tt.name, err)
+			}
+			if string(decoded) != string(data) {
+				t.Errorf("decodeString(%q) = %x, want %x", tt.name, decoded, data)
+			}
+		})
+	}
+
+	if _, err := encodeBytes(data, "base58"); err == nil {
+		t.Error("expected error for unsupported encoding")
+	}
+}
+
+func TestEncodingModuleAndCryptoOutput(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	registerEncodingModule(L)
+	registerCryptoModule(L)
+
+	script := `
+		local encoding = require("encoding")
+		local crypto = require("crypto")
+
+		assert(encoding.base64_encode("hello") == "aGVsbG8=")
+		assert(encoding.base64_encode("hello", {padding = false}) == "aGVsbG8")
+		assert(encoding.base64url_decode("aGVsbG8") == "hello")
+		assert(encoding.base64url_decode("aGVsbG8=") == "hello")
+		assert(encoding.hex_decode(encoding.hex_encode("hello")) == "hello")
+		assert(encoding.base32_decode(encoding.base32_encode("hello")) == "hello")
+
+		local value, err = encoding.decode("zz", "hex")
+		assert(value == nil and err ~= nil)
+
+		local raw = crypto.sha256("hello", "raw")
+		assert(#raw == 32)
+		assert(encoding.hex_encode(raw) == crypto.sha256("hello"))
+		assert(crypto.hash("sha384", "hello", "base64url_raw") ==
+			encoding.encode(crypto.digest("sha384", "hello", "raw"), "base64url_raw"))
+		assert(crypto.deep_hash({a = 1}, "sha256", "base64") ==
+			encoding.base64_encode(crypto.deep_hash({a = 1}, "sha256", "raw")))
+
+		local jwk = crypto.generate_jwk("ES256")
+		local sig = crypto.sign(jwk, "payload", "hex")
+		assert(crypto.verify(jwk, "payload", sig, "hex"))
+		assert(crypto.verify(jwk, "payload", encoding.encode(encoding.hex_decode(sig), "base64url")))
+	`
+	if err := L.DoString(script); err != nil {
+		t.Fatal(err)
+	}
+}
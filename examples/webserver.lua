@@ -16,17 +16,15 @@ logView:SetWrap(true)
 logView:SetWordWrap(true)
 statusBar:SetTextColor(0x00ff00) -- Green
 
--- Logging function
+-- Logging function. Handlers run outside the UI, so the log view is
+-- updated on the event loop.
 local function log(message)
     local timestamp = os.date("%H:%M:%S")
     local logMessage = string.format("[%s] %s\n", timestamp, message)
     
-    -- Get current text and append
-    local currentText = ""
-    if logView.GetText then
-        currentText = logView:GetText()
-    end
-    logView:SetText(currentText .. logMessage)
+    app:QueueUpdateDraw(function(line)
+        logView:SetText(logView:GetText() .. line)
+    end, logMessage)
 end
 
 -- Create HTTP server
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/yuin/gopher-lua"
+)
+
+func newFormatsTestState(t *testing.T) *lua.LState {
+	t.Helper()
+	L := lua.NewState()
+	registerJSONModule(L)
+	registerYAMLModule(L)
+	registerTOMLModule(L)
+	registerCSVModule(L)
+	registerMsgPackModule(L)
+	t.Cleanup(L.Close)
+	return L
+}
+
+func TestFormatsRoundTrip(t *testing.T) {
+	for _, format := range []string{"yaml", "toml", "msgpack"} {
+		t.Run(format, func(t *testing.T) {
+			L := newFormatsTestState(t)
+			script := `
+				local codec = require("` + format + `")
+				local json = require("json")
+				local doc = {
+					name = "hype",
+					port = 8080,
+					ratio = 0.25,
+					enabled = true,
+					tags = {"lua", "go"},
+					db = { path = "app.db", buckets = {"users", "sessions"} },
+				}
+				local encoded, err = codec.encode(doc)
+				assert(err == nil, err)
+				local decoded, err = codec.decode(encoded)
+				assert(err == nil, err)
+				return json.encode(decoded, {sort_keys = true})
+			`
+			if err := L.DoString(script); err != nil {
+				t.Fatalf("script failed: %v", err)
+			}
+			want := `{"db":{"buckets":["users","sessions"],"path":"app.db"},"enabled":true,"name":"hype","port":8080,"ratio":0.25,"tags":["lua","go"]}`
+			if got := L.Get(-1).String(); got != want {
+				t.Fatalf("got %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestTOMLEncodeRequiresTable(t *testing.T) {
+	L := newFormatsTestState(t)
+	if err := L.DoString(`return require("toml").encode({1, 2, 3})`); err != nil {
+		t.Fatalf("script failed: %v", err)
+	}
+	if L.Get(-2) != lua.LNil {
+		t.Fatalf("expected nil result for array document")
+	}
+}
+
+func TestCSVDecodeWithHeader(t *testing.T) {
+	L := newFormatsTestState(t)
+	script := `
+		local csv = require("csv")
+		local rows, err = csv.decode("id;name\n1;alice\n2;\"bob; jr\"\n", {header = true, delimiter = ";"})
+		assert(err == nil, err)
+		assert(#rows == 2)
+		assert(rows[1].id == "1" and rows[1].name == "alice")
+		return rows[2].name
+	`
+	if err := L.DoString(script); err != nil {
+		t.Fatalf("script failed: %v", err)
+	}
+	if got := L.Get(-1).String(); got != "bob; jr" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestCSVEncodeWriteErrors(t *testing.T) {
+	L := newFormatsTestState(t)
+	script := `
+		local csv = require("csv")
+		local out, err = csv.encode({{"a", "b"}}, {delimiter = '"'})
+		assert(out == nil and err and err:find("row 1"), err)
+		out, err = csv.encode({{a = 1}}, {header = true, delimiter = "\n"})
+		assert(out == nil and err ~= nil)
+	`
+	if err := L.DoString(script); err != nil {
+		t.Fatalf("script failed: %v", err)
+	}
+}
+
+func TestCSVStreamingWriterAndReader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.csv")
+	L := newFormatsTestState(t)
+	L.SetGlobal("path", lua.LString(path))
+
+	script := `
+		local csv = require("csv")
+		local w = assert(csv.writer(path, {header = {"id", "name", "active"}}))
+		assert(w:write({id = 1, name = "alice", active = true}) == nil)
+		assert(w:write({2, "bob", false}) == nil)
+		assert(w:close() == nil)
+
+		local r = assert(csv.reader(path, {header = true}))
+		local names = {}
+		for row in r:rows() do
+			table.insert(names, row.name .. ":" .. row.active)
+		end
+		r:close()
+		return table.concat(names, ",")
+	`
+	if err := L.DoString(script); err != nil {
+		t.Fatalf("script failed: %v", err)
+	}
+	if got := L.Get(-1).String(); got != "alice:true,bob:false" {
+		t.Fatalf("got %q", got)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "id,name,active\n1,alice,true\n2,bob,false\n"; string(data) != want {
+		t.Fatalf("file contents %q, want %q", data, want)
+	}
+}
@@ -0,0 +1,574 @@
+// json_functions.go - JSON module implementation for Hype
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// jsonMaxDepth limits nesting so deeply recursive structures fail cleanly
+const jsonMaxDepth = 1000
+
+// jsonNullValue backs the json.null sentinel userdata
+type jsonNullValue struct{}
+
+var jsonNull = &jsonNullValue{}
+
+// JSONEncodeOptions controls how Lua values are rendered as JSON
+type JSONEncodeOptions struct {
+	Indent   string // Indentation per nesting level, empty for compact output
+	SortKeys bool   // Emit object keys in sorted order
+}
+
+// registerJSONModule adds JSON encoding and decoding to Lua
+func registerJSONModule(L *lua.LState) {
+	// json.null renders as "null" when printed
+	nullMT := L.NewTypeMetatable("JSONNull")
+	L.SetField(nullMT, "__tostring", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString("null"))
+		return 1
+	}))
+
+	// Marker metatable for tables that must encode as arrays even when empty
+	L.NewTypeMetatable("JSONArray")
+
+	L.PreloadModule("json", func(L *lua.LState) int {
+		jsonModule := L.NewTable()
+
+		L.SetField(jsonModule, "encode", L.NewFunction(jsonEncode))
+		L.SetField(jsonModule, "decode", L.NewFunction(jsonDecode))
+		L.SetField(jsonModule, "array", L.NewFunction(jsonArray))
+		L.SetField(jsonModule, "null", jsonNullSentinel(L))
+
+		L.Push(jsonModule)
+		return 1
+	})
+}
+
+// jsonEncode converts a Lua value to a JSON string
+func jsonEncode(L *lua.LState) int {
+	value := L.CheckAny(1)
+	options := jsonEncodeOptionsFromTable(L.OptTable(2, nil))
+
+	data, err := marshalLuaJSON(L, value, options)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	L.Push(lua.LString(string(data)))
+	return 1
+}
+
+// jsonDecode parses a JSON string into Lua values
+func jsonDecode(L *lua.LState) int {
+	data := L.CheckString(1)
+
+	value, err := unmarshalLuaJSON(L, data)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	L.Push(value)
+	return 1
+}
+
+// jsonArray marks a table so it always encodes as a JSON array
+func jsonArray(L *lua.LState) int {
+	table := L.OptTable(1, L.NewTable())
+	L.SetMetatable(table, L.GetTypeMetatable("JSONArray"))
+	L.Push(table)
+	return 1
+}
+
+// jsonNullSentinel returns the shared json.null userdata for this Lua state
+func jsonNullSentinel(L *lua.LState) lua.LValue {
+	if ud, ok := L.G.Registry.RawGetString("hype.json.null").(*lua.LUserData); ok {
+		return ud
+	}
+
+	ud := L.NewUserData()
+	ud.Value = jsonNull
+	L.SetMetatable(ud, L.GetTypeMetatable("JSONNull"))
+	L.G.Registry.RawSetString("hype.json.null", ud)
+	return ud
+}
+
+// isJSONNull reports whether a Lua value is the json.null sentinel
+func isJSONNull(value lua.LValue) bool {
+	ud, ok := value.(*lua.LUserData)
+	return ok && ud.Value == jsonNull
+}
+
+// jsonEncodeOptionsFromTable reads {indent=, sort_keys=} from an optional Lua table
+func jsonEncodeOptionsFromTable(table *lua.LTable) JSONEncodeOptions {
+	options := JSONEncodeOptions{}
+	if table == nil {
+		return options
+	}
+
+	switch indent := table.RawGetString("indent").(type) {
+	case lua.LNumber:
+		options.Indent = strings.Repeat(" ", int(indent))
+	case lua.LString:
+		options.Indent = string(indent)
+	case lua.LBool:
+		if indent {
+			options.Indent = "  "
+		}
+	}
+
+	if sortKeys, ok := table.RawGetString("sort_keys").(lua.LBool); ok {
+		options.SortKeys = bool(sortKeys)
+	}
+
+	return options
+}
+
+// luaTableArrayLength returns the length of a table when its keys are exactly 1..n
+func luaTableArrayLength(table *lua.LTable) (int, bool) {
+	count := 0
+	maxIndex := 0
+	isArray := true
+
+	table.ForEach(func(key, _ lua.LValue) {
+		count++
+		num, ok := key.(lua.LNumber)
+		if !ok || num < 1 || float64(num) != math.Trunc(float64(num)) {
+			isArray = false
+			return
+		}
+		if int(num) > maxIndex {
+			maxIndex = int(num)
+		}
+	})
+
+	return count, isArray && maxIndex == count
+}
+
+// isLuaArray reports whether a table should be treated as a JSON array
+func isLuaArray(L *lua.LState, table *lua.LTable) (int, bool) {
+	length, isArray := luaTableArrayLength(table)
+	if length == 0 {
+		return 0, table.Metatable == L.GetTypeMetatable("JSONArray")
+	}
+	return length, isArray
+}
+
+// jsonEncoder writes Lua values as JSON into a buffer
+type jsonEncoder struct {
+	L       *lua.LState
+	options JSONEncodeOptions
+	buf     bytes.Buffer
+	visited map[*lua.LTable]bool
+}
+
+// marshalLuaJSON encodes a Lua value as JSON
+func marshalLuaJSON(L *lua.LState, value lua.LValue, options JSONEncodeOptions) ([]byte, error) {
+	enc := &jsonEncoder{
+		L:       L,
+		options: options,
+		visited: make(map[*lua.LTable]bool),
+	}
+
+	if err := enc.encode(value, 0); err != nil {
+		return nil, err
+	}
+	return enc.buf.Bytes(), nil
+}
+
+func (e *jsonEncoder) encode(value lua.LValue, depth int) error {
+	switch v := value.(type) {
+	case *lua.LNilType:
+		e.buf.WriteString("null")
+	case lua.LBool:
+		if v {
+			e.buf.WriteString("true")
+		} else {
+			e.buf.WriteString("false")
+		}
+	case lua.LNumber:
+		num, err := formatJSONNumber(float64(v))
+		if err != nil {
+			return err
+		}
+		e.buf.WriteString(num)
+	case lua.LString:
+		writeJSONString(&e.buf, string(v))
+	case *lua.LUserData:
+		if v.Value != jsonNull {
+			return fmt.Errorf("cannot encode userdata as JSON")
+		}
+		e.buf.WriteString("null")
+	case *lua.LTable:
+		return e.encodeTable(v, depth)
+	default:
+		return fmt.Errorf("cannot encode %s as JSON", value.Type().String())
+	}
+	return nil
+}
+
+func (e *jsonEncoder) encodeTable(table *lua.LTable, depth int) error {
+	if depth >= jsonMaxDepth {
+		return fmt.Errorf("cannot encode JSON: nesting deeper than %d levels", jsonMaxDepth)
+	}
+	if e.visited[table] {
+		return fmt.Errorf("cannot encode recursive table as JSON")
+	}
+	e.visited[table] = true
+	defer delete(e.visited, table)
+
+	if length, isArray := isLuaArray(e.L, table); isArray {
+		e.buf.WriteByte('[')
+		for i := 1; i <= length; i++ {
+			if i > 1 {
+				e.buf.WriteByte(',')
+			}
+			e.newline(depth + 1)
+			if err := e.encode(table.RawGetInt(i), depth+1); err != nil {
+				return err
+			}
+		}
+		if length > 0 {
+			e.newline(depth)
+		}
+		e.buf.WriteByte(']')
+		return nil
+	}
+
+	type jsonField struct {
+		key   string
+		value lua.LValue
+	}
+
+	// Next walks keys in insertion order, so unsorted output follows the source table
+	var fields []jsonField
+	for key, value := table.Next(lua.LNil); key != lua.LNil; key, value = table.Next(key) {
+		switch k := key.(type) {
+		case lua.LString:
+			fields = append(fields, jsonField{string(k), value})
+		case lua.LNumber:
+			num, err := formatJSONNumber(float64(k))
+			if err != nil {
+				return err
+			}
+			fields = append(fields, jsonField{num, value})
+		default:
+			return fmt.Errorf("cannot encode table key of type %s as JSON", key.Type().String())
+		}
+	}
+
+	if e.options.SortKeys {
+		sort.Slice(fields, func(i, j int) bool {
+			return fields[i].key < fields[j].key
+		})
+	}
+
+	e.buf.WriteByte('{')
+	for i, field := range fields {
+		if i > 0 {
+			e.buf.WriteByte(',')
+		}
+		e.newline(depth + 1)
+		writeJSONString(&e.buf, field.key)
+		e.buf.WriteByte(':')
+		if e.options.Indent != "" {
+			e.buf.WriteByte(' ')
+		}
+		if err := e.encode(field.value, depth+1); err != nil {
+			return err
+		}
+	}
+	if len(fields) > 0 {
+		e.newline(depth)
+	}
+	e.buf.WriteByte('}')
+	return nil
+}
+
+// newline starts a new indented line when pretty printing
+func (e *jsonEncoder) newline(depth int) {
+	if e.options.Indent == "" {
+		return
+	}
+	e.buf.WriteByte('\n')
+	for i := 0; i < depth; i++ {
+		e.buf.WriteString(e.options.Indent)
+	}
+}
+
+// formatJSONNumber renders integral values without a fractional part
+func formatJSONNumber(f float64) (string, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return "", fmt.Errorf("cannot encode %v as JSON", f)
+	}
+	if f == math.Trunc(f) && math.Abs(f) < 1e15 {
+		return strconv.FormatInt(int64(f), 10), nil
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64), nil
+}
+
+// writeJSONString writes a quoted JSON string, replacing invalid UTF-8
+func writeJSONString(buf *bytes.Buffer, s string) {
+	buf.WriteByte('"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			switch c {
+			case '"', '\\':
+				buf.WriteByte('\\')
+				buf.WriteByte(c)
+			case '\n':
+				buf.WriteString(`\n`)
+			case '\r':
+				buf.WriteString(`\r`)
+			case '\t':
+				buf.WriteString(`\t`)
+			default:
+				if c < 0x20 {
+					fmt.Fprintf(buf, `\u%04x`, c)
+				} else {
+					buf.WriteByte(c)
+				}
+			}
+			i++
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			buf.WriteRune(utf8.RuneError)
+		} else {
+			buf.WriteString(s[i : i+size])
+		}
+		i += size
+	}
+	buf.WriteByte('"')
+}
+
+// unmarshalLuaJSON decodes a JSON document into Lua values
+func unmarshalLuaJSON(L *lua.LState, data string) (lua.LValue, error) {
+	dec := json.NewDecoder(strings.NewReader(data))
+	dec.UseNumber()
+
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return nil, jsonDecodeError(data, err)
+	}
+
+	// Only whitespace may follow the top-level value
+	offset := dec.InputOffset()
+	rest := strings.TrimLeft(data[offset:], " \t\r\n")
+	if rest != "" {
+		offset = int64(len(data) - len(rest))
+		return nil, fmt.Errorf("invalid character %q after top-level value at %s", rest[0], jsonPosition(data, offset+1))
+	}
+
+	return goValueToLua(L, value), nil
+}
+
+// jsonDecodeError annotates decoder errors with line and column information
+func jsonDecodeError(data string, err error) error {
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		return fmt.Errorf("%s at %s", e.Error(), jsonPosition(data, e.Offset))
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("unexpected end of JSON input at %s", jsonPosition(data, int64(len(data))))
+	}
+	return err
+}
+
+// jsonPosition describes a byte offset as a 1-based line and column
+func jsonPosition(data string, offset int64) string {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	if offset < 0 {
+		offset = 0
+	}
+
+	consumed := data[:offset]
+	line := strings.Count(consumed, "\n") + 1
+	column := len(consumed) - (strings.LastIndex(consumed, "\n") + 1)
+	if column == 0 {
+		column = 1
+	}
+
+	return fmt.Sprintf("line %d, column %d (offset %d)", line, column, offset)
+}
+
+// goValueToLua converts decoded Go values into Lua values
+func goValueToLua(L *lua.LState, value interface{}) lua.LValue {
+	switch v := value.(type) {
+	case nil:
+		return jsonNullSentinel(L)
+	case bool:
+		return lua.LBool(v)
+	case string:
+		return lua.LString(v)
+	case []byte:
+		return lua.LString(string(v))
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return lua.LString(v.String())
+		}
+		return lua.LNumber(f)
+	case float64:
+		return lua.LNumber(v)
+	case float32:
+		return lua.LNumber(v)
+	case int:
+		return lua.LNumber(v)
+	case int64:
+		return lua.LNumber(v)
+	case uint64:
+		return lua.LNumber(v)
+	case []interface{}:
+		table := L.NewTable()
+		for i, item := range v {
+			table.RawSetInt(i+1, goValueToLua(L, item))
+		}
+		L.SetMetatable(table, L.GetTypeMetatable("JSONArray"))
+		return table
+	case map[string]interface{}:
+		table := L.NewTable()
+		for key, item := range v {
+			table.RawSetString(key, goValueToLua(L, item))
+		}
+		return table
+	case map[interface{}]interface{}:
+		table := L.NewTable()
+		for key, item := range v {
+			table.RawSetString(fmt.Sprint(key), goValueToLua(L, item))
+		}
+		return table
+	case time.Time:
+		return lua.LString(v.Format(time.RFC3339Nano))
+	}
+
+	// Remaining sized numbers, typed slices and maps produced by the format decoders
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return lua.LNumber(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return lua.LNumber(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return lua.LNumber(rv.Float())
+	case reflect.Slice, reflect.Array:
+		table := L.NewTable()
+		for i := 0; i < rv.Len(); i++ {
+			table.RawSetInt(i+1, goValueToLua(L, rv.Index(i).Interface()))
+		}
+		L.SetMetatable(table, L.GetTypeMetatable("JSONArray"))
+		return table
+	case reflect.Map:
+		table := L.NewTable()
+		iter := rv.MapRange()
+		for iter.Next() {
+			table.RawSetString(fmt.Sprint(iter.Key().Interface()), goValueToLua(L, iter.Value().Interface()))
+		}
+		return table
+	}
+
+	return lua.LString(fmt.Sprint(value))
+}
+
+// luaValueToGo converts a Lua value into plain Go maps, slices and scalars.
+// Integral numbers become int64 so formats with an integer type keep it.
+func luaValueToGo(L *lua.LState, value lua.LValue) (interface{}, error) {
+	return luaValueToGoVisited(L, value, make(map[*lua.LTable]bool))
+}
+
+func luaValueToGoVisited(L *lua.LState, value lua.LValue, visited map[*lua.LTable]bool) (interface{}, error) {
+	switch v := value.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		return bool(v), nil
+	case lua.LNumber:
+		f := float64(v)
+		if f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+			return int64(f), nil
+		}
+		return f, nil
+	case lua.LString:
+		return string(v), nil
+	case *lua.LUserData:
+		if v.Value == jsonNull {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("cannot convert userdata")
+	case *lua.LTable:
+		if visited[v] {
+			return nil, fmt.Errorf("cannot convert recursive table")
+		}
+		visited[v] = true
+		defer delete(visited, v)
+
+		if length, isArray := isLuaArray(L, v); isArray {
+			items := make([]interface{}, 0, length)
+			for i := 1; i <= length; i++ {
+				item, err := luaValueToGoVisited(L, v.RawGetInt(i), visited)
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, item)
+			}
+			return items, nil
+		}
+
+		result := make(map[string]interface{})
+		for key, val := v.Next(lua.LNil); key != lua.LNil; key, val = v.Next(key) {
+			var keyStr string
+			switch k := key.(type) {
+			case lua.LString:
+				keyStr = string(k)
+			case lua.LNumber:
+				keyStr = k.String()
+			default:
+				return nil, fmt.Errorf("cannot convert table key of type %s", key.Type().String())
+			}
+
+			item, err := luaValueToGoVisited(L, val, visited)
+			if err != nil {
+				return nil, err
+			}
+			result[keyStr] = item
+		}
+		return result, nil
+	default:
+		return nil, fmt.Errorf("cannot convert %s", value.Type().String())
+	}
+}
+
+// newJSONBodyFunction returns a Lua method that decodes the given payload as JSON
+func newJSONBodyFunction(L *lua.LState, body string) *lua.LFunction {
+	return L.NewFunction(func(L *lua.LState) int {
+		value, err := unmarshalLuaJSON(L, body)
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+
+		L.Push(value)
+		return 1
+	})
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/yuin/gopher-lua"
+)
+
+func newJSONTestState(t *testing.T) *lua.LState {
+	t.Helper()
+	L := lua.NewState()
+	registerJSONModule(L)
+	t.Cleanup(L.Close)
+	return L
+}
+
+func TestJSONEncode(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   string
+	}{
+		{"array", `return json.encode({1, 2, "three", true})`, `[1,2,"three",true]`},
+		{"nested", `return json.encode({user = {name = "alice", tags = {"a", "b"}}})`, `{"user":{"name":"alice","tags":["a","b"]}}`},
+		{"insertion order", `return json.encode({b = 1, a = 2})`, `{"b":1,"a":2}`},
+		{"sort keys", `return json.encode({b = 1, a = 2, c = {z = 1, y = 2}}, {sort_keys = true})`, `{"a":2,"b":1,"c":{"y":2,"z":1}}`},
+		{"indent", `return json.encode({a = {1, 2}}, {indent = 2})`, "{\n  \"a\": [\n    1,\n    2\n  ]\n}"},
+		{"null", `return json.encode({1, json.null, 3})`, `[1,null,3]`},
+		{"empty object", `return json.encode({})`, `{}`},
+		{"empty array", `return json.encode(json.array())`, `[]`},
+		{"sparse array", `return json.encode({[1] = "a", [3] = "c"})`, `{"1":"a","3":"c"}`},
+		{"numbers", `return json.encode({1.5, -2, 1e20})`, `[1.5,-2,1e+20]`},
+		{"escapes", `return json.encode("a\"b\\c\n\1")`, `"a\"b\\c\n\u0001"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			L := newJSONTestState(t)
+			if err := L.DoString(`json = require("json")` + "\n" + tt.script); err != nil {
+				t.Fatalf("script failed: %v", err)
+			}
+			if got := L.Get(-1).String(); got != tt.want {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONEncodeErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   string
+	}{
+		{"recursive", `local t = {} t.self = t return json.encode(t)`, "recursive table"},
+		{"function", `return json.encode({f = print})`, "cannot encode function"},
+		{"nan", `return json.encode(0/0)`, "cannot encode"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			L := newJSONTestState(t)
+			if err := L.DoString(`json = require("json")` + "\n" + tt.script); err != nil {
+				t.Fatalf("script failed: %v", err)
+			}
+			if L.Get(-2) != lua.LNil {
+				t.Fatalf("expected nil result, got %s", L.Get(-2))
+			}
+			if got := L.Get(-1).String(); !strings.Contains(got, tt.want) {
+				t.Fatalf("error %q does not contain %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	L := newJSONTestState(t)
+	script := `
+		json = require("json")
+		local doc = '{"name":"hype","tags":[],"meta":{"count":3,"ratio":0.5,"missing":null},"list":[1,[2,3]]}'
+		local value, err = json.decode(doc)
+		assert(err == nil, err)
+		assert(value.name == "hype")
+		assert(value.meta.count == 3)
+		assert(value.meta.missing == json.null)
+		assert(value.list[2][2] == 3)
+		return json.encode(value, {sort_keys = true})
+	`
+	if err := L.DoString(script); err != nil {
+		t.Fatalf("script failed: %v", err)
+	}
+	want := `{"list":[1,[2,3]],"meta":{"count":3,"missing":null,"ratio":0.5},"name":"hype","tags":[]}`
+	if got := L.Get(-1).String(); got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
+func TestJSONDecodeErrorPosition(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"{\"a\": 1,\n \"b\": tru}", "line 2, column 10"},
+		{`{"a": 1`, "unexpected end of JSON input at line 1, column 7"},
+		{`[1, 2] x`, "after top-level value at line 1, column 8"},
+	}
+
+	for _, tt := range tests {
+		L := newJSONTestState(t)
+		_, err := unmarshalLuaJSON(L, tt.input)
+		if err == nil {
+			t.Fatalf("expected error decoding %q", tt.input)
+		}
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Fatalf("error %q does not contain %q", err.Error(), tt.want)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+// kv_backup_functions.go - Hot backups and compaction for the kv module
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+	"go.etcd.io/bbolt"
+)
+
+// kvDefaultCompactTxSize is how many bytes kv.compact copies per transaction
+const kvDefaultCompactTxSize = 65536
+
+// kvDefaultCompactTimeout is how long kv.compact waits for the file lock of
+// a path that another process has open
+const kvDefaultCompactTimeout = time.Second
+
+// kvLuaWriter adapts a Lua object with a write method to io.Writer so that
+// both HTTP response objects and file handles can receive a backup
+type kvLuaWriter struct {
+	L      *lua.LState
+	target lua.LValue
+}
+
+func (w *kvLuaWriter) Write(p []byte) (int, error) {
+	write := w.L.GetField(w.target, "write")
+	if write.Type() != lua.LTFunction {
+		return 0, fmt.Errorf("writer has no write method")
+	}
+	err := w.L.CallByParam(lua.P{
+		Fn:      write,
+		NRet:    1,
+		Protect: true,
+	}, w.target, lua.LString(p))
+	if err != nil {
+		return 0, err
+	}
+
+	// File handles return themselves, responses return nothing; only an
+	// error string or false signals a failed write
+	ret := w.L.Get(-1)
+	w.L.Pop(1)
+	if s, ok := ret.(lua.LString); ok {
+		return 0, fmt.Errorf("%s", string(s))
+	}
+	if ret == lua.LFalse {
+		return 0, fmt.Errorf("write failed")
+	}
+	return len(p), nil
+}
+
+// kvWriterFromLua returns an io.Writer for a Go writer wrapped in userdata
+// or for any Lua value with a write method
+func kvWriterFromLua(L *lua.LState, n int) io.Writer {
+	value := L.CheckAny(n)
+	if ud, ok := value.(*lua.LUserData); ok {
+		if w, ok := ud.Value.(io.Writer); ok {
+			return w
+		}
+	}
+	if L.GetField(value, "write").Type() != lua.LTFunction {
+		L.ArgError(n, "writer expected")
+	}
+	return &kvLuaWriter{L: L, target: value}
+}
+
+// backup writes a consistent copy of the database to path. The copy is
+// taken in a read transaction, so writers are not blocked, and is renamed
+// into place only once complete.
+func (d *KVDB) backup(path string) (int64, error) {
+	if abs, err := filepath.Abs(path); err == nil {
+		if src, err := filepath.Abs(d.path); err == nil && abs == src {
+			return 0, fmt.Errorf("cannot back up %s onto itself", path)
+		}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	var size int64
+	err = d.db.View(func(tx KVEngineTx) error {
+		var err error
+		size, err = kvWriteSnapshot(tx, tmp)
+		return err
+	})
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0600)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// backupTo streams a consistent copy of the database to w
+func (d *KVDB) backupTo(w io.Writer) (int64, error) {
+	var size int64
+	err := d.db.View(func(tx KVEngineTx) error {
+		var err error
+		size, err = kvWriteSnapshot(tx, w)
+		return err
+	})
+	return size, err
+}
+
+// kvWriteSnapshot writes the database file as seen by tx. Only engines
+// with a single-file format, such as bbolt, support it.
+func kvWriteSnapshot(tx KVEngineTx, w io.Writer) (int64, error) {
+	snapshot, ok := tx.(io.WriterTo)
+	if !ok {
+		return 0, errors.New("backups are not supported by this storage engine")
+	}
+	return snapshot.WriteTo(w)
+}
+
+// kvBackupMethod implements db:backup(path) and db:backup_to(writer), both
+// returning the number of bytes written
+func kvBackupMethod(db *KVDB, method string) lua.LGFunction {
+	return func(L *lua.LState) int {
+		var size int64
+		var err error
+		if method == "backup" {
+			size, err = db.backup(L.CheckString(2))
+		} else {
+			size, err = db.backupTo(kvWriterFromLua(L, 2))
+		}
+
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LNumber(size))
+		L.Push(lua.LNil)
+		return 2
+	}
+}
+
+// kvCompact copies every bucket of src into a new database at dst, leaving
+// behind the free pages that bbolt never returns to the file system
+func kvCompact(src *bbolt.DB, dst string, txMaxSize int64) (int64, error) {
+	if _, err := os.Stat(dst); err == nil {
+		return 0, fmt.Errorf("destination %s already exists", dst)
+	}
+
+	out, err := bbolt.Open(dst, 0600, nil)
+	if err != nil {
+		return 0, err
+	}
+	err = bbolt.Compact(out, src, txMaxSize)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return 0, err
+	}
+
+	info, err := os.Stat(dst)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// kvOpenDatabase returns the open database of this process at path, or nil
+func kvOpenDatabase(path string) *KVDB {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil
+	}
+	kvOpenDatabases.Lock()
+	defer kvOpenDatabases.Unlock()
+	for db := range kvOpenDatabases.dbs {
+		if other, err := filepath.Abs(db.path); err == nil && other == abs && db.db != nil {
+			return db
+		}
+	}
+	return nil
+}
+
+// kvCompactFunction implements kv.compact(src, dst, {tx_max_size=, timeout=}). The
+// source is a path or an open database; it returns the sizes before and after.
+func kvCompactFunction(L *lua.LState) int {
+	dst := L.CheckString(2)
+	txMaxSize := int64(kvDefaultCompactTxSize)
+	timeout := kvDefaultCompactTimeout
+	if opts := L.OptTable(3, nil); opts != nil {
+		if size, ok := opts.RawGetString("tx_max_size").(lua.LNumber); ok {
+			txMaxSize = int64(size)
+		}
+		if seconds, ok := opts.RawGetString("timeout").(lua.LNumber); ok {
+			timeout = time.Duration(float64(seconds) * float64(time.Second))
+		}
+	}
+
+	// A path this script has open is compacted from the open database, as
+	// bbolt's file lock would keep a second handle waiting
+	var db *KVDB
+	if ud, ok := L.Get(1).(*lua.LUserData); ok {
+		if db, ok = ud.Value.(*KVDB); !ok {
+			L.ArgError(1, "path or kv database expected")
+		}
+	} else {
+		db = kvOpenDatabase(L.CheckString(1))
+	}
+
+	var src *bbolt.DB
+	if db != nil {
+		bolt, ok := db.db.(*kvBoltEngine)
+		if !ok {
+			err := errors.New("compaction is only supported by the bbolt engine")
+			if db.db == nil {
+				err = bbolt.ErrDatabaseNotOpen
+			}
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		src = bolt.db
+	} else {
+		path := L.CheckString(1)
+		opened, err := bbolt.Open(path, 0600, &bbolt.Options{ReadOnly: true, Timeout: timeout})
+		if errors.Is(err, bbolt.ErrTimeout) {
+			err = kvLockError(path, timeout)
+		}
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		defer opened.Close()
+		src = opened
+	}
+
+	var before int64
+	if info, err := os.Stat(src.Path()); err == nil {
+		before = info.Size()
+	}
+
+	after, err := kvCompact(src, dst, txMaxSize)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	result := L.NewTable()
+	result.RawSetString("before", lua.LNumber(before))
+	result.RawSetString("after", lua.LNumber(after))
+	L.Push(result)
+	L.Push(lua.LNil)
+	return 2
+}
@@ -0,0 +1,337 @@
+// kv_cli.go - "hype kv" commands for inspecting and editing kv databases
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"go.etcd.io/bbolt"
+)
+
+// kvCLILockTimeout is how long kv commands wait for a database that is open
+// in another process before giving up
+const kvCLILockTimeout = 2 * time.Second
+
+var kvCmd = &cobra.Command{
+	Use:   "kv",
+	Short: "Inspect and edit kv database files",
+	Long: `Inspect and edit database files created with kv.open.
+
+Bucket arguments are bucket paths separated by '/', for example users/alice/sessions.
+
+Examples:
+  hype kv ls app.db
+  hype kv ls app.db users
+  hype kv get app.db users alice
+  hype kv put app.db users alice '{"name":"Alice"}'
+  hype kv del app.db users alice
+  hype kv dump app.db > app.jsonl
+  hype kv load copy.db app.jsonl
+  hype kv import --mode replace copy.db app.jsonl
+  hype kv stats app.db`,
+}
+
+var kvLsCmd = &cobra.Command{
+	Use:   "ls [file] [bucket]",
+	Short: "List buckets, or the keys and sub-buckets of a bucket",
+	Args:  cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		all, _ := cmd.Flags().GetBool("all")
+		var path [][]byte
+		if len(args) > 1 {
+			path = kvCLIBucketPath(args[1])
+		}
+		kvCLIRun(args[0], true, func(db KVEngine) error {
+			return kvCLIList(db, path, all, os.Stdout)
+		})
+	},
+}
+
+var kvGetCmd = &cobra.Command{
+	Use:   "get [file] [bucket] [key]",
+	Short: "Print the value of a key",
+	Args:  cobra.ExactArgs(3),
+	Run: func(cmd *cobra.Command, args []string) {
+		kvCLIRun(args[0], true, func(db KVEngine) error {
+			return db.View(func(tx KVEngineTx) error {
+				if err := kvCLICheckUnencrypted(tx); err != nil {
+					return err
+				}
+				path := kvCLIBucketPath(args[1])
+				value, err := kvGetEntry(tx, path, []byte(args[2]))
+				if err != nil {
+					return err
+				}
+				if value == nil {
+					return fmt.Errorf("key %s not found in bucket %s", args[2], kvBucketName(path))
+				}
+				_, err = os.Stdout.Write(value)
+				return err
+			})
+		})
+	},
+}
+
+var kvPutCmd = &cobra.Command{
+	Use:   "put [file] [bucket] [key] [value]",
+	Short: "Set the value of a key, creating the bucket if needed (value '-' reads stdin)",
+	Args:  cobra.ExactArgs(4),
+	Run: func(cmd *cobra.Command, args []string) {
+		value := []byte(args[3])
+		if args[3] == "-" {
+			data, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error reading value: %v\n", err)
+				os.Exit(1)
+			}
+			value = data
+		}
+		kvCLIRun(args[0], false, func(db KVEngine) error {
+			return db.Update(func(tx KVEngineTx) error {
+				if err := kvCLICheckUnencrypted(tx); err != nil {
+					return err
+				}
+				path := kvCLIBucketPath(args[1])
+				if _, err := kvCreateBucket(tx, path); err != nil {
+					return err
+				}
+				return kvPutEntry(tx, path, []byte(args[2]), value, 0)
+			})
+		})
+	},
+}
+
+var kvDelCmd = &cobra.Command{
+	Use:   "del [file] [bucket] [key]",
+	Short: "Delete a key",
+	Args:  cobra.ExactArgs(3),
+	Run: func(cmd *cobra.Command, args []string) {
+		kvCLIRun(args[0], false, func(db KVEngine) error {
+			return db.Update(func(tx KVEngineTx) error {
+				if err := kvCLICheckUnencrypted(tx); err != nil {
+					return err
+				}
+				return kvDeleteEntry(tx, kvCLIBucketPath(args[1]), []byte(args[2]))
+			})
+		})
+	},
+}
+
+var kvDumpCmd = &cobra.Command{
+	Use:     "dump [file] [bucket...]",
+	Aliases: []string{"export"},
+	Short:   "Write buckets as JSON lines to stdout",
+	Args:    cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		all, _ := cmd.Flags().GetBool("all")
+		var buckets [][][]byte
+		for _, name := range args[1:] {
+			buckets = append(buckets, kvCLIBucketPath(name))
+		}
+		kvCLIRun(args[0], true, func(db KVEngine) error {
+			out := bufio.NewWriter(os.Stdout)
+			err := db.View(func(tx KVEngineTx) error {
+				_, err := kvDump(tx, buckets, all, out)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			return out.Flush()
+		})
+	},
+}
+
+var kvLoadCmd = &cobra.Command{
+	Use:     "load [file] [input]",
+	Aliases: []string{"import"},
+	Short:   "Import JSON lines produced by dump (reads stdin without input)",
+	Args:    cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		mode, _ := cmd.Flags().GetString("mode")
+		if mode != "merge" && mode != "replace" {
+			fmt.Fprintf(os.Stderr, "Error: --mode must be merge or replace\n")
+			os.Exit(1)
+		}
+		in := io.Reader(os.Stdin)
+		if len(args) > 1 {
+			f, err := os.Open(args[1])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error opening input: %v\n", err)
+				os.Exit(1)
+			}
+			defer f.Close()
+			in = f
+		}
+		kvCLIRun(args[0], false, func(db KVEngine) error {
+			var count int
+			err := db.Update(func(tx KVEngineTx) error {
+				var err error
+				count, err = kvLoad(tx, in, KVLoadOptions{Replace: mode == "replace", Raw: true})
+				return err
+			})
+			if err == nil {
+				fmt.Fprintf(os.Stderr, "Loaded %d keys\n", count)
+			}
+			return err
+		})
+	},
+}
+
+var kvStatsCmd = &cobra.Command{
+	Use:   "stats [file]",
+	Short: "Print page usage and key counts",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		all, _ := cmd.Flags().GetBool("all")
+		kvCLIRun(args[0], true, func(db KVEngine) error {
+			return kvStats(db, all, os.Stdout)
+		})
+	},
+}
+
+func init() {
+	kvLsCmd.Flags().BoolP("all", "a", false, "Include internal buckets used for expiry and indexes")
+	kvDumpCmd.Flags().BoolP("all", "a", false, "Include internal buckets used for expiry and indexes")
+	kvLoadCmd.Flags().String("mode", "merge", "merge into existing buckets, or replace the buckets in the input")
+	kvStatsCmd.Flags().BoolP("all", "a", false, "Include internal buckets used for expiry and indexes")
+
+	kvCmd.AddCommand(kvLsCmd)
+	kvCmd.AddCommand(kvGetCmd)
+	kvCmd.AddCommand(kvPutCmd)
+	kvCmd.AddCommand(kvDelCmd)
+	kvCmd.AddCommand(kvDumpCmd)
+	kvCmd.AddCommand(kvLoadCmd)
+	kvCmd.AddCommand(kvStatsCmd)
+	rootCmd.AddCommand(kvCmd)
+}
+
+// kvCLIRun opens a database file, runs fn and exits on error. Read-only
+// commands refuse to create missing files.
+func kvCLIRun(file string, readonly bool, fn func(KVEngine) error) {
+	if readonly {
+		if _, err := os.Stat(file); err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening database: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	db, err := kvOpenBoltEngine(file, KVEngineOptions{Mode: 0600, ReadOnly: readonly, Timeout: kvCLILockTimeout})
+	if errors.Is(err, bbolt.ErrTimeout) {
+		err = kvLockError(file, kvCLILockTimeout)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening database: %v\n", err)
+		os.Exit(1)
+	}
+
+	err = fn(db)
+	db.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// kvCLICheckUnencrypted rejects reading or writing single values of an
+// encrypted database, which needs the key. Dump and load copy encrypted
+// entries as they are.
+func kvCLICheckUnencrypted(tx KVEngineTx) error {
+	if tx.Bucket(kvCryptoBucket) != nil {
+		return fmt.Errorf("%s is encrypted; open it with kv.open and its key instead", tx.Engine().Path())
+	}
+	return nil
+}
+
+// kvCLIBucketPath splits a bucket argument such as users/alice into a path
+func kvCLIBucketPath(name string) [][]byte {
+	var path [][]byte
+	for _, part := range strings.Split(name, "/") {
+		if part != "" {
+			path = append(path, []byte(part))
+		}
+	}
+	if len(path) == 0 {
+		path = [][]byte{[]byte("default")}
+	}
+	return path
+}
+
+// kvCLIList prints top-level buckets, or the sub-buckets and keys of a
+// bucket. Sub-buckets are printed with a trailing slash.
+func kvCLIList(db KVEngine, path [][]byte, all bool, w io.Writer) error {
+	return db.View(func(tx KVEngineTx) error {
+		if path == nil {
+			return tx.ForEach(func(name []byte, _ KVEngineBucket) error {
+				if !all && strings.HasPrefix(string(name), kvInternalPrefix) {
+					return nil
+				}
+				_, err := fmt.Fprintf(w, "%s/\n", name)
+				return err
+			})
+		}
+
+		bucket := kvBucket(tx, path)
+		if bucket == nil {
+			return kvBucketNotFound(path)
+		}
+		expired := kvExpiryFunc(tx, path)
+		return bucket.ForEach(func(k, v []byte) error {
+			var err error
+			if v == nil {
+				_, err = fmt.Fprintf(w, "%s/\n", k)
+			} else if !expired(k) {
+				_, err = fmt.Fprintf(w, "%s\n", k)
+			}
+			return err
+		})
+	})
+}
+
+// kvStats prints file and page statistics followed by per-bucket key counts
+func kvStats(engine KVEngine, all bool, w io.Writer) error {
+	bolt, ok := engine.(*kvBoltEngine)
+	if !ok {
+		return fmt.Errorf("%s is not a bbolt database", engine.Path())
+	}
+	db := bolt.db
+	return db.View(func(tx *bbolt.Tx) error {
+		info := db.Info()
+		stats := db.Stats()
+		fmt.Fprintf(w, "File:        %s\n", db.Path())
+		fmt.Fprintf(w, "Size:        %d bytes\n", tx.Size())
+		fmt.Fprintf(w, "Page size:   %d bytes\n", info.PageSize)
+		fmt.Fprintf(w, "Pages:       %d\n", tx.Size()/int64(info.PageSize))
+		fmt.Fprintf(w, "Free pages:  %d (%d pending)\n", stats.FreePageN, stats.PendingPageN)
+		fmt.Fprintf(w, "Freelist:    %d bytes\n\n", stats.FreelistInuse)
+
+		var names []string
+		err := tx.ForEach(func(name []byte, _ *bbolt.Bucket) error {
+			if all || !strings.HasPrefix(string(name), kvInternalPrefix) {
+				names = append(names, string(name))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		sort.Strings(names)
+
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "BUCKET\tKEYS\tBUCKETS\tDEPTH\tBRANCH PAGES\tLEAF PAGES\tLEAF IN USE")
+		for _, name := range names {
+			s := tx.Bucket([]byte(name)).Stats()
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%d\n",
+				name, s.KeyN, s.BucketN-1, s.Depth, s.BranchPageN, s.LeafPageN, s.LeafInuse)
+		}
+		return tw.Flush()
+	})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func openTestBolt(t *testing.T, name string) KVEngine {
+	t.Helper()
+	db, err := kvOpenBoltEngine(filepath.Join(t.TempDir(), name), KVEngineOptions{Mode: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestKVDumpLoadRoundTrip(t *testing.T) {
+	src := openTestBolt(t, "src.db")
+	err := src.Update(func(tx KVEngineTx) error {
+		users, err := kvCreateBucket(tx, kvCLIBucketPath("users"))
+		if err != nil {
+			return err
+		}
+		users.Put([]byte("alice"), []byte(`{"name":"Alice"}`))
+		users.Put([]byte{0xff, 0x00}, []byte{0x01, 0x02})
+		if _, err := kvCreateBucket(tx, kvCLIBucketPath("users/bob/sessions")); err != nil {
+			return err
+		}
+		if _, err := kvCreateBucket(tx, kvCLIBucketPath("empty")); err != nil {
+			return err
+		}
+		return kvPutEntry(tx, kvCLIBucketPath("users"), []byte("temp"), []byte("x"), 1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dump bytes.Buffer
+	err = src.View(func(tx KVEngineTx) error {
+		_, err := kvDump(tx, nil, false, &dump)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(dump.String(), kvInternalPrefix) || strings.Contains(dump.String(), "temp") {
+		t.Fatalf("dump contains internal buckets or expired keys:\n%s", dump.String())
+	}
+	if !strings.Contains(dump.String(), `"encoding":"base64"`) {
+		t.Fatalf("expected binary entry to be base64 encoded:\n%s", dump.String())
+	}
+
+	dst := openTestBolt(t, "dst.db")
+	var count int
+	err = dst.Update(func(tx KVEngineTx) error {
+		var err error
+		count, err = kvLoad(tx, &dump, KVLoadOptions{Raw: true})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("loaded %d keys, want 2", count)
+	}
+
+	var list bytes.Buffer
+	if err := kvCLIList(dst, nil, false, &list); err != nil {
+		t.Fatal(err)
+	}
+	if list.String() != "empty/\nusers/\n" {
+		t.Errorf("ls = %q", list.String())
+	}
+	list.Reset()
+	if err := kvCLIList(dst, kvCLIBucketPath("users"), false, &list); err != nil {
+		t.Fatal(err)
+	}
+	if list.String() != "alice\nbob/\n\xff\x00\n" {
+		t.Errorf("ls users = %q", list.String())
+	}
+
+	dst.View(func(tx KVEngineTx) error {
+		if v := tx.Bucket([]byte("users")).Get([]byte{0xff, 0x00}); !bytes.Equal(v, []byte{0x01, 0x02}) {
+			t.Errorf("binary value = %x", v)
+		}
+		if kvBucket(tx, kvCLIBucketPath("users/bob/sessions")) == nil {
+			t.Error("nested bucket was not restored")
+		}
+		return nil
+	})
+
+	if err := dst.Update(func(tx KVEngineTx) error {
+		_, err := kvLoad(tx, strings.NewReader("{\"bucket\":[]}\n"), KVLoadOptions{Raw: true})
+		return err
+	}); err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Errorf("expected line error, got %v", err)
+	}
+
+	var stats bytes.Buffer
+	if err := kvStats(dst, false, &stats); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stats.String(), "Page size:") || !strings.Contains(stats.String(), "users") {
+		t.Errorf("unexpected stats output:\n%s", stats.String())
+	}
+}
@@ -0,0 +1,671 @@
+// kv_collection_functions.go - Indexed document collections for the kv module
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/yuin/gopher-lua"
+	"go.etcd.io/bbolt"
+)
+
+// kvIndexBucket holds collection indexes as nested buckets
+// (collection name, then field name)
+var kvIndexBucket = []byte(kvInternalPrefix + "index")
+
+// Type tags for index keys. Values of different types sort by tag, so
+// booleans sort before numbers and numbers before strings.
+const (
+	kvIndexBool   byte = 0x01
+	kvIndexNumber byte = 0x02
+	kvIndexString byte = 0x03
+)
+
+// KVCollection stores Lua tables as documents with secondary indexes
+type KVCollection struct {
+	db      *KVDB
+	name    string
+	indexes []string
+	codec   string
+}
+
+// kvNewCollection creates a collection, e.g.
+// kv.collection(db, "users", {indexes = {"email", "created_at"}})
+func kvNewCollection(L *lua.LState) int {
+	db, ok := L.CheckUserData(1).Value.(*KVDB)
+	if !ok {
+		L.ArgError(1, "kv database expected")
+	}
+	name := L.CheckString(2)
+	opts := L.OptTable(3, nil)
+
+	col := &KVCollection{db: db, name: name, codec: db.codec}
+	if opts != nil {
+		if indexes, ok := opts.RawGetString("indexes").(*lua.LTable); ok {
+			for i := 1; i <= indexes.Len(); i++ {
+				col.indexes = append(col.indexes, indexes.RawGetInt(i).String())
+			}
+		}
+		if codec := opts.RawGetString("codec"); codec != lua.LNil {
+			col.codec = codec.String()
+		}
+	}
+
+	err := kvCheckCodec(col.codec)
+	if err == nil && db.db == nil {
+		err = bbolt.ErrDatabaseNotOpen
+	}
+	// Index keys hold field values in the clear
+	if err == nil && db.cipher != nil && len(col.indexes) > 0 {
+		err = fmt.Errorf("collection %s: indexes are not supported on encrypted databases", name)
+	}
+	if err == nil {
+		err = db.update(L, func(tx KVEngineTx) error {
+			return col.ensureBuckets(L, tx)
+		})
+	}
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	db.trackCollection(col)
+
+	ud := L.NewUserData()
+	ud.Value = col
+	L.SetMetatable(ud, L.GetTypeMetatable("KVCollection"))
+	L.Push(ud)
+	L.Push(lua.LNil)
+	return 2
+}
+
+// kvIndexValue encodes a field value so that index keys sort in value
+// order. Only booleans, numbers and strings are indexed.
+func kvIndexValue(value lua.LValue) ([]byte, bool) {
+	switch v := value.(type) {
+	case lua.LBool:
+		if v {
+			return []byte{kvIndexBool, 1}, true
+		}
+		return []byte{kvIndexBool, 0}, true
+	case lua.LNumber:
+		// Flip the sign bit of positive numbers and every bit of negative
+		// ones so the big-endian bytes sort like the floats
+		bits := math.Float64bits(float64(v))
+		if v >= 0 {
+			bits ^= 1 << 63
+		} else {
+			bits = ^bits
+		}
+		key := make([]byte, 9)
+		key[0] = kvIndexNumber
+		binary.BigEndian.PutUint64(key[1:], bits)
+		return key, true
+	case lua.LString:
+		return append([]byte{kvIndexString}, v...), true
+	}
+	return nil, false
+}
+
+// kvIndexKey builds the index entry key for a document id
+func kvIndexKey(value []byte, id string) []byte {
+	key := append(append([]byte(nil), value...), 0)
+	return append(key, id...)
+}
+
+func (c *KVCollection) docsPath() [][]byte {
+	return [][]byte{[]byte(c.name)}
+}
+
+func (c *KVCollection) indexPath(field string) [][]byte {
+	return [][]byte{kvIndexBucket, []byte(c.name), []byte(field)}
+}
+
+func (c *KVCollection) isIndexed(field string) bool {
+	for _, index := range c.indexes {
+		if index == field {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureBuckets creates the document and index buckets, building any index
+// that is new for documents already in the collection
+func (c *KVCollection) ensureBuckets(L *lua.LState, tx KVEngineTx) error {
+	docs, err := kvCreateBucket(tx, c.docsPath())
+	if err != nil {
+		return err
+	}
+
+	for _, field := range c.indexes {
+		if kvBucket(tx, c.indexPath(field)) != nil {
+			continue
+		}
+		index, err := kvCreateBucket(tx, c.indexPath(field))
+		if err != nil {
+			return err
+		}
+		err = docs.ForEach(func(id, data []byte) error {
+			if data == nil {
+				return nil
+			}
+			id, data, err := kvCipherFor(tx).open(c.docsPath(), id, data)
+			if err != nil {
+				return err
+			}
+			doc, err := c.decode(L, data)
+			if err != nil {
+				return err
+			}
+			if value, ok := kvIndexValue(doc.RawGetString(field)); ok {
+				return index.Put(kvIndexKey(value, string(id)), id)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trackCollection remembers a collection so that db:import can rebuild its
+// indexes
+func (d *KVDB) trackCollection(c *KVCollection) {
+	key := c.name + "\x00" + c.codec + "\x00" + strings.Join(c.indexes, "\x00")
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.collections == nil {
+		d.collections = make(map[string]*KVCollection)
+	}
+	d.collections[key] = c
+}
+
+// rebuildIndexes builds the indexes that are missing for the collections
+// opened on d, such as those dropped by kvLoad
+func (d *KVDB) rebuildIndexes(L *lua.LState, tx KVEngineTx) error {
+	d.mu.Lock()
+	collections := make([]*KVCollection, 0, len(d.collections))
+	for _, c := range d.collections {
+		collections = append(collections, c)
+	}
+	d.mu.Unlock()
+
+	for _, c := range collections {
+		if kvBucket(tx, c.docsPath()) == nil {
+			continue
+		}
+		if err := c.ensureBuckets(L, tx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// kvDropIndexes drops the indexes of the collection stored in bucket name
+func kvDropIndexes(tx KVEngineTx, name []byte) error {
+	indexes := tx.Bucket(kvIndexBucket)
+	if indexes == nil || indexes.Bucket(name) == nil {
+		return nil
+	}
+	return indexes.DeleteBucket(name)
+}
+
+func (c *KVCollection) decode(L *lua.LState, data []byte) (*lua.LTable, error) {
+	var value lua.LValue
+	var err error
+	if c.codec == "json" {
+		value, err = unmarshalLuaJSON(L, string(data))
+	} else {
+		value, err = unmarshalLuaMsgPack(L, data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	doc, ok := value.(*lua.LTable)
+	if !ok {
+		return nil, fmt.Errorf("collection %s: stored value is not a document", c.name)
+	}
+	return doc, nil
+}
+
+// load reads and decodes a document, returning nil if it does not exist
+func (c *KVCollection) load(L *lua.LState, tx KVEngineTx, id string) (*lua.LTable, error) {
+	data, err := kvGetEntry(tx, c.docsPath(), []byte(id))
+	if data == nil || err != nil {
+		return nil, err
+	}
+	return c.decode(L, data)
+}
+
+// store writes a document and moves its index entries from old to doc.
+// old is nil for new documents.
+func (c *KVCollection) store(L *lua.LState, tx KVEngineTx, id string, old, doc *lua.LTable) error {
+	if old != nil {
+		if err := c.unindex(tx, id, old); err != nil {
+			return err
+		}
+	}
+
+	if doc == nil {
+		return kvDeleteEntry(tx, c.docsPath(), []byte(id))
+	}
+
+	data, err := kvEncodeValue(L, doc, c.codec)
+	if err != nil {
+		return err
+	}
+	if err := kvPutEntry(tx, c.docsPath(), []byte(id), data, 0); err != nil {
+		return err
+	}
+
+	for _, field := range c.indexes {
+		value, ok := kvIndexValue(doc.RawGetString(field))
+		if !ok {
+			continue
+		}
+		index, err := kvCreateBucket(tx, c.indexPath(field))
+		if err != nil {
+			return err
+		}
+		if err := index.Put(kvIndexKey(value, id), []byte(id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindex removes the index entries of a document
+func (c *KVCollection) unindex(tx KVEngineTx, id string, doc *lua.LTable) error {
+	for _, field := range c.indexes {
+		value, ok := kvIndexValue(doc.RawGetString(field))
+		if !ok {
+			continue
+		}
+		if index := kvBucket(tx, c.indexPath(field)); index != nil {
+			if err := index.Delete(kvIndexKey(value, id)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// kvDocumentMatches reports whether doc has every field of query with an equal value
+func kvDocumentMatches(doc, query *lua.LTable) bool {
+	matched := true
+	query.ForEach(func(field, value lua.LValue) {
+		if matched && doc.RawGet(field) != value {
+			matched = false
+		}
+	})
+	return matched
+}
+
+// find returns documents matching every field of query. An indexed field
+// narrows the candidates; otherwise the whole collection is scanned.
+func (c *KVCollection) find(L *lua.LState, tx KVEngineTx, query *lua.LTable, limit int) ([]*lua.LTable, error) {
+	var results []*lua.LTable
+	collect := func(doc *lua.LTable) bool {
+		if kvDocumentMatches(doc, query) {
+			results = append(results, doc)
+		}
+		return limit <= 0 || len(results) < limit
+	}
+
+	for _, field := range c.indexes {
+		value, ok := kvIndexValue(query.RawGetString(field))
+		if !ok {
+			continue
+		}
+		index := kvBucket(tx, c.indexPath(field))
+		if index == nil {
+			return nil, kvBucketNotFound(c.indexPath(field))
+		}
+
+		prefix := kvIndexKey(value, "")
+		cursor := index.Cursor()
+		for k, id := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, id = cursor.Next() {
+			doc, err := c.load(L, tx, string(id))
+			if err != nil {
+				return nil, err
+			}
+			if doc != nil && !collect(doc) {
+				break
+			}
+		}
+		return results, nil
+	}
+
+	docs := kvBucket(tx, c.docsPath())
+	if docs == nil {
+		return nil, kvBucketNotFound(c.docsPath())
+	}
+	crypt := kvCipherFor(tx)
+	expired := kvExpiryFunc(tx, c.docsPath())
+	cursor := docs.Cursor()
+	for k, data := cursor.First(); k != nil; k, data = cursor.Next() {
+		// Skip nested buckets and expired documents, as load does
+		if data == nil || expired(k) {
+			continue
+		}
+		_, data, err := crypt.open(c.docsPath(), k, data)
+		if err != nil {
+			return nil, err
+		}
+		doc, err := c.decode(L, data)
+		if err != nil {
+			return nil, err
+		}
+		if !collect(doc) {
+			break
+		}
+	}
+	return results, nil
+}
+
+// rangeBy returns documents ordered by an indexed field. Start is inclusive
+// and stop is exclusive, as with db:range.
+func (c *KVCollection) rangeBy(L *lua.LState, tx KVEngineTx, field string, opts *lua.LTable) ([]*lua.LTable, error) {
+	if !c.isIndexed(field) {
+		return nil, fmt.Errorf("field %s is not indexed", field)
+	}
+	index := kvBucket(tx, c.indexPath(field))
+	if index == nil {
+		return nil, kvBucketNotFound(c.indexPath(field))
+	}
+
+	var rangeOpts KVRangeOptions
+	limit := math.MaxInt
+	if opts != nil {
+		bounds := []struct {
+			name   string
+			target *[]byte
+		}{{"start", &rangeOpts.Start}, {"stop", &rangeOpts.Stop}}
+		for _, bound := range bounds {
+			v := opts.RawGetString(bound.name)
+			if v == lua.LNil {
+				continue
+			}
+			encoded, ok := kvIndexValue(v)
+			if !ok {
+				return nil, fmt.Errorf("%s must be a boolean, number or string", bound.name)
+			}
+			// Bounds of one type only match values of that type
+			if rangeOpts.Prefix != nil && rangeOpts.Prefix[0] != encoded[0] {
+				return nil, errors.New("start and stop must have the same type")
+			}
+			*bound.target = encoded
+			rangeOpts.Prefix = encoded[:1]
+		}
+		rangeOpts.Reverse = lua.LVAsBool(opts.RawGetString("reverse"))
+		if n, ok := opts.RawGetString("limit").(lua.LNumber); ok && n > 0 {
+			limit = int(n)
+		}
+	}
+
+	entries := kvRangeBatch(index, rangeOpts, nil, limit, func([]byte) bool { return false })
+	results := make([]*lua.LTable, 0, len(entries))
+	for _, entry := range entries {
+		doc, err := c.load(L, tx, string(entry[1]))
+		if err != nil {
+			return nil, err
+		}
+		if doc != nil {
+			results = append(results, doc)
+		}
+	}
+	return results, nil
+}
+
+// kvDocumentID returns the id of a document as a key
+func kvDocumentID(L *lua.LState, n int) string {
+	id := L.CheckAny(n)
+	if id.Type() != lua.LTString && id.Type() != lua.LTNumber {
+		L.ArgError(n, "document id must be a string or number")
+	}
+	return id.String()
+}
+
+// kvPushDocuments pushes documents as a Lua array with an error message
+func kvPushDocuments(L *lua.LState, docs []*lua.LTable, err error) int {
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	table := L.NewTable()
+	for i, doc := range docs {
+		table.RawSetInt(i+1, doc)
+	}
+	L.Push(table)
+	L.Push(lua.LNil)
+	return 2
+}
+
+func kvCollectionIndex(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	col := ud.Value.(*KVCollection)
+	method := L.CheckString(2)
+
+	// update and view run fn in a transaction on the collection's database
+	update := func(fn func(tx KVEngineTx) error) error {
+		return col.db.update(L, fn)
+	}
+	view := func(fn func(tx KVEngineTx) error) error {
+		if col.db.db == nil {
+			return bbolt.ErrDatabaseNotOpen
+		}
+		return col.db.db.View(fn)
+	}
+
+	switch method {
+	case "insert":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			doc := L.CheckTable(2)
+
+			var id lua.LValue
+			err := update(func(tx KVEngineTx) error {
+				docs := kvBucket(tx, col.docsPath())
+				if docs == nil {
+					return kvBucketNotFound(col.docsPath())
+				}
+
+				id = doc.RawGetString("id")
+				if id == lua.LNil {
+					seq, err := docs.NextSequence()
+					if err != nil {
+						return err
+					}
+					id = lua.LNumber(seq)
+					doc.RawSetString("id", id)
+				} else if id.Type() != lua.LTString && id.Type() != lua.LTNumber {
+					return fmt.Errorf("document id must be a string or number")
+				}
+
+				existing, err := col.load(L, tx, id.String())
+				if err != nil {
+					return err
+				}
+				if existing != nil {
+					return fmt.Errorf("document %s already exists", id.String())
+				}
+				return col.store(L, tx, id.String(), nil, doc)
+			})
+
+			if err != nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LString(err.Error()))
+				return 2
+			}
+			L.Push(id)
+			L.Push(lua.LNil)
+			return 2
+		}))
+	case "get":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			id := kvDocumentID(L, 2)
+
+			var doc *lua.LTable
+			err := view(func(tx KVEngineTx) error {
+				var err error
+				doc, err = col.load(L, tx, id)
+				return err
+			})
+
+			if err != nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LString(err.Error()))
+				return 2
+			}
+			if doc == nil {
+				L.Push(lua.LNil)
+			} else {
+				L.Push(doc)
+			}
+			L.Push(lua.LNil)
+			return 2
+		}))
+	case "update":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			id := kvDocumentID(L, 2)
+			changes := L.CheckTable(3)
+
+			err := update(func(tx KVEngineTx) error {
+				old, err := col.load(L, tx, id)
+				if err != nil {
+					return err
+				}
+				if old == nil {
+					return fmt.Errorf("document %s does not exist", id)
+				}
+
+				// Merge the changed fields into a copy of the document
+				doc := L.NewTable()
+				for k, v := old.Next(lua.LNil); k != lua.LNil; k, v = old.Next(k) {
+					doc.RawSet(k, v)
+				}
+				for k, v := changes.Next(lua.LNil); k != lua.LNil; k, v = changes.Next(k) {
+					if k.String() == "id" {
+						continue
+					}
+					doc.RawSet(k, v)
+				}
+				return col.store(L, tx, id, old, doc)
+			})
+
+			if err != nil {
+				L.Push(lua.LString(err.Error()))
+				return 1
+			}
+			return 0
+		}))
+	case "delete":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			id := kvDocumentID(L, 2)
+
+			err := update(func(tx KVEngineTx) error {
+				old, err := col.load(L, tx, id)
+				if err != nil || old == nil {
+					return err
+				}
+				return col.store(L, tx, id, old, nil)
+			})
+
+			if err != nil {
+				L.Push(lua.LString(err.Error()))
+				return 1
+			}
+			return 0
+		}))
+	case "find":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			query := L.OptTable(2, L.NewTable())
+			limit := 0
+			if opts := L.OptTable(3, nil); opts != nil {
+				if n, ok := opts.RawGetString("limit").(lua.LNumber); ok {
+					limit = int(n)
+				}
+			}
+
+			var docs []*lua.LTable
+			err := view(func(tx KVEngineTx) error {
+				var err error
+				docs, err = col.find(L, tx, query, limit)
+				return err
+			})
+			return kvPushDocuments(L, docs, err)
+		}))
+	case "find_one":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			query := L.CheckTable(2)
+
+			var docs []*lua.LTable
+			err := view(func(tx KVEngineTx) error {
+				var err error
+				docs, err = col.find(L, tx, query, 1)
+				return err
+			})
+
+			if err != nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LString(err.Error()))
+				return 2
+			}
+			if len(docs) == 0 {
+				L.Push(lua.LNil)
+			} else {
+				L.Push(docs[0])
+			}
+			L.Push(lua.LNil)
+			return 2
+		}))
+	case "range":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			field := L.CheckString(2)
+			opts := L.OptTable(3, nil)
+
+			var docs []*lua.LTable
+			err := view(func(tx KVEngineTx) error {
+				var err error
+				docs, err = col.rangeBy(L, tx, field, opts)
+				return err
+			})
+			return kvPushDocuments(L, docs, err)
+		}))
+	case "count":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			var count int
+			err := view(func(tx KVEngineTx) error {
+				docs := kvBucket(tx, col.docsPath())
+				if docs == nil {
+					return kvBucketNotFound(col.docsPath())
+				}
+				expired := kvExpiryFunc(tx, col.docsPath())
+				return docs.ForEach(func(k, v []byte) error {
+					if v != nil && !expired(k) {
+						count++
+					}
+					return nil
+				})
+			})
+
+			if err != nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LString(err.Error()))
+				return 2
+			}
+			L.Push(lua.LNumber(count))
+			L.Push(lua.LNil)
+			return 2
+		}))
+	}
+
+	return kvDeliverAfter(L)
+}
@@ -0,0 +1,480 @@
+// kv_crypto_functions.go - Encrypted values and keys for the kv module
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/yuin/gopher-lua"
+	"go.etcd.io/bbolt"
+)
+
+// kvCryptoBucket holds the parameters of an encrypted database: how the key
+// was derived, whether keys are hashed, and a sealed check value used to
+// reject a wrong key on open
+var kvCryptoBucket = []byte(kvInternalPrefix + "crypto")
+
+// kvDefaultKDFIterations is the PBKDF2-SHA256 work factor for passphrases
+const kvDefaultKDFIterations = 600000
+
+// kvSealVersion prefixes every encrypted value so the format can change
+const kvSealVersion = 1
+
+// kvKeyCheck is sealed with the key when the database is created
+var kvKeyCheck = []byte("hype kv key check")
+
+// kvErrUnordered is returned for ordered scans of a database with hashed keys
+var kvErrUnordered = errors.New("prefix and range queries are not available when keys are hashed")
+
+// KVCipher encrypts the values, and optionally the keys, of one database.
+// Values are sealed with AES-256-GCM, bound to their bucket and key through
+// the additional data. Hashed keys are stored as HMAC-SHA256 digests and the
+// original key is kept inside the sealed value so iteration can return it.
+//
+// A nil *KVCipher stores data unchanged.
+type KVCipher struct {
+	aead     cipher.AEAD
+	mac      []byte
+	hashKeys bool
+}
+
+// KVEncryptionOptions is the encryption table passed to kv.open or
+// db:rotate_key. Exactly one of Key and Passphrase is set.
+type KVEncryptionOptions struct {
+	Key        []byte
+	Passphrase string
+	HashKeys   bool
+	Iterations int
+}
+
+// kvCiphers maps open storage engines to their cipher, so that entry helpers
+// only need the transaction
+var kvCiphers = struct {
+	sync.Mutex
+	byDB map[KVEngine]*KVCipher
+}{byDB: make(map[KVEngine]*KVCipher)}
+
+// kvCipherFor returns the cipher of the transaction's database, or nil
+func kvCipherFor(tx KVEngineTx) *KVCipher {
+	kvCiphers.Lock()
+	defer kvCiphers.Unlock()
+	return kvCiphers.byDB[tx.Engine()]
+}
+
+func kvSetCipher(db KVEngine, c *KVCipher) {
+	kvCiphers.Lock()
+	defer kvCiphers.Unlock()
+	if c == nil {
+		delete(kvCiphers.byDB, db)
+	} else {
+		kvCiphers.byDB[db] = c
+	}
+}
+
+// kvEncryptionOptions reads the encryption table of kv.open or db:rotate_key
+func kvEncryptionOptions(L *lua.LState, table *lua.LTable) (*KVEncryptionOptions, error) {
+	opts := &KVEncryptionOptions{
+		HashKeys:   lua.LVAsBool(table.RawGetString("hash_keys")),
+		Iterations: kvDefaultKDFIterations,
+	}
+	if key, ok := table.RawGetString("key").(lua.LString); ok {
+		opts.Key = []byte(key)
+	}
+	if passphrase, ok := table.RawGetString("passphrase").(lua.LString); ok {
+		opts.Passphrase = string(passphrase)
+	}
+	if iterations, ok := table.RawGetString("iterations").(lua.LNumber); ok {
+		opts.Iterations = int(iterations)
+	}
+
+	switch {
+	case opts.Key != nil && opts.Passphrase != "":
+		return nil, errors.New("encryption takes a key or a passphrase, not both")
+	case opts.Key != nil && len(opts.Key) < 16:
+		return nil, errors.New("encryption key must be at least 16 bytes")
+	case opts.Key == nil && opts.Passphrase == "":
+		return nil, errors.New("encryption requires a key or a passphrase")
+	case opts.Iterations < 1:
+		return nil, errors.New("iterations must be positive")
+	}
+	return opts, nil
+}
+
+// newKVCipher derives the encryption and MAC keys from a master key
+func newKVCipher(master []byte, hashKeys bool) (*KVCipher, error) {
+	block, err := aes.NewCipher(kvDeriveKey(master, "hype kv values"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &KVCipher{aead: aead, mac: kvDeriveKey(master, "hype kv keys"), hashKeys: hashKeys}, nil
+}
+
+// kvDeriveKey derives a 256-bit subkey for one purpose
+func kvDeriveKey(master []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// kvPBKDF2 implements PBKDF2 with HMAC-SHA256 (RFC 8018) for a 32-byte key
+func kvPBKDF2(passphrase, salt []byte, iterations int) []byte {
+	prf := hmac.New(sha256.New, passphrase)
+	prf.Write(salt)
+	prf.Write([]byte{0, 0, 0, 1})
+	u := prf.Sum(nil)
+	key := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
+
+// kvInitCipher sets up encryption for a database. A new database records
+// the key parameters; an existing one must accept the key.
+func kvInitCipher(db KVEngine, opts *KVEncryptionOptions) (*KVCipher, error) {
+	var c *KVCipher
+	err := db.View(func(tx KVEngineTx) error {
+		meta := tx.Bucket(kvCryptoBucket)
+		if meta == nil {
+			return nil
+		}
+		var err error
+		c, err = kvCipherFromMeta(meta, opts)
+		return err
+	})
+	if err != nil || c != nil {
+		return c, err
+	}
+
+	if db.IsReadOnly() {
+		return nil, errors.New("database is not encrypted")
+	}
+	err = db.Update(func(tx KVEngineTx) error {
+		if kvHasUserData(tx) {
+			return errors.New("cannot enable encryption on a database that already has data")
+		}
+		var err error
+		c, err = kvWriteCipherMeta(tx, opts)
+		return err
+	})
+	return c, err
+}
+
+// kvCipherFromMeta rebuilds the cipher of an encrypted database and checks
+// that the key is the one it was created with
+func kvCipherFromMeta(meta KVEngineBucket, opts *KVEncryptionOptions) (*KVCipher, error) {
+	master := opts.Key
+	if kdf := string(meta.Get([]byte("kdf"))); kdf == "pbkdf2-sha256" {
+		if opts.Passphrase == "" {
+			return nil, errors.New("database is encrypted with a passphrase")
+		}
+		iterations := meta.Get([]byte("iterations"))
+		if len(iterations) != 8 {
+			return nil, errors.New("invalid encryption metadata")
+		}
+		master = kvPBKDF2([]byte(opts.Passphrase), meta.Get([]byte("salt")), int(binary.BigEndian.Uint64(iterations)))
+	} else if opts.Key == nil {
+		return nil, errors.New("database is encrypted with a key")
+	}
+
+	// The check value is sealed before key hashing is switched on
+	c, err := newKVCipher(master, false)
+	if err != nil {
+		return nil, err
+	}
+	if _, check, err := c.open([][]byte{kvCryptoBucket}, []byte("check"), meta.Get([]byte("check"))); err != nil || !bytes.Equal(check, kvKeyCheck) {
+		return nil, errors.New("wrong encryption key")
+	}
+	c.hashKeys = meta.Get([]byte("hash_keys")) != nil
+	return c, nil
+}
+
+// kvWriteCipherMeta derives a cipher for opts and records its parameters,
+// replacing any previous ones
+func kvWriteCipherMeta(tx KVEngineTx, opts *KVEncryptionOptions) (*KVCipher, error) {
+	if tx.Bucket(kvCryptoBucket) != nil {
+		if err := tx.DeleteBucket(kvCryptoBucket); err != nil {
+			return nil, err
+		}
+	}
+	meta, err := tx.CreateBucket(kvCryptoBucket)
+	if err != nil {
+		return nil, err
+	}
+
+	master := opts.Key
+	if opts.Passphrase != "" {
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		iterations := make([]byte, 8)
+		binary.BigEndian.PutUint64(iterations, uint64(opts.Iterations))
+		master = kvPBKDF2([]byte(opts.Passphrase), salt, opts.Iterations)
+
+		meta.Put([]byte("kdf"), []byte("pbkdf2-sha256"))
+		meta.Put([]byte("salt"), salt)
+		meta.Put([]byte("iterations"), iterations)
+	} else {
+		meta.Put([]byte("kdf"), []byte("raw"))
+	}
+	if opts.HashKeys {
+		meta.Put([]byte("hash_keys"), []byte{1})
+	}
+
+	c, err := newKVCipher(master, false)
+	if err != nil {
+		return nil, err
+	}
+	_, check, err := c.seal([][]byte{kvCryptoBucket}, []byte("check"), kvKeyCheck)
+	if err != nil {
+		return nil, err
+	}
+	c.hashKeys = opts.HashKeys
+	return c, meta.Put([]byte("check"), check)
+}
+
+// kvHasUserData reports whether any bucket outside the internal ones exists
+func kvHasUserData(tx KVEngineTx) bool {
+	found := false
+	tx.ForEach(func(name []byte, _ KVEngineBucket) error {
+		if !bytes.HasPrefix(name, []byte(kvInternalPrefix)) {
+			found = true
+		}
+		return nil
+	})
+	return found
+}
+
+// ordered reports whether stored keys keep the order of the original keys
+func (c *KVCipher) ordered() bool {
+	return c == nil || !c.hashKeys
+}
+
+// storeKey returns the key under which key is stored in a bucket
+func (c *KVCipher) storeKey(path [][]byte, key []byte) []byte {
+	if c == nil || !c.hashKeys {
+		return key
+	}
+	mac := hmac.New(sha256.New, c.mac)
+	mac.Write(kvTTLName(path))
+	mac.Write([]byte{0})
+	mac.Write(key)
+	return mac.Sum(nil)
+}
+
+// seal returns the stored key and the encrypted value for a key and value
+func (c *KVCipher) seal(path [][]byte, key, value []byte) ([]byte, []byte, error) {
+	if c == nil {
+		return key, value, nil
+	}
+	stored := c.storeKey(path, key)
+
+	plaintext := value
+	if c.hashKeys {
+		plaintext = binary.AppendUvarint(nil, uint64(len(key)))
+		plaintext = append(append(plaintext, key...), value...)
+	}
+
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	out := append([]byte{kvSealVersion}, nonce...)
+	return stored, c.aead.Seal(out, nonce, plaintext, kvSealData(path, stored)), nil
+}
+
+// open decrypts a stored entry and returns the original key and value
+func (c *KVCipher) open(path [][]byte, stored, sealed []byte) ([]byte, []byte, error) {
+	if c == nil {
+		return stored, sealed, nil
+	}
+	size := c.aead.NonceSize()
+	if len(sealed) < 1+size || sealed[0] != kvSealVersion {
+		return nil, nil, fmt.Errorf("value of %s in bucket %s is not encrypted", stored, kvBucketName(path))
+	}
+	plaintext, err := c.aead.Open(nil, sealed[1:1+size], sealed[1+size:], kvSealData(path, stored))
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot decrypt value in bucket %s: %v", kvBucketName(path), err)
+	}
+	if !c.hashKeys {
+		return stored, plaintext, nil
+	}
+
+	n, read := binary.Uvarint(plaintext)
+	if read <= 0 || uint64(len(plaintext)-read) < n {
+		return nil, nil, fmt.Errorf("corrupt value in bucket %s", kvBucketName(path))
+	}
+	return plaintext[read : read+int(n)], plaintext[read+int(n):], nil
+}
+
+// kvBucketGet reads and decrypts a value from a bucket at path, treating
+// expired keys as missing
+func kvBucketGet(bucket KVEngineBucket, path [][]byte, key []byte) ([]byte, error) {
+	c := kvCipherFor(bucket.Tx())
+	stored := c.storeKey(path, key)
+	value := bucket.Get(stored)
+	if value == nil || kvExpiryFunc(bucket.Tx(), path)(stored) {
+		return nil, nil
+	}
+	_, value, err := c.open(path, stored, value)
+	return value, err
+}
+
+// kvBucketPut encrypts and writes a value to a bucket at path, notifying
+// watches. A nil value deletes the key. A live key keeps its expiry, while
+// an expired one is written as a new key without it.
+func kvBucketPut(bucket KVEngineBucket, path [][]byte, key, value []byte) error {
+	tx := bucket.Tx()
+	c := kvCipherFor(tx)
+	stored := c.storeKey(path, key)
+	expired := kvExpiryFunc(tx, path)(stored)
+	notify := kvObserve(bucket, path, key)
+	var err error
+	if value == nil {
+		err = bucket.Delete(stored)
+	} else {
+		var sealed []byte
+		if stored, sealed, err = c.seal(path, key, value); err == nil {
+			err = bucket.Put(stored, sealed)
+		}
+	}
+	if err == nil && (value == nil || expired) {
+		err = kvSetExpiry(tx, path, stored, 0)
+	}
+	if err == nil && notify != nil {
+		notify(value)
+	}
+	return err
+}
+
+// kvSealData binds a sealed value to its bucket and stored key, so values
+// cannot be swapped between keys without detection
+func kvSealData(path [][]byte, stored []byte) []byte {
+	data := append(kvTTLName(path), 0)
+	return append(data, stored...)
+}
+
+// rotateKey re-encrypts every entry with a cipher for opts in a single
+// transaction and switches the database to it
+func (d *KVDB) rotateKey(L *lua.LState, opts *KVEncryptionOptions) error {
+	if d.db == nil {
+		return bbolt.ErrDatabaseNotOpen
+	}
+	old := d.cipher
+	if old == nil {
+		return errors.New("database is not encrypted")
+	}
+
+	var next *KVCipher
+	err := d.update(L, func(tx KVEngineTx) error {
+		var err error
+		if next, err = kvWriteCipherMeta(tx, opts); err != nil {
+			return err
+		}
+
+		var paths [][][]byte
+		err = tx.ForEach(func(name []byte, b KVEngineBucket) error {
+			if !bytes.HasPrefix(name, []byte(kvInternalPrefix)) {
+				paths = kvCollectBucketPaths(b, [][]byte{append([]byte(nil), name...)}, paths)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, path := range paths {
+			if err := kvResealBucket(tx, path, old, next); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	d.cipher = next
+	kvSetCipher(d.db, next)
+	return nil
+}
+
+// kvCollectBucketPaths appends the path of a bucket and all nested buckets
+func kvCollectBucketPaths(b KVEngineBucket, path [][]byte, paths [][][]byte) [][][]byte {
+	paths = append(paths, path)
+	b.ForEachBucket(func(name []byte) error {
+		child := append(append([][]byte(nil), path...), append([]byte(nil), name...))
+		paths = kvCollectBucketPaths(b.Bucket(name), child, paths)
+		return nil
+	})
+	return paths
+}
+
+// kvResealBucket re-encrypts the entries of one bucket, moving expiry
+// metadata along with keys whose stored form changes
+func kvResealBucket(tx KVEngineTx, path [][]byte, old, next *KVCipher) error {
+	bucket := kvBucket(tx, path)
+	var entries [][2][]byte
+	err := bucket.ForEach(func(k, v []byte) error {
+		if v != nil {
+			entries = append(entries, [2][]byte{append([]byte(nil), k...), append([]byte(nil), v...)})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var meta KVEngineBucket
+	if root := tx.Bucket(kvTTLBucket); root != nil {
+		meta = root.Bucket(kvTTLName(path))
+	}
+
+	for _, entry := range entries {
+		key, value, err := old.open(path, entry[0], entry[1])
+		if err != nil {
+			return err
+		}
+		stored, sealed, err := next.seal(path, key, value)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(stored, entry[0]) {
+			if err := bucket.Delete(entry[0]); err != nil {
+				return err
+			}
+			if expiry := meta; expiry != nil {
+				if v := expiry.Get(entry[0]); v != nil {
+					v = append([]byte(nil), v...)
+					if err := expiry.Delete(entry[0]); err != nil {
+						return err
+					}
+					if err := expiry.Put(stored, v); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		if err := bucket.Put(stored, sealed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+// kv_engine_functions.go - Storage engines behind the kv module
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// kvDefaultEngine stores databases in a bbolt file
+const kvDefaultEngine = "bbolt"
+
+// KVEngine is a transactional store of nested buckets, modelled on bbolt.
+// Keys within a bucket are ordered bytewise and share one key space with
+// the bucket's sub-buckets. Engines report errors with bbolt's error values
+// (bbolt.ErrBucketNotFound, bbolt.ErrTxClosed and so on) so the kv module
+// can treat them alike.
+type KVEngine interface {
+	// Begin starts a transaction; only one writable transaction is open at a time
+	Begin(writable bool) (KVEngineTx, error)
+	// Update, View and Batch run fn in a managed transaction
+	Update(fn func(KVEngineTx) error) error
+	View(fn func(KVEngineTx) error) error
+	Batch(fn func(KVEngineTx) error) error
+	Path() string
+	IsReadOnly() bool
+	Close() error
+}
+
+// KVEngineTx is a transaction. Data returned by a transaction is only valid
+// until it ends.
+type KVEngineTx interface {
+	Engine() KVEngine
+	Writable() bool
+	Bucket(name []byte) KVEngineBucket
+	CreateBucket(name []byte) (KVEngineBucket, error)
+	CreateBucketIfNotExists(name []byte) (KVEngineBucket, error)
+	DeleteBucket(name []byte) error
+	ForEach(fn func(name []byte, b KVEngineBucket) error) error
+	// OnCommit registers fn to run after the transaction commits
+	OnCommit(fn func())
+	Commit() error
+	Rollback() error
+}
+
+// KVEngineBucket is a bucket within a transaction. Lookups of missing
+// buckets return nil.
+type KVEngineBucket interface {
+	Tx() KVEngineTx
+	Get(key []byte) []byte
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	Bucket(name []byte) KVEngineBucket
+	CreateBucketIfNotExists(name []byte) (KVEngineBucket, error)
+	DeleteBucket(name []byte) error
+	// ForEach visits keys and sub-buckets in order; v is nil for sub-buckets
+	ForEach(fn func(k, v []byte) error) error
+	ForEachBucket(fn func(name []byte) error) error
+	Cursor() KVEngineCursor
+	NextSequence() (uint64, error)
+}
+
+// KVEngineCursor iterates a bucket in key order. Movements return a nil key
+// past either end and a nil value for sub-buckets.
+type KVEngineCursor interface {
+	Bucket() KVEngineBucket
+	First() ([]byte, []byte)
+	Last() ([]byte, []byte)
+	Next() ([]byte, []byte)
+	Prev() ([]byte, []byte)
+	Seek(seek []byte) ([]byte, []byte)
+	Delete() error
+}
+
+// KVEngineOptions are the kv.open options that engines may honour
+type KVEngineOptions struct {
+	ReadOnly        bool
+	Timeout         time.Duration
+	NoSync          bool
+	Mode            os.FileMode
+	InitialMmapSize int
+	MaxBatchSize    int
+	MaxBatchDelay   time.Duration
+}
+
+// kvEngines maps engine names to constructors. Engines that need extra
+// dependencies register themselves from files behind build tags.
+var kvEngines = map[string]func(path string, opts KVEngineOptions) (KVEngine, error){
+	"bbolt":  kvOpenBoltEngine,
+	"memory": kvOpenMemoryEngine,
+}
+
+// kvOpenEngine opens path with the named engine
+func kvOpenEngine(name, path string, opts KVEngineOptions) (KVEngine, error) {
+	open, ok := kvEngines[name]
+	if !ok {
+		names := make([]string, 0, len(kvEngines))
+		for engine := range kvEngines {
+			names = append(names, engine)
+		}
+		sort.Strings(names)
+		err := fmt.Errorf("unknown kv engine %s (available: %s)", name, strings.Join(names, ", "))
+		if name == "lmdb" {
+			err = fmt.Errorf("%v; the lmdb engine needs a build with -tags lmdb", err)
+		}
+		return nil, err
+	}
+	return open(path, opts)
+}
+
+// kvBoltEngine adapts a bbolt database to KVEngine
+type kvBoltEngine struct {
+	db *bbolt.DB
+}
+
+type kvBoltTx struct {
+	tx     *bbolt.Tx
+	engine *kvBoltEngine
+}
+
+type kvBoltBucket struct {
+	bucket *bbolt.Bucket
+	tx     *kvBoltTx
+}
+
+type kvBoltCursor struct {
+	cursor *bbolt.Cursor
+	bucket *kvBoltBucket
+}
+
+func kvOpenBoltEngine(path string, opts KVEngineOptions) (KVEngine, error) {
+	db, err := bbolt.Open(path, opts.Mode, &bbolt.Options{
+		ReadOnly:        opts.ReadOnly,
+		Timeout:         opts.Timeout,
+		NoSync:          opts.NoSync,
+		InitialMmapSize: opts.InitialMmapSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if opts.MaxBatchSize > 0 {
+		db.MaxBatchSize = opts.MaxBatchSize
+	}
+	if opts.MaxBatchDelay > 0 {
+		db.MaxBatchDelay = opts.MaxBatchDelay
+	}
+	return &kvBoltEngine{db: db}, nil
+}
+
+func (e *kvBoltEngine) wrap(tx *bbolt.Tx) *kvBoltTx {
+	return &kvBoltTx{tx: tx, engine: e}
+}
+
+func (e *kvBoltEngine) Begin(writable bool) (KVEngineTx, error) {
+	tx, err := e.db.Begin(writable)
+	if err != nil {
+		return nil, err
+	}
+	return e.wrap(tx), nil
+}
+
+func (e *kvBoltEngine) Update(fn func(KVEngineTx) error) error {
+	return e.db.Update(func(tx *bbolt.Tx) error { return fn(e.wrap(tx)) })
+}
+
+func (e *kvBoltEngine) View(fn func(KVEngineTx) error) error {
+	return e.db.View(func(tx *bbolt.Tx) error { return fn(e.wrap(tx)) })
+}
+
+func (e *kvBoltEngine) Batch(fn func(KVEngineTx) error) error {
+	return e.db.Batch(func(tx *bbolt.Tx) error { return fn(e.wrap(tx)) })
+}
+
+func (e *kvBoltEngine) Path() string     { return e.db.Path() }
+func (e *kvBoltEngine) IsReadOnly() bool { return e.db.IsReadOnly() }
+func (e *kvBoltEngine) Close() error     { return e.db.Close() }
+
+func (t *kvBoltTx) wrap(bucket *bbolt.Bucket) KVEngineBucket {
+	if bucket == nil {
+		return nil
+	}
+	return &kvBoltBucket{bucket: bucket, tx: t}
+}
+
+func (t *kvBoltTx) Engine() KVEngine { return t.engine }
+func (t *kvBoltTx) Writable() bool   { return t.tx.Writable() }
+
+func (t *kvBoltTx) Bucket(name []byte) KVEngineBucket {
+	return t.wrap(t.tx.Bucket(name))
+}
+
+func (t *kvBoltTx) CreateBucket(name []byte) (KVEngineBucket, error) {
+	bucket, err := t.tx.CreateBucket(name)
+	return t.wrap(bucket), err
+}
+
+func (t *kvBoltTx) CreateBucketIfNotExists(name []byte) (KVEngineBucket, error) {
+	bucket, err := t.tx.CreateBucketIfNotExists(name)
+	return t.wrap(bucket), err
+}
+
+func (t *kvBoltTx) DeleteBucket(name []byte) error { return t.tx.DeleteBucket(name) }
+
+func (t *kvBoltTx) ForEach(fn func(name []byte, b KVEngineBucket) error) error {
+	return t.tx.ForEach(func(name []byte, b *bbolt.Bucket) error {
+		return fn(name, t.wrap(b))
+	})
+}
+
+func (t *kvBoltTx) OnCommit(fn func()) { t.tx.OnCommit(fn) }
+func (t *kvBoltTx) Commit() error      { return t.tx.Commit() }
+func (t *kvBoltTx) Rollback() error    { return t.tx.Rollback() }
+
+// WriteTo writes a consistent copy of the database file, for db:backup
+func (t *kvBoltTx) WriteTo(w io.Writer) (int64, error) { return t.tx.WriteTo(w) }
+
+func (b *kvBoltBucket) Tx() KVEngineTx                 { return b.tx }
+func (b *kvBoltBucket) Get(key []byte) []byte          { return b.bucket.Get(key) }
+func (b *kvBoltBucket) Put(key, value []byte) error    { return b.bucket.Put(key, value) }
+func (b *kvBoltBucket) Delete(key []byte) error        { return b.bucket.Delete(key) }
+func (b *kvBoltBucket) DeleteBucket(name []byte) error { return b.bucket.DeleteBucket(name) }
+func (b *kvBoltBucket) NextSequence() (uint64, error)  { return b.bucket.NextSequence() }
+
+func (b *kvBoltBucket) Bucket(name []byte) KVEngineBucket {
+	return b.tx.wrap(b.bucket.Bucket(name))
+}
+
+func (b *kvBoltBucket) CreateBucketIfNotExists(name []byte) (KVEngineBucket, error) {
+	bucket, err := b.bucket.CreateBucketIfNotExists(name)
+	return b.tx.wrap(bucket), err
+}
+
+func (b *kvBoltBucket) ForEach(fn func(k, v []byte) error) error { return b.bucket.ForEach(fn) }
+
+func (b *kvBoltBucket) ForEachBucket(fn func(name []byte) error) error {
+	return b.bucket.ForEachBucket(fn)
+}
+
+func (b *kvBoltBucket) Cursor() KVEngineCursor {
+	return &kvBoltCursor{cursor: b.bucket.Cursor(), bucket: b}
+}
+
+func (c *kvBoltCursor) Bucket() KVEngineBucket            { return c.bucket }
+func (c *kvBoltCursor) First() ([]byte, []byte)           { return c.cursor.First() }
+func (c *kvBoltCursor) Last() ([]byte, []byte)            { return c.cursor.Last() }
+func (c *kvBoltCursor) Next() ([]byte, []byte)            { return c.cursor.Next() }
+func (c *kvBoltCursor) Prev() ([]byte, []byte)            { return c.cursor.Prev() }
+func (c *kvBoltCursor) Seek(seek []byte) ([]byte, []byte) { return c.cursor.Seek(seek) }
+func (c *kvBoltCursor) Delete() error                     { return c.cursor.Delete() }
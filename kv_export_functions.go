@@ -0,0 +1,353 @@
+// kv_export_functions.go - JSON Lines export and import for the kv module
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/yuin/gopher-lua"
+	"go.etcd.io/bbolt"
+)
+
+// KVDumpRecord is one line of a kv dump. A record without a key creates the
+// bucket, so empty buckets survive a dump and load. Keys and values that are
+// not valid UTF-8 are base64 encoded and Encoding is set to "base64".
+type KVDumpRecord struct {
+	Bucket   []string `json:"bucket"`
+	Key      *string  `json:"key,omitempty"`
+	Value    *string  `json:"value,omitempty"`
+	Encoding string   `json:"encoding,omitempty"`
+}
+
+// KVLoadOptions controls how kvLoad applies a dump
+type KVLoadOptions struct {
+	// Replace drops each bucket named in the dump before loading it, so
+	// keys missing from the dump are removed. Otherwise keys are merged.
+	Replace bool
+	// Raw stores entries as they are, without encrypting them or clearing
+	// their expiry, and allows the internal buckets used for expiry,
+	// indexes and encryption. The CLI loads dumps made with --all this way.
+	Raw bool
+}
+
+// kvIsInternal reports whether a bucket path belongs to the kv module itself
+func kvIsInternal(path [][]byte) bool {
+	return strings.HasPrefix(string(path[0]), kvInternalPrefix)
+}
+
+// kvDump writes the given buckets, or every bucket, as JSON lines and
+// returns how many keys were written. Nested buckets are written after the
+// keys of their parent. Values of encrypted databases are decrypted when
+// the database was opened with its key and copied as they are otherwise.
+func kvDump(tx KVEngineTx, buckets [][][]byte, all bool, w io.Writer) (int, error) {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+
+	if len(buckets) == 0 {
+		err := tx.ForEach(func(name []byte, _ KVEngineBucket) error {
+			if all || !strings.HasPrefix(string(name), kvInternalPrefix) {
+				buckets = append(buckets, [][]byte{append([]byte(nil), name...)})
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	count := 0
+	for _, path := range buckets {
+		bucket := kvBucket(tx, path)
+		if bucket == nil {
+			return count, kvBucketNotFound(path)
+		}
+		if err := kvDumpBucket(tx, bucket, path, enc, &count); err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+func kvDumpBucket(tx KVEngineTx, bucket KVEngineBucket, path [][]byte, enc *json.Encoder, count *int) error {
+	names := make([]string, len(path))
+	for i, part := range path {
+		names[i] = string(part)
+	}
+	if err := enc.Encode(KVDumpRecord{Bucket: names}); err != nil {
+		return err
+	}
+
+	var children [][]byte
+	c := kvCipherFor(tx)
+	expired := kvExpiryFunc(tx, path)
+	err := bucket.ForEach(func(k, v []byte) error {
+		if v == nil {
+			children = append(children, append([]byte(nil), k...))
+			return nil
+		}
+		if expired(k) {
+			return nil
+		}
+		k, v, err := c.open(path, k, v)
+		if err != nil {
+			return err
+		}
+
+		key, value := string(k), string(v)
+		record := KVDumpRecord{Bucket: names, Key: &key, Value: &value}
+		if !utf8.Valid(k) || !utf8.Valid(v) {
+			key = base64.StdEncoding.EncodeToString(k)
+			value = base64.StdEncoding.EncodeToString(v)
+			record.Encoding = "base64"
+		}
+		*count++
+		return enc.Encode(record)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range children {
+		child := append(append([][]byte(nil), path...), name)
+		if err := kvDumpBucket(tx, bucket.Bucket(name), child, enc, count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// kvLoad imports JSON lines written by kvDump and returns how many keys
+// were stored. Existing keys are overwritten and lose their expiry.
+func kvLoad(tx KVEngineTx, r io.Reader, opts KVLoadOptions) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	// reset holds the buckets already dropped in replace mode; buckets
+	// nested in one of them were dropped along with it
+	var reset []string
+	replaced := func(name string) bool {
+		for _, prefix := range reset {
+			if name == prefix || strings.HasPrefix(name, prefix+"\x00") {
+				return true
+			}
+		}
+		return false
+	}
+
+	// touched holds the top-level buckets written, whose collection indexes
+	// no longer match their documents
+	touched := map[string]bool{}
+
+	count, line := 0, 0
+	for scanner.Scan() {
+		line++
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+
+		var record KVDumpRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return count, fmt.Errorf("line %d: %v", line, err)
+		}
+		if len(record.Bucket) == 0 {
+			return count, fmt.Errorf("line %d: missing bucket", line)
+		}
+
+		path := make([][]byte, len(record.Bucket))
+		for i, name := range record.Bucket {
+			path[i] = []byte(name)
+		}
+		if !opts.Raw && kvIsInternal(path) {
+			return count, fmt.Errorf("line %d: bucket %s is internal to the kv module", line, kvBucketName(path))
+		}
+
+		if name := string(kvTTLName(path)); opts.Replace && !replaced(name) {
+			if kvBucket(tx, path) != nil {
+				if err := kvDropBucket(tx, path); err != nil {
+					return count, fmt.Errorf("line %d: %v", line, err)
+				}
+			}
+			reset = append(reset, name)
+		}
+		bucket, err := kvCreateBucket(tx, path)
+		if err != nil {
+			return count, fmt.Errorf("line %d: %v", line, err)
+		}
+		if !kvIsInternal(path) {
+			touched[string(path[0])] = true
+		}
+		if record.Key == nil {
+			continue
+		}
+
+		key, value := []byte(*record.Key), []byte{}
+		if record.Value != nil {
+			value = []byte(*record.Value)
+		}
+		switch record.Encoding {
+		case "":
+		case "base64":
+			if key, err = base64.StdEncoding.DecodeString(*record.Key); err != nil {
+				return count, fmt.Errorf("line %d: key: %v", line, err)
+			}
+			if value, err = base64.StdEncoding.DecodeString(string(value)); err != nil {
+				return count, fmt.Errorf("line %d: value: %v", line, err)
+			}
+		default:
+			return count, fmt.Errorf("line %d: unsupported encoding %s", line, record.Encoding)
+		}
+
+		if opts.Raw {
+			err = bucket.Put(key, value)
+		} else {
+			err = kvPutEntry(tx, path, key, value, 0)
+		}
+		if err != nil {
+			return count, fmt.Errorf("line %d: %v", line, err)
+		}
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		return count, err
+	}
+
+	// Indexes are rebuilt from the documents when the collection is opened
+	for name := range touched {
+		if err := kvDropIndexes(tx, []byte(name)); err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// exportFile writes the given buckets, or every data bucket, to a JSON
+// Lines file. The file is only readable by its owner because values of
+// encrypted databases are written in the clear.
+func (d *KVDB) exportFile(path string, buckets [][][]byte) (int, error) {
+	if d.db == nil {
+		return 0, bbolt.ErrDatabaseNotOpen
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, err
+	}
+
+	out := bufio.NewWriter(f)
+	var count int
+	err = d.db.View(func(tx KVEngineTx) error {
+		var err error
+		count, err = kvDump(tx, buckets, false, out)
+		return err
+	})
+	if err == nil {
+		err = out.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return 0, err
+	}
+	return count, nil
+}
+
+// importFile loads a JSON Lines file in a single transaction, so a file
+// that fails part way leaves the database unchanged. The indexes of
+// collections opened on d are rebuilt in the same transaction.
+func (d *KVDB) importFile(L *lua.LState, path string, replace bool) (int, error) {
+	if d.db == nil {
+		return 0, bbolt.ErrDatabaseNotOpen
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var count int
+	err = d.update(L, func(tx KVEngineTx) error {
+		var err error
+		if count, err = kvLoad(tx, f, KVLoadOptions{Replace: replace}); err != nil {
+			return err
+		}
+		return d.rebuildIndexes(L, tx)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// kvExportBuckets reads the buckets option of db:export, a list of bucket
+// names or paths
+func kvExportBuckets(L *lua.LState, opts *lua.LTable) [][][]byte {
+	if opts == nil {
+		return nil
+	}
+	list, ok := opts.RawGetString("buckets").(*lua.LTable)
+	if !ok {
+		return nil
+	}
+
+	var buckets [][][]byte
+	for i := 1; i <= list.Len(); i++ {
+		switch v := list.RawGetInt(i).(type) {
+		case lua.LString:
+			buckets = append(buckets, [][]byte{[]byte(v)})
+		case *lua.LTable:
+			var path [][]byte
+			for j := 1; j <= v.Len(); j++ {
+				path = append(path, []byte(v.RawGetInt(j).String()))
+			}
+			if len(path) == 0 {
+				L.ArgError(3, "bucket path must not be empty")
+			}
+			buckets = append(buckets, path)
+		default:
+			L.ArgError(3, "buckets must be a list of bucket names or paths")
+		}
+	}
+	return buckets
+}
+
+// kvExportMethod implements db:export(path, {buckets=}) and
+// db:import(path, {mode=}), both returning the number of keys copied
+func kvExportMethod(db *KVDB, method string) lua.LGFunction {
+	return func(L *lua.LState) int {
+		path := L.CheckString(2)
+		opts := L.OptTable(3, nil)
+
+		var count int
+		var err error
+		if method == "export" {
+			count, err = db.exportFile(path, kvExportBuckets(L, opts))
+		} else {
+			mode := "merge"
+			if opts != nil {
+				if v := opts.RawGetString("mode"); v != lua.LNil {
+					mode = v.String()
+				}
+			}
+			if mode != "merge" && mode != "replace" {
+				L.ArgError(3, "mode must be merge or replace")
+			}
+			count, err = db.importFile(L, path, mode == "replace")
+		}
+
+		if err != nil {
+			L.Push(lua.LNil)
+			L.Push(lua.LString(err.Error()))
+			return 2
+		}
+		L.Push(lua.LNumber(count))
+		L.Push(lua.LNil)
+		return 2
+	}
+}
@@ -0,0 +1,1622 @@
+// kv_functions.go - Key-value database module implementation for Hype
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+	"go.etcd.io/bbolt"
+)
+
+// kvDefaultBucket is used when a bucket argument is omitted
+const kvDefaultBucket = "default"
+
+// kvRangeBatchSize is how many entries db:range reads per transaction
+const kvRangeBatchSize = 100
+
+// kvDefaultCodec encodes values stored with put_value
+const kvDefaultCodec = "msgpack"
+
+// registerKVModule adds the bbolt-backed kv module to Lua
+func registerKVModule(L *lua.LState) {
+	L.PreloadModule("kv", func(L *lua.LState) int {
+		kvModule := L.NewTable()
+		L.SetField(kvModule, "open", L.NewFunction(kvOpen))
+		L.SetField(kvModule, "collection", L.NewFunction(kvNewCollection))
+		L.SetField(kvModule, "compact", L.NewFunction(kvCompactFunction))
+		L.Push(kvModule)
+		return 1
+	})
+
+	// Set up database metatable
+	dbMT := L.NewTypeMetatable("KVDB")
+	L.SetField(dbMT, "__index", L.NewFunction(kvIndex))
+	L.SetField(dbMT, "__gc", L.NewFunction(kvGC))
+
+	// Set up transaction metatable
+	txnMT := L.NewTypeMetatable("KVTxn")
+	L.SetField(txnMT, "__index", L.NewFunction(kvTxnIndex))
+	L.SetField(txnMT, "__gc", L.NewFunction(kvTxnGC))
+
+	// Set up cursor metatable
+	cursorMT := L.NewTypeMetatable("KVCursor")
+	L.SetField(cursorMT, "__index", L.NewFunction(kvCursorIndex))
+	L.SetField(cursorMT, "__gc", L.NewFunction(kvCursorGC))
+
+	// Set up collection metatable
+	collectionMT := L.NewTypeMetatable("KVCollection")
+	L.SetField(collectionMT, "__index", L.NewFunction(kvCollectionIndex))
+}
+
+type KVDB struct {
+	db     KVEngine
+	path   string
+	codec  string
+	cipher *KVCipher
+	mu     sync.Mutex
+	txns   map[*KVTxn]struct{}
+	// writer is the open writable transaction from begin, if any
+	writer *KVTxn
+	// closers run before the database closes, such as stopping queue workers
+	closers []func()
+	// collections opened with kv.collection, keyed by name, codec and
+	// indexes; db:import rebuilds their indexes
+	collections map[string]*KVCollection
+
+	stopSweeper chan struct{}
+	sweeper     sync.WaitGroup
+}
+
+type KVTxn struct {
+	tx      KVEngineTx
+	db      *KVDB
+	mu      sync.Mutex
+	done    bool
+	managed bool // committed by bbolt, as in db:batch
+	scoped  bool // ends with its db:update callback
+	// owner is the script that began a writable transaction
+	owner *lua.Global
+}
+
+// kvOpenDatabases tracks open databases so they can be closed at script exit
+var kvOpenDatabases = struct {
+	sync.Mutex
+	dbs map[*KVDB]struct{}
+}{dbs: make(map[*KVDB]struct{})}
+
+// begin starts a transaction for L and records it as open on the database
+func (d *KVDB) begin(L *lua.LState, writable, scoped bool) (*KVTxn, error) {
+	if d.db == nil {
+		return nil, bbolt.ErrDatabaseNotOpen
+	}
+	if writable {
+		if err := d.releaseWriter(L); err != nil {
+			return nil, err
+		}
+	}
+	tx, err := d.db.Begin(writable)
+	if err != nil {
+		return nil, err
+	}
+
+	txn := &KVTxn{tx: tx, db: d, scoped: scoped}
+	d.mu.Lock()
+	d.txns[txn] = struct{}{}
+	if writable {
+		txn.owner = L.G
+		d.writer = txn
+	}
+	d.mu.Unlock()
+	return txn, nil
+}
+
+// releaseWriter makes way for a write from L. A writable transaction the
+// same script still holds would block that write forever: one from
+// db:begin_txn counts as abandoned and is rolled back, while one from a
+// running db:update callback is an error. Other scripts just wait for it.
+func (d *KVDB) releaseWriter(L *lua.LState) error {
+	d.mu.Lock()
+	txn := d.writer
+	d.mu.Unlock()
+	if txn == nil || txn.owner != L.G {
+		return nil
+	}
+	if txn.scoped {
+		return kvErrOpenTxn
+	}
+	txn.rollback()
+	return nil
+}
+
+// update runs fn in its own write transaction on behalf of L
+func (d *KVDB) update(L *lua.LState, fn func(KVEngineTx) error) error {
+	if d.db == nil {
+		return bbolt.ErrDatabaseNotOpen
+	}
+	if err := d.releaseWriter(L); err != nil {
+		return err
+	}
+	return d.db.Update(fn)
+}
+
+// onClose registers fn to run when the database closes
+func (d *KVDB) onClose(fn func()) {
+	d.mu.Lock()
+	d.closers = append(d.closers, fn)
+	d.mu.Unlock()
+}
+
+// close rolls back any transactions the script left open, then closes the
+// database. bbolt would otherwise block forever waiting for them.
+func (d *KVDB) close() error {
+	d.mu.Lock()
+	closers := d.closers
+	d.closers = nil
+	d.mu.Unlock()
+	for _, fn := range closers {
+		fn()
+	}
+
+	d.mu.Lock()
+	txns := make([]*KVTxn, 0, len(d.txns))
+	for txn := range d.txns {
+		txns = append(txns, txn)
+	}
+	d.mu.Unlock()
+
+	for _, txn := range txns {
+		txn.rollback()
+	}
+
+	kvOpenDatabases.Lock()
+	delete(kvOpenDatabases.dbs, d)
+	kvOpenDatabases.Unlock()
+
+	d.stopSweeping()
+	if d.db == nil {
+		return nil
+	}
+	d.unwatchAll()
+	kvSetCipher(d.db, nil)
+	err := d.db.Close()
+	d.db = nil
+	return err
+}
+
+// closed reports whether the transaction has been committed or rolled back
+func (t *KVTxn) closed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.done
+}
+
+// finish ends the transaction once, with either commit or rollback
+func (t *KVTxn) finish(commit bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return bbolt.ErrTxClosed
+	}
+	if t.managed {
+		return kvErrManagedTxn
+	}
+	t.done = true
+
+	t.db.mu.Lock()
+	delete(t.db.txns, t)
+	if t.db.writer == t {
+		t.db.writer = nil
+	}
+	t.db.mu.Unlock()
+
+	if commit {
+		return t.tx.Commit()
+	}
+	return t.tx.Rollback()
+}
+
+func (t *KVTxn) commit() error   { return t.finish(true) }
+func (t *KVTxn) rollback() error { return t.finish(false) }
+
+// updateBucket runs fn against a bucket in its own write transaction
+func (d *KVDB) updateBucket(L *lua.LState, path [][]byte, fn func(KVEngineBucket) error) error {
+	return d.update(L, func(tx KVEngineTx) error {
+		bucket := kvBucket(tx, path)
+		if bucket == nil {
+			return kvBucketNotFound(path)
+		}
+		return fn(bucket)
+	})
+}
+
+// updateBucket runs fn against a bucket within the transaction
+func (t *KVTxn) updateBucket(_ *lua.LState, path [][]byte, fn func(KVEngineBucket) error) error {
+	bucket := kvBucket(t.tx, path)
+	if bucket == nil {
+		return kvBucketNotFound(path)
+	}
+	return fn(bucket)
+}
+
+// kvCloseAll closes every database opened by the script, rolling back any
+// transactions that were never committed
+func kvCloseAll() {
+	kvOpenDatabases.Lock()
+	dbs := make([]*KVDB, 0, len(kvOpenDatabases.dbs))
+	for db := range kvOpenDatabases.dbs {
+		dbs = append(dbs, db)
+	}
+	kvOpenDatabases.Unlock()
+
+	for _, db := range dbs {
+		db.close()
+	}
+}
+
+// newKVTxnUserData wraps a transaction for Lua. gopher-lua never calls
+// __gc, so a finalizer rolls back transactions the script abandoned; an
+// abandoned writable one is also rolled back by the script's next write.
+func newKVTxnUserData(L *lua.LState, txn *KVTxn) *lua.LUserData {
+	ud := L.NewUserData()
+	ud.Value = txn
+	L.SetMetatable(ud, L.GetTypeMetatable("KVTxn"))
+	runtime.SetFinalizer(ud, func(ud *lua.LUserData) {
+		if txn, ok := ud.Value.(*KVTxn); ok {
+			txn.rollback()
+		}
+	})
+	return ud
+}
+
+// kvRunTxn calls fn with a new transaction, committing if it returns
+// normally and rolling back if it raises an error
+func kvRunTxn(L *lua.LState, db *KVDB, writable bool, fn *lua.LFunction) error {
+	txn, err := db.begin(L, writable, true)
+	if err != nil {
+		return err
+	}
+
+	L.Push(fn)
+	L.Push(newKVTxnUserData(L, txn))
+	if err := L.PCall(1, 0, nil); err != nil {
+		txn.rollback()
+		return err
+	}
+
+	if !writable {
+		return txn.rollback()
+	}
+	return txn.commit()
+}
+
+// kvRunBatch calls fn with a transaction that bbolt may share with
+// concurrent db:batch calls. fn can run more than once if the batch fails,
+// so it must only depend on the transaction.
+func kvRunBatch(L *lua.LState, db *KVDB, fn *lua.LFunction) error {
+	if db.db == nil {
+		return bbolt.ErrDatabaseNotOpen
+	}
+	if err := db.releaseWriter(L); err != nil {
+		return err
+	}
+	return db.db.Batch(func(tx KVEngineTx) error {
+		txn := &KVTxn{tx: tx, db: db, managed: true}
+		defer func() {
+			txn.mu.Lock()
+			txn.done = true
+			txn.mu.Unlock()
+		}()
+
+		L.Push(fn)
+		L.Push(newKVTxnUserData(L, txn))
+		return L.PCall(1, 0, nil)
+	})
+}
+
+// kvErrManagedTxn is returned when a script commits or aborts a db:batch
+// transaction, which bbolt commits itself
+var kvErrManagedTxn = errors.New("batch transactions are committed automatically")
+
+// kvErrOpenTxn is returned when a script writes outside the db:update
+// transaction it is still running, which would otherwise wait on itself
+var kvErrOpenTxn = errors.New("a db:update transaction is still open; write through its tx")
+
+// kvLockError explains a timeout waiting for another process to release
+// the database file lock
+func kvLockError(path string, timeout time.Duration) error {
+	return fmt.Errorf("database %s is locked by another process (waited %s)", path, timeout)
+}
+
+type KVCursor struct {
+	cursor KVEngineCursor
+	txn    *KVTxn
+	owner  *lua.LUserData // keeps the transaction from being finalized
+	path   [][]byte
+	key    []byte // current position, reported to watches on delete
+}
+
+// KVRangeOptions bounds a db:range scan. Start is inclusive and Stop is
+// exclusive; in reverse order the scan runs from Stop down to Start.
+type KVRangeOptions struct {
+	Start   []byte
+	Stop    []byte
+	Prefix  []byte
+	Reverse bool
+	Limit   int
+}
+
+// kvBucketPath reads a bucket argument from the stack. It accepts a bucket
+// name, or a table of names such as {"users", "alice", "sessions"} that
+// addresses nested buckets. A missing argument selects the default bucket.
+func kvBucketPath(L *lua.LState, n int) [][]byte {
+	switch v := L.Get(n).(type) {
+	case *lua.LNilType:
+		return [][]byte{[]byte(kvDefaultBucket)}
+	case lua.LString:
+		return [][]byte{[]byte(v)}
+	case *lua.LTable:
+		var path [][]byte
+		for i := 1; i <= v.Len(); i++ {
+			name := v.RawGetInt(i)
+			if name.Type() != lua.LTString && name.Type() != lua.LTNumber {
+				L.ArgError(n, "bucket path must contain only strings")
+			}
+			path = append(path, []byte(name.String()))
+		}
+		if len(path) == 0 {
+			L.ArgError(n, "bucket path must not be empty")
+		}
+		return path
+	}
+	L.ArgError(n, "bucket name or path expected")
+	return nil
+}
+
+// kvBucketName formats a bucket path for error messages
+func kvBucketName(path [][]byte) string {
+	return string(bytes.Join(path, []byte("/")))
+}
+
+// kvBucketNotFound reports a missing bucket
+func kvBucketNotFound(path [][]byte) error {
+	return fmt.Errorf("bucket %s does not exist", kvBucketName(path))
+}
+
+// kvBucket walks a bucket path, returning nil if any level is missing
+func kvBucket(tx KVEngineTx, path [][]byte) KVEngineBucket {
+	bucket := tx.Bucket(path[0])
+	for _, name := range path[1:] {
+		if bucket == nil {
+			return nil
+		}
+		bucket = bucket.Bucket(name)
+	}
+	return bucket
+}
+
+// kvCreateBucket creates every missing level of a bucket path
+func kvCreateBucket(tx KVEngineTx, path [][]byte) (KVEngineBucket, error) {
+	bucket, err := tx.CreateBucketIfNotExists(path[0])
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range path[1:] {
+		bucket, err = bucket.CreateBucketIfNotExists(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return bucket, nil
+}
+
+// kvDropBucket deletes the last bucket of a path along with its contents
+func kvDropBucket(tx KVEngineTx, path [][]byte) error {
+	var err error
+	if len(path) == 1 {
+		err = tx.DeleteBucket(path[0])
+	} else {
+		parent := kvBucket(tx, path[:len(path)-1])
+		if parent == nil {
+			return kvBucketNotFound(path)
+		}
+		err = parent.DeleteBucket(path[len(path)-1])
+	}
+	if errors.Is(err, bbolt.ErrBucketNotFound) {
+		return kvBucketNotFound(path)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Dropping a collection's bucket also drops its indexes
+	if len(path) == 1 {
+		if err := kvDropIndexes(tx, path[0]); err != nil {
+			return err
+		}
+	}
+	return kvClearExpiries(tx, path)
+}
+
+// kvBucketNames lists top-level buckets, or the buckets nested under path
+func kvBucketNames(tx KVEngineTx, path [][]byte) ([]string, error) {
+	var names []string
+	if len(path) == 0 {
+		err := tx.ForEach(func(name []byte, _ KVEngineBucket) error {
+			if !bytes.HasPrefix(name, []byte(kvInternalPrefix)) {
+				names = append(names, string(name))
+			}
+			return nil
+		})
+		return names, err
+	}
+
+	bucket := kvBucket(tx, path)
+	if bucket == nil {
+		return nil, kvBucketNotFound(path)
+	}
+	err := bucket.ForEachBucket(func(name []byte) error {
+		names = append(names, string(name))
+		return nil
+	})
+	return names, err
+}
+
+// kvStringList converts names to a Lua array
+func kvStringList(L *lua.LState, names []string) *lua.LTable {
+	table := L.NewTable()
+	for i, name := range names {
+		table.RawSetInt(i+1, lua.LString(name))
+	}
+	return table
+}
+
+// kvOptionalBucketPath reads an optional parent path for buckets()
+func kvOptionalBucketPath(L *lua.LState, n int) [][]byte {
+	if L.Get(n) == lua.LNil {
+		return nil
+	}
+	return kvBucketPath(L, n)
+}
+
+func kvOpen(L *lua.LState) int {
+	path := L.CheckString(1)
+
+	// Optional options table
+	var readonly bool = false
+	sweepInterval := kvDefaultSweepInterval
+	codec := kvDefaultCodec
+	engine := kvDefaultEngine
+	options := KVEngineOptions{Mode: 0600}
+	var encryption *KVEncryptionOptions
+
+	if L.GetTop() >= 2 {
+		table := L.CheckTable(2)
+		if readonlyVal := L.GetField(table, "readonly"); readonlyVal != lua.LNil {
+			readonly = lua.LVAsBool(readonlyVal)
+		}
+		if interval, ok := L.GetField(table, "sweep_interval").(lua.LNumber); ok {
+			sweepInterval = time.Duration(float64(interval) * float64(time.Second))
+		}
+		if codecVal := L.GetField(table, "codec"); codecVal != lua.LNil {
+			codec = codecVal.String()
+		}
+		if engineVal := L.GetField(table, "engine"); engineVal != lua.LNil {
+			engine = engineVal.String()
+		}
+		if timeout, ok := L.GetField(table, "timeout").(lua.LNumber); ok {
+			options.Timeout = time.Duration(float64(timeout) * float64(time.Second))
+		}
+		options.NoSync = lua.LVAsBool(L.GetField(table, "nosync"))
+		if size, ok := L.GetField(table, "initial_mmap_size").(lua.LNumber); ok {
+			options.InitialMmapSize = int(size)
+		}
+		if size, ok := L.GetField(table, "max_batch_size").(lua.LNumber); ok {
+			options.MaxBatchSize = int(size)
+		}
+		if delay, ok := L.GetField(table, "max_batch_delay").(lua.LNumber); ok {
+			options.MaxBatchDelay = time.Duration(float64(delay) * float64(time.Second))
+		}
+
+		if encryptionVal, ok := L.GetField(table, "encryption").(*lua.LTable); ok {
+			var err error
+			if encryption, err = kvEncryptionOptions(L, encryptionVal); err != nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LString(err.Error()))
+				return 2
+			}
+		}
+
+		// Lua has no octal literals, so modes may be given as "0640"
+		switch modeVal := L.GetField(table, "mode").(type) {
+		case lua.LNumber:
+			options.Mode = os.FileMode(int(modeVal))
+		case lua.LString:
+			parsed, err := strconv.ParseUint(string(modeVal), 8, 32)
+			if err != nil {
+				L.ArgError(2, "mode must be an octal string such as \"0640\"")
+			}
+			options.Mode = os.FileMode(parsed)
+		}
+	}
+	options.ReadOnly = readonly
+
+	if err := kvCheckCodec(codec); err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	db, err := kvOpenEngine(engine, path, options)
+	if errors.Is(err, bbolt.ErrTimeout) {
+		err = kvLockError(path, options.Timeout)
+	}
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	// Values of an encrypted database are unreadable without the key, so
+	// refuse to open one without it rather than return ciphertext
+	var cipher *KVCipher
+	if encryption != nil {
+		cipher, err = kvInitCipher(db, encryption)
+	} else {
+		err = db.View(func(tx KVEngineTx) error {
+			if tx.Bucket(kvCryptoBucket) != nil {
+				return fmt.Errorf("database %s is encrypted", path)
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		db.Close()
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	kvSetCipher(db, cipher)
+
+	kvdb := &KVDB{
+		db:     db,
+		path:   path,
+		codec:  codec,
+		cipher: cipher,
+		txns:   make(map[*KVTxn]struct{}),
+	}
+
+	kvOpenDatabases.Lock()
+	kvOpenDatabases.dbs[kvdb] = struct{}{}
+	kvOpenDatabases.Unlock()
+
+	// Expired keys are hidden on read; the sweeper reclaims their space
+	if !readonly && sweepInterval > 0 {
+		kvdb.startSweeper(sweepInterval)
+	}
+
+	ud := L.NewUserData()
+	ud.Value = kvdb
+	L.SetMetatable(ud, L.GetTypeMetatable("KVDB"))
+	L.Push(ud)
+	L.Push(lua.LNil)
+	return 2
+}
+
+func kvIndex(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	db := ud.Value.(*KVDB)
+	method := L.CheckString(2)
+
+	switch method {
+	case "open_db":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			path := kvBucketPath(L, 2)
+
+			// Create bucket (and any parents) if it doesn't exist
+			err := db.update(L, func(tx KVEngineTx) error {
+				_, err := kvCreateBucket(tx, path)
+				return err
+			})
+
+			if err != nil {
+				L.Push(lua.LString(err.Error()))
+				return 1
+			}
+			return 0
+		}))
+	case "drop_db":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			path := kvBucketPath(L, 2)
+
+			err := db.update(L, func(tx KVEngineTx) error {
+				return kvDropBucket(tx, path)
+			})
+
+			if err != nil {
+				L.Push(lua.LString(err.Error()))
+				return 1
+			}
+			return 0
+		}))
+	case "buckets":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			path := kvOptionalBucketPath(L, 2)
+
+			var names []string
+			err := db.db.View(func(tx KVEngineTx) error {
+				var err error
+				names, err = kvBucketNames(tx, path)
+				return err
+			})
+
+			if err != nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LString(err.Error()))
+				return 2
+			}
+
+			L.Push(kvStringList(L, names))
+			L.Push(lua.LNil)
+			return 2
+		}))
+	case "put":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			path := kvBucketPath(L, 2)
+			key := L.CheckString(3)
+			value := L.CheckString(4)
+			ttl := kvPutOptions(L, 5)
+
+			err := db.update(L, func(tx KVEngineTx) error {
+				return kvPutEntry(tx, path, []byte(key), []byte(value), ttl)
+			})
+
+			if err != nil {
+				L.Push(lua.LString(err.Error()))
+				return 1
+			}
+			return 0
+		}))
+	case "get":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			path := kvBucketPath(L, 2)
+			key := L.CheckString(3)
+
+			var value []byte
+			err := db.db.View(func(tx KVEngineTx) error {
+				var err error
+				value, err = kvGetEntry(tx, path, []byte(key))
+				return err
+			})
+
+			if err != nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LString(err.Error()))
+				return 2
+			}
+
+			if value == nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LNil)
+			} else {
+				L.Push(lua.LString(string(value)))
+				L.Push(lua.LNil)
+			}
+			return 2
+		}))
+	case "delete":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			path := kvBucketPath(L, 2)
+			key := L.CheckString(3)
+
+			err := db.update(L, func(tx KVEngineTx) error {
+				return kvDeleteEntry(tx, path, []byte(key))
+			})
+
+			if err != nil {
+				L.Push(lua.LString(err.Error()))
+				return 1
+			}
+			return 0
+		}))
+	case "put_value":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			path := kvBucketPath(L, 2)
+			key := L.CheckString(3)
+			value := L.CheckAny(4)
+			ttl := kvPutOptions(L, 5)
+
+			data, err := kvEncodeValue(L, value, kvCodecOption(L, 5, db.codec))
+			if err == nil {
+				err = db.update(L, func(tx KVEngineTx) error {
+					return kvPutEntry(tx, path, []byte(key), data, ttl)
+				})
+			}
+
+			if err != nil {
+				L.Push(lua.LString(err.Error()))
+				return 1
+			}
+			return 0
+		}))
+	case "get_value":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			path := kvBucketPath(L, 2)
+			key := L.CheckString(3)
+			codec := kvCodecOption(L, 4, db.codec)
+
+			var data []byte
+			err := db.db.View(func(tx KVEngineTx) error {
+				value, err := kvGetEntry(tx, path, []byte(key))
+				if value != nil {
+					// Copy out of the mmap before the transaction ends
+					data = append([]byte(nil), value...)
+				}
+				return err
+			})
+
+			return kvPushDecodedValue(L, data, codec, err)
+		}))
+	case "sweep":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			var removed int
+			err := db.update(L, func(tx KVEngineTx) error {
+				var err error
+				removed, err = kvSweepExpired(tx)
+				return err
+			})
+
+			if err != nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LString(err.Error()))
+				return 2
+			}
+			L.Push(lua.LNumber(removed))
+			L.Push(lua.LNil)
+			return 2
+		}))
+	case "next_id", "incr", "cas":
+		L.Push(L.NewFunction(kvCounterMethod(method, db.updateBucket)))
+	case "backup", "backup_to":
+		L.Push(L.NewFunction(kvBackupMethod(db, method)))
+	case "export", "import":
+		L.Push(L.NewFunction(kvExportMethod(db, method)))
+	case "watch":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			path := kvBucketPath(L, 2)
+			prefix := L.OptString(3, "")
+			fn := L.CheckFunction(4)
+			if db.db == nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LString(bbolt.ErrDatabaseNotOpen.Error()))
+				return 2
+			}
+
+			w := db.watch(L, path, []byte(prefix), fn)
+			L.Push(L.NewFunction(func(L *lua.LState) int {
+				db.unwatch(w)
+				return 0
+			}))
+			L.Push(lua.LNil)
+			return 2
+		}))
+	case "poll_watches":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			timeout := time.Duration(float64(L.OptNumber(2, 0)) * float64(time.Second))
+			L.Push(lua.LNumber(kvPollWatches(L, timeout)))
+			return 1
+		}))
+	case "begin_txn":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			writable := !L.OptBool(2, false)
+
+			txn, err := db.begin(L, writable, false)
+			if err != nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LString(err.Error()))
+				return 2
+			}
+
+			L.Push(newKVTxnUserData(L, txn))
+			L.Push(lua.LNil)
+			return 2
+		}))
+	case "rotate_key":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			table := L.CheckTable(2)
+			opts, err := kvEncryptionOptions(L, table)
+			if err == nil {
+				// Keep hashing keys unless the new options say otherwise
+				if table.RawGetString("hash_keys") == lua.LNil && db.cipher != nil {
+					opts.HashKeys = db.cipher.hashKeys
+				}
+				err = db.rotateKey(L, opts)
+			}
+
+			if err != nil {
+				L.Push(lua.LString(err.Error()))
+				return 1
+			}
+			return 0
+		}))
+	case "batch":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			fn := L.CheckFunction(2)
+
+			if err := kvRunBatch(L, db, fn); err != nil {
+				L.Push(lua.LString(err.Error()))
+				return 1
+			}
+			return 0
+		}))
+	case "update", "view":
+		writable := method == "update"
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			fn := L.CheckFunction(2)
+
+			if err := kvRunTxn(L, db, writable, fn); err != nil {
+				L.Push(lua.LString(err.Error()))
+				return 1
+			}
+			return 0
+		}))
+	case "keys":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			path := kvBucketPath(L, 2)
+			prefix := L.OptString(3, "")
+			limit := L.OptInt(4, 0)
+
+			var keys []string
+			err := db.db.View(func(tx KVEngineTx) error {
+				bucket := kvBucket(tx, path)
+				if bucket == nil {
+					return kvBucketNotFound(path)
+				}
+
+				crypt := kvCipherFor(tx)
+				if prefix != "" && !crypt.ordered() {
+					return kvErrUnordered
+				}
+
+				// Seek straight to the prefix instead of scanning the bucket
+				prefixBytes := []byte(prefix)
+				expired := kvExpiryFunc(tx, path)
+				c := bucket.Cursor()
+				for k, v := c.Seek(prefixBytes); k != nil && bytes.HasPrefix(k, prefixBytes); k, v = c.Next() {
+					// Nested buckets are listed by buckets(), not keys()
+					if v == nil || expired(k) {
+						continue
+					}
+					key, _, err := crypt.open(path, k, v)
+					if err != nil {
+						return err
+					}
+					keys = append(keys, string(key))
+					if limit > 0 && len(keys) >= limit {
+						break
+					}
+				}
+				return nil
+			})
+
+			if err != nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LString(err.Error()))
+				return 2
+			}
+
+			L.Push(kvStringList(L, keys))
+			L.Push(lua.LNil)
+			return 2
+		}))
+	case "range":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			path := kvBucketPath(L, 2)
+			opts := kvRangeOptionsFromTable(L.OptTable(3, nil))
+			return kvPushRangeIterator(L, db.db.View, path, opts)
+		}))
+	case "foreach":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			path := kvBucketPath(L, 2)
+			callback := L.CheckFunction(3)
+
+			err := db.db.View(func(tx KVEngineTx) error {
+				bucket := kvBucket(tx, path)
+				if bucket == nil {
+					return kvBucketNotFound(path)
+				}
+
+				crypt := kvCipherFor(tx)
+				expired := kvExpiryFunc(tx, path)
+				c := bucket.Cursor()
+				for k, v := c.First(); k != nil; k, v = c.Next() {
+					if v == nil || expired(k) {
+						continue
+					}
+					key, value, err := crypt.open(path, k, v)
+					if err != nil {
+						return err
+					}
+					L.Push(callback)
+					L.Push(lua.LString(string(key)))
+					L.Push(lua.LString(string(value)))
+					if err := L.PCall(2, 1, nil); err != nil {
+						return fmt.Errorf("callback error: %v", err)
+					}
+
+					// Check if callback returned false to break
+					result := L.Get(-1)
+					L.Pop(1)
+					if result == lua.LFalse {
+						break
+					}
+				}
+				return nil
+			})
+
+			if err != nil {
+				L.Push(lua.LString(err.Error()))
+				return 1
+			}
+			return 0
+		}))
+	case "close":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			if err := db.close(); err != nil {
+				L.Push(lua.LString(err.Error()))
+				return 1
+			}
+			return 0
+		}))
+	}
+
+	return kvDeliverAfter(L)
+}
+
+func kvGC(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	if db, ok := ud.Value.(*KVDB); ok {
+		db.close()
+	}
+	return 0
+}
+
+func kvTxnIndex(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	txn := ud.Value.(*KVTxn)
+	method := L.CheckString(2)
+
+	// open wraps a method so that calls after commit or abort return an
+	// error instead of panicking inside bbolt. nret is the method's number
+	// of results; the error is always the last one.
+	open := func(nret int, fn lua.LGFunction) *lua.LFunction {
+		return L.NewFunction(func(L *lua.LState) int {
+			if txn.closed() {
+				if nret == 2 {
+					L.Push(lua.LNil)
+				}
+				L.Push(lua.LString(bbolt.ErrTxClosed.Error()))
+				return nret
+			}
+			return fn(L)
+		})
+	}
+
+	switch method {
+	case "open_db":
+		L.Push(open(1, func(L *lua.LState) int {
+			path := kvBucketPath(L, 2)
+
+			if _, err := kvCreateBucket(txn.tx, path); err != nil {
+				L.Push(lua.LString(err.Error()))
+				return 1
+			}
+			return 0
+		}))
+	case "drop_db":
+		L.Push(open(1, func(L *lua.LState) int {
+			path := kvBucketPath(L, 2)
+
+			if err := kvDropBucket(txn.tx, path); err != nil {
+				L.Push(lua.LString(err.Error()))
+				return 1
+			}
+			return 0
+		}))
+	case "buckets":
+		L.Push(open(2, func(L *lua.LState) int {
+			path := kvOptionalBucketPath(L, 2)
+
+			names, err := kvBucketNames(txn.tx, path)
+			if err != nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LString(err.Error()))
+				return 2
+			}
+
+			L.Push(kvStringList(L, names))
+			L.Push(lua.LNil)
+			return 2
+		}))
+	case "put":
+		L.Push(open(1, func(L *lua.LState) int {
+			path := kvBucketPath(L, 2)
+			key := L.CheckString(3)
+			value := L.CheckString(4)
+			ttl := kvPutOptions(L, 5)
+
+			err := kvPutEntry(txn.tx, path, []byte(key), []byte(value), ttl)
+			if err != nil {
+				L.Push(lua.LString(err.Error()))
+				return 1
+			}
+			return 0
+		}))
+	case "get":
+		L.Push(open(2, func(L *lua.LState) int {
+			path := kvBucketPath(L, 2)
+			key := L.CheckString(3)
+
+			value, err := kvGetEntry(txn.tx, path, []byte(key))
+			if err != nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LString(err.Error()))
+				return 2
+			}
+
+			if value == nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LNil)
+			} else {
+				L.Push(lua.LString(string(value)))
+				L.Push(lua.LNil)
+			}
+			return 2
+		}))
+	case "delete":
+		L.Push(open(1, func(L *lua.LState) int {
+			path := kvBucketPath(L, 2)
+			key := L.CheckString(3)
+
+			err := kvDeleteEntry(txn.tx, path, []byte(key))
+			if err != nil {
+				L.Push(lua.LString(err.Error()))
+				return 1
+			}
+			return 0
+		}))
+	case "put_value":
+		L.Push(open(1, func(L *lua.LState) int {
+			path := kvBucketPath(L, 2)
+			key := L.CheckString(3)
+			value := L.CheckAny(4)
+			ttl := kvPutOptions(L, 5)
+
+			data, err := kvEncodeValue(L, value, kvCodecOption(L, 5, txn.db.codec))
+			if err == nil {
+				err = kvPutEntry(txn.tx, path, []byte(key), data, ttl)
+			}
+
+			if err != nil {
+				L.Push(lua.LString(err.Error()))
+				return 1
+			}
+			return 0
+		}))
+	case "get_value":
+		L.Push(open(2, func(L *lua.LState) int {
+			path := kvBucketPath(L, 2)
+			key := L.CheckString(3)
+			codec := kvCodecOption(L, 4, txn.db.codec)
+
+			data, err := kvGetEntry(txn.tx, path, []byte(key))
+			return kvPushDecodedValue(L, data, codec, err)
+		}))
+	case "next_id", "incr", "cas":
+		L.Push(open(2, kvCounterMethod(method, txn.updateBucket)))
+	case "cursor":
+		L.Push(open(2, func(L *lua.LState) int {
+			path := kvBucketPath(L, 2)
+
+			bucket := kvBucket(txn.tx, path)
+			if bucket == nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LString(kvBucketNotFound(path).Error()))
+				return 2
+			}
+
+			ud := L.NewUserData()
+			ud.Value = &KVCursor{cursor: bucket.Cursor(), txn: txn, owner: L.CheckUserData(1), path: path}
+			L.SetMetatable(ud, L.GetTypeMetatable("KVCursor"))
+			L.Push(ud)
+			L.Push(lua.LNil)
+			return 2
+		}))
+	case "range":
+		L.Push(open(2, func(L *lua.LState) int {
+			path := kvBucketPath(L, 2)
+			opts := kvRangeOptionsFromTable(L.OptTable(3, nil))
+			owner := L.CheckUserData(1)
+			view := func(fn func(KVEngineTx) error) error {
+				txn := owner.Value.(*KVTxn)
+				if txn.closed() {
+					return bbolt.ErrTxClosed
+				}
+				return fn(txn.tx)
+			}
+			return kvPushRangeIterator(L, view, path, opts)
+		}))
+	case "commit":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			err := txn.commit()
+			if err != nil {
+				L.Push(lua.LString(err.Error()))
+				return 1
+			}
+			return 0
+		}))
+	case "abort":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			err := txn.rollback()
+			if err != nil {
+				L.Push(lua.LString(err.Error()))
+				return 1
+			}
+			return 0
+		}))
+	}
+
+	return kvDeliverAfter(L)
+}
+
+func kvTxnGC(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	if txn, ok := ud.Value.(*KVTxn); ok {
+		txn.rollback()
+	}
+	return 0
+}
+
+func kvCursorIndex(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	cursor := ud.Value.(*KVCursor)
+	method := L.CheckString(2)
+
+	// move wraps a cursor movement so that using a cursor after its
+	// transaction has ended returns an error instead of panicking. Expired
+	// keys are passed over with step, the movement continuing in the same
+	// direction.
+	move := func(fn func(L *lua.LState) ([]byte, []byte), step func() ([]byte, []byte)) *lua.LFunction {
+		// Entries of encrypted databases are decrypted before they are returned
+		return L.NewFunction(func(L *lua.LState) int {
+			if cursor.txn.closed() {
+				L.Push(lua.LNil)
+				L.Push(lua.LNil)
+				L.Push(lua.LString(bbolt.ErrTxClosed.Error()))
+				return 3
+			}
+			expired := kvExpiryFunc(cursor.txn.tx, cursor.path)
+			k, v := fn(L)
+			for k != nil && v != nil && expired(k) {
+				k, v = step()
+			}
+			cursor.key = nil
+			if k != nil && v != nil {
+				var err error
+				k, v, err = kvCipherFor(cursor.txn.tx).open(cursor.path, k, v)
+				if err != nil {
+					L.Push(lua.LNil)
+					L.Push(lua.LNil)
+					L.Push(lua.LString(err.Error()))
+					return 3
+				}
+				cursor.key = k
+			}
+			return kvPushPair(L, k, v)
+		})
+	}
+
+	switch method {
+	case "first":
+		L.Push(move(func(L *lua.LState) ([]byte, []byte) {
+			return cursor.cursor.First()
+		}, cursor.cursor.Next))
+	case "last":
+		L.Push(move(func(L *lua.LState) ([]byte, []byte) {
+			return cursor.cursor.Last()
+		}, cursor.cursor.Prev))
+	case "next":
+		L.Push(move(func(L *lua.LState) ([]byte, []byte) {
+			return cursor.cursor.Next()
+		}, cursor.cursor.Next))
+	case "prev":
+		L.Push(move(func(L *lua.LState) ([]byte, []byte) {
+			return cursor.cursor.Prev()
+		}, cursor.cursor.Prev))
+	case "seek":
+		L.Push(move(func(L *lua.LState) ([]byte, []byte) {
+			seek := L.CheckString(2)
+			if !kvCipherFor(cursor.txn.tx).ordered() {
+				L.RaiseError("%s", kvErrUnordered.Error())
+			}
+			return cursor.cursor.Seek([]byte(seek))
+		}, cursor.cursor.Next))
+	case "delete":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			if cursor.txn.closed() {
+				L.Push(lua.LString(bbolt.ErrTxClosed.Error()))
+				return 1
+			}
+			var notify func([]byte)
+			if cursor.key != nil {
+				notify = kvObserve(cursor.cursor.Bucket(), cursor.path, cursor.key)
+			}
+			if err := cursor.cursor.Delete(); err != nil {
+				L.Push(lua.LString(err.Error()))
+				return 1
+			}
+			if notify != nil {
+				notify(nil)
+			}
+			return 0
+		}))
+	}
+
+	return 1
+}
+
+func kvCursorGC(L *lua.LState) int {
+	// Cursors are automatically cleaned up when transaction ends
+	return 0
+}
+
+// kvPushPair pushes a key/value pair, or two nils at the end of a bucket.
+// Nested buckets have a key but no value.
+func kvPushPair(L *lua.LState, k, v []byte) int {
+	if k == nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LNil)
+		return 2
+	}
+
+	L.Push(lua.LString(string(k)))
+	if v == nil {
+		L.Push(lua.LNil)
+	} else {
+		L.Push(lua.LString(string(v)))
+	}
+	return 2
+}
+
+// kvCheckCodec validates a value codec name
+func kvCheckCodec(codec string) error {
+	switch codec {
+	case "msgpack", "json":
+		return nil
+	}
+	return fmt.Errorf("unsupported codec: %s", codec)
+}
+
+// kvCodecOption reads the codec field of an optional options table
+func kvCodecOption(L *lua.LState, n int, codec string) string {
+	if opts := L.OptTable(n, nil); opts != nil {
+		if v := opts.RawGetString("codec"); v != lua.LNil {
+			codec = v.String()
+		}
+	}
+	return codec
+}
+
+// kvEncodeValue serializes any Lua value for put_value
+func kvEncodeValue(L *lua.LState, value lua.LValue, codec string) ([]byte, error) {
+	switch codec {
+	case "msgpack":
+		return marshalLuaMsgPack(L, value)
+	case "json":
+		return marshalLuaJSON(L, value, JSONEncodeOptions{})
+	}
+	return nil, kvCheckCodec(codec)
+}
+
+// kvPushDecodedValue decodes a value read by get_value and pushes it with
+// an error message. Missing keys decode to nil.
+func kvPushDecodedValue(L *lua.LState, data []byte, codec string, err error) int {
+	var value lua.LValue = lua.LNil
+	if err == nil && data != nil {
+		switch codec {
+		case "msgpack":
+			value, err = unmarshalLuaMsgPack(L, data)
+		case "json":
+			value, err = unmarshalLuaJSON(L, string(data))
+		default:
+			err = kvCheckCodec(codec)
+		}
+	}
+
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(value)
+	L.Push(lua.LNil)
+	return 2
+}
+
+// kvCounterMethod implements next_id, incr and cas on top of update, which
+// runs a function against a writable bucket. Each returns its result and an
+// error message.
+func kvCounterMethod(method string, update func(*lua.LState, [][]byte, func(KVEngineBucket) error) error) lua.LGFunction {
+	switch method {
+	case "next_id":
+		return func(L *lua.LState) int {
+			path := kvBucketPath(L, 2)
+
+			var id uint64
+			err := update(L, path, func(bucket KVEngineBucket) error {
+				var err error
+				id, err = bucket.NextSequence()
+				return err
+			})
+
+			if err != nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LString(err.Error()))
+				return 2
+			}
+			L.Push(lua.LNumber(id))
+			L.Push(lua.LNil)
+			return 2
+		}
+	case "incr":
+		return func(L *lua.LState) int {
+			path := kvBucketPath(L, 2)
+			key := L.CheckString(3)
+			delta := L.OptNumber(4, 1)
+			if delta != lua.LNumber(int64(delta)) {
+				L.ArgError(4, "delta must be an integer")
+			}
+
+			var value int64
+			err := update(L, path, func(bucket KVEngineBucket) error {
+				current, err := kvBucketGet(bucket, path, []byte(key))
+				if err != nil {
+					return err
+				}
+				if current != nil {
+					n, err := strconv.ParseInt(string(current), 10, 64)
+					if err != nil {
+						return fmt.Errorf("value of %s is not an integer", key)
+					}
+					value = n
+				}
+				value += int64(delta)
+				return kvBucketPut(bucket, path, []byte(key), []byte(strconv.FormatInt(value, 10)))
+			})
+
+			if err != nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LString(err.Error()))
+				return 2
+			}
+			L.Push(lua.LNumber(value))
+			L.Push(lua.LNil)
+			return 2
+		}
+	case "cas":
+		return func(L *lua.LState) int {
+			path := kvBucketPath(L, 2)
+			key := []byte(L.CheckString(3))
+			// nil as the expected value means the key must not exist, and
+			// nil as the new value deletes the key
+			expected, newValue := L.Get(4), L.Get(5)
+
+			swapped := false
+			err := update(L, path, func(bucket KVEngineBucket) error {
+				current, err := kvBucketGet(bucket, path, key)
+				if err != nil {
+					return err
+				}
+				if expected == lua.LNil {
+					if current != nil {
+						return nil
+					}
+				} else if current == nil || string(current) != lua.LVAsString(expected) {
+					return nil
+				}
+
+				swapped = true
+				if newValue == lua.LNil {
+					return kvBucketPut(bucket, path, key, nil)
+				}
+				return kvBucketPut(bucket, path, key, []byte(lua.LVAsString(newValue)))
+			})
+
+			if err != nil {
+				L.Push(lua.LFalse)
+				L.Push(lua.LString(err.Error()))
+				return 2
+			}
+			L.Push(lua.LBool(swapped))
+			L.Push(lua.LNil)
+			return 2
+		}
+	}
+	return nil
+}
+
+// kvRangeOptionsFromTable reads start, stop, prefix, reverse and limit
+func kvRangeOptionsFromTable(table *lua.LTable) KVRangeOptions {
+	var opts KVRangeOptions
+	if table == nil {
+		return opts
+	}
+	if v := table.RawGetString("start"); v != lua.LNil {
+		opts.Start = []byte(v.String())
+	}
+	if v := table.RawGetString("stop"); v != lua.LNil {
+		opts.Stop = []byte(v.String())
+	}
+	if v := table.RawGetString("prefix"); v != lua.LNil {
+		opts.Prefix = []byte(v.String())
+	}
+	opts.Reverse = lua.LVAsBool(table.RawGetString("reverse"))
+	if v, ok := table.RawGetString("limit").(lua.LNumber); ok {
+		opts.Limit = int(v)
+	}
+	return opts
+}
+
+// kvPrefixEnd returns the smallest key greater than every key with prefix,
+// or nil if there is none
+func kvPrefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// kvRangeBatch reads up to max entries of a range. When after is non-nil the
+// scan resumes just past that key.
+func kvRangeBatch(bucket KVEngineBucket, opts KVRangeOptions, after []byte, max int, expired func([]byte) bool) [][2][]byte {
+	lower := opts.Start
+	if opts.Prefix != nil && bytes.Compare(opts.Prefix, lower) > 0 {
+		lower = opts.Prefix
+	}
+	upper := opts.Stop
+	if end := kvPrefixEnd(opts.Prefix); end != nil && (upper == nil || bytes.Compare(end, upper) < 0) {
+		upper = end
+	}
+
+	c := bucket.Cursor()
+	var k, v []byte
+	if !opts.Reverse {
+		switch {
+		case after != nil:
+			k, v = c.Seek(after)
+			if bytes.Equal(k, after) {
+				k, v = c.Next()
+			}
+		default:
+			k, v = c.Seek(lower)
+		}
+	} else {
+		seek := upper
+		if after != nil {
+			seek = after
+		}
+		if seek == nil {
+			k, v = c.Last()
+		} else if k, v = c.Seek(seek); k == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Prev()
+		}
+	}
+
+	var entries [][2][]byte
+	for ; k != nil && len(entries) < max; k, v = kvRangeStep(c, opts.Reverse) {
+		if !opts.Reverse && upper != nil && bytes.Compare(k, upper) >= 0 {
+			break
+		}
+		if opts.Reverse && bytes.Compare(k, lower) < 0 {
+			break
+		}
+		if v == nil || !bytes.HasPrefix(k, opts.Prefix) || expired(k) {
+			continue
+		}
+		// Copy out of the mmap; the data is only valid inside the transaction
+		entries = append(entries, [2][]byte{append([]byte(nil), k...), append([]byte(nil), v...)})
+	}
+	return entries
+}
+
+// kvRangeStep advances a cursor in the scan direction
+func kvRangeStep(c KVEngineCursor, reverse bool) ([]byte, []byte) {
+	if reverse {
+		return c.Prev()
+	}
+	return c.Next()
+}
+
+// kvPushRangeIterator pushes a Lua iterator over a range. Entries are read in
+// batches, each in its own call to view, so no transaction is left open if
+// the loop ends early.
+func kvPushRangeIterator(L *lua.LState, view func(func(KVEngineTx) error) error, path [][]byte, opts KVRangeOptions) int {
+	// batch holds the stored key, used to resume the scan, followed by the
+	// decrypted key and value
+	var batch [][3][]byte
+	var last []byte
+	emitted := 0
+	done := false
+
+	fill := func() error {
+		max := kvRangeBatchSize
+		if opts.Limit > 0 && opts.Limit-emitted < max {
+			max = opts.Limit - emitted
+		}
+		return view(func(tx KVEngineTx) error {
+			bucket := kvBucket(tx, path)
+			if bucket == nil {
+				return kvBucketNotFound(path)
+			}
+			crypt := kvCipherFor(tx)
+			if !crypt.ordered() && (opts.Start != nil || opts.Stop != nil || opts.Prefix != nil) {
+				return kvErrUnordered
+			}
+			entries := kvRangeBatch(bucket, opts, last, max, kvExpiryFunc(tx, path))
+			batch = batch[:0]
+			for _, entry := range entries {
+				key, value, err := crypt.open(path, entry[0], entry[1])
+				if err != nil {
+					return err
+				}
+				batch = append(batch, [3][]byte{entry[0], key, value})
+			}
+			done = len(entries) < max
+			return nil
+		})
+	}
+
+	// Read the first batch eagerly so a missing bucket is reported up front
+	if err := fill(); err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	L.Push(L.NewFunction(func(L *lua.LState) int {
+		if opts.Limit > 0 && emitted >= opts.Limit {
+			return kvPushPair(L, nil, nil)
+		}
+		if len(batch) == 0 {
+			if done {
+				return kvPushPair(L, nil, nil)
+			}
+			if err := fill(); err != nil {
+				L.RaiseError("%s", err.Error())
+			}
+			if len(batch) == 0 {
+				return kvPushPair(L, nil, nil)
+			}
+		}
+
+		entry := batch[0]
+		batch = batch[1:]
+		last = entry[0]
+		emitted++
+		return kvPushPair(L, entry[1], entry[2])
+	}))
+	L.Push(lua.LNil)
+	return 2
+}
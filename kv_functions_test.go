@@ -0,0 +1,990 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"path/filepath"
+	"runtime/debug"
+	"testing"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// runKVScript runs a Lua script with db_path set to a fresh database file
+func runKVScript(t *testing.T, script string) {
+	t.Helper()
+	L := lua.NewState()
+	defer L.Close()
+	registerKVModule(L)
+	registerJSONModule(L)
+	L.SetGlobal("db_path", lua.LString(filepath.Join(t.TempDir(), "test.db")))
+
+	if err := L.DoString(script); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// kvTestEngines are the storage engines runKVEngineScripts covers. Engines
+// behind build tags add themselves from tagged test files.
+var kvTestEngines = []string{"bbolt", "memory"}
+
+// runKVEngineScripts runs a script once per storage engine, with kv.open
+// defaulting to that engine
+func runKVEngineScripts(t *testing.T, script string) {
+	t.Helper()
+	for _, engine := range kvTestEngines {
+		t.Run(engine, func(t *testing.T) {
+			runKVScript(t, `
+				local kv = require("kv")
+				local open = kv.open
+				kv.open = function(path, opts)
+					opts = opts or {}
+					opts.engine = opts.engine or "`+engine+`"
+					return open(path, opts)
+				end
+			`+script)
+		})
+	}
+}
+
+func TestKVNestedBuckets(t *testing.T) {
+	runKVEngineScripts(t, `
+		local kv = require("kv")
+		local db = assert(kv.open(db_path))
+
+		local sessions = {"users", "alice", "sessions"}
+		assert(db:open_db(sessions) == nil)
+		assert(db:open_db("config") == nil)
+		assert(db:put(sessions, "s1", "token") == nil)
+		assert(db:get(sessions, "s1") == "token")
+
+		local top = db:buckets()
+		assert(#top == 2 and top[1] == "config" and top[2] == "users", table.concat(top, ","))
+		local nested = db:buckets({"users", "alice"})
+		assert(#nested == 1 and nested[1] == "sessions")
+
+		-- Nested buckets are not reported as keys
+		assert(db:put({"users", "alice"}, "email", "a@example.com") == nil)
+		local keys = db:keys({"users", "alice"})
+		assert(#keys == 1 and keys[1] == "email")
+
+		local value, err = db:get({"users", "bob"}, "s1")
+		assert(value == nil and err == "bucket users/bob does not exist", err)
+
+		local txn = assert(db:begin_txn())
+		assert(txn:open_db({"users", "bob"}) == nil)
+		assert(txn:put({"users", "bob"}, "name", "Bob") == nil)
+		assert(txn:drop_db({"users", "alice"}) == nil)
+		assert(#txn:buckets("users") == 1)
+		assert(txn:commit() == nil)
+
+		assert(db:get({"users", "bob"}, "name") == "Bob")
+		assert(select(2, db:get(sessions, "s1")) ~= nil)
+		assert(db:drop_db("config") == nil)
+		assert(db:drop_db("config") == "bucket config does not exist")
+		db:close()
+	`)
+}
+
+func TestKVRangeAndCursor(t *testing.T) {
+	runKVEngineScripts(t, `
+		local kv = require("kv")
+		local db = assert(kv.open(db_path))
+		assert(db:open_db("items") == nil)
+		assert(db:open_db({"items", "nested"}) == nil)
+
+		local txn = assert(db:begin_txn())
+		for i = 1, 250 do
+			assert(txn:put("items", string.format("item:%03d", i), tostring(i)) == nil)
+		end
+		assert(txn:put("items", "other", "x") == nil)
+		assert(txn:commit() == nil)
+
+		local function collect(opts)
+			local keys = {}
+			for k, v in assert(db:range("items", opts)) do
+				keys[#keys + 1] = k
+			end
+			return keys
+		end
+
+		-- Batches are stitched together and nested buckets are skipped
+		assert(#collect() == 251)
+		assert(#collect({prefix = "item:"}) == 250)
+
+		local page = collect({start = "item:010", stop = "item:015"})
+		assert(#page == 5 and page[1] == "item:010" and page[5] == "item:014")
+
+		local rev = collect({prefix = "item:", reverse = true, limit = 3})
+		assert(#rev == 3 and rev[1] == "item:250" and rev[3] == "item:248", table.concat(rev, ","))
+
+		rev = collect({stop = "item:002", reverse = true})
+		assert(#rev == 1 and rev[1] == "item:001")
+
+		local keys = db:keys("items", "item:2", 5)
+		assert(#keys == 5 and keys[1] == "item:200")
+
+		local iter, err = db:range("missing")
+		assert(iter == nil and err == "bucket missing does not exist")
+
+		local rtx = assert(db:begin_txn(true))
+		local c = assert(rtx:cursor("items"))
+		local k, v = c:seek("item:100")
+		assert(k == "item:100" and v == "100")
+		k = c:next()
+		assert(k == "item:101")
+		k = c:prev()
+		k = c:prev()
+		assert(k == "item:099")
+		k = c:last()
+		assert(k == "other")
+		k, v = c:seek("item:999")
+		assert(k == "nested" and v == nil)
+		assert(rtx:abort() == nil)
+
+		local k, v, err = c:first()
+		assert(k == nil and err ~= nil)
+		db:close()
+	`)
+}
+
+func TestKVUpdateAndView(t *testing.T) {
+	runKVEngineScripts(t, `
+		local kv = require("kv")
+		local db = assert(kv.open(db_path))
+		assert(db:open_db("accounts") == nil)
+
+		assert(db:update(function(tx)
+			assert(tx:put("accounts", "alice", "100") == nil)
+		end) == nil)
+
+		-- A Lua error rolls the transaction back and is returned
+		local saved
+		local err = db:update(function(tx)
+			saved = tx
+			tx:put("accounts", "alice", "0")
+			error("insufficient funds")
+		end)
+		assert(err and err:find("insufficient funds"), err)
+		assert(db:get("accounts", "alice") == "100")
+
+		-- Transactions cannot be used after the closure returns
+		assert(saved:put("accounts", "alice", "1") == "tx closed")
+		local value, err = saved:get("accounts", "alice")
+		assert(value == nil and err == "tx closed")
+
+		local seen
+		assert(db:view(function(tx)
+			seen = tx:get("accounts", "alice")
+		end) == nil)
+		assert(seen == "100")
+
+		-- Writes are rejected in view
+		err = db:view(function(tx)
+			local err = tx:put("accounts", "bob", "1")
+			assert(err == nil, err)
+		end)
+		assert(err ~= nil)
+
+		-- Closing the database rolls back abandoned transactions instead of blocking
+		local txn = assert(db:begin_txn())
+		txn:put("accounts", "carol", "5")
+		assert(db:close() == nil)
+		assert(txn:commit() == "tx closed")
+
+		db = assert(kv.open(db_path))
+		assert(db:get("accounts", "carol") == nil)
+		db:close()
+	`)
+}
+
+func TestKVAbandonedWriteTxn(t *testing.T) {
+	// The next write must not depend on a GC finalizing the transaction
+	defer debug.SetGCPercent(debug.SetGCPercent(-1))
+
+	runKVEngineScripts(t, `
+		local kv = require("kv")
+		local db = assert(kv.open(db_path))
+		assert(db:open_db("b") == nil)
+
+		-- A transaction lost to an error is rolled back by the next write
+		assert(not pcall(function()
+			local tx = db:begin_txn()
+			tx:put("b", "k", "v")
+			error("x")
+		end))
+		assert(db:put("b", "k2", "v2") == nil)
+		assert(db:get("b", "k") == nil)
+		assert(db:get("b", "k2") == "v2")
+
+		-- So is one still held, which then reports itself closed
+		local tx = assert(db:begin_txn())
+		assert(tx:put("b", "k3", "v3") == nil)
+		assert(db:incr("b", "n") == 1)
+		assert(tx:commit() == "tx closed")
+		local tx2 = assert(db:begin_txn())
+		assert(db:begin_txn():abort() == nil)
+		assert(tx2:commit() == "tx closed")
+		assert(db:get("b", "k3") == nil)
+
+		-- Inside db:update the outer transaction is still running
+		local err = db:update(function(tx)
+			local err = db:put("b", "k4", "v4")
+			assert(err and err:find("still open"), err)
+			assert(db:update(function() end):find("still open"))
+			assert(tx:put("b", "k5", "v5") == nil)
+		end)
+		assert(err == nil, err)
+		assert(db:get("b", "k4") == nil)
+		assert(db:get("b", "k5") == "v5")
+		db:close()
+	`)
+}
+
+func TestKVCounters(t *testing.T) {
+	runKVEngineScripts(t, `
+		local kv = require("kv")
+		local db = assert(kv.open(db_path))
+		assert(db:open_db("orders") == nil)
+
+		assert(db:next_id("orders") == 1)
+		assert(db:next_id("orders") == 2)
+
+		assert(db:incr("orders", "hits") == 1)
+		assert(db:incr("orders", "hits", 10) == 11)
+		assert(db:incr("orders", "hits", -1) == 10)
+		assert(db:get("orders", "hits") == "10")
+
+		db:put("orders", "name", "abc")
+		local value, err = db:incr("orders", "name")
+		assert(value == nil and err == "value of name is not an integer", err)
+
+		-- nil expected value means "must not exist"
+		assert(db:cas("orders", "lock", nil, "owner-1") == true)
+		assert(db:cas("orders", "lock", nil, "owner-2") == false)
+		assert(db:cas("orders", "lock", "owner-2", "owner-3") == false)
+		assert(db:cas("orders", "lock", "owner-1", "owner-2") == true)
+		assert(db:get("orders", "lock") == "owner-2")
+		-- nil new value deletes the key
+		assert(db:cas("orders", "lock", "owner-2", nil) == true)
+		assert(db:get("orders", "lock") == nil)
+
+		assert(db:update(function(tx)
+			assert(tx:next_id("orders") == 3)
+			assert(tx:incr("orders", "hits", 5) == 15)
+			assert(tx:cas("orders", "hits", "15", "0") == true)
+		end) == nil)
+		assert(db:get("orders", "hits") == "0")
+
+		local ok, err = db:cas("missing", "k", nil, "v")
+		assert(ok == false and err == "bucket missing does not exist")
+		db:close()
+	`)
+}
+
+func TestKVTTL(t *testing.T) {
+	runKVEngineScripts(t, `
+		local kv = require("kv")
+		local db = assert(kv.open(db_path, {sweep_interval = 0}))
+		assert(db:open_db("sessions") == nil)
+
+		local function wait(seconds)
+			local deadline = os.clock() + seconds
+			while os.clock() < deadline do end
+		end
+
+		assert(db:put("sessions", "short", "a", {ttl = 0.05}) == nil)
+		assert(db:put("sessions", "long", "b", {ttl = 3600}) == nil)
+		assert(db:put("sessions", "forever", "c") == nil)
+		assert(db:put("sessions", "cleared", "d", {ttl = 0.05}) == nil)
+		-- Overwriting without a ttl removes the expiry
+		assert(db:put("sessions", "cleared", "d") == nil)
+		assert(db:get("sessions", "short") == "a")
+
+		wait(0.1)
+
+		-- Expired keys are hidden from reads before they are swept
+		assert(db:get("sessions", "short") == nil)
+		local keys = db:keys("sessions")
+		assert(#keys == 3, table.concat(keys, ","))
+		local count = 0
+		for k in db:range("sessions") do count = count + 1 end
+		assert(count == 3)
+		assert(db:view(function(tx) assert(tx:get("sessions", "short") == nil) end) == nil)
+
+		assert(db:sweep() == 1)
+		assert(db:sweep() == 0)
+		assert(db:get("sessions", "long") == "b")
+		assert(db:get("sessions", "cleared") == "d")
+
+		-- Internal buckets are not listed
+		local buckets = db:buckets()
+		assert(#buckets == 1 and buckets[1] == "sessions")
+		db:close()
+	`)
+}
+
+func TestKVTTLCountersAndCursors(t *testing.T) {
+	runKVEngineScripts(t, `
+		local kv = require("kv")
+		local db = assert(kv.open(db_path, {sweep_interval = 0}))
+		assert(db:open_db("limits") == nil)
+
+		assert(db:put("limits", "a", "1", {ttl = 0.05}) == nil)
+		assert(db:put("limits", "b", "5", {ttl = 0.05}) == nil)
+		assert(db:put("limits", "c", "x", {ttl = 0.05}) == nil)
+		assert(db:put("limits", "d", "1", {ttl = 3600}) == nil)
+		assert(db:put("limits", "e", "2") == nil)
+
+		local deadline = os.clock() + 0.1
+		while os.clock() < deadline do end
+
+		-- Counters treat expired keys as missing and drop their expiry
+		assert(db:incr("limits", "b") == 1)
+		assert(db:get("limits", "b") == "1")
+		assert(db:cas("limits", "c", nil, "y") == true)
+		assert(db:get("limits", "c") == "y")
+		-- Live keys keep theirs
+		assert(db:incr("limits", "d") == 2)
+
+		-- Cursors skip expired keys in both directions
+		assert(db:view(function(tx)
+			local c = assert(tx:cursor("limits"))
+			local k = c:first()
+			assert(k == "b", k)
+			assert(c:seek("a") == "b")
+			assert(c:next() == "c")
+			k = c:last()
+			assert(k == "e", k)
+			assert(c:prev() == "d")
+			assert(c:prev() == "c")
+			assert(c:prev() == "b")
+			assert(c:prev() == nil)
+		end) == nil)
+
+		-- Only a was still due; b and c are live keys again
+		assert(db:sweep() == 1)
+		assert(db:get("limits", "b") == "1" and db:get("limits", "c") == "y")
+		assert(db:get("limits", "d") == "2")
+		db:close()
+	`)
+}
+
+func TestKVTTLBucketNames(t *testing.T) {
+	runKVEngineScripts(t, `
+		local kv = require("kv")
+		local db = assert(kv.open(db_path, {sweep_interval = 0}))
+		-- Bucket names holding NUL bytes keep their own expiry metadata
+		assert(db:open_db({"a", "b"}) == nil)
+		assert(db:open_db("a\0b") == nil)
+		assert(db:open_db("x\0y") == nil)
+
+		assert(db:put({"a", "b"}, "k", "nested", {ttl = 0.05}) == nil)
+		assert(db:put("a\0b", "k", "flat") == nil)
+		assert(db:put("x\0y", "k", "v", {ttl = 0.05}) == nil)
+
+		local deadline = os.clock() + 0.1
+		while os.clock() < deadline do end
+
+		assert(db:get({"a", "b"}, "k") == nil)
+		assert(db:get("x\0y", "k") == nil)
+		assert(db:sweep() == 2)
+		assert(db:get({"a", "b"}, "k") == nil)
+		assert(db:get("x\0y", "k") == nil)
+		assert(db:get("a\0b", "k") == "flat")
+		db:close()
+	`)
+}
+
+func TestKVSweeper(t *testing.T) {
+	runKVEngineScripts(t, `
+		local kv = require("kv")
+		local db = assert(kv.open(db_path, {sweep_interval = 0.02}))
+		assert(db:open_db("cache") == nil)
+		assert(db:put("cache", "k", "v", {ttl = 0.01}) == nil)
+
+		local deadline = os.clock() + 0.2
+		while os.clock() < deadline do end
+
+		-- The background sweeper has already removed the key
+		assert(db:sweep() == 0)
+		db:close()
+	`)
+}
+
+func TestKVTypedValues(t *testing.T) {
+	runKVScript(t, `
+		local kv = require("kv")
+		local json = require("json")
+		local db = assert(kv.open(db_path))
+		assert(db:open_db("objects") == nil)
+
+		local doc = {
+			name = "widget",
+			price = 9.5,
+			stock = 3,
+			active = true,
+			tags = {"a", "b"},
+			dims = {w = 10, h = 20},
+		}
+
+		for _, codec in ipairs({"msgpack", "json"}) do
+			assert(db:put_value("objects", codec, doc, {codec = codec}) == nil)
+			local value, err = db:get_value("objects", codec, {codec = codec})
+			assert(err == nil, err)
+			assert(value.name == "widget" and value.price == 9.5 and value.stock == 3)
+			assert(value.active == true and value.tags[2] == "b" and value.dims.h == 20)
+		end
+
+		-- JSON-coded values are plain JSON for string readers
+		assert(json.decode(db:get("objects", "json")).name == "widget")
+
+		assert(db:put_value("objects", "n", 42) == nil)
+		assert(db:get_value("objects", "n") == 42)
+		assert(db:put_value("objects", "b", false) == nil)
+		assert(db:get_value("objects", "b") == false)
+		local value, err = db:get_value("objects", "missing")
+		assert(value == nil and err == nil)
+
+		-- The default codec can be chosen when opening the database
+		db:close()
+		db = assert(kv.open(db_path, {codec = "json"}))
+		assert(db:get_value("objects", "json").dims.w == 10)
+		assert(db:update(function(tx)
+			assert(tx:put_value("objects", "list", {1, 2, 3}) == nil)
+			assert(#tx:get_value("objects", "list") == 3)
+		end) == nil)
+		assert(db:get("objects", "list") == "[1,2,3]")
+
+		local _, err = kv.open(db_path .. ".x", {codec = "xml"})
+		assert(err == "unsupported codec: xml")
+		db:close()
+	`)
+}
+
+func TestKVCollection(t *testing.T) {
+	runKVEngineScripts(t, `
+		local kv = require("kv")
+		local db = assert(kv.open(db_path))
+		local users = assert(kv.collection(db, "users", {indexes = {"email", "age"}}))
+
+		local id = assert(users:insert({email = "alice@example.com", name = "Alice", age = 31}))
+		assert(id == 1)
+		assert(users:insert({email = "bob@example.com", name = "Bob", age = 25}) == 2)
+		assert(users:insert({id = "carol", email = "carol@example.com", name = "Carol", age = -4.5}) == "carol")
+		local _, err = users:insert({id = "carol", email = "x"})
+		assert(err == "document carol already exists", err)
+
+		local found = assert(users:find({email = "bob@example.com"}))
+		assert(#found == 1 and found[1].name == "Bob" and found[1].id == 2)
+		assert(users:find_one({name = "Alice"}).age == 31) -- unindexed scan
+		assert(#users:find({email = "bob@example.com", name = "Alice"}) == 0)
+
+		-- Ordered range queries on an indexed field
+		local byAge = users:range("age")
+		assert(#byAge == 3 and byAge[1].id == "carol" and byAge[3].id == 1)
+		local adults = users:range("age", {start = 18, stop = 30})
+		assert(#adults == 1 and adults[1].name == "Bob")
+		local oldest = users:range("age", {reverse = true, limit = 1})
+		assert(oldest[1].name == "Alice")
+		local _, err = users:range("name")
+		assert(err == "field name is not indexed")
+
+		-- Updates move index entries in the same transaction
+		assert(users:update(1, {email = "alice@new.example"}) == nil)
+		assert(#users:find({email = "alice@example.com"}) == 0)
+		assert(users:find_one({email = "alice@new.example"}).name == "Alice")
+		assert(users:get(1).age == 31)
+
+		assert(users:delete("carol") == nil)
+		assert(users:get("carol") == nil)
+		assert(#users:find({email = "carol@example.com"}) == 0)
+		assert(users:count() == 2)
+		local _, err = users:range("age", {start = 18, stop = "z"})
+		assert(err == "start and stop must have the same type", err)
+		local _, err = users:range("age", {start = "a", stop = 30})
+		assert(err == "start and stop must have the same type", err)
+
+		-- Scans skip nested buckets and expired documents
+		assert(db:open_db({"users", "archive"}) == nil)
+		assert(db:put_value("users", "temp", {name = "Temp"}, {ttl = 0.05}) == nil)
+		assert(users:count() == 3 and #users:find({}) == 3)
+		local deadline = os.clock() + 0.1
+		while os.clock() < deadline do end
+		assert(users:count() == 2 and #users:find({}) == 2)
+		assert(users:find_one({name = "Temp"}) == nil)
+
+		-- Adding an index later builds it for existing documents
+		local reindexed = assert(kv.collection(db, "users", {indexes = {"email", "age", "name"}}))
+		assert(reindexed:find({name = "Bob"})[1].age == 25)
+		assert(#reindexed:range("name") == 2)
+
+		-- Index buckets are internal
+		local buckets = db:buckets()
+		assert(#buckets == 1 and buckets[1] == "users")
+
+		-- Dropping the collection's bucket removes its indexes too
+		assert(db:drop_db("users") == nil)
+		local fresh = assert(kv.collection(db, "users", {indexes = {"email"}}))
+		assert(#fresh:find({email = "bob@example.com"}) == 0)
+		db:close()
+	`)
+}
+
+func TestKVBackupAndCompact(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	registerKVModule(L)
+	dir := t.TempDir()
+	L.SetGlobal("dir", lua.LString(dir))
+
+	var streamed bytes.Buffer
+	ud := L.NewUserData()
+	ud.Value = io.Writer(&streamed)
+	L.SetGlobal("stream", ud)
+
+	script := `
+		local kv = require("kv")
+		local db = assert(kv.open(dir .. "/live.db"))
+		assert(db:open_db("items") == nil)
+		for i = 1, 500 do
+			assert(db:put("items", "key" .. i, string.rep("x", 1000)) == nil)
+		end
+		for i = 1, 450 do
+			assert(db:delete("items", "key" .. i) == nil)
+		end
+
+		local size, err = db:backup(dir .. "/backup.db")
+		assert(err == nil, err)
+		assert(size > 0)
+		local _, err = db:backup(dir .. "/live.db")
+		assert(err ~= nil)
+
+		-- Any object with a write method receives the stream in chunks
+		local chunks = {}
+		local sink = { write = function(self, chunk) table.insert(chunks, chunk) end }
+		assert(db:backup_to(sink) == size)
+		assert(#table.concat(chunks) == size)
+		assert(db:backup_to(stream) == size)
+
+		local copy = assert(kv.open(dir .. "/backup.db"))
+		assert(copy:get("items", "key500") == string.rep("x", 1000))
+		assert(copy:get("items", "key1") == nil)
+		copy:close()
+
+		local stats = assert(kv.compact(db, dir .. "/compact.db"))
+		assert(stats.after < stats.before, stats.after .. " >= " .. stats.before)
+		local _, err = kv.compact(db, dir .. "/compact.db")
+		assert(err ~= nil)
+		-- The path of an open database is compacted from the open handle
+		assert(kv.compact(dir .. "/live.db", dir .. "/compact3.db"))
+		db:close()
+
+		assert(kv.compact(dir .. "/live.db", dir .. "/compact2.db"))
+		local compacted = assert(kv.open(dir .. "/compact2.db"))
+		assert(#compacted:keys("items") == 50)
+		compacted:close()
+	`
+	if err := L.DoString(script); err != nil {
+		t.Fatal(err)
+	}
+	if int64(streamed.Len()) == 0 {
+		t.Fatal("expected backup to stream to Go writer")
+	}
+}
+
+func TestKVWatch(t *testing.T) {
+	runKVEngineScripts(t, `
+		local kv = require("kv")
+		local db = assert(kv.open(db_path))
+		assert(db:open_db("users") == nil)
+		assert(db:open_db("other") == nil)
+
+		-- Tables are cleared in place: gopher-lua can detach upvalues of the
+		-- main chunk after an error is caught, so they are never reassigned
+		local events = {}
+		local function reset()
+			for i = #events, 1, -1 do events[i] = nil end
+		end
+		local stop = assert(db:watch("users", "user:", function(key, old, new, op)
+			table.insert(events, table.concat({op, key, old or "-", new or "-"}, " "))
+		end))
+
+		assert(db:put("users", "user:1", "a") == nil)
+		assert(db:put("users", "user:1", "b") == nil)
+		assert(db:put("users", "session:1", "x") == nil)
+		assert(db:put("other", "user:1", "x") == nil)
+		assert(db:delete("users", "user:1") == nil)
+		assert(db:delete("users", "user:missing") == nil)
+		assert(#events == 3, table.concat(events, "; "))
+		assert(events[1] == "put user:1 - a")
+		assert(events[2] == "put user:1 a b")
+		assert(events[3] == "delete user:1 b -")
+
+		-- Transactional writes are delivered after commit, and never on rollback
+		reset()
+		local txn = assert(db:begin_txn())
+		txn:put("users", "user:2", "c")
+		txn:incr("users", "user:count")
+		assert(#events == 0)
+		assert(txn:commit() == nil)
+		assert(#events == 2 and events[1] == "put user:2 - c" and events[2] == "put user:count - 1")
+
+		reset()
+		assert(db:update(function(txn)
+			txn:put("users", "user:3", "d")
+			error("abort")
+		end) ~= nil)
+		assert(db:cas("users", "user:2", "c", nil))
+		assert(#events == 1 and events[1] == "delete user:2 c -", table.concat(events, "; "))
+
+		-- Callbacks may write; their own changes are delivered in turn
+		reset()
+		local mirrored = {}
+		local stop_mirror = db:watch("users", "user:", function(key, old, new, op)
+			if op == "put" and key ~= "user:mirror" then
+				table.insert(mirrored, key)
+				db:put("users", "user:mirror", new)
+			end
+		end)
+		assert(db:put("users", "user:4", "e") == nil)
+		assert(#mirrored == 1)
+		assert(db:get("users", "user:mirror") == "e")
+		assert(#events == 2 and events[2] == "put user:mirror - e", table.concat(events, "; "))
+		stop_mirror()
+
+		stop()
+		reset()
+		assert(db:put("users", "user:5", "f") == nil)
+		assert(#events == 0)
+		db:close()
+	`)
+}
+
+func TestKVWatchExpiry(t *testing.T) {
+	runKVEngineScripts(t, `
+		local kv = require("kv")
+		local plain = assert(kv.open(db_path, {sweep_interval = 0}))
+		local hashed = assert(kv.open(db_path .. ".enc", {
+			sweep_interval = 0,
+			encryption = { key = string.rep("k", 32), hash_keys = true },
+		}))
+
+		for _, db in ipairs({plain, hashed}) do
+			assert(db:open_db("sessions") == nil)
+			local events = {}
+			db:watch("sessions", "user:", function(key, old, new, op)
+				table.insert(events, table.concat({op, key, old or "-", new or "-"}, " "))
+			end)
+			assert(db:put("sessions", "user:1", "a", {ttl = 0.05}) == nil)
+			assert(db:put("sessions", "other:1", "b", {ttl = 0.05}) == nil)
+
+			local deadline = os.clock() + 0.1
+			while os.clock() < deadline do end
+
+			-- Swept keys are reported as deletes of the expired value
+			assert(db:sweep() == 2)
+			db:poll_watches(0)
+			assert(#events == 2, table.concat(events, "; "))
+			assert(events[2] == "delete user:1 a -", events[2])
+			db:close()
+		end
+	`)
+}
+
+func TestKVWatchOtherState(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	registerKVModule(L)
+	L.SetGlobal("db_path", lua.LString(filepath.Join(t.TempDir(), "test.db")))
+	if err := L.DoString(`
+		local kv = require("kv")
+		db = assert(kv.open(db_path))
+		assert(db:open_db("users") == nil)
+		events = {}
+		db:watch("users", "", function(key, old, new, op)
+			table.insert(events, op .. " " .. key)
+		end)
+		db:watch("users", "", function() error("watch failed") end)
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another state writes through the same database on its own goroutine
+	writer := lua.NewState()
+	defer writer.Close()
+	registerKVModule(writer)
+	ud := writer.NewUserData()
+	ud.Value = L.GetGlobal("db").(*lua.LUserData).Value
+	writer.SetMetatable(ud, writer.GetTypeMetatable("KVDB"))
+	writer.SetGlobal("db", ud)
+	done := make(chan error)
+	go func() {
+		done <- writer.DoString(`
+			assert(db:put("users", "user:1", "a") == nil)
+			assert(db:delete("users", "user:1") == nil)
+		`)
+	}()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes wait for the owning state, which delivers them when it polls
+	if err := L.DoString(`
+		assert(#events == 0)
+		assert(db:poll_watches(1) == 4)
+		assert(#events == 2 and events[1] == "put user:1" and events[2] == "delete user:1", table.concat(events, "; "))
+		assert(db:poll_watches(0.01) == 0)
+		db:close()
+	`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKVOpenOptions(t *testing.T) {
+	runKVScript(t, `
+		local kv = require("kv")
+		local db = assert(kv.open(db_path, { nosync = true, mode = "0640", initial_mmap_size = 1048576 }))
+		assert(db:open_db("items") == nil)
+		assert(db:put("items", "a", "1") == nil)
+
+		-- A second handle cannot take the file lock while the first is open
+		local locked, err = kv.open(db_path, { readonly = true, timeout = 0.05 })
+		assert(locked == nil and err:find("locked by another process"), err)
+
+		db:close()
+		local reader = assert(kv.open(db_path, { readonly = true, timeout = 1 }))
+		assert(reader:get("items", "a") == "1")
+		assert(reader:put("items", "b", "2") ~= nil)
+		reader:close()
+
+		local batched = assert(kv.open(db_path, { max_batch_size = 10, max_batch_delay = 0.001 }))
+		assert(batched:batch(function(txn)
+			assert(txn:put("items", "b", "2") == nil)
+			assert(txn:commit() ~= nil)
+		end) == nil)
+		assert(batched:get("items", "b") == "2")
+		assert(batched:batch(function(txn) error("failed") end):find("failed"))
+		batched:close()
+	`)
+}
+
+func TestKVEncryption(t *testing.T) {
+	runKVScript(t, `
+		local kv = require("kv")
+		local key = string.rep("k", 32)
+		local db = assert(kv.open(db_path, { encryption = { key = key } }))
+		assert(db:open_db("secrets") == nil)
+		assert(db:put("secrets", "token:1", "s3cret") == nil)
+		assert(db:put_value("secrets", "token:2", { scope = "admin" }) == nil)
+		assert(db:get("secrets", "token:1") == "s3cret")
+		assert(db:get_value("secrets", "token:2").scope == "admin")
+		assert(db:incr("secrets", "count") == 1)
+		assert(db:cas("secrets", "count", "1", "2"))
+		assert(#db:keys("secrets", "token:") == 2)
+
+		local txn = assert(db:begin_txn())
+		assert(txn:put("secrets", "token:3", "x") == nil)
+		local cursor = assert(txn:cursor("secrets"))
+		local k, v = cursor:seek("token:3")
+		assert(k == "token:3" and v == "x")
+		assert(txn:commit() == nil)
+
+		local collected = {}
+		for k, v in db:range("secrets", { prefix = "token:" }) do collected[k] = v end
+		assert(collected["token:1"] == "s3cret" and collected["token:3"] == "x")
+		db:close()
+
+		-- Values are not stored in the clear
+		local raw = assert(io.open(db_path, "rb")):read("*a")
+		assert(not raw:find("s3cret", 1, true))
+
+		local _, err = kv.open(db_path)
+		assert(err and err:find("encrypted"), err)
+		local _, err = kv.open(db_path, { encryption = { key = string.rep("x", 32) } })
+		assert(err == "wrong encryption key", err)
+
+		-- Rotate from a raw key to a passphrase, hashing keys as well
+		db = assert(kv.open(db_path, { encryption = { key = key } }))
+		assert(db:rotate_key({ passphrase = "correct horse", iterations = 1000, hash_keys = true }) == nil)
+		assert(db:get("secrets", "token:1") == "s3cret")
+		local _, err = db:keys("secrets", "token:")
+		assert(err and err:find("hashed"), err)
+		local keys = db:keys("secrets")
+		table.sort(keys)
+		assert(table.concat(keys, ",") == "count,token:1,token:2,token:3", table.concat(keys, ","))
+		db:close()
+
+		local _, err = kv.open(db_path, { encryption = { key = key } })
+		assert(err and err:find("passphrase"), err)
+		db = assert(kv.open(db_path, { encryption = { passphrase = "correct horse" } }))
+		assert(db:get("secrets", "token:3") == "x")
+		assert(db:delete("secrets", "token:3") == nil)
+		assert(db:get("secrets", "token:3") == nil)
+		db:close()
+
+		raw = assert(io.open(db_path, "rb")):read("*a")
+		assert(not raw:find("token:1", 1, true))
+	`)
+}
+
+func TestKVPBKDF2(t *testing.T) {
+	tests := []struct {
+		iterations int
+		expected   string
+	}{
+		{1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+	}
+	for _, tt := range tests {
+		key := kvPBKDF2([]byte("password"), []byte("salt"), tt.iterations)
+		if got := hex.EncodeToString(key); got != tt.expected {
+			t.Errorf("kvPBKDF2(%d) = %s, want %s", tt.iterations, got, tt.expected)
+		}
+	}
+}
+
+func TestKVMemoryEngine(t *testing.T) {
+	runKVScript(t, `
+		local kv = require("kv")
+		local db = assert(kv.open(db_path, {engine = "memory"}))
+		assert(db:open_db("items") == nil)
+		assert(db:put("items", "a", "1") == nil)
+
+		-- Read transactions keep the snapshot they started with
+		local rtx = assert(db:begin_txn(true))
+		assert(db:put("items", "a", "2") == nil)
+		assert(db:put("items", "b", "3") == nil)
+		assert(rtx:get("items", "a") == "1")
+		assert(rtx:get("items", "b") == nil)
+		assert(rtx:abort() == nil)
+		assert(db:get("items", "a") == "2")
+
+		-- Cursors survive deletes made through them
+		local txn = assert(db:begin_txn())
+		local c = assert(txn:cursor("items"))
+		assert(c:first() == "a")
+		assert(c:delete() == nil)
+		assert(c:next() == "b")
+		assert(txn:commit() == nil)
+		assert(#db:keys("items") == 1)
+
+		local _, err = db:backup(db_path .. ".bak")
+		assert(err == "backups are not supported by this storage engine", err)
+		_, err = kv.compact(db, db_path .. ".compact")
+		assert(err == "compaction is only supported by the bbolt engine", err)
+		db:close()
+
+		-- Nothing is written to disk
+		assert(io.open(db_path, "rb") == nil)
+		db = assert(kv.open(db_path, {engine = "memory"}))
+		assert(#db:buckets() == 0)
+		db:close()
+
+		_, err = kv.open(db_path, {engine = "nope"})
+		assert(err and err:find("unknown kv engine nope"), err)
+	`)
+}
+
+func TestKVImportCollection(t *testing.T) {
+	runKVScript(t, `
+		local kv = require("kv")
+		local export_path = db_path .. ".jsonl"
+		local src = assert(kv.open(db_path))
+		local users = assert(kv.collection(src, "users", {indexes = {"email"}}))
+		assert(users:insert({id = "a", email = "alice@example.com"}))
+		assert(users:insert({id = "b", email = "bob@example.com"}))
+		assert(src:export(export_path, {buckets = {"users"}}) == 2)
+		src:close()
+
+		-- Indexes of open collections are rebuilt by the import
+		local dst = assert(kv.open(db_path .. ".merge"))
+		local copy = assert(kv.collection(dst, "users", {indexes = {"email"}}))
+		assert(copy:insert({id = "b", email = "old@example.com"}))
+		assert(dst:import(export_path) == 2)
+		assert(#copy:find({email = "old@example.com"}) == 0)
+		local found = copy:find({email = "bob@example.com"})
+		assert(#found == 1 and found[1].id == "b")
+		assert(#copy:find({email = "alice@example.com"}) == 1)
+		dst:close()
+
+		-- Others are rebuilt when the collection is opened again
+		dst = assert(kv.open(db_path .. ".merge"))
+		copy = assert(kv.collection(dst, "users", {indexes = {"email"}}))
+		assert(copy:delete("b") == nil)
+		assert(copy:insert({id = "b", email = "new@example.com"}))
+		dst:close()
+		dst = assert(kv.open(db_path .. ".merge"))
+		assert(dst:import(export_path, {mode = "replace"}) == 2)
+		copy = assert(kv.collection(dst, "users", {indexes = {"email"}}))
+		assert(#copy:find({email = "new@example.com"}) == 0)
+		assert(#copy:find({email = "bob@example.com"}) == 1)
+		assert(copy:count() == 2)
+		dst:close()
+	`)
+}
+
+func TestKVExportImport(t *testing.T) {
+	runKVScript(t, `
+		local kv = require("kv")
+		local export_path = db_path .. ".jsonl"
+		local src = assert(kv.open(db_path, { encryption = { key = string.rep("k", 32), hash_keys = true } }))
+		assert(src:open_db({"users", "alice"}) == nil)
+		assert(src:open_db("config") == nil)
+		assert(src:open_db("empty") == nil)
+		assert(src:put("users", "bob", "s3cret") == nil)
+		assert(src:put({"users", "alice"}, "bin", "\255\0\1") == nil)
+		assert(src:put("config", "mode", "prod") == nil)
+		assert(src:put("config", "temp", "x", { ttl = 0.01 }) == nil)
+
+		-- Exports are decrypted; expired keys and internal buckets are skipped
+		local ok = false
+		for _ = 1, 100 do
+			if src:get("config", "temp") == nil then ok = true break end
+			os.execute("sleep 0.01")
+		end
+		assert(ok)
+		assert(src:export(export_path) == 3)
+		local data = assert(io.open(export_path, "rb")):read("*a")
+		assert(data:find('"value":"s3cret"', 1, true), data)
+		assert(data:find('"encoding":"base64"', 1, true), data)
+		assert(not data:find("__hype_", 1, true), data)
+		assert(not data:find("temp", 1, true), data)
+
+		local dst = assert(kv.open(db_path .. ".copy", { engine = "memory" }))
+		assert(dst:import(export_path) == 3)
+		assert(dst:get("users", "bob") == "s3cret")
+		assert(dst:get({"users", "alice"}, "bin") == "\255\0\1")
+		assert(#dst:buckets() == 3)
+
+		-- Merging keeps other keys; replacing drops keys missing from the file
+		assert(src:export(export_path, { buckets = {"config", {"users", "alice"}} }) == 2)
+		assert(dst:put("config", "extra", "1") == nil)
+		assert(dst:put({"users", "alice"}, "extra", "1") == nil)
+		assert(dst:import(export_path, { mode = "merge" }) == 2)
+		assert(dst:get("config", "extra") == "1")
+		assert(dst:import(export_path, { mode = "replace" }) == 2)
+		assert(dst:get("config", "extra") == nil)
+		assert(dst:get({"users", "alice"}, "extra") == nil)
+		assert(dst:get({"users", "alice"}, "bin") == "\255\0\1")
+		assert(dst:get("users", "bob") == "s3cret")
+
+		local _, err = src:export(export_path, { buckets = {"missing"} })
+		assert(err == "bucket missing does not exist", err)
+		assert(io.open(export_path, "rb") == nil)
+
+		local f = assert(io.open(export_path, "wb"))
+		f:write('{"bucket":["config"],"key":"mode","value":"dev"}\n{"bucket":["__hype_ttl"]}\n')
+		f:close()
+		_, err = dst:import(export_path)
+		assert(err and err:find("line 2: bucket __hype_ttl is internal"), err)
+		assert(dst:get("config", "mode") == "prod")
+		src:close()
+		dst:close()
+
+		_, err = dst:import(export_path)
+		assert(err == "database not open", err)
+	`)
+}
@@ -0,0 +1,527 @@
+//go:build lmdb
+
+// kv_lmdb_functions.go - LMDB storage engine for the kv module
+//
+// Built only with -tags lmdb, since it needs cgo and lmdb-go, the binding
+// used by examples/plugins/lmdb. Executables built by such a hype include
+// it too; see runtimeBuildTags.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"runtime"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+	"go.etcd.io/bbolt"
+)
+
+// kvDefaultLMDBMapSize is the map size used without initial_mmap_size;
+// LMDB databases cannot grow beyond it
+const kvDefaultLMDBMapSize = 1 << 30
+
+func init() {
+	kvEngines["lmdb"] = kvOpenLMDBEngine
+}
+
+// Nested buckets are flattened into the root database. A bucket's prefix
+// is, for each name on its path, kvLMDBBucketSep, the name's length and the
+// name. Its entries are stored under prefix + kvLMDBEntrySep + key, so they
+// sort together and before the contents of its sub-buckets. Each value is
+// tagged: kvLMDBValueRecord precedes data, and kvLMDBBucketRecord precedes
+// the sequence of a sub-bucket.
+const (
+	kvLMDBEntrySep  = 0x00
+	kvLMDBBucketSep = 0x01
+
+	kvLMDBValueRecord  = 0x00
+	kvLMDBBucketRecord = 0x01
+)
+
+type kvLMDBEngine struct {
+	env      *lmdb.Env
+	path     string
+	readonly bool
+}
+
+type kvLMDBTx struct {
+	engine   *kvLMDBEngine
+	txn      *lmdb.Txn
+	dbi      lmdb.DBI
+	writable bool
+	managed  bool
+	done     bool
+	commits  []func()
+}
+
+type kvLMDBBucket struct {
+	tx     *kvLMDBTx
+	prefix []byte
+	marker []byte // key holding the bucket's sequence in its parent
+}
+
+// kvLMDBCursor keeps its position as a key and seeks on every move, so it
+// needs no LMDB cursor to be closed and survives writes to the bucket
+type kvLMDBCursor struct {
+	bucket *kvLMDBBucket
+	key    []byte
+}
+
+func kvOpenLMDBEngine(path string, opts KVEngineOptions) (KVEngine, error) {
+	env, err := lmdb.NewEnv()
+	if err != nil {
+		return nil, err
+	}
+	mapSize := int64(kvDefaultLMDBMapSize)
+	if opts.InitialMmapSize > 0 {
+		mapSize = int64(opts.InitialMmapSize)
+	}
+	if err := env.SetMapSize(mapSize); err != nil {
+		env.Close()
+		return nil, err
+	}
+
+	// NoTLS lets read transactions move between goroutines, as Lua
+	// scripts hold them across calls
+	flags := uint(lmdb.NoSubdir | lmdb.NoTLS)
+	if opts.ReadOnly {
+		flags |= lmdb.Readonly
+	}
+	if opts.NoSync {
+		flags |= lmdb.NoSync
+	}
+	if err := env.Open(path, flags, opts.Mode); err != nil {
+		env.Close()
+		return nil, err
+	}
+	return &kvLMDBEngine{env: env, path: path, readonly: opts.ReadOnly}, nil
+}
+
+func (e *kvLMDBEngine) Begin(writable bool) (KVEngineTx, error) {
+	flags := uint(lmdb.Readonly)
+	if writable {
+		if e.readonly {
+			return nil, bbolt.ErrDatabaseReadOnly
+		}
+		// Write transactions must stay on the thread that began them
+		runtime.LockOSThread()
+		flags = 0
+	}
+
+	txn, err := e.env.BeginTxn(nil, flags)
+	if err != nil {
+		if writable {
+			runtime.UnlockOSThread()
+		}
+		return nil, err
+	}
+	dbi, err := txn.OpenRoot(0)
+	if err != nil {
+		txn.Abort()
+		if writable {
+			runtime.UnlockOSThread()
+		}
+		return nil, err
+	}
+	return &kvLMDBTx{engine: e, txn: txn, dbi: dbi, writable: writable}, nil
+}
+
+// managed runs fn in a transaction that is committed when fn succeeds
+func (e *kvLMDBEngine) managed(writable bool, fn func(KVEngineTx) error) error {
+	t, err := e.Begin(writable)
+	if err != nil {
+		return err
+	}
+	tx := t.(*kvLMDBTx)
+	tx.managed = true
+	defer func() {
+		if !tx.done {
+			tx.managed = false
+			tx.Rollback()
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	tx.managed = false
+	if !writable {
+		return tx.Rollback()
+	}
+	return tx.Commit()
+}
+
+func (e *kvLMDBEngine) Update(fn func(KVEngineTx) error) error { return e.managed(true, fn) }
+func (e *kvLMDBEngine) View(fn func(KVEngineTx) error) error   { return e.managed(false, fn) }
+func (e *kvLMDBEngine) Batch(fn func(KVEngineTx) error) error  { return e.managed(true, fn) }
+
+func (e *kvLMDBEngine) Path() string     { return e.path }
+func (e *kvLMDBEngine) IsReadOnly() bool { return e.readonly }
+func (e *kvLMDBEngine) Close() error     { return e.env.Close() }
+
+// kvLMDBChildPrefix returns the prefix of the sub-bucket name of prefix
+func kvLMDBChildPrefix(prefix, name []byte) []byte {
+	child := append([]byte(nil), prefix...)
+	child = append(child, kvLMDBBucketSep)
+	child = binary.AppendUvarint(child, uint64(len(name)))
+	return append(child, name...)
+}
+
+// kvLMDBEntryKey returns the stored key of key within the bucket at prefix
+func kvLMDBEntryKey(prefix, key []byte) []byte {
+	entry := make([]byte, 0, len(prefix)+1+len(key))
+	entry = append(entry, prefix...)
+	entry = append(entry, kvLMDBEntrySep)
+	return append(entry, key...)
+}
+
+func (t *kvLMDBTx) checkWritable() error {
+	if t.done {
+		return bbolt.ErrTxClosed
+	}
+	if !t.writable {
+		return bbolt.ErrTxNotWritable
+	}
+	return nil
+}
+
+// get returns the stored record of key, or nil
+func (t *kvLMDBTx) get(key []byte) []byte {
+	if t.done {
+		return nil
+	}
+	record, err := t.txn.Get(t.dbi, key)
+	if err != nil {
+		return nil
+	}
+	return record
+}
+
+func (t *kvLMDBTx) put(key, record []byte) error {
+	if len(key) > t.engine.env.MaxKeySize() {
+		return bbolt.ErrKeyTooLarge
+	}
+	return t.txn.Put(t.dbi, key, record, 0)
+}
+
+// seek returns the first stored record at or after key, in the given
+// direction when not found exactly
+func (t *kvLMDBTx) seek(key []byte, reverse bool) ([]byte, []byte) {
+	if t.done {
+		return nil, nil
+	}
+	cursor, err := t.txn.OpenCursor(t.dbi)
+	if err != nil {
+		return nil, nil
+	}
+	defer cursor.Close()
+
+	k, v, err := cursor.Get(key, nil, lmdb.SetRange)
+	if reverse {
+		if lmdb.IsNotFound(err) {
+			k, v, err = cursor.Get(nil, nil, lmdb.Last)
+		} else if err == nil {
+			k, v, err = cursor.Get(nil, nil, lmdb.Prev)
+		}
+	}
+	if err != nil {
+		return nil, nil
+	}
+	return k, v
+}
+
+// deleteRange removes every stored key starting with prefix
+func (t *kvLMDBTx) deleteRange(prefix []byte) error {
+	cursor, err := t.txn.OpenCursor(t.dbi)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+
+	k, _, err := cursor.Get(prefix, nil, lmdb.SetRange)
+	for err == nil && bytes.HasPrefix(k, prefix) {
+		if err = cursor.Del(0); err != nil {
+			return err
+		}
+		k, _, err = cursor.Get(prefix, nil, lmdb.SetRange)
+	}
+	if err != nil && !lmdb.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// bucket returns the sub-bucket name of the bucket at prefix, or nil
+func (t *kvLMDBTx) bucket(prefix, name []byte) KVEngineBucket {
+	marker := kvLMDBEntryKey(prefix, name)
+	record := t.get(marker)
+	if len(record) == 0 || record[0] != kvLMDBBucketRecord {
+		return nil
+	}
+	return &kvLMDBBucket{tx: t, prefix: kvLMDBChildPrefix(prefix, name), marker: marker}
+}
+
+func (t *kvLMDBTx) createBucket(prefix, name []byte, mustCreate bool) (KVEngineBucket, error) {
+	if err := t.checkWritable(); err != nil {
+		return nil, err
+	}
+	if len(name) == 0 {
+		return nil, bbolt.ErrBucketNameRequired
+	}
+	marker := kvLMDBEntryKey(prefix, name)
+	if record := t.get(marker); record != nil {
+		if record[0] != kvLMDBBucketRecord {
+			return nil, bbolt.ErrIncompatibleValue
+		}
+		if mustCreate {
+			return nil, bbolt.ErrBucketExists
+		}
+	} else {
+		record = make([]byte, 9)
+		record[0] = kvLMDBBucketRecord
+		if err := t.put(marker, record); err != nil {
+			return nil, err
+		}
+	}
+	return &kvLMDBBucket{tx: t, prefix: kvLMDBChildPrefix(prefix, name), marker: marker}, nil
+}
+
+func (t *kvLMDBTx) deleteBucket(prefix, name []byte) error {
+	if err := t.checkWritable(); err != nil {
+		return err
+	}
+	marker := kvLMDBEntryKey(prefix, name)
+	record := t.get(marker)
+	if record == nil {
+		return bbolt.ErrBucketNotFound
+	}
+	if record[0] != kvLMDBBucketRecord {
+		return bbolt.ErrIncompatibleValue
+	}
+	if err := t.txn.Del(t.dbi, marker, nil); err != nil {
+		return err
+	}
+	return t.deleteRange(kvLMDBChildPrefix(prefix, name))
+}
+
+func (t *kvLMDBTx) Engine() KVEngine { return t.engine }
+func (t *kvLMDBTx) Writable() bool   { return t.writable }
+
+func (t *kvLMDBTx) Bucket(name []byte) KVEngineBucket {
+	return t.bucket(nil, name)
+}
+
+func (t *kvLMDBTx) CreateBucket(name []byte) (KVEngineBucket, error) {
+	return t.createBucket(nil, name, true)
+}
+
+func (t *kvLMDBTx) CreateBucketIfNotExists(name []byte) (KVEngineBucket, error) {
+	return t.createBucket(nil, name, false)
+}
+
+func (t *kvLMDBTx) DeleteBucket(name []byte) error {
+	return t.deleteBucket(nil, name)
+}
+
+func (t *kvLMDBTx) ForEach(fn func(name []byte, b KVEngineBucket) error) error {
+	if t.done {
+		return bbolt.ErrTxClosed
+	}
+	root := &kvLMDBBucket{tx: t}
+	return root.ForEachBucket(func(name []byte) error {
+		return fn(name, t.bucket(nil, name))
+	})
+}
+
+func (t *kvLMDBTx) OnCommit(fn func()) { t.commits = append(t.commits, fn) }
+
+// end finishes the transaction and releases the thread of a writer
+func (t *kvLMDBTx) end() {
+	t.done = true
+	if t.writable {
+		runtime.UnlockOSThread()
+	}
+}
+
+func (t *kvLMDBTx) Commit() error {
+	if t.managed {
+		return kvErrManagedEngineTx
+	}
+	if err := t.checkWritable(); err != nil {
+		return err
+	}
+	err := t.txn.Commit()
+	t.end()
+	if err != nil {
+		return err
+	}
+
+	for _, fn := range t.commits {
+		fn()
+	}
+	return nil
+}
+
+func (t *kvLMDBTx) Rollback() error {
+	if t.managed {
+		return kvErrManagedEngineTx
+	}
+	if t.done {
+		return bbolt.ErrTxClosed
+	}
+	t.txn.Abort()
+	t.end()
+	return nil
+}
+
+// entryPrefix is the common prefix of the bucket's stored keys
+func (b *kvLMDBBucket) entryPrefix() []byte {
+	return kvLMDBEntryKey(b.prefix, nil)
+}
+
+func (b *kvLMDBBucket) Tx() KVEngineTx { return b.tx }
+
+func (b *kvLMDBBucket) Get(key []byte) []byte {
+	record := b.tx.get(kvLMDBEntryKey(b.prefix, key))
+	if len(record) == 0 || record[0] != kvLMDBValueRecord {
+		return nil
+	}
+	return record[1:]
+}
+
+func (b *kvLMDBBucket) Put(key, value []byte) error {
+	if err := b.tx.checkWritable(); err != nil {
+		return err
+	}
+	if len(key) == 0 {
+		return bbolt.ErrKeyRequired
+	}
+	entry := kvLMDBEntryKey(b.prefix, key)
+	if record := b.tx.get(entry); len(record) > 0 && record[0] == kvLMDBBucketRecord {
+		return bbolt.ErrIncompatibleValue
+	}
+	record := make([]byte, 0, 1+len(value))
+	record = append(record, kvLMDBValueRecord)
+	return b.tx.put(entry, append(record, value...))
+}
+
+func (b *kvLMDBBucket) Delete(key []byte) error {
+	if err := b.tx.checkWritable(); err != nil {
+		return err
+	}
+	entry := kvLMDBEntryKey(b.prefix, key)
+	record := b.tx.get(entry)
+	if record == nil {
+		return nil
+	}
+	if record[0] == kvLMDBBucketRecord {
+		return bbolt.ErrIncompatibleValue
+	}
+	return b.tx.txn.Del(b.tx.dbi, entry, nil)
+}
+
+func (b *kvLMDBBucket) Bucket(name []byte) KVEngineBucket {
+	return b.tx.bucket(b.prefix, name)
+}
+
+func (b *kvLMDBBucket) CreateBucketIfNotExists(name []byte) (KVEngineBucket, error) {
+	return b.tx.createBucket(b.prefix, name, false)
+}
+
+func (b *kvLMDBBucket) DeleteBucket(name []byte) error {
+	return b.tx.deleteBucket(b.prefix, name)
+}
+
+func (b *kvLMDBBucket) ForEach(fn func(k, v []byte) error) error {
+	if b.tx.done {
+		return bbolt.ErrTxClosed
+	}
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *kvLMDBBucket) ForEachBucket(fn func(name []byte) error) error {
+	return b.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return nil
+		}
+		return fn(k)
+	})
+}
+
+func (b *kvLMDBBucket) Cursor() KVEngineCursor {
+	return &kvLMDBCursor{bucket: b}
+}
+
+func (b *kvLMDBBucket) NextSequence() (uint64, error) {
+	if err := b.tx.checkWritable(); err != nil {
+		return 0, err
+	}
+	record := b.tx.get(b.marker)
+	if len(record) != 9 {
+		return 0, bbolt.ErrBucketNotFound
+	}
+	seq := binary.BigEndian.Uint64(record[1:]) + 1
+	next := make([]byte, 9)
+	next[0] = kvLMDBBucketRecord
+	binary.BigEndian.PutUint64(next[1:], seq)
+	return seq, b.tx.put(b.marker, next)
+}
+
+// position decodes a stored record of the bucket and moves the cursor to it
+func (c *kvLMDBCursor) position(stored, record []byte) ([]byte, []byte) {
+	prefix := c.bucket.entryPrefix()
+	if stored == nil || !bytes.HasPrefix(stored, prefix) || len(record) == 0 {
+		c.key = nil
+		return nil, nil
+	}
+	c.key = stored[len(prefix):]
+	if record[0] == kvLMDBBucketRecord {
+		return c.key, nil
+	}
+	return c.key, record[1:]
+}
+
+func (c *kvLMDBCursor) Bucket() KVEngineBucket { return c.bucket }
+
+func (c *kvLMDBCursor) First() ([]byte, []byte) {
+	return c.position(c.bucket.tx.seek(c.bucket.entryPrefix(), false))
+}
+
+func (c *kvLMDBCursor) Last() ([]byte, []byte) {
+	// Entries end where the contents of sub-buckets begin
+	end := append([]byte(nil), c.bucket.prefix...)
+	end = append(end, kvLMDBBucketSep)
+	return c.position(c.bucket.tx.seek(end, true))
+}
+
+func (c *kvLMDBCursor) Next() ([]byte, []byte) {
+	if c.key == nil {
+		return c.position(nil, nil)
+	}
+	after := append(kvLMDBEntryKey(c.bucket.prefix, c.key), 0x00)
+	return c.position(c.bucket.tx.seek(after, false))
+}
+
+func (c *kvLMDBCursor) Prev() ([]byte, []byte) {
+	if c.key == nil {
+		return c.position(nil, nil)
+	}
+	return c.position(c.bucket.tx.seek(kvLMDBEntryKey(c.bucket.prefix, c.key), true))
+}
+
+func (c *kvLMDBCursor) Seek(seek []byte) ([]byte, []byte) {
+	return c.position(c.bucket.tx.seek(kvLMDBEntryKey(c.bucket.prefix, seek), false))
+}
+
+func (c *kvLMDBCursor) Delete() error {
+	if c.key == nil {
+		return nil
+	}
+	return c.bucket.Delete(c.key)
+}
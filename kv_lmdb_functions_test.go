@@ -0,0 +1,65 @@
+//go:build lmdb
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func init() {
+	kvTestEngines = append(kvTestEngines, "lmdb")
+}
+
+func TestKVLMDBEngine(t *testing.T) {
+	runKVScript(t, `
+		local kv = require("kv")
+		local db = assert(kv.open(db_path, {engine = "lmdb", initial_mmap_size = 1048576}))
+		assert(db:open_db({"users", "alice"}) == nil)
+		assert(db:put({"users", "alice"}, "name", "Alice") == nil)
+		assert(db:put("users", "count", "1") == nil)
+
+		-- Entries sort before sub-buckets, which are listed separately
+		local keys = db:keys("users")
+		assert(#keys == 1 and keys[1] == "count", table.concat(keys, ","))
+		local buckets = db:buckets("users")
+		assert(#buckets == 1 and buckets[1] == "alice")
+		assert(db:close() == nil)
+
+		db = assert(kv.open(db_path, {engine = "lmdb", readonly = true}))
+		assert(db:get({"users", "alice"}, "name") == "Alice")
+		assert(db:put("users", "count", "2") ~= nil)
+		db:close()
+	`)
+}
+
+func TestBuildExecutableLMDB(t *testing.T) {
+	dir := t.TempDir()
+	scriptPath := filepath.Join(dir, "lmdb.lua")
+	script := `
+		local kv = require("kv")
+		local db = assert(kv.open(arg[1], {engine = "lmdb"}))
+		assert(db:open_db("b") == nil)
+		assert(db:put("b", "k", "stored in lmdb") == nil)
+		print(db:get("b", "k"))
+		db:close()
+	`
+	if err := os.WriteFile(scriptPath, []byte(script), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	outputPath := filepath.Join(dir, "lmdb-app")
+	if err := buildExecutable(scriptPath, outputPath, "current"); err != nil {
+		t.Fatalf("buildExecutable failed: %v", err)
+	}
+	out, err := exec.Command(outputPath, filepath.Join(dir, "app.lmdb")).CombinedOutput()
+	if err != nil {
+		t.Fatalf("built executable failed: %v\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "stored in lmdb") {
+		t.Fatalf("unexpected output: %s", out)
+	}
+}
@@ -0,0 +1,553 @@
+// kv_memory_functions.go - In-memory storage engine for the kv module
+package main
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"sync"
+
+	"go.etcd.io/bbolt"
+)
+
+// kvErrManagedEngineTx mirrors bbolt, which forbids ending a managed transaction
+// from inside its function
+var kvErrManagedEngineTx = errors.New("managed tx commit or rollback not allowed")
+
+// kvMemoryEngine keeps a database in memory for tests and caches; nothing
+// is written to path and every open starts empty. Buckets are copy-on-write
+// trees: the writer clones each node it touches, so read transactions keep
+// the snapshot they began with and commit is a pointer swap.
+type kvMemoryEngine struct {
+	path     string
+	readonly bool
+
+	writer sync.Mutex // held by the open writable transaction
+
+	mu     sync.RWMutex
+	root   *kvMemNode
+	closed bool
+	nextID uint64
+}
+
+// kvMemNode is a bucket. Entries are sorted by key and hold either a value
+// or a sub-bucket. A node may only be changed in place by its owner.
+type kvMemNode struct {
+	entries []kvMemEntry
+	seq     uint64
+	owner   uint64
+}
+
+type kvMemEntry struct {
+	key    []byte
+	value  []byte
+	bucket *kvMemNode
+}
+
+type kvMemTx struct {
+	engine   *kvMemoryEngine
+	id       uint64
+	root     *kvMemNode
+	writable bool
+	managed  bool
+	done     bool
+	commits  []func()
+}
+
+// kvMemBucket finds its node by name on every access, since the node is
+// replaced when the transaction first writes to it
+type kvMemBucket struct {
+	tx     *kvMemTx
+	parent *kvMemBucket // nil for top-level buckets
+	name   []byte
+}
+
+// kvMemCursor remembers its position by key, so it stays valid when the
+// bucket is modified
+type kvMemCursor struct {
+	bucket *kvMemBucket
+	key    []byte
+}
+
+func kvOpenMemoryEngine(path string, opts KVEngineOptions) (KVEngine, error) {
+	return &kvMemoryEngine{path: path, readonly: opts.ReadOnly, root: &kvMemNode{}}, nil
+}
+
+func (e *kvMemoryEngine) Begin(writable bool) (KVEngineTx, error) {
+	if writable {
+		if e.readonly {
+			return nil, bbolt.ErrDatabaseReadOnly
+		}
+		e.writer.Lock()
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		if writable {
+			e.writer.Unlock()
+		}
+		return nil, bbolt.ErrDatabaseNotOpen
+	}
+	e.nextID++
+	return &kvMemTx{engine: e, id: e.nextID, root: e.root, writable: writable}, nil
+}
+
+// managed runs fn in a transaction that is committed when fn succeeds
+func (e *kvMemoryEngine) managed(writable bool, fn func(KVEngineTx) error) error {
+	t, err := e.Begin(writable)
+	if err != nil {
+		return err
+	}
+	tx := t.(*kvMemTx)
+	tx.managed = true
+	defer func() {
+		if !tx.done {
+			tx.managed = false
+			tx.Rollback()
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	tx.managed = false
+	if !writable {
+		return tx.Rollback()
+	}
+	return tx.Commit()
+}
+
+func (e *kvMemoryEngine) Update(fn func(KVEngineTx) error) error { return e.managed(true, fn) }
+func (e *kvMemoryEngine) View(fn func(KVEngineTx) error) error   { return e.managed(false, fn) }
+func (e *kvMemoryEngine) Batch(fn func(KVEngineTx) error) error  { return e.managed(true, fn) }
+
+func (e *kvMemoryEngine) Path() string     { return e.path }
+func (e *kvMemoryEngine) IsReadOnly() bool { return e.readonly }
+
+func (e *kvMemoryEngine) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.closed = true
+	e.root = nil
+	return nil
+}
+
+// find returns the position of key and whether it is present
+func (n *kvMemNode) find(key []byte) (int, bool) {
+	i := sort.Search(len(n.entries), func(i int) bool {
+		return bytes.Compare(n.entries[i].key, key) >= 0
+	})
+	return i, i < len(n.entries) && bytes.Equal(n.entries[i].key, key)
+}
+
+func (n *kvMemNode) insert(i int, entry kvMemEntry) {
+	n.entries = append(n.entries, kvMemEntry{})
+	copy(n.entries[i+1:], n.entries[i:])
+	n.entries[i] = entry
+}
+
+func (n *kvMemNode) remove(i int) {
+	n.entries = append(n.entries[:i], n.entries[i+1:]...)
+}
+
+func (n *kvMemNode) child(name []byte) *kvMemNode {
+	if i, ok := n.find(name); ok {
+		return n.entries[i].bucket
+	}
+	return nil
+}
+
+func (n *kvMemNode) clone(owner uint64) *kvMemNode {
+	return &kvMemNode{
+		entries: append([]kvMemEntry(nil), n.entries...),
+		seq:     n.seq,
+		owner:   owner,
+	}
+}
+
+// mutableChild returns the sub-bucket name of a node owned by tx, cloning it
+// for tx if needed
+func (n *kvMemNode) mutableChild(owner uint64, name []byte) (*kvMemNode, error) {
+	i, ok := n.find(name)
+	if !ok {
+		return nil, bbolt.ErrBucketNotFound
+	}
+	child := n.entries[i].bucket
+	if child == nil {
+		return nil, bbolt.ErrIncompatibleValue
+	}
+	if child.owner != owner {
+		child = child.clone(owner)
+		n.entries[i].bucket = child
+	}
+	return child, nil
+}
+
+// createChild adds an empty sub-bucket to a node owned by tx
+func (n *kvMemNode) createChild(owner uint64, name []byte, mustCreate bool) (*kvMemNode, error) {
+	if len(name) == 0 {
+		return nil, bbolt.ErrBucketNameRequired
+	}
+	i, ok := n.find(name)
+	if ok {
+		if n.entries[i].bucket == nil {
+			return nil, bbolt.ErrIncompatibleValue
+		}
+		if mustCreate {
+			return nil, bbolt.ErrBucketExists
+		}
+		return n.mutableChild(owner, name)
+	}
+	child := &kvMemNode{owner: owner}
+	n.insert(i, kvMemEntry{key: append([]byte(nil), name...), bucket: child})
+	return child, nil
+}
+
+func (n *kvMemNode) deleteChild(name []byte) error {
+	i, ok := n.find(name)
+	if !ok {
+		return bbolt.ErrBucketNotFound
+	}
+	if n.entries[i].bucket == nil {
+		return bbolt.ErrIncompatibleValue
+	}
+	n.remove(i)
+	return nil
+}
+
+// checkWritable reports why the transaction cannot be written to
+func (t *kvMemTx) checkWritable() error {
+	if t.done {
+		return bbolt.ErrTxClosed
+	}
+	if !t.writable {
+		return bbolt.ErrTxNotWritable
+	}
+	return nil
+}
+
+func (t *kvMemTx) mutableRoot() *kvMemNode {
+	if t.root.owner != t.id {
+		t.root = t.root.clone(t.id)
+	}
+	return t.root
+}
+
+func (t *kvMemTx) Engine() KVEngine { return t.engine }
+func (t *kvMemTx) Writable() bool   { return t.writable }
+
+func (t *kvMemTx) Bucket(name []byte) KVEngineBucket {
+	if t.done || t.root.child(name) == nil {
+		return nil
+	}
+	return &kvMemBucket{tx: t, name: append([]byte(nil), name...)}
+}
+
+func (t *kvMemTx) createBucket(name []byte, mustCreate bool) (KVEngineBucket, error) {
+	if err := t.checkWritable(); err != nil {
+		return nil, err
+	}
+	if _, err := t.mutableRoot().createChild(t.id, name, mustCreate); err != nil {
+		return nil, err
+	}
+	return &kvMemBucket{tx: t, name: append([]byte(nil), name...)}, nil
+}
+
+func (t *kvMemTx) CreateBucket(name []byte) (KVEngineBucket, error) {
+	return t.createBucket(name, true)
+}
+
+func (t *kvMemTx) CreateBucketIfNotExists(name []byte) (KVEngineBucket, error) {
+	return t.createBucket(name, false)
+}
+
+func (t *kvMemTx) DeleteBucket(name []byte) error {
+	if err := t.checkWritable(); err != nil {
+		return err
+	}
+	if t.root.child(name) == nil {
+		return t.root.deleteChild(name)
+	}
+	return t.mutableRoot().deleteChild(name)
+}
+
+func (t *kvMemTx) ForEach(fn func(name []byte, b KVEngineBucket) error) error {
+	if t.done {
+		return bbolt.ErrTxClosed
+	}
+	for _, entry := range append([]kvMemEntry(nil), t.root.entries...) {
+		if err := fn(entry.key, &kvMemBucket{tx: t, name: entry.key}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *kvMemTx) OnCommit(fn func()) { t.commits = append(t.commits, fn) }
+
+func (t *kvMemTx) Commit() error {
+	if t.managed {
+		return kvErrManagedEngineTx
+	}
+	if err := t.checkWritable(); err != nil {
+		return err
+	}
+	t.done = true
+
+	e := t.engine
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		e.writer.Unlock()
+		return bbolt.ErrDatabaseNotOpen
+	}
+	e.root = t.root
+	e.mu.Unlock()
+	e.writer.Unlock()
+
+	for _, fn := range t.commits {
+		fn()
+	}
+	return nil
+}
+
+func (t *kvMemTx) Rollback() error {
+	if t.managed {
+		return kvErrManagedEngineTx
+	}
+	if t.done {
+		return bbolt.ErrTxClosed
+	}
+	t.done = true
+	if t.writable {
+		t.engine.writer.Unlock()
+	}
+	return nil
+}
+
+// node returns the bucket's current node, or nil once it has been deleted
+func (b *kvMemBucket) node() *kvMemNode {
+	if b.tx.done {
+		return nil
+	}
+	parent := b.tx.root
+	if b.parent != nil {
+		parent = b.parent.node()
+	}
+	if parent == nil {
+		return nil
+	}
+	return parent.child(b.name)
+}
+
+// mutable returns the bucket's node, cloned for the transaction
+func (b *kvMemBucket) mutable() (*kvMemNode, error) {
+	if err := b.tx.checkWritable(); err != nil {
+		return nil, err
+	}
+	parent := b.tx.mutableRoot()
+	if b.parent != nil {
+		var err error
+		if parent, err = b.parent.mutable(); err != nil {
+			return nil, err
+		}
+	}
+	return parent.mutableChild(b.tx.id, b.name)
+}
+
+func (b *kvMemBucket) Tx() KVEngineTx { return b.tx }
+
+func (b *kvMemBucket) Get(key []byte) []byte {
+	node := b.node()
+	if node == nil {
+		return nil
+	}
+	if i, ok := node.find(key); ok {
+		return node.entries[i].value
+	}
+	return nil
+}
+
+func (b *kvMemBucket) Put(key, value []byte) error {
+	if len(key) == 0 {
+		return bbolt.ErrKeyRequired
+	}
+	if len(key) > bbolt.MaxKeySize {
+		return bbolt.ErrKeyTooLarge
+	}
+	if int64(len(value)) > bbolt.MaxValueSize {
+		return bbolt.ErrValueTooLarge
+	}
+	node, err := b.mutable()
+	if err != nil {
+		return err
+	}
+
+	value = append(make([]byte, 0, len(value)), value...)
+	i, ok := node.find(key)
+	if ok {
+		if node.entries[i].bucket != nil {
+			return bbolt.ErrIncompatibleValue
+		}
+		node.entries[i].value = value
+		return nil
+	}
+	node.insert(i, kvMemEntry{key: append([]byte(nil), key...), value: value})
+	return nil
+}
+
+func (b *kvMemBucket) Delete(key []byte) error {
+	node, err := b.mutable()
+	if err != nil {
+		return err
+	}
+	i, ok := node.find(key)
+	if !ok {
+		return nil
+	}
+	if node.entries[i].bucket != nil {
+		return bbolt.ErrIncompatibleValue
+	}
+	node.remove(i)
+	return nil
+}
+
+func (b *kvMemBucket) Bucket(name []byte) KVEngineBucket {
+	node := b.node()
+	if node == nil || node.child(name) == nil {
+		return nil
+	}
+	return &kvMemBucket{tx: b.tx, parent: b, name: append([]byte(nil), name...)}
+}
+
+func (b *kvMemBucket) CreateBucketIfNotExists(name []byte) (KVEngineBucket, error) {
+	node, err := b.mutable()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := node.createChild(b.tx.id, name, false); err != nil {
+		return nil, err
+	}
+	return &kvMemBucket{tx: b.tx, parent: b, name: append([]byte(nil), name...)}, nil
+}
+
+func (b *kvMemBucket) DeleteBucket(name []byte) error {
+	node, err := b.mutable()
+	if err != nil {
+		return err
+	}
+	return node.deleteChild(name)
+}
+
+func (b *kvMemBucket) ForEach(fn func(k, v []byte) error) error {
+	if b.tx.done {
+		return bbolt.ErrTxClosed
+	}
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *kvMemBucket) ForEachBucket(fn func(name []byte) error) error {
+	return b.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return nil
+		}
+		return fn(k)
+	})
+}
+
+func (b *kvMemBucket) Cursor() KVEngineCursor {
+	return &kvMemCursor{bucket: b}
+}
+
+func (b *kvMemBucket) NextSequence() (uint64, error) {
+	node, err := b.mutable()
+	if err != nil {
+		return 0, err
+	}
+	node.seq++
+	return node.seq, nil
+}
+
+// move positions the cursor on entry i of node
+func (c *kvMemCursor) move(node *kvMemNode, i int) ([]byte, []byte) {
+	if node == nil || i < 0 || i >= len(node.entries) {
+		c.key = nil
+		return nil, nil
+	}
+	entry := node.entries[i]
+	c.key = entry.key
+	if entry.bucket != nil {
+		return entry.key, nil
+	}
+	return entry.key, entry.value
+}
+
+func (c *kvMemCursor) Bucket() KVEngineBucket { return c.bucket }
+
+func (c *kvMemCursor) First() ([]byte, []byte) {
+	return c.move(c.bucket.node(), 0)
+}
+
+func (c *kvMemCursor) Last() ([]byte, []byte) {
+	node := c.bucket.node()
+	if node == nil {
+		return c.move(nil, 0)
+	}
+	return c.move(node, len(node.entries)-1)
+}
+
+func (c *kvMemCursor) Next() ([]byte, []byte) {
+	node := c.bucket.node()
+	if node == nil || c.key == nil {
+		return c.move(nil, 0)
+	}
+	i, ok := node.find(c.key)
+	if ok {
+		i++
+	}
+	return c.move(node, i)
+}
+
+func (c *kvMemCursor) Prev() ([]byte, []byte) {
+	node := c.bucket.node()
+	if node == nil || c.key == nil {
+		return c.move(nil, 0)
+	}
+	i, _ := node.find(c.key)
+	return c.move(node, i-1)
+}
+
+func (c *kvMemCursor) Seek(seek []byte) ([]byte, []byte) {
+	node := c.bucket.node()
+	if node == nil {
+		return c.move(nil, 0)
+	}
+	i, _ := node.find(seek)
+	return c.move(node, i)
+}
+
+func (c *kvMemCursor) Delete() error {
+	if c.key == nil {
+		return nil
+	}
+	node, err := c.bucket.mutable()
+	if err != nil {
+		return err
+	}
+	i, ok := node.find(c.key)
+	if !ok {
+		return nil
+	}
+	if node.entries[i].bucket != nil {
+		return bbolt.ErrIncompatibleValue
+	}
+	node.remove(i)
+	return nil
+}
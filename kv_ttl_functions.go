@@ -0,0 +1,284 @@
+// kv_ttl_functions.go - Expiring keys for the kv module
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// kvInternalPrefix marks top-level buckets used by the kv module itself
+const kvInternalPrefix = "__hype_"
+
+// kvTTLBucket holds expiry metadata. It has one nested bucket per data
+// bucket, named by kvTTLName, mapping each key to its expiry time in Unix
+// nanoseconds.
+var kvTTLBucket = []byte(kvInternalPrefix + "ttl")
+
+// kvDefaultSweepInterval is how often expired keys are deleted in the background
+const kvDefaultSweepInterval = time.Minute
+
+// kvTTLName returns the metadata bucket name for a bucket path. Each name
+// on the path is preceded by its length as a uvarint, so bucket names can
+// hold any bytes and still decode to the same path.
+func kvTTLName(path [][]byte) []byte {
+	var name []byte
+	for _, part := range path {
+		name = binary.AppendUvarint(name, uint64(len(part)))
+		name = append(name, part...)
+	}
+	return name
+}
+
+// kvTTLPath decodes a metadata bucket name, returning nil if it is malformed
+func kvTTLPath(name []byte) [][]byte {
+	var path [][]byte
+	for len(name) > 0 {
+		n, read := binary.Uvarint(name)
+		if read <= 0 || uint64(len(name)-read) < n {
+			return nil
+		}
+		path = append(path, name[read:read+int(n)])
+		name = name[read+int(n):]
+	}
+	return path
+}
+
+// kvPutOptions reads the optional {ttl = seconds} table passed to put
+func kvPutOptions(L *lua.LState, n int) time.Duration {
+	opts := L.OptTable(n, nil)
+	if opts == nil {
+		return 0
+	}
+	ttl, ok := opts.RawGetString("ttl").(lua.LNumber)
+	if !ok {
+		return 0
+	}
+	if ttl <= 0 {
+		L.ArgError(n, "ttl must be positive")
+	}
+	return time.Duration(float64(ttl) * float64(time.Second))
+}
+
+// kvSetExpiry records when key expires, or clears its expiry if ttl is zero
+func kvSetExpiry(tx KVEngineTx, path [][]byte, key []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		root := tx.Bucket(kvTTLBucket)
+		if root == nil {
+			return nil
+		}
+		meta := root.Bucket(kvTTLName(path))
+		if meta == nil {
+			return nil
+		}
+		return meta.Delete(key)
+	}
+
+	meta, err := kvCreateBucket(tx, [][]byte{kvTTLBucket, kvTTLName(path)})
+	if err != nil {
+		return err
+	}
+	expiry := make([]byte, 8)
+	binary.BigEndian.PutUint64(expiry, uint64(time.Now().Add(ttl).UnixNano()))
+	return meta.Put(key, expiry)
+}
+
+// kvClearExpiries drops the expiry metadata of a bucket
+func kvClearExpiries(tx KVEngineTx, path [][]byte) error {
+	root := tx.Bucket(kvTTLBucket)
+	if root == nil || root.Bucket(kvTTLName(path)) == nil {
+		return nil
+	}
+	return root.DeleteBucket(kvTTLName(path))
+}
+
+// kvExpiryFunc returns a function reporting whether a key of the bucket has
+// expired. Expired keys are hidden from reads until the sweeper removes them.
+func kvExpiryFunc(tx KVEngineTx, path [][]byte) func(key []byte) bool {
+	var meta KVEngineBucket
+	if root := tx.Bucket(kvTTLBucket); root != nil {
+		meta = root.Bucket(kvTTLName(path))
+	}
+	if meta == nil {
+		return func([]byte) bool { return false }
+	}
+
+	now := uint64(time.Now().UnixNano())
+	return func(key []byte) bool {
+		expiry := meta.Get(key)
+		return len(expiry) == 8 && binary.BigEndian.Uint64(expiry) <= now
+	}
+}
+
+// kvPutEntry stores a value and updates its expiry in one transaction.
+// Values of encrypted databases are sealed here.
+func kvPutEntry(tx KVEngineTx, path [][]byte, key, value []byte, ttl time.Duration) error {
+	bucket := kvBucket(tx, path)
+	if bucket == nil {
+		return kvBucketNotFound(path)
+	}
+	stored, sealed, err := kvCipherFor(tx).seal(path, key, value)
+	if err != nil {
+		return err
+	}
+	notify := kvObserve(bucket, path, key)
+	if err := bucket.Put(stored, sealed); err != nil {
+		return err
+	}
+	if notify != nil {
+		notify(value)
+	}
+	return kvSetExpiry(tx, path, stored, ttl)
+}
+
+// kvGetEntry reads a value, treating expired keys as missing
+func kvGetEntry(tx KVEngineTx, path [][]byte, key []byte) ([]byte, error) {
+	bucket := kvBucket(tx, path)
+	if bucket == nil {
+		return nil, kvBucketNotFound(path)
+	}
+	c := kvCipherFor(tx)
+	stored := c.storeKey(path, key)
+	value := bucket.Get(stored)
+	if value == nil || kvExpiryFunc(tx, path)(stored) {
+		return nil, nil
+	}
+	_, value, err := c.open(path, stored, value)
+	return value, err
+}
+
+// kvDeleteEntry removes a value along with its expiry
+func kvDeleteEntry(tx KVEngineTx, path [][]byte, key []byte) error {
+	bucket := kvBucket(tx, path)
+	if bucket == nil {
+		return kvBucketNotFound(path)
+	}
+	stored := kvCipherFor(tx).storeKey(path, key)
+	notify := kvObserve(bucket, path, key)
+	if err := bucket.Delete(stored); err != nil {
+		return err
+	}
+	if notify != nil {
+		notify(nil)
+	}
+	return kvSetExpiry(tx, path, stored, 0)
+}
+
+// kvSweepExpired deletes every expired key and returns how many were removed
+func kvSweepExpired(tx KVEngineTx) (int, error) {
+	root := tx.Bucket(kvTTLBucket)
+	if root == nil {
+		return 0, nil
+	}
+
+	var names [][]byte
+	err := root.ForEachBucket(func(name []byte) error {
+		names = append(names, append([]byte(nil), name...))
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	now := uint64(time.Now().UnixNano())
+	removed := 0
+	for _, name := range names {
+		meta := root.Bucket(name)
+		var expired [][]byte
+		err := meta.ForEach(func(k, v []byte) error {
+			if len(v) == 8 && binary.BigEndian.Uint64(v) <= now {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return removed, err
+		}
+
+		// The data bucket may have been dropped since the keys were written
+		var data KVEngineBucket
+		path := kvTTLPath(name)
+		if path != nil {
+			data = kvBucket(tx, path)
+		}
+		for _, key := range expired {
+			if data != nil {
+				kvObserveExpired(data, path, key)
+				if err := data.Delete(key); err != nil {
+					return removed, err
+				}
+			}
+			if err := meta.Delete(key); err != nil {
+				return removed, err
+			}
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// kvHasExpired reports whether any key is due to be swept
+func kvHasExpired(tx KVEngineTx) bool {
+	root := tx.Bucket(kvTTLBucket)
+	if root == nil {
+		return false
+	}
+
+	now := uint64(time.Now().UnixNano())
+	found := errors.New("found")
+	err := root.ForEachBucket(func(name []byte) error {
+		return root.Bucket(name).ForEach(func(_, v []byte) error {
+			if len(v) == 8 && binary.BigEndian.Uint64(v) <= now {
+				return found
+			}
+			return nil
+		})
+	})
+	return err == found
+}
+
+// startSweeper deletes expired keys every interval until the database closes
+func (d *KVDB) startSweeper(interval time.Duration) {
+	db := d.db
+	stop := make(chan struct{})
+	d.stopSweeper = stop
+	d.sweeper.Add(1)
+
+	go func() {
+		defer d.sweeper.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				// Check in a read transaction first; an empty write
+				// transaction would still sync a new meta page to disk
+				pending := false
+				db.View(func(tx KVEngineTx) error {
+					pending = kvHasExpired(tx)
+					return nil
+				})
+				if pending {
+					db.Update(func(tx KVEngineTx) error {
+						_, err := kvSweepExpired(tx)
+						return err
+					})
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopSweeping stops the background sweeper and waits for it to finish
+func (d *KVDB) stopSweeping() {
+	if d.stopSweeper != nil {
+		close(d.stopSweeper)
+		d.stopSweeper = nil
+		d.sweeper.Wait()
+	}
+}
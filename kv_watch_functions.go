@@ -0,0 +1,314 @@
+// kv_watch_functions.go - Change notifications for the kv module
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// KVWatch is a callback registered with db:watch for the keys of one bucket
+// that start with prefix
+type KVWatch struct {
+	L         *lua.LState
+	path      [][]byte
+	prefix    []byte
+	fn        *lua.LFunction
+	queue     *kvWatchQueue
+	cancelled bool
+}
+
+// kvWatches holds the watches of every open database. It is keyed by the
+// storage engine so that write helpers only need the transaction.
+var kvWatches = struct {
+	sync.Mutex
+	byDB map[KVEngine][]*KVWatch
+}{byDB: make(map[KVEngine][]*KVWatch)}
+
+// kvWatchEvent is a committed change waiting to be delivered to a watch
+type kvWatchEvent struct {
+	w               *KVWatch
+	key, old, value []byte
+	op              string
+}
+
+// kvWatchQueue holds the changes for the watches of one Lua state. Commits
+// may happen on any goroutine, such as a queue worker's, so callbacks are
+// only called by the state that registered them, when it drains its queue.
+type kvWatchQueue struct {
+	mu     sync.Mutex
+	events []kvWatchEvent
+	ready  chan struct{}
+}
+
+// kvWatchQueues maps Lua states with watches to their queue
+var kvWatchQueues = struct {
+	sync.Mutex
+	byState map[*lua.LState]*kvWatchQueue
+}{byState: make(map[*lua.LState]*kvWatchQueue)}
+
+// kvQueueFor returns the watch queue of L, creating it if needed
+func kvQueueFor(L *lua.LState) *kvWatchQueue {
+	kvWatchQueues.Lock()
+	defer kvWatchQueues.Unlock()
+	q, ok := kvWatchQueues.byState[L]
+	if !ok {
+		q = &kvWatchQueue{ready: make(chan struct{}, 1)}
+		kvWatchQueues.byState[L] = q
+	}
+	return q
+}
+
+// push queues a change and wakes a waiting db:poll_watches
+func (q *kvWatchQueue) push(event kvWatchEvent) {
+	q.mu.Lock()
+	q.events = append(q.events, event)
+	q.mu.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pop removes the oldest queued change
+func (q *kvWatchQueue) pop() (kvWatchEvent, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.events) == 0 {
+		return kvWatchEvent{}, false
+	}
+	event := q.events[0]
+	q.events[0] = kvWatchEvent{}
+	q.events = q.events[1:]
+	return event, true
+}
+
+// watch registers fn for changes to keys of path starting with prefix
+func (d *KVDB) watch(L *lua.LState, path [][]byte, prefix []byte, fn *lua.LFunction) *KVWatch {
+	w := &KVWatch{L: L, path: path, prefix: prefix, fn: fn, queue: kvQueueFor(L)}
+	kvWatches.Lock()
+	kvWatches.byDB[d.db] = append(kvWatches.byDB[d.db], w)
+	kvWatches.Unlock()
+	return w
+}
+
+// unwatch removes a watch; changes already committed are not delivered
+func (d *KVDB) unwatch(w *KVWatch) {
+	kvWatches.Lock()
+	defer kvWatches.Unlock()
+	w.cancelled = true
+	watches := kvWatches.byDB[d.db]
+	for i, other := range watches {
+		if other == w {
+			kvWatches.byDB[d.db] = append(watches[:i:i], watches[i+1:]...)
+			break
+		}
+	}
+	if len(kvWatches.byDB[d.db]) == 0 {
+		delete(kvWatches.byDB, d.db)
+	}
+	kvReleaseQueue(w.L)
+}
+
+// unwatchAll removes every watch of the database when it closes
+func (d *KVDB) unwatchAll() {
+	kvWatches.Lock()
+	defer kvWatches.Unlock()
+	watches := kvWatches.byDB[d.db]
+	delete(kvWatches.byDB, d.db)
+	for _, w := range watches {
+		w.cancelled = true
+		kvReleaseQueue(w.L)
+	}
+}
+
+// kvReleaseQueue drops the watch queue of L once it has no watches left.
+// kvWatches must be locked.
+func kvReleaseQueue(L *lua.LState) {
+	for _, watches := range kvWatches.byDB {
+		for _, w := range watches {
+			if w.L == L {
+				return
+			}
+		}
+	}
+	kvWatchQueues.Lock()
+	delete(kvWatchQueues.byState, L)
+	kvWatchQueues.Unlock()
+}
+
+// kvMatchingWatches returns the watches interested in a key of a bucket
+func kvMatchingWatches(db KVEngine, path [][]byte, key []byte) []*KVWatch {
+	kvWatches.Lock()
+	defer kvWatches.Unlock()
+
+	var matches []*KVWatch
+	for _, w := range kvWatches.byDB[db] {
+		if kvBucketName(w.path) == kvBucketName(path) && bytes.HasPrefix(key, w.prefix) {
+			matches = append(matches, w)
+		}
+	}
+	return matches
+}
+
+// kvObserve must be called before a key of bucket is written, with the
+// unencrypted key. It returns nil when nothing watches the key; otherwise
+// the returned function takes the new unencrypted value (nil for a delete)
+// and queues a notification that is delivered only if the transaction
+// commits.
+func kvObserve(bucket KVEngineBucket, path [][]byte, key []byte) func(value []byte) {
+	tx := bucket.Tx()
+	watches := kvMatchingWatches(tx.Engine(), path, key)
+	if len(watches) == 0 {
+		return nil
+	}
+
+	key = append([]byte(nil), key...)
+	c := kvCipherFor(tx)
+	stored := c.storeKey(path, key)
+	var old []byte
+	if current := bucket.Get(stored); current != nil && !kvExpiryFunc(tx, path)(stored) {
+		if _, value, err := c.open(path, stored, current); err == nil {
+			old = append([]byte(nil), value...)
+		}
+	}
+
+	return func(value []byte) {
+		if old == nil && value == nil {
+			return
+		}
+		op := "put"
+		if value == nil {
+			op = "delete"
+		} else {
+			value = append([]byte(nil), value...)
+		}
+		tx.OnCommit(func() {
+			kvDeliverChange(watches, key, old, value, op)
+		})
+	}
+}
+
+// kvObserveExpired must be called before the sweeper deletes an expired
+// key, given as stored. Watches of the key get a delete with the expired
+// value as the old value once the sweep commits.
+func kvObserveExpired(bucket KVEngineBucket, path [][]byte, stored []byte) {
+	tx := bucket.Tx()
+	kvWatches.Lock()
+	watched := len(kvWatches.byDB[tx.Engine()]) > 0
+	kvWatches.Unlock()
+	current := bucket.Get(stored)
+	if !watched || current == nil {
+		return
+	}
+
+	// Hashed keys can only be matched against prefixes once decrypted
+	key, old, err := kvCipherFor(tx).open(path, stored, current)
+	if err != nil {
+		return
+	}
+	watches := kvMatchingWatches(tx.Engine(), path, key)
+	if len(watches) == 0 {
+		return
+	}
+	key = append([]byte(nil), key...)
+	old = append([]byte(nil), old...)
+	tx.OnCommit(func() {
+		kvDeliverChange(watches, key, old, nil, "delete")
+	})
+}
+
+// kvDeliverChange queues a change with key, old value, new value and
+// operation for each watch. It runs on the committing goroutine, so it never
+// calls Lua itself.
+func kvDeliverChange(watches []*KVWatch, key, old, value []byte, op string) {
+	for _, w := range watches {
+		w.queue.push(kvWatchEvent{w: w, key: key, old: old, value: value, op: op})
+	}
+}
+
+// kvDeliverPending calls the watches of L with their queued changes and
+// returns how many were delivered. Errors raised by callbacks are reported
+// but do not affect the write, which has already been committed.
+func kvDeliverPending(L *lua.LState) int {
+	kvWatchQueues.Lock()
+	q := kvWatchQueues.byState[L]
+	kvWatchQueues.Unlock()
+	if q == nil {
+		return 0
+	}
+
+	delivered := 0
+	for {
+		event, ok := q.pop()
+		if !ok {
+			return delivered
+		}
+		kvWatches.Lock()
+		cancelled := event.w.cancelled
+		kvWatches.Unlock()
+		if cancelled {
+			continue
+		}
+
+		delivered++
+		err := L.CallByParam(lua.P{
+			Fn:      event.w.fn,
+			NRet:    0,
+			Protect: true,
+		}, lua.LString(event.key), kvOptionalString(event.old), kvOptionalString(event.value), lua.LString(event.op))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "kv watch callback error: %v\n", err)
+		}
+	}
+}
+
+// kvPollWatches delivers the changes queued for L, waiting up to timeout
+// for one to arrive when none is queued
+func kvPollWatches(L *lua.LState, timeout time.Duration) int {
+	if delivered := kvDeliverPending(L); delivered > 0 || timeout <= 0 {
+		return delivered
+	}
+	q := kvQueueFor(L)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-q.ready:
+			if delivered := kvDeliverPending(L); delivered > 0 {
+				return delivered
+			}
+		case <-timer.C:
+			return kvDeliverPending(L)
+		}
+	}
+}
+
+// kvDeliverAfter wraps the method on top of the stack so that the changes
+// queued for the calling state are delivered when the method returns,
+// which is how a script sees its own writes before the writing call returns
+func kvDeliverAfter(L *lua.LState) int {
+	fn, ok := L.Get(-1).(*lua.LFunction)
+	if !ok || !fn.IsG {
+		return 1
+	}
+	L.Pop(1)
+	L.Push(L.NewFunction(func(L *lua.LState) int {
+		n := fn.GFunction(L)
+		kvDeliverPending(L)
+		return n
+	}))
+	return 1
+}
+
+// kvOptionalString converts a missing value to nil
+func kvOptionalString(data []byte) lua.LValue {
+	if data == nil {
+		return lua.LNil
+	}
+	return lua.LString(data)
+}
@@ -0,0 +1,76 @@
+// msgpack_functions.go - MessagePack module implementation for Hype
+package main
+
+import (
+	"bytes"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/yuin/gopher-lua"
+)
+
+// registerMsgPackModule adds MessagePack encoding and decoding to Lua
+func registerMsgPackModule(L *lua.LState) {
+	L.PreloadModule("msgpack", func(L *lua.LState) int {
+		msgpackModule := L.NewTable()
+
+		L.SetField(msgpackModule, "encode", L.NewFunction(msgpackEncode))
+		L.SetField(msgpackModule, "decode", L.NewFunction(msgpackDecode))
+		L.SetField(msgpackModule, "null", jsonNullSentinel(L))
+
+		L.Push(msgpackModule)
+		return 1
+	})
+}
+
+// marshalLuaMsgPack encodes a Lua value as MessagePack with sorted map keys
+func marshalLuaMsgPack(L *lua.LState, value lua.LValue) ([]byte, error) {
+	goValue, err := luaValueToGo(L, value)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	encoder := msgpack.NewEncoder(&buf)
+	encoder.SetSortMapKeys(true)
+	if err := encoder.Encode(goValue); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// unmarshalLuaMsgPack decodes MessagePack bytes into Lua values
+func unmarshalLuaMsgPack(L *lua.LState, data []byte) (lua.LValue, error) {
+	var value interface{}
+	if err := msgpack.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	return goValueToLua(L, value), nil
+}
+
+// msgpackEncode converts a Lua value to a MessagePack binary string
+func msgpackEncode(L *lua.LState) int {
+	data, err := marshalLuaMsgPack(L, L.CheckAny(1))
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString("cannot encode MessagePack: " + err.Error()))
+		return 2
+	}
+
+	L.Push(lua.LString(string(data)))
+	return 1
+}
+
+// msgpackDecode parses a MessagePack binary string into Lua values
+func msgpackDecode(L *lua.LState) int {
+	data := L.CheckString(1)
+
+	value, err := unmarshalLuaMsgPack(L, []byte(data))
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString("invalid MessagePack: " + err.Error()))
+		return 2
+	}
+
+	L.Push(value)
+	return 1
+}
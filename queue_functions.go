@@ -0,0 +1,806 @@
+// queue_functions.go - Durable job queues stored in kv databases
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+	"go.etcd.io/bbolt"
+)
+
+// queueBucket holds one bucket per queue name, each with the job records
+// and the indexes that order them
+var queueBucket = []byte(kvInternalPrefix + "queue")
+
+var (
+	queueJobsBucket      = []byte("jobs")      // id -> JSON job record
+	queueReadyBucket     = []byte("ready")     // priority, id -> nil
+	queueScheduledBucket = []byte("scheduled") // run time, id -> nil
+	queueRunningBucket   = []byte("running")   // lease deadline, id -> nil
+	queueDeadBucket      = []byte("dead")      // id -> nil
+)
+
+const (
+	queueStateReady     = "ready"
+	queueStateScheduled = "scheduled"
+	queueStateRunning   = "running"
+	queueStateDead      = "dead"
+)
+
+// QueueOptions are the options of queue.open
+type QueueOptions struct {
+	VisibilityTimeout time.Duration
+	MaxAttempts       int
+	Backoff           time.Duration
+	MaxBackoff        time.Duration
+	PollInterval      time.Duration
+}
+
+// Queue runs jobs stored in a kv database. Jobs move from ready (or
+// scheduled, while delayed or backing off) to running, where a worker holds
+// a lease until it finishes or the visibility timeout expires, and end up
+// deleted or, after too many attempts, in the dead-letter bucket.
+type Queue struct {
+	db      *KVDB
+	opts    QueueOptions
+	ctx     context.Context
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
+}
+
+// QueueJob is the stored form of a job
+type QueueJob struct {
+	ID          uint64 `json:"id"`
+	Payload     []byte `json:"payload"`
+	Priority    int64  `json:"priority"`
+	Attempts    int    `json:"attempts"`
+	MaxAttempts int    `json:"max_attempts"`
+	EnqueuedAt  int64  `json:"enqueued_at"`
+	State       string `json:"state"`
+	RunAt       int64  `json:"run_at,omitempty"`
+	Deadline    int64  `json:"deadline,omitempty"`
+	LastError   string `json:"last_error,omitempty"`
+}
+
+// QueueStats counts the jobs of a queue in each state
+type QueueStats struct {
+	Ready, Scheduled, Running, Dead int
+}
+
+// queueSignals wakes idle workers when a job is enqueued on the same
+// database, instead of waiting for the next poll
+var queueSignals = struct {
+	sync.Mutex
+	byQueue map[queueSignalKey]chan struct{}
+}{byQueue: make(map[queueSignalKey]chan struct{})}
+
+type queueSignalKey struct {
+	db   *KVDB
+	name string
+}
+
+func registerQueueModule(L *lua.LState) {
+	L.PreloadModule("queue", func(L *lua.LState) int {
+		queueModule := L.NewTable()
+		L.SetField(queueModule, "open", L.NewFunction(queueOpen))
+		L.Push(queueModule)
+		return 1
+	})
+
+	queueMT := L.NewTypeMetatable("Queue")
+	L.SetField(queueMT, "__index", L.NewFunction(queueIndex))
+}
+
+// queueWaitChannel returns a channel that is closed on the next enqueue
+func queueWaitChannel(db *KVDB, name string) <-chan struct{} {
+	queueSignals.Lock()
+	defer queueSignals.Unlock()
+	key := queueSignalKey{db, name}
+	ch, ok := queueSignals.byQueue[key]
+	if !ok {
+		ch = make(chan struct{})
+		queueSignals.byQueue[key] = ch
+	}
+	return ch
+}
+
+// queueNotify wakes the workers waiting on a queue
+func queueNotify(db *KVDB, name string) {
+	queueSignals.Lock()
+	defer queueSignals.Unlock()
+	key := queueSignalKey{db, name}
+	if ch, ok := queueSignals.byQueue[key]; ok {
+		close(ch)
+		delete(queueSignals.byQueue, key)
+	}
+}
+
+// queueKey joins big-endian integers into an index key
+func queueKey(parts ...uint64) []byte {
+	key := make([]byte, 8*len(parts))
+	for i, part := range parts {
+		binary.BigEndian.PutUint64(key[8*i:], part)
+	}
+	return key
+}
+
+// queuePriorityKey orders higher priorities first, then by id
+func queuePriorityKey(priority int64, id uint64) []byte {
+	return queueKey(^(uint64(priority) ^ (1 << 63)), id)
+}
+
+// indexKey returns the bucket and key that place the job in its state
+func (j *QueueJob) indexKey() ([]byte, []byte) {
+	switch j.State {
+	case queueStateReady:
+		return queueReadyBucket, queuePriorityKey(j.Priority, j.ID)
+	case queueStateScheduled:
+		return queueScheduledBucket, queueKey(uint64(j.RunAt), j.ID)
+	case queueStateRunning:
+		return queueRunningBucket, queueKey(uint64(j.Deadline), j.ID)
+	}
+	return queueDeadBucket, queueKey(j.ID)
+}
+
+// queueBuckets is one queue's buckets within a transaction
+type queueBuckets struct {
+	root  KVEngineBucket
+	index map[string]KVEngineBucket
+}
+
+// queueOpenBuckets finds, or in a writable transaction creates, the
+// buckets of the queue name. It returns nil for a queue never written to.
+func queueOpenBuckets(tx KVEngineTx, name string) (*queueBuckets, error) {
+	var root KVEngineBucket
+	if tx.Writable() {
+		parent, err := tx.CreateBucketIfNotExists(queueBucket)
+		if err != nil {
+			return nil, err
+		}
+		if root, err = parent.CreateBucketIfNotExists([]byte(name)); err != nil {
+			return nil, err
+		}
+	} else if parent := tx.Bucket(queueBucket); parent != nil {
+		root = parent.Bucket([]byte(name))
+	}
+	if root == nil {
+		return nil, nil
+	}
+
+	b := &queueBuckets{root: root, index: make(map[string]KVEngineBucket)}
+	for _, name := range [][]byte{queueJobsBucket, queueReadyBucket, queueScheduledBucket, queueRunningBucket, queueDeadBucket} {
+		bucket := root.Bucket(name)
+		if bucket == nil {
+			var err error
+			if bucket, err = root.CreateBucketIfNotExists(name); err != nil {
+				return nil, err
+			}
+		}
+		b.index[string(name)] = bucket
+	}
+	return b, nil
+}
+
+func (b *queueBuckets) load(id uint64) (*QueueJob, error) {
+	data := b.index[string(queueJobsBucket)].Get(queueKey(id))
+	if data == nil {
+		return nil, nil
+	}
+	job := &QueueJob{}
+	if err := json.Unmarshal(data, job); err != nil {
+		return nil, fmt.Errorf("corrupt job %d: %v", id, err)
+	}
+	return job, nil
+}
+
+// save writes the job record and adds it to the index of its state
+func (b *queueBuckets) save(job *QueueJob) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	if err := b.index[string(queueJobsBucket)].Put(queueKey(job.ID), data); err != nil {
+		return err
+	}
+	bucket, key := job.indexKey()
+	return b.index[string(bucket)].Put(key, []byte{})
+}
+
+// unindex removes the job from the index of its current state
+func (b *queueBuckets) unindex(job *QueueJob) error {
+	bucket, key := job.indexKey()
+	return b.index[string(bucket)].Delete(key)
+}
+
+// count returns the number of keys in an index
+func (b *queueBuckets) count(bucket []byte) int {
+	n := 0
+	b.index[string(bucket)].ForEach(func(_, _ []byte) error {
+		n++
+		return nil
+	})
+	return n
+}
+
+// backoff returns the delay before retrying after the given attempt
+func (q *Queue) backoff(attempt int) time.Duration {
+	delay := float64(q.opts.Backoff) * math.Pow(2, float64(attempt-1))
+	if delay > float64(q.opts.MaxBackoff) {
+		return q.opts.MaxBackoff
+	}
+	return time.Duration(delay)
+}
+
+// enqueue stores a job that becomes ready after delay
+func (q *Queue) enqueue(L *lua.LState, name string, payload []byte, priority int64, delay time.Duration, maxAttempts int) (uint64, error) {
+	var id uint64
+	err := q.db.update(L, func(tx KVEngineTx) error {
+		b, err := queueOpenBuckets(tx, name)
+		if err != nil {
+			return err
+		}
+		if id, err = b.index[string(queueJobsBucket)].NextSequence(); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		job := &QueueJob{
+			ID:          id,
+			Payload:     payload,
+			Priority:    priority,
+			MaxAttempts: maxAttempts,
+			EnqueuedAt:  now.UnixNano(),
+			State:       queueStateReady,
+		}
+		if delay > 0 {
+			job.State = queueStateScheduled
+			job.RunAt = now.Add(delay).UnixNano()
+		}
+		tx.OnCommit(func() { queueNotify(q.db, name) })
+		return b.save(job)
+	})
+	return id, err
+}
+
+// failJob records a failed attempt, scheduling a retry or moving the job
+// to the dead-letter bucket once it has no attempts left
+func (q *Queue) failJob(b *queueBuckets, job *QueueJob, reason string, now time.Time) error {
+	if err := b.unindex(job); err != nil {
+		return err
+	}
+	job.LastError = reason
+	job.Deadline = 0
+	if job.Attempts >= job.MaxAttempts {
+		job.State = queueStateDead
+	} else {
+		job.State = queueStateScheduled
+		job.RunAt = now.Add(q.backoff(job.Attempts)).UnixNano()
+	}
+	return b.save(job)
+}
+
+// claim leases the next ready job of a queue. Delayed jobs that are due
+// become ready first, and jobs whose lease expired count as failed. With no
+// job ready, it returns how long to wait for the next scheduled job.
+func (q *Queue) claim(name string) (*QueueJob, time.Duration, error) {
+	if q.db.db == nil {
+		return nil, 0, bbolt.ErrDatabaseNotOpen
+	}
+	var claimed *QueueJob
+	wait := q.opts.PollInterval
+	err := q.db.db.Update(func(tx KVEngineTx) error {
+		b, err := queueOpenBuckets(tx, name)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+
+		// Each pass takes the first entry again, as the entry is moved
+		due := func(bucket []byte, fn func(*QueueJob) error) error {
+			c := b.index[string(bucket)].Cursor()
+			for k, _ := c.First(); k != nil; k, _ = c.First() {
+				at := time.Unix(0, int64(binary.BigEndian.Uint64(k)))
+				if at.After(now) {
+					if until := at.Sub(now); until < wait {
+						wait = until
+					}
+					return nil
+				}
+				job, err := b.load(binary.BigEndian.Uint64(k[8:]))
+				if err != nil {
+					return err
+				}
+				if job == nil {
+					if err := c.Delete(); err != nil {
+						return err
+					}
+					continue
+				}
+				if err := fn(job); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		err = due(queueScheduledBucket, func(job *QueueJob) error {
+			if err := b.unindex(job); err != nil {
+				return err
+			}
+			job.State = queueStateReady
+			job.RunAt = 0
+			return b.save(job)
+		})
+		if err != nil {
+			return err
+		}
+		err = due(queueRunningBucket, func(job *QueueJob) error {
+			return q.failJob(b, job, "visibility timeout expired", now)
+		})
+		if err != nil {
+			return err
+		}
+
+		k, _ := b.index[string(queueReadyBucket)].Cursor().First()
+		if k == nil {
+			return nil
+		}
+		job, err := b.load(binary.BigEndian.Uint64(k[8:]))
+		if err != nil {
+			return err
+		}
+		if job == nil {
+			return b.index[string(queueReadyBucket)].Delete(k)
+		}
+		if err := b.unindex(job); err != nil {
+			return err
+		}
+		job.State = queueStateRunning
+		job.Attempts++
+		job.Deadline = now.Add(q.opts.VisibilityTimeout).UnixNano()
+		claimed = job
+		return b.save(job)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return claimed, wait, nil
+}
+
+// finish ends a lease: a nil err deletes the job, otherwise the attempt
+// fails. A released job returns to ready without using up an attempt. Jobs
+// whose lease was lost to the visibility timeout are left alone.
+func (q *Queue) finish(name string, leased *QueueJob, err error, release bool) error {
+	if q.db.db == nil {
+		return bbolt.ErrDatabaseNotOpen
+	}
+	return q.db.db.Update(func(tx KVEngineTx) error {
+		b, txErr := queueOpenBuckets(tx, name)
+		if txErr != nil {
+			return txErr
+		}
+		job, txErr := b.load(leased.ID)
+		if txErr != nil || job == nil || job.State != queueStateRunning || job.Deadline != leased.Deadline {
+			return txErr
+		}
+
+		switch {
+		case release:
+			if err := b.unindex(job); err != nil {
+				return err
+			}
+			job.State = queueStateReady
+			job.Attempts--
+			job.Deadline = 0
+			return b.save(job)
+		case err != nil:
+			return q.failJob(b, job, err.Error(), time.Now())
+		}
+		if err := b.unindex(job); err != nil {
+			return err
+		}
+		return b.index[string(queueJobsBucket)].Delete(queueKey(job.ID))
+	})
+}
+
+// stats counts the jobs of a queue by state
+func (q *Queue) stats(name string) (QueueStats, error) {
+	var stats QueueStats
+	if q.db.db == nil {
+		return stats, bbolt.ErrDatabaseNotOpen
+	}
+	err := q.db.db.View(func(tx KVEngineTx) error {
+		b, err := queueOpenBuckets(tx, name)
+		if err != nil || b == nil {
+			return err
+		}
+		stats = QueueStats{
+			Ready:     b.count(queueReadyBucket),
+			Scheduled: b.count(queueScheduledBucket),
+			Running:   b.count(queueRunningBucket),
+			Dead:      b.count(queueDeadBucket),
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// dead returns up to limit jobs from the dead-letter bucket, oldest first
+func (q *Queue) dead(name string, limit int) ([]*QueueJob, error) {
+	if q.db.db == nil {
+		return nil, bbolt.ErrDatabaseNotOpen
+	}
+	var jobs []*QueueJob
+	err := q.db.db.View(func(tx KVEngineTx) error {
+		b, err := queueOpenBuckets(tx, name)
+		if err != nil || b == nil {
+			return err
+		}
+		c := b.index[string(queueDeadBucket)].Cursor()
+		for k, _ := c.First(); k != nil && (limit <= 0 || len(jobs) < limit); k, _ = c.Next() {
+			job, err := b.load(binary.BigEndian.Uint64(k))
+			if err != nil {
+				return err
+			}
+			if job != nil {
+				jobs = append(jobs, job)
+			}
+		}
+		return nil
+	})
+	return jobs, err
+}
+
+// retry moves a dead job back to ready with its attempts reset
+func (q *Queue) retry(L *lua.LState, name string, id uint64) error {
+	return q.db.update(L, func(tx KVEngineTx) error {
+		b, err := queueOpenBuckets(tx, name)
+		if err != nil {
+			return err
+		}
+		job, err := b.load(id)
+		if err != nil {
+			return err
+		}
+		if job == nil || job.State != queueStateDead {
+			return fmt.Errorf("job %d is not in the dead-letter bucket of %s", id, name)
+		}
+		if err := b.unindex(job); err != nil {
+			return err
+		}
+		job.State = queueStateReady
+		job.Attempts = 0
+		tx.OnCommit(func() { queueNotify(q.db, name) })
+		return b.save(job)
+	})
+}
+
+// work starts concurrency workers for a queue, each with its own Lua state
+func (q *Queue) work(name string, proto *lua.FunctionProto, concurrency int) {
+	for i := 0; i < concurrency; i++ {
+		q.workers.Add(1)
+		go q.runWorker(name, proto)
+	}
+}
+
+func (q *Queue) runWorker(name string, proto *lua.FunctionProto) {
+	defer q.workers.Done()
+	var L *lua.LState
+	var handler *lua.LFunction
+	defer func() {
+		if L != nil {
+			L.Close()
+		}
+	}()
+
+	for q.ctx.Err() == nil {
+		wake := queueWaitChannel(q.db, name)
+		job, wait, err := q.claim(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "queue %s error: %v\n", name, err)
+			wait = q.opts.PollInterval
+		}
+		if job == nil {
+			select {
+			case <-q.ctx.Done():
+			case <-wake:
+			case <-time.After(wait):
+			}
+			continue
+		}
+
+		if L == nil {
+			L = newTaskState()
+			handler = L.NewFunctionFromProto(proto)
+		}
+		ctx, cancel := context.WithDeadline(q.ctx, time.Unix(0, job.Deadline))
+		err = q.runJob(L, handler, ctx, job)
+		interrupted := err != nil && ctx.Err() != nil
+		cancel()
+
+		stopping := interrupted && q.ctx.Err() != nil
+		if interrupted && !stopping {
+			err = errors.New("visibility timeout expired")
+		}
+		if finishErr := q.finish(name, job, err, stopping); finishErr != nil {
+			fmt.Fprintf(os.Stderr, "queue %s error: %v\n", name, finishErr)
+		}
+
+		// An interrupted state may be part way through the handler
+		if interrupted {
+			L.Close()
+			L = nil
+		}
+	}
+}
+
+// runJob calls the handler with the job and the database. The job fails if
+// the handler raises an error or returns nil or false and a message.
+func (q *Queue) runJob(L *lua.LState, handler *lua.LFunction, ctx context.Context, job *QueueJob) error {
+	payload, err := unmarshalLuaMsgPack(L, job.Payload)
+	if err != nil {
+		return err
+	}
+	jobTable := L.NewTable()
+	jobTable.RawSetString("id", lua.LNumber(job.ID))
+	jobTable.RawSetString("payload", payload)
+	jobTable.RawSetString("attempts", lua.LNumber(job.Attempts))
+	jobTable.RawSetString("priority", lua.LNumber(job.Priority))
+	jobTable.RawSetString("enqueued_at", lua.LNumber(float64(job.EnqueuedAt)/float64(time.Second)))
+
+	dbUD := L.NewUserData()
+	dbUD.Value = q.db
+	L.SetMetatable(dbUD, L.GetTypeMetatable("KVDB"))
+
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+	err = L.CallByParam(lua.P{
+		Fn:      handler,
+		NRet:    2,
+		Protect: true,
+	}, jobTable, dbUD)
+	if err != nil {
+		return err
+	}
+
+	ok, message := L.Get(-2), L.Get(-1)
+	L.Pop(2)
+	if !lua.LVAsBool(ok) && message != lua.LNil {
+		return errors.New(message.String())
+	}
+	return nil
+}
+
+// stop cancels the workers and waits for them. Jobs they were running go
+// back to ready.
+func (q *Queue) stop() {
+	q.cancel()
+	q.workers.Wait()
+}
+
+// drain waits until a queue has no ready, scheduled or running jobs
+func (q *Queue) drain(name string, timeout time.Duration) (bool, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		stats, err := q.stats(name)
+		if err != nil {
+			return false, err
+		}
+		if stats.Ready+stats.Scheduled+stats.Running == 0 {
+			return true, nil
+		}
+		if timeout > 0 && time.Now().After(deadline) {
+			return false, nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// queueSeconds reads an optional duration in seconds from an options table
+func queueSeconds(L *lua.LState, opts *lua.LTable, name string, def time.Duration) time.Duration {
+	if opts == nil {
+		return def
+	}
+	if seconds, ok := L.GetField(opts, name).(lua.LNumber); ok {
+		return time.Duration(float64(seconds) * float64(time.Second))
+	}
+	return def
+}
+
+// queueInt reads an optional integer from an options table
+func queueInt(L *lua.LState, opts *lua.LTable, name string, def int) int {
+	if opts == nil {
+		return def
+	}
+	if n, ok := L.GetField(opts, name).(lua.LNumber); ok {
+		return int(n)
+	}
+	return def
+}
+
+// queueOpen implements queue.open(db, {visibility_timeout=, max_attempts=,
+// backoff=, max_backoff=, poll_interval=})
+func queueOpen(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	db, ok := ud.Value.(*KVDB)
+	if !ok {
+		L.ArgError(1, "kv database expected")
+	}
+	opts := L.OptTable(2, nil)
+
+	var err error
+	switch {
+	case db.db == nil:
+		err = bbolt.ErrDatabaseNotOpen
+	case db.db.IsReadOnly():
+		err = errors.New("queues need a writable database")
+	case db.cipher != nil:
+		err = errors.New("queues are not supported on encrypted databases")
+	}
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	q := &Queue{
+		db: db,
+		opts: QueueOptions{
+			VisibilityTimeout: queueSeconds(L, opts, "visibility_timeout", 30*time.Second),
+			MaxAttempts:       queueInt(L, opts, "max_attempts", 5),
+			Backoff:           queueSeconds(L, opts, "backoff", time.Second),
+			MaxBackoff:        queueSeconds(L, opts, "max_backoff", 5*time.Minute),
+			PollInterval:      queueSeconds(L, opts, "poll_interval", time.Second),
+		},
+	}
+	if q.opts.PollInterval <= 0 {
+		q.opts.PollInterval = time.Second
+	}
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+	db.onClose(q.stop)
+
+	qud := L.NewUserData()
+	qud.Value = q
+	L.SetMetatable(qud, L.GetTypeMetatable("Queue"))
+	L.Push(qud)
+	L.Push(lua.LNil)
+	return 2
+}
+
+// queueJobTable converts a stored job for q:dead
+func queueJobTable(L *lua.LState, job *QueueJob) *lua.LTable {
+	table := L.NewTable()
+	table.RawSetString("id", lua.LNumber(job.ID))
+	if payload, err := unmarshalLuaMsgPack(L, job.Payload); err == nil {
+		table.RawSetString("payload", payload)
+	}
+	table.RawSetString("attempts", lua.LNumber(job.Attempts))
+	table.RawSetString("priority", lua.LNumber(job.Priority))
+	table.RawSetString("enqueued_at", lua.LNumber(float64(job.EnqueuedAt)/float64(time.Second)))
+	table.RawSetString("error", lua.LString(job.LastError))
+	return table
+}
+
+func queueIndex(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	q := ud.Value.(*Queue)
+	method := L.CheckString(2)
+
+	switch method {
+	case "enqueue":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			name := L.CheckString(2)
+			opts := L.OptTable(4, nil)
+			var id uint64
+			payload, err := marshalLuaMsgPack(L, L.Get(3))
+			if err == nil {
+				id, err = q.enqueue(L, name, payload,
+					int64(queueInt(L, opts, "priority", 0)),
+					queueSeconds(L, opts, "delay", 0),
+					queueInt(L, opts, "max_attempts", q.opts.MaxAttempts))
+			}
+
+			if err != nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LString(err.Error()))
+				return 2
+			}
+			L.Push(lua.LNumber(id))
+			L.Push(lua.LNil)
+			return 2
+		}))
+	case "work":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			name := L.CheckString(2)
+			proto, err := taskProto(L.CheckFunction(3), "queue handler")
+			if err != nil {
+				L.Push(lua.LString(err.Error()))
+				return 1
+			}
+			if q.ctx.Err() != nil {
+				L.Push(lua.LString("queue is stopped"))
+				return 1
+			}
+			concurrency := queueInt(L, L.OptTable(4, nil), "concurrency", 1)
+			if concurrency < 1 {
+				L.ArgError(4, "concurrency must be at least 1")
+			}
+			q.work(name, proto, concurrency)
+			return 0
+		}))
+	case "stats":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			stats, err := q.stats(L.CheckString(2))
+			if err != nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LString(err.Error()))
+				return 2
+			}
+			table := L.NewTable()
+			table.RawSetString("ready", lua.LNumber(stats.Ready))
+			table.RawSetString("scheduled", lua.LNumber(stats.Scheduled))
+			table.RawSetString("running", lua.LNumber(stats.Running))
+			table.RawSetString("dead", lua.LNumber(stats.Dead))
+			L.Push(table)
+			L.Push(lua.LNil)
+			return 2
+		}))
+	case "dead":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			jobs, err := q.dead(L.CheckString(2), L.OptInt(3, 0))
+			if err != nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LString(err.Error()))
+				return 2
+			}
+			list := L.NewTable()
+			for i, job := range jobs {
+				list.RawSetInt(i+1, queueJobTable(L, job))
+			}
+			L.Push(list)
+			L.Push(lua.LNil)
+			return 2
+		}))
+	case "retry":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			if err := q.retry(L, L.CheckString(2), uint64(L.CheckInt64(3))); err != nil {
+				L.Push(lua.LString(err.Error()))
+				return 1
+			}
+			return 0
+		}))
+	case "drain":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			timeout := time.Duration(float64(L.OptNumber(3, 0)) * float64(time.Second))
+			drained, err := q.drain(L.CheckString(2), timeout)
+			if err != nil {
+				L.Push(lua.LFalse)
+				L.Push(lua.LString(err.Error()))
+				return 2
+			}
+			if !drained {
+				L.Push(lua.LFalse)
+				L.Push(lua.LString("timeout"))
+				return 2
+			}
+			L.Push(lua.LTrue)
+			L.Push(lua.LNil)
+			return 2
+		}))
+	case "stop":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			q.stop()
+			return 0
+		}))
+	}
+
+	return 1
+}
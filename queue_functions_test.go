@@ -0,0 +1,124 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// runQueueScript runs a Lua script with the kv and queue modules and db_path
+// set to a fresh database file
+func runQueueScript(t *testing.T, script string) {
+	t.Helper()
+	L := lua.NewState()
+	defer L.Close()
+	defer kvCloseAll()
+	registerKVModule(L)
+	registerQueueModule(L)
+	L.SetGlobal("db_path", lua.LString(filepath.Join(t.TempDir(), "queue.db")))
+
+	if err := L.DoString(script); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueueWorkers(t *testing.T) {
+	runQueueScript(t, `
+		local kv = require("kv")
+		local queue = require("queue")
+		local db = assert(kv.open(db_path))
+		assert(db:open_db("results") == nil)
+		local q = assert(queue.open(db, {poll_interval = 0.05}))
+
+		assert(q:enqueue("jobs", {name = "low"}) == 1)
+		assert(q:enqueue("jobs", {name = "high"}, {priority = 10}) == 2)
+		assert(q:enqueue("jobs", {name = "later"}, {delay = 0.2}) == 3)
+		local stats = q:stats("jobs")
+		assert(stats.ready == 2 and stats.scheduled == 1 and stats.running == 0)
+
+		-- Watches of this script see worker writes when it next uses the
+		-- database, never on the worker's goroutine
+		local seen = {}
+		db:watch("results", "", function(key) table.insert(seen, key) end)
+
+		-- Handlers run in their own Lua state and receive the database
+		assert(q:work("jobs", function(job, db)
+			assert(db:update(function(tx)
+				local n = tx:incr("results", "n")
+				tx:put("results", tostring(n), job.payload.name .. ":" .. job.attempts)
+			end) == nil)
+		end) == nil)
+
+		assert(q:drain("jobs", 5))
+		assert(db:get("results", "1") == "high:1")
+		assert(db:get("results", "2") == "low:1")
+		assert(db:get("results", "3") == "later:1")
+		db:poll_watches(0)
+		assert(#seen == 6, table.concat(seen, ","))
+
+		local captured = 1
+		local err = q:work("jobs", function() return captured end)
+		assert(err and err:find("local variables of the script (captured)", 1, true), err)
+		q:stop()
+		db:close()
+	`)
+}
+
+func TestQueueRetriesAndDeadLetters(t *testing.T) {
+	runQueueScript(t, `
+		local kv = require("kv")
+		local queue = require("queue")
+		local db = assert(kv.open(db_path))
+		local q = assert(queue.open(db, {
+			poll_interval = 0.05,
+			backoff = 0.01,
+			max_attempts = 3,
+			visibility_timeout = 0.2,
+		}))
+
+		assert(q:enqueue("flaky", "boom"))
+		assert(q:enqueue("slow", "spin", {max_attempts = 1}))
+		assert(q:work("flaky", function(job)
+			if job.attempts < 3 then
+				return nil, "attempt " .. job.attempts .. " failed"
+			end
+			error("gave up")
+		end, {concurrency = 2}) == nil)
+
+		-- Handlers that outlive the visibility timeout are interrupted
+		assert(q:work("slow", function(job)
+			while true do end
+		end) == nil)
+
+		assert(q:drain("flaky", 5))
+		assert(q:drain("slow", 5))
+
+		local dead = assert(q:dead("flaky"))
+		assert(#dead == 1 and dead[1].payload == "boom" and dead[1].attempts == 3)
+		assert(dead[1].error:find("gave up"), dead[1].error)
+		dead = assert(q:dead("slow"))
+		assert(#dead == 1 and dead[1].error == "visibility timeout expired", dead[1].error)
+
+		local stats = q:stats("flaky")
+		assert(stats.dead == 1 and stats.ready == 0)
+		q:stop()
+
+		-- Retried jobs start over with a full set of attempts
+		assert(q:retry("flaky", dead[1].id) == nil)
+		assert(q:retry("flaky", dead[1].id) ~= nil)
+		stats = q:stats("flaky")
+		assert(stats.dead == 0 and stats.ready == 1)
+		db:close()
+
+		-- Jobs survive reopening the database
+		db = assert(kv.open(db_path))
+		q = assert(queue.open(db))
+		assert(q:stats("flaky").ready == 1)
+		assert(#db:buckets() == 0)
+		db:close()
+
+		local _, err = queue.open(db)
+		assert(err == "database not open", err)
+	`)
+}
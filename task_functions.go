@@ -0,0 +1,47 @@
+// task_functions.go - Isolated Lua states for background work
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// A Lua state may only be used by one goroutine at a time, so background
+// work such as queue workers runs in task states of its own. Functions are
+// moved into a task state by recompiling their prototype there; they see
+// the task state's globals and must not capture locals of the script.
+
+// newTaskState creates a Lua state with the standard libraries and the
+// built-in modules that do not need a terminal
+func newTaskState() *lua.LState {
+	L := lua.NewState()
+	registerHTTPModule(L)
+	registerKVModule(L)
+	registerCryptoModule(L)
+	registerHTTPSigModule(L)
+	registerWebSocketModule(L)
+	registerJSONModule(L)
+	registerYAMLModule(L)
+	registerTOMLModule(L)
+	registerCSVModule(L)
+	registerMsgPackModule(L)
+	registerEncodingModule(L)
+	registerQueueModule(L)
+	return L
+}
+
+// taskProto returns the prototype of fn so it can be instantiated in a task
+// state with NewFunctionFromProto. what names fn in errors, such as
+// "queue handler".
+func taskProto(fn *lua.LFunction, what string) (*lua.FunctionProto, error) {
+	if fn.IsG || fn.Proto == nil {
+		return nil, fmt.Errorf("%s must be a Lua function", what)
+	}
+	if fn.Proto.NumUpvalues > 0 {
+		return nil, fmt.Errorf("%s cannot use local variables of the script (%s): it runs in its own Lua state, so require modules inside it and pass data through its arguments",
+			what, strings.Join(fn.Proto.DbgUpvalues, ", "))
+	}
+	return fn.Proto, nil
+}
@@ -0,0 +1,69 @@
+// toml_functions.go - TOML module implementation for Hype
+package main
+
+import (
+	"bytes"
+
+	"github.com/BurntSushi/toml"
+	"github.com/yuin/gopher-lua"
+)
+
+// registerTOMLModule adds TOML encoding and decoding to Lua
+func registerTOMLModule(L *lua.LState) {
+	L.PreloadModule("toml", func(L *lua.LState) int {
+		tomlModule := L.NewTable()
+
+		L.SetField(tomlModule, "encode", L.NewFunction(tomlEncode))
+		L.SetField(tomlModule, "decode", L.NewFunction(tomlDecode))
+
+		L.Push(tomlModule)
+		return 1
+	})
+}
+
+// tomlEncode converts a Lua table to a TOML document
+func tomlEncode(L *lua.LState) int {
+	value, err := luaValueToGo(L, L.CheckAny(1))
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString("cannot encode TOML: " + err.Error()))
+		return 2
+	}
+
+	document, ok := value.(map[string]interface{})
+	if !ok {
+		L.Push(lua.LNil)
+		L.Push(lua.LString("cannot encode TOML: document must be a table with string keys"))
+		return 2
+	}
+
+	var buf bytes.Buffer
+	encoder := toml.NewEncoder(&buf)
+	if options := L.OptTable(2, nil); options != nil {
+		encoder.Indent = jsonEncodeOptionsFromTable(options).Indent
+	}
+
+	if err := encoder.Encode(document); err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString("cannot encode TOML: " + err.Error()))
+		return 2
+	}
+
+	L.Push(lua.LString(buf.String()))
+	return 1
+}
+
+// tomlDecode parses a TOML document into a Lua table
+func tomlDecode(L *lua.LState) int {
+	data := L.CheckString(1)
+
+	var document map[string]interface{}
+	if _, err := toml.Decode(data, &document); err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	L.Push(goValueToLua(L, document))
+	return 1
+}
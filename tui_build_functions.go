@@ -0,0 +1,722 @@
+// tui_build_functions.go - Declarative tui layouts built from Lua tables
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rivo/tview"
+	"github.com/yuin/gopher-lua"
+)
+
+// tui.build{type = "flex", direction = "row", children = {...}} creates a
+// widget with the tui.new* constructor for its type and applies every other
+// key through the widget's metatable: title calls SetTitle, border_color
+// calls SetBorderColor and on_selected calls SetSelectedFunc. A property
+// given as a function is computed from it, and computed again when a
+// tui.state value the function read changes or on app:Refresh().
+
+// tuiBuildTypes maps the type names accepted by tui.build to constructors
+var tuiBuildTypes = map[string]lua.LGFunction{
+	"textview":    luaNewTextView,
+	"text":        luaNewTextView,
+	"inputfield":  luaNewInputField,
+	"input":       luaNewInputField,
+	"button":      luaNewButton,
+	"flex":        luaNewFlex,
+	"list":        luaNewList,
+	"table":       luaNewTable,
+	"treeview":    luaNewTreeView,
+	"tree":        luaNewTreeView,
+	"form":        luaNewForm,
+	"modal":       luaNewModal,
+	"pages":       luaNewPages,
+	"grid":        luaNewGrid,
+	"dropdown":    luaNewDropDown,
+	"checkbox":    luaNewCheckbox,
+	"progressbar": luaNewProgressBar,
+	"progress":    luaNewProgressBar,
+}
+
+// tuiBuildPlacement lists the keys that place a widget in its parent
+// rather than set one of its properties
+var tuiBuildPlacement = map[string]bool{
+	"type": true, "id": true,
+	"size": true, "proportion": true, "focus": true,
+	"row": true, "column": true, "row_span": true, "column_span": true,
+	"min_height": true, "min_width": true,
+	"name": true, "resize": true, "visible": true,
+}
+
+// tuiBuildContent lists the keys that fill a widget with other widgets or
+// items. They are applied before the other properties.
+var tuiBuildContent = map[string]bool{
+	"children": true, "items": true, "cells": true, "root": true, "buttons": true,
+}
+
+// tuiBuildCallbacks maps the callback keys that don't follow the
+// on_<name> -> Set<Name>Func pattern
+var tuiBuildCallbacks = map[string]string{
+	"on_input": "SetInputCapture",
+	"on_mouse": "SetMouseCapture",
+}
+
+// tuiBuildListSetters take a list, so their values are not unpacked
+var tuiBuildListSetters = map[string]bool{
+	"SetOptions":  true,
+	"SetPrefixes": true,
+}
+
+var tuiAligns = map[string]int{
+	"left":   tview.AlignLeft,
+	"center": tview.AlignCenter,
+	"right":  tview.AlignRight,
+}
+
+// tuiBuildConstants names the numeric values of some properties
+var tuiBuildConstants = map[string]map[string]int{
+	"direction":     {"row": tview.FlexRow, "column": tview.FlexColumn},
+	"align":         tuiAligns,
+	"text_align":    tuiAligns,
+	"title_align":   tuiAligns,
+	"buttons_align": tuiAligns,
+}
+
+// tuiLayout holds what one tui.build call created: the widgets registered
+// by id and the computed properties. app:SetRoot attaches the layout of the
+// root to the app, which then recomputes properties on its event loop.
+type tuiLayout struct {
+	mu       sync.Mutex
+	ids      map[string]lua.LValue
+	bindings []*tuiBinding
+	app      *TUIApp
+}
+
+// tuiLayouts maps the root widget of each built layout to the layout
+var tuiLayouts sync.Map
+
+// tuiTracking maps a Lua state to the binding being computed in it, so
+// tui.state tables know who reads them
+var tuiTracking sync.Map
+
+// tuiBinding is a widget property computed by a Lua function
+type tuiBinding struct {
+	layout *tuiLayout
+	ud     lua.LValue
+	fn     *lua.LFunction
+	apply  func(L *lua.LState, b *tuiBuilder, value lua.LValue)
+	states []*tuiState
+
+	// Bindings, ids and widgets built by the last apply, which are dropped
+	// when the property is computed again
+	owned   []*tuiBinding
+	ids     []string
+	widgets []interface{}
+
+	queued bool
+	dead   bool
+}
+
+// tuiState is a table created by tui.state. Writing one of its values
+// recomputes the properties whose functions read the table.
+type tuiState struct {
+	mu     sync.Mutex
+	values *lua.LTable
+	deps   []*tuiBinding
+}
+
+func (s *tuiState) get(L *lua.LState, key lua.LValue) lua.LValue {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if value, ok := tuiTracking.Load(L); ok {
+		b := value.(*tuiBinding)
+		if !s.dependsOn(b) {
+			s.deps = append(s.deps, b)
+			b.states = append(b.states, s)
+		}
+	}
+	return s.values.RawGet(key)
+}
+
+func (s *tuiState) set(L *lua.LState, key, value lua.LValue) {
+	s.mu.Lock()
+	s.values.RawSet(key, value)
+	deps := append([]*tuiBinding(nil), s.deps...)
+	s.mu.Unlock()
+	for _, b := range deps {
+		b.layout.schedule(L, b)
+	}
+}
+
+func (s *tuiState) dependsOn(b *tuiBinding) bool {
+	for _, dep := range s.deps {
+		if dep == b {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *tuiState) forget(b *tuiBinding) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, dep := range s.deps {
+		if dep == b {
+			s.deps = append(s.deps[:i], s.deps[i+1:]...)
+			return
+		}
+	}
+}
+
+// schedule recomputes a binding after a state change: on the event loop of
+// the app showing the layout, or right away before the layout is shown
+func (l *tuiLayout) schedule(L *lua.LState, b *tuiBinding) {
+	l.mu.Lock()
+	app := l.app
+	if b.dead || (app != nil && b.queued) {
+		l.mu.Unlock()
+		return
+	}
+	b.queued = app != nil
+	l.mu.Unlock()
+
+	if app == nil {
+		b.eval(L)
+		return
+	}
+	app.queue(tuiUpdate{call: func(L *lua.LState) {
+		l.mu.Lock()
+		b.queued = false
+		dead := b.dead
+		l.mu.Unlock()
+		if !dead {
+			b.eval(L)
+		}
+	}, draw: true})
+}
+
+// refresh recomputes every property of the layout
+func (l *tuiLayout) refresh(L *lua.LState) {
+	l.mu.Lock()
+	live := l.bindings[:0]
+	for _, b := range l.bindings {
+		if !b.dead {
+			live = append(live, b)
+		}
+	}
+	l.bindings = live
+	bindings := append([]*tuiBinding(nil), live...)
+	l.mu.Unlock()
+
+	for _, b := range bindings {
+		l.mu.Lock()
+		dead := b.dead
+		l.mu.Unlock()
+		if !dead {
+			b.eval(L)
+		}
+	}
+}
+
+func (l *tuiLayout) find(id string) lua.LValue {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if ud, ok := l.ids[id]; ok {
+		return ud
+	}
+	return lua.LNil
+}
+
+// eval computes the property, recording the states its function reads, and
+// applies the result
+func (b *tuiBinding) eval(L *lua.LState) {
+	b.release()
+	value := b.compute(L)
+	b.apply(L, &tuiBuilder{layout: b.layout, owner: b}, value)
+}
+
+func (b *tuiBinding) compute(L *lua.LState) lua.LValue {
+	previous, tracking := tuiTracking.Load(L)
+	tuiTracking.Store(L, b)
+	defer func() {
+		if tracking {
+			tuiTracking.Store(L, previous)
+		} else {
+			tuiTracking.Delete(L)
+		}
+	}()
+	return tuiCall(L, b.fn, 1, b.ud)
+}
+
+// release drops the states the binding read and the widgets its last
+// apply built
+func (b *tuiBinding) release() {
+	b.layout.mu.Lock()
+	released := b.layout.kill(b)
+	b.layout.mu.Unlock()
+	for _, binding := range released {
+		for _, s := range binding.states {
+			s.forget(binding)
+		}
+		tuiForgetClasses(binding.widgets)
+		binding.states, binding.widgets = nil, nil
+	}
+}
+
+// kill marks the bindings owned by b dead, unregisters the ids of the
+// widgets b built and returns the bindings whose states need releasing.
+// The layout's mutex must be held.
+func (l *tuiLayout) kill(b *tuiBinding) []*tuiBinding {
+	released := []*tuiBinding{b}
+	for _, owned := range b.owned {
+		owned.dead = true
+		released = append(released, l.kill(owned)...)
+	}
+	for _, id := range b.ids {
+		delete(l.ids, id)
+	}
+	b.owned, b.ids = nil, nil
+	return released
+}
+
+// tuiBuilder creates the widgets of a layout. Widgets built while applying
+// a computed property belong to its binding.
+type tuiBuilder struct {
+	layout *tuiLayout
+	owner  *tuiBinding
+}
+
+func (b *tuiBuilder) register(id string, ud lua.LValue) {
+	b.layout.mu.Lock()
+	defer b.layout.mu.Unlock()
+	b.layout.ids[id] = ud
+	if b.owner != nil {
+		b.owner.ids = append(b.owner.ids, id)
+	}
+}
+
+// created records a widget built for the owner, whose style classes are
+// forgotten when the owner drops it
+func (b *tuiBuilder) created(ud lua.LValue) {
+	if b.owner == nil {
+		return
+	}
+	b.layout.mu.Lock()
+	defer b.layout.mu.Unlock()
+	b.owner.widgets = append(b.owner.widgets, ud.(*lua.LUserData).Value)
+}
+
+func (b *tuiBuilder) bind(L *lua.LState, ud lua.LValue, fn *lua.LFunction, apply func(*lua.LState, *tuiBuilder, lua.LValue)) {
+	binding := &tuiBinding{layout: b.layout, ud: ud, fn: fn, apply: apply}
+	b.layout.mu.Lock()
+	b.layout.bindings = append(b.layout.bindings, binding)
+	if b.owner != nil {
+		b.owner.owned = append(b.owner.owned, binding)
+	}
+	b.layout.mu.Unlock()
+	binding.eval(L)
+}
+
+// adopt merges the layout built for an existing widget, so its ids and
+// computed properties become part of the layout being built
+func (b *tuiBuilder) adopt(p tview.Primitive) {
+	value, ok := tuiLayouts.LoadAndDelete(p)
+	if !ok {
+		return
+	}
+	other := value.(*tuiLayout)
+	other.mu.Lock()
+	defer other.mu.Unlock()
+	for id, ud := range other.ids {
+		b.register(id, ud)
+	}
+	b.layout.mu.Lock()
+	defer b.layout.mu.Unlock()
+	for _, binding := range other.bindings {
+		binding.layout = b.layout
+		b.layout.bindings = append(b.layout.bindings, binding)
+		if b.owner != nil {
+			b.owner.owned = append(b.owner.owned, binding)
+		}
+	}
+}
+
+// build creates the widget described by spec, or adopts spec when it is a
+// widget already
+func (b *tuiBuilder) build(L *lua.LState, spec lua.LValue) lua.LValue {
+	switch v := spec.(type) {
+	case *lua.LUserData:
+		if p, ok := v.Value.(tview.Primitive); ok {
+			b.adopt(p)
+			return v
+		}
+	case *lua.LTable:
+		typ := strings.ToLower(lua.LVAsString(v.RawGetString("type")))
+		constructor, ok := tuiBuildTypes[typ]
+		if !ok {
+			L.RaiseError("tui.build: unknown widget type %q", typ)
+		}
+		L.Push(L.NewFunction(constructor))
+		L.Call(0, 1)
+		ud := L.Get(-1)
+		L.Pop(1)
+		b.created(ud)
+		b.configure(L, ud, typ, v)
+		return ud
+	}
+	L.RaiseError("tui.build: widget table or widget expected, got %s", spec.Type().String())
+	return lua.LNil
+}
+
+// configure registers the widget's id and applies its content, then its
+// properties and then its callbacks, each in key order
+func (b *tuiBuilder) configure(L *lua.LState, ud lua.LValue, typ string, spec *lua.LTable) {
+	if id := spec.RawGetString("id"); id != lua.LNil {
+		b.register(id.String(), ud)
+	}
+
+	var content, properties, callbacks []string
+	spec.ForEach(func(k, _ lua.LValue) {
+		key, ok := k.(lua.LString)
+		switch {
+		case !ok || tuiBuildPlacement[string(key)]:
+		case tuiBuildContent[string(key)]:
+			content = append(content, string(key))
+		case strings.HasPrefix(string(key), "on_"):
+			callbacks = append(callbacks, string(key))
+		default:
+			properties = append(properties, string(key))
+		}
+	})
+	sort.Strings(content)
+	sort.Strings(properties)
+	sort.Strings(callbacks)
+
+	for _, key := range content {
+		b.property(L, ud, spec.RawGetString(key), tuiBuildContentApply(L, ud, typ, key))
+	}
+	for _, key := range properties {
+		b.property(L, ud, spec.RawGetString(key), tuiBuildSetter(L, ud, typ, key))
+	}
+	for _, key := range callbacks {
+		method, ok := tuiBuildCallbacks[key]
+		if !ok {
+			method = "Set" + tuiPascalCase(strings.TrimPrefix(key, "on_")) + "Func"
+		}
+		tuiBuildCall(L, ud, typ, key, method, spec.RawGetString(key))
+	}
+}
+
+// property applies a value, or binds it when it is a function
+func (b *tuiBuilder) property(L *lua.LState, ud, value lua.LValue, apply func(*lua.LState, *tuiBuilder, lua.LValue)) {
+	if fn, ok := value.(*lua.LFunction); ok {
+		b.bind(L, ud, fn, apply)
+		return
+	}
+	apply(L, b, value)
+}
+
+// tuiPascalCase turns a key such as "border_color" into "BorderColor"
+func tuiPascalCase(key string) string {
+	var sb strings.Builder
+	for _, part := range strings.Split(key, "_") {
+		if part != "" {
+			sb.WriteString(strings.ToUpper(part[:1]) + part[1:])
+		}
+	}
+	return sb.String()
+}
+
+// tuiBuildCall calls a widget method through its metatable
+func tuiBuildCall(L *lua.LState, ud lua.LValue, typ, key, method string, args ...lua.LValue) {
+	fn, ok := L.GetField(ud, method).(*lua.LFunction)
+	if !ok {
+		L.RaiseError("tui.build: %s has no property %s", typ, key)
+	}
+	L.Push(fn)
+	L.Push(ud)
+	for _, arg := range args {
+		L.Push(arg)
+	}
+	L.Call(len(args)+1, 0)
+}
+
+// tuiBuildSetter applies a property with its Set method, or with the
+// method named by the key itself, as in show_secondary_text. Lists are
+// passed as separate arguments, so rows = {3, 0, 1} calls SetRows(3, 0, 1).
+func tuiBuildSetter(L *lua.LState, ud lua.LValue, typ, key string) func(*lua.LState, *tuiBuilder, lua.LValue) {
+	method := "Set" + tuiPascalCase(key)
+	if L.GetField(ud, method) == lua.LNil {
+		method = tuiPascalCase(key)
+	}
+	return func(L *lua.LState, _ *tuiBuilder, value lua.LValue) {
+		tuiBuildCall(L, ud, typ, key, method, tuiBuildArgs(key, method, value)...)
+	}
+}
+
+// tuiBuildArgs converts a property value to the arguments of its method
+func tuiBuildArgs(key, method string, value lua.LValue) []lua.LValue {
+	if s, ok := value.(lua.LString); ok {
+		if n, ok := tuiBuildConstants[key][strings.ToLower(string(s))]; ok {
+			value = lua.LNumber(n)
+		}
+	}
+	t, ok := value.(*lua.LTable)
+	if !ok || tuiBuildListSetters[method] || t.Len() == 0 {
+		return []lua.LValue{value}
+	}
+	args := make([]lua.LValue, 0, t.Len())
+	for i := 1; i <= t.Len(); i++ {
+		args = append(args, t.RawGetInt(i))
+	}
+	return args
+}
+
+// tuiBuildContentApply returns the function filling a widget with the
+// children, items, cells, root node or buttons given for key
+func tuiBuildContentApply(L *lua.LState, ud lua.LValue, typ, key string) func(*lua.LState, *tuiBuilder, lua.LValue) {
+	widget := ud.(*lua.LUserData).Value
+	supported := false
+	switch key {
+	case "children":
+		switch widget.(type) {
+		case *tview.Flex, *tview.Grid, *tview.Pages, *tview.Form, *tview.TreeNode:
+			supported = true
+		}
+	case "items":
+		_, supported = widget.(*tview.List)
+	case "cells":
+		_, supported = widget.(*tview.Table)
+	case "root":
+		_, supported = widget.(*tview.TreeView)
+	case "buttons":
+		_, supported = widget.(*tview.Modal)
+	}
+	if !supported {
+		L.RaiseError("tui.build: %s has no property %s", typ, key)
+	}
+
+	return func(L *lua.LState, b *tuiBuilder, value lua.LValue) {
+		list, ok := value.(*lua.LTable)
+		if !ok {
+			L.RaiseError("tui.build: %s of %s must be a list, got %s", key, typ, value.Type().String())
+		}
+		switch key {
+		case "children":
+			b.children(L, ud, typ, list)
+		case "items":
+			tuiBuildCall(L, ud, typ, key, "Clear")
+			for i := 1; i <= list.Len(); i++ {
+				tuiBuildCall(L, ud, typ, key, "AddItem", tuiBuildItem(list.RawGetInt(i))...)
+			}
+		case "cells":
+			tuiBuildCall(L, ud, typ, key, "Clear")
+			for row := 1; row <= list.Len(); row++ {
+				cells, ok := list.RawGetInt(row).(*lua.LTable)
+				if !ok {
+					continue
+				}
+				for column := 1; column <= cells.Len(); column++ {
+					tuiBuildCall(L, ud, typ, key, "SetCell",
+						lua.LNumber(row-1), lua.LNumber(column-1), cells.RawGetInt(column))
+				}
+			}
+		case "root":
+			node := b.node(L, list)
+			tuiBuildCall(L, ud, typ, key, "SetRoot", node)
+			tuiBuildCall(L, ud, typ, key, "SetCurrentNode", node)
+		case "buttons":
+			tuiBuildCall(L, ud, typ, key, "ClearButtons")
+			tuiBuildCall(L, ud, typ, key, "AddButtons", list)
+		}
+	}
+}
+
+// tuiBuildItem returns the AddItem arguments for a list item given as text
+// or as {text, secondary, shortcut, on_selected}
+func tuiBuildItem(item lua.LValue) []lua.LValue {
+	t, ok := item.(*lua.LTable)
+	if !ok {
+		return []lua.LValue{lua.LString(item.String())}
+	}
+	field := func(key string, index int) lua.LValue {
+		if value := t.RawGetString(key); value != lua.LNil {
+			return value
+		}
+		return t.RawGetInt(index)
+	}
+	text, secondary, shortcut := field("text", 1), field("secondary", 2), field("shortcut", 3)
+	if secondary == lua.LNil {
+		secondary = lua.LString("")
+	}
+	if shortcut == lua.LNil {
+		shortcut = lua.LString("")
+	}
+	return []lua.LValue{lua.LString(text.String()), secondary, shortcut, field("on_selected", 4)}
+}
+
+// node builds a tree node and its children from a table of node properties
+func (b *tuiBuilder) node(L *lua.LState, spec *lua.LTable) lua.LValue {
+	ud := tuiNewUserData(L, tview.NewTreeNode(""))
+	b.configure(L, ud, "treenode", spec)
+	return ud
+}
+
+// tuiBuildOpt reads a placement option of a child
+func tuiBuildOpt(child lua.LValue, key string, def int) int {
+	if t, ok := child.(*lua.LTable); ok {
+		if n, ok := t.RawGetString(key).(lua.LNumber); ok {
+			return int(n)
+		}
+	}
+	return def
+}
+
+func tuiBuildOptBool(child lua.LValue, key string, def bool) bool {
+	if t, ok := child.(*lua.LTable); ok {
+		if value := t.RawGetString(key); value != lua.LNil {
+			return lua.LVAsBool(value)
+		}
+	}
+	return def
+}
+
+func tuiBuildOptString(child lua.LValue, key string, def string) string {
+	if t, ok := child.(*lua.LTable); ok {
+		if value := t.RawGetString(key); value != lua.LNil {
+			return value.String()
+		}
+	}
+	return def
+}
+
+// children replaces the contents of a container with the widgets built from
+// list, placed with the size, proportion, row, column, name and similar
+// keys of each child
+func (b *tuiBuilder) children(L *lua.LState, ud lua.LValue, typ string, list *lua.LTable) {
+	switch container := ud.(*lua.LUserData).Value.(type) {
+	case *tview.Flex:
+		container.Clear()
+		for i := 1; i <= list.Len(); i++ {
+			child := list.RawGetInt(i)
+			item := b.build(L, child).(*lua.LUserData).Value.(tview.Primitive)
+			container.AddItem(item, tuiBuildOpt(child, "size", 0),
+				tuiBuildOpt(child, "proportion", 1), tuiBuildOptBool(child, "focus", false))
+		}
+	case *tview.Grid:
+		container.Clear()
+		for i := 1; i <= list.Len(); i++ {
+			child := list.RawGetInt(i)
+			item := b.build(L, child).(*lua.LUserData).Value.(tview.Primitive)
+			container.AddItem(item, tuiBuildOpt(child, "row", 0), tuiBuildOpt(child, "column", 0),
+				tuiBuildOpt(child, "row_span", 1), tuiBuildOpt(child, "column_span", 1),
+				tuiBuildOpt(child, "min_height", 0), tuiBuildOpt(child, "min_width", 0),
+				tuiBuildOptBool(child, "focus", false))
+		}
+	case *tview.Pages:
+		for _, name := range container.GetPageNames(false) {
+			container.RemovePage(name)
+		}
+		for i := 1; i <= list.Len(); i++ {
+			child := list.RawGetInt(i)
+			item := b.build(L, child).(*lua.LUserData).Value.(tview.Primitive)
+			// Pages are named by name or id; only the first is visible
+			name := tuiBuildOptString(child, "name", tuiBuildOptString(child, "id", lua.LNumber(i).String()))
+			container.AddPage(name, item, tuiBuildOptBool(child, "resize", true),
+				tuiBuildOptBool(child, "visible", i == 1))
+		}
+	case *tview.Form:
+		container.Clear(true)
+		for i := 1; i <= list.Len(); i++ {
+			child := list.RawGetInt(i)
+			// Forms create their own buttons, so button tables configure one
+			if t, ok := child.(*lua.LTable); ok && strings.EqualFold(lua.LVAsString(t.RawGetString("type")), "button") {
+				container.AddButton("", nil)
+				button := tuiNewUserData(L, container.GetButton(container.GetButtonCount()-1))
+				b.created(button)
+				b.configure(L, button, "button", t)
+				continue
+			}
+			item, ok := b.build(L, child).(*lua.LUserData).Value.(tview.FormItem)
+			if !ok {
+				L.RaiseError("tui.build: form children must be form items or buttons")
+			}
+			container.AddFormItem(item)
+		}
+	case *tview.TreeNode:
+		container.ClearChildren()
+		for i := 1; i <= list.Len(); i++ {
+			child, ok := list.RawGetInt(i).(*lua.LTable)
+			if !ok {
+				L.RaiseError("tui.build: tree node children must be tables")
+			}
+			container.AddChild(b.node(L, child).(*lua.LUserData).Value.(*tview.TreeNode))
+		}
+	default:
+		L.RaiseError("tui.build: %s has no property children", typ)
+	}
+}
+
+// luaTUIBuild creates a widget tree from nested tables
+func luaTUIBuild(L *lua.LState) int {
+	spec := L.CheckTable(1)
+	layout := &tuiLayout{ids: map[string]lua.LValue{}}
+	root := (&tuiBuilder{layout: layout}).build(L, spec)
+	if p, ok := root.(*lua.LUserData).Value.(tview.Primitive); ok {
+		tuiLayouts.Store(p, layout)
+	}
+	L.Push(root)
+	return 1
+}
+
+// luaTUIState creates a table whose changes recompute the built properties
+// reading it. Values are read and assigned by key; changes inside a nested
+// table go unnoticed until the table is assigned again.
+func luaTUIState(L *lua.LState) int {
+	s := &tuiState{values: L.NewTable()}
+	if initial := L.OptTable(1, nil); initial != nil {
+		initial.ForEach(func(k, v lua.LValue) {
+			s.values.RawSet(k, v)
+		})
+	}
+
+	mt := L.NewTable()
+	L.SetField(mt, "__index", L.NewFunction(func(L *lua.LState) int {
+		L.Push(s.get(L, L.Get(2)))
+		return 1
+	}))
+	L.SetField(mt, "__newindex", L.NewFunction(func(L *lua.LState) int {
+		s.set(L, L.Get(2), L.Get(3))
+		return 0
+	}))
+	state := L.NewTable()
+	L.SetMetatable(state, mt)
+	L.Push(state)
+	return 1
+}
+
+// attach connects the layout built for root, if any, to the app
+func (a *TUIApp) attach(root tview.Primitive) {
+	var layout *tuiLayout
+	if value, ok := tuiLayouts.Load(root); ok {
+		layout = value.(*tuiLayout)
+		layout.mu.Lock()
+		layout.app = a
+		layout.mu.Unlock()
+	}
+	a.mu.Lock()
+	a.layout = layout
+	a.mu.Unlock()
+}
+
+// find returns the widget registered with id in the root's layout
+func (a *TUIApp) find(id string) lua.LValue {
+	a.mu.Lock()
+	layout := a.layout
+	a.mu.Unlock()
+	if layout == nil {
+		return lua.LNil
+	}
+	return layout.find(id)
+}
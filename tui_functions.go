@@ -0,0 +1,997 @@
+// tui_functions.go - Terminal user interfaces built on tview
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+	"github.com/yuin/gopher-lua"
+)
+
+// Widgets are exposed with tview's method names. Setters return the widget
+// so calls can be chained, and indices are zero-based as in tview. Lua
+// callbacks run on the goroutine that called app:Run().
+
+// TUIApp is a tview application together with the Lua functions queued for
+// its event loop by app:QueueUpdate
+type TUIApp struct {
+	*tview.Application
+	mu      sync.Mutex
+	L       *lua.LState // state that called Run; queued functions run in it
+	pending []tuiUpdate
+	pumping bool
+	err     error         // first error raised by a callback, see fail
+	stopped chan struct{} // closed when Run returns
+
+	pasteCapture func(text string) (string, bool)
+	keyCapture   func(event *tcell.EventKey) *tcell.EventKey
+
+	keys    []*tuiKeyBinding // see app:Bind
+	chord   []string         // keys of an unfinished chord
+	overlay *tuiOverlay      // help or command palette shown over the root
+
+	root     *tuiRoot
+	layout   *tuiLayout   // built by tui.build for the root, see app:Find
+	headless *tuiHeadless // set for apps drawing to a simulated screen
+}
+
+// tuiUpdate is a queued Lua function and its arguments, or a Go function
+// run in the app's state. Updates without either only redraw the screen.
+type tuiUpdate struct {
+	fn   *lua.LFunction
+	args []lua.LValue
+	call func(L *lua.LState)
+	draw bool
+}
+
+// NewTUIApp returns a new application
+func NewTUIApp() *TUIApp {
+	app := &TUIApp{Application: tview.NewApplication()}
+	app.SetInputCapture(app.captureKey)
+	return app
+}
+
+// queue adds an update for the event loop without waiting for it. tview's
+// QueueUpdate blocks until the update has run, which would deadlock when
+// called from a callback or before Run, so a goroutine hands the pending
+// updates over instead.
+func (a *TUIApp) queue(update tuiUpdate) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pending = append(a.pending, update)
+	if a.headless != nil {
+		// Headless apps run their updates at the next test step
+		return
+	}
+	if !a.pumping {
+		a.pumping = true
+		go a.Application.QueueUpdate(a.runPending)
+	}
+}
+
+// runPending runs the queued updates on the event loop in the order they
+// were queued and redraws once if any of them asked for it
+func (a *TUIApp) runPending() {
+	a.mu.Lock()
+	updates, L := a.pending, a.L
+	a.pending, a.pumping = nil, false
+	a.mu.Unlock()
+
+	draw := false
+	for _, update := range updates {
+		if a.failure() != nil {
+			return
+		}
+		if update.fn != nil {
+			tuiCall(L, update.fn, 0, update.args...)
+		}
+		if update.call != nil {
+			call := update.call
+			L.Push(L.NewFunction(func(L *lua.LState) int {
+				call(L)
+				return 0
+			}))
+			tuiPCall(L, 0, 0)
+		}
+		draw = draw || update.draw
+	}
+	if draw {
+		a.ForceDraw()
+	}
+}
+
+// run runs the event loop; queued Lua functions run in the state L
+func (a *TUIApp) run(L *lua.LState) error {
+	a.mu.Lock()
+	a.L = L
+	a.err = nil
+	a.stopped = make(chan struct{})
+	a.mu.Unlock()
+
+	tuiRunning.Lock()
+	tuiRunning.apps[L] = a
+	tuiRunning.Unlock()
+	defer func() {
+		tuiRunning.Lock()
+		delete(tuiRunning.apps, L)
+		tuiRunning.Unlock()
+		close(a.stopped)
+	}()
+	return a.Application.Run()
+}
+
+// fail stops the app after a callback raised err; app:Run raises the first
+// such error once the event loop has ended
+func (a *TUIApp) fail(err error) {
+	a.mu.Lock()
+	if a.err == nil {
+		a.err = err
+	}
+	a.mu.Unlock()
+	a.Stop()
+}
+
+// failure returns the error passed to fail, if any
+func (a *TUIApp) failure() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.err
+}
+
+// tuiRunning maps Lua states to the app running its event loop in them
+var tuiRunning = struct {
+	sync.Mutex
+	apps map[*lua.LState]*TUIApp
+}{apps: make(map[*lua.LState]*TUIApp)}
+
+// tuiRunningApp returns the app running its event loop in L, or nil
+func tuiRunningApp(L *lua.LState) *TUIApp {
+	tuiRunning.Lock()
+	defer tuiRunning.Unlock()
+	return tuiRunning.apps[L]
+}
+
+// tuiEnter runs fn, which calls into L from another goroutine, such as an
+// HTTP or WebSocket handler. A Lua state runs one call at a time, so while
+// an app runs its event loop in L, fn waits its turn on the event loop with
+// the app's callbacks; otherwise it runs at once.
+func tuiEnter(L *lua.LState, fn func()) {
+	app := tuiRunningApp(L)
+	if app == nil {
+		fn()
+		return
+	}
+	app.mu.Lock()
+	stopped := app.stopped
+	app.mu.Unlock()
+
+	// Whichever of the event loop and a stopped app claims fn runs it, so
+	// it runs exactly once
+	var claimed int32
+	done := make(chan struct{})
+	app.queue(tuiUpdate{call: func(*lua.LState) {
+		defer close(done)
+		if atomic.CompareAndSwapInt32(&claimed, 0, 1) {
+			fn()
+		}
+	}})
+	select {
+	case <-done:
+	case <-stopped:
+		if atomic.CompareAndSwapInt32(&claimed, 0, 1) {
+			fn()
+		} else {
+			<-done
+		}
+	}
+}
+
+func registerTUIFunctions(L *lua.LState) {
+	// Create TUI module
+	tuiModule := L.NewTable()
+
+	// Basic TUI functions
+	L.SetField(tuiModule, "newApp", L.NewFunction(luaNewApp))
+	L.SetField(tuiModule, "newTextView", L.NewFunction(luaNewTextView))
+	L.SetField(tuiModule, "newInputField", L.NewFunction(luaNewInputField))
+	L.SetField(tuiModule, "newButton", L.NewFunction(luaNewButton))
+	L.SetField(tuiModule, "newFlex", L.NewFunction(luaNewFlex))
+
+	// Widgets from tui_widgets_functions.go
+	L.SetField(tuiModule, "newList", L.NewFunction(luaNewList))
+	L.SetField(tuiModule, "newTable", L.NewFunction(luaNewTable))
+	L.SetField(tuiModule, "newTreeView", L.NewFunction(luaNewTreeView))
+	L.SetField(tuiModule, "newTreeNode", L.NewFunction(luaNewTreeNode))
+	L.SetField(tuiModule, "newForm", L.NewFunction(luaNewForm))
+	L.SetField(tuiModule, "newModal", L.NewFunction(luaNewModal))
+	L.SetField(tuiModule, "newPages", L.NewFunction(luaNewPages))
+	L.SetField(tuiModule, "newGrid", L.NewFunction(luaNewGrid))
+	L.SetField(tuiModule, "newDropDown", L.NewFunction(luaNewDropDown))
+	L.SetField(tuiModule, "newCheckbox", L.NewFunction(luaNewCheckbox))
+	L.SetField(tuiModule, "newProgressBar", L.NewFunction(luaNewProgressBar))
+
+	// Declarative layouts from tui_build_functions.go
+	L.SetField(tuiModule, "build", L.NewFunction(luaTUIBuild))
+	L.SetField(tuiModule, "state", L.NewFunction(luaTUIState))
+
+	// Themes and style classes from tui_theme_functions.go
+	L.SetField(tuiModule, "setTheme", L.NewFunction(luaTUISetTheme))
+	L.SetField(tuiModule, "getTheme", L.NewFunction(luaTUIGetTheme))
+	L.SetField(tuiModule, "setClass", L.NewFunction(luaTUISetClass))
+
+	L.SetGlobal("tui", tuiModule)
+	L.PreloadModule("tui", func(L *lua.LState) int {
+		L.Push(tuiModule)
+		return 1
+	})
+
+	// Set up metatables for TUI objects
+	setupTUIMetatables(L)
+}
+
+// tuiTypes lists the metatable name and __index function of each wrapped type
+var tuiTypes = []struct {
+	name  string
+	index lua.LGFunction
+}{
+	{"App", appIndex},
+	{"TextView", textViewIndex},
+	{"InputField", inputFieldIndex},
+	{"Button", buttonIndex},
+	{"Flex", flexIndex},
+	{"List", listIndex},
+	{"Table", tableIndex},
+	{"TreeView", treeViewIndex},
+	{"TreeNode", treeNodeIndex},
+	{"Form", formIndex},
+	{"Modal", modalIndex},
+	{"Pages", pagesIndex},
+	{"Grid", gridIndex},
+	{"DropDown", dropDownIndex},
+	{"Checkbox", checkboxIndex},
+	{"ProgressBar", progressBarIndex},
+	{"Event", eventIndex},
+	{"MouseEvent", mouseEventIndex},
+}
+
+func setupTUIMetatables(L *lua.LState) {
+	for _, t := range tuiTypes {
+		mt := L.NewTypeMetatable(t.name)
+		L.SetField(mt, "__index", L.NewFunction(t.index))
+	}
+}
+
+// tuiNewUserData wraps a tview object in userdata with the metatable of
+// its type. Tree nodes keep their userdata so callbacks receive the same
+// object the script created.
+func tuiNewUserData(L *lua.LState, value interface{}) lua.LValue {
+	var name string
+	switch v := value.(type) {
+	case *TUIApp:
+		name = "App"
+	case *tview.TextView:
+		name = "TextView"
+	case *tview.InputField:
+		name = "InputField"
+	case *tview.Button:
+		name = "Button"
+	case *tview.Flex:
+		name = "Flex"
+	case *tview.List:
+		name = "List"
+	case *tview.Table:
+		name = "Table"
+	case *tview.TreeView:
+		name = "TreeView"
+	case *tview.TreeNode:
+		if v == nil {
+			return lua.LNil
+		}
+		return tuiTreeNodeUserData(L, v)
+	case *tview.Form:
+		name = "Form"
+	case *tview.Modal:
+		name = "Modal"
+	case *tview.Pages:
+		name = "Pages"
+	case *tview.Grid:
+		name = "Grid"
+	case *tview.DropDown:
+		name = "DropDown"
+	case *tview.Checkbox:
+		name = "Checkbox"
+	case *TUIProgressBar:
+		name = "ProgressBar"
+	case *tcell.EventKey:
+		name = "Event"
+	case *tcell.EventMouse:
+		name = "MouseEvent"
+	case *tuiRoot:
+		return tuiNewUserData(L, v.Primitive)
+	default:
+		return lua.LNil
+	}
+
+	ud := L.NewUserData()
+	ud.Value = value
+	L.SetMetatable(ud, L.GetTypeMetatable(name))
+	return ud
+}
+
+// tuiCheckPrimitive returns the widget passed as argument n
+func tuiCheckPrimitive(L *lua.LState, n int) tview.Primitive {
+	ud := L.CheckUserData(n)
+	p, ok := ud.Value.(tview.Primitive)
+	if !ok {
+		L.ArgError(n, "expected tview primitive")
+	}
+	return p
+}
+
+// tuiCheckColor reads a color given as a 256-color palette index, an RGB
+// number such as 0xff8800, or a string parsed by tuiParseColor: a name such
+// as "red" or "primary", "#rrggbb" or "rgb(r, g, b)"
+func tuiCheckColor(L *lua.LState, n int) tcell.Color {
+	switch v := L.Get(n).(type) {
+	case lua.LNumber:
+		if v >= 0 && v < 256 {
+			return tcell.PaletteColor(int(v))
+		}
+		if v >= 256 && v <= 0xffffff {
+			return tcell.NewHexColor(int32(v))
+		}
+		L.ArgError(n, "color number out of range")
+	case lua.LString:
+		if color, ok := tuiParseColor(string(v)); ok {
+			return color
+		}
+		L.ArgError(n, "unknown color "+string(v))
+	}
+	L.ArgError(n, "color number or name expected")
+	return tcell.ColorDefault
+}
+
+// tuiCheckStrings reads a list of strings
+func tuiCheckStrings(L *lua.LState, n int) []string {
+	table := L.CheckTable(n)
+	values := make([]string, 0, table.Len())
+	for i := 1; i <= table.Len(); i++ {
+		values = append(values, table.RawGetInt(i).String())
+	}
+	return values
+}
+
+// tuiOptRune reads an optional shortcut given as a one-character string
+func tuiOptRune(L *lua.LState, n int) rune {
+	s := L.OptString(n, "")
+	for _, r := range s {
+		return r
+	}
+	return 0
+}
+
+// tuiCall calls a Lua callback from a tview handler and returns its first
+// result, or nil when nret is zero or the callback failed
+func tuiCall(L *lua.LState, fn *lua.LFunction, nret int, args ...lua.LValue) lua.LValue {
+	L.Push(fn)
+	for _, arg := range args {
+		L.Push(arg)
+	}
+	if !tuiPCall(L, len(args), nret) || nret == 0 {
+		return lua.LNil
+	}
+	result := L.Get(-nret)
+	L.Pop(nret)
+	return result
+}
+
+// tuiPCall calls the function below nargs arguments on the stack and
+// reports whether it succeeded. While an app runs its event loop in L, an
+// error stops the app rather than unwinding through tview, and app:Run
+// raises it; otherwise, as in headless apps, the error is raised at once.
+func tuiPCall(L *lua.LState, nargs, nret int) bool {
+	app := tuiRunningApp(L)
+	if app == nil {
+		L.Call(nargs, nret)
+		return true
+	}
+	if err := L.PCall(nargs, nret, nil); err != nil {
+		app.fail(err)
+		return false
+	}
+	return true
+}
+
+// tuiBoxIndex pushes the methods every widget inherits from tview.Box, or
+// nil for unknown methods
+func tuiBoxIndex(L *lua.LState, ud *lua.LUserData, box *tview.Box, method string) {
+	switch method {
+	case "SetBorder":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			box.SetBorder(L.CheckBool(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetBorderColor":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			box.SetBorderColor(tuiCheckColor(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetBorderPadding":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			box.SetBorderPadding(L.CheckInt(2), L.CheckInt(3), L.CheckInt(4), L.CheckInt(5))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetBackgroundColor":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			box.SetBackgroundColor(tuiCheckColor(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetTitle":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			box.SetTitle(L.CheckString(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "GetTitle":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LString(box.GetTitle()))
+			return 1
+		}))
+	case "SetTitleColor":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			box.SetTitleColor(tuiCheckColor(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetTitleAlign":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			box.SetTitleAlign(L.CheckInt(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "GetRect":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			x, y, width, height := box.GetRect()
+			L.Push(lua.LNumber(x))
+			L.Push(lua.LNumber(y))
+			L.Push(lua.LNumber(width))
+			L.Push(lua.LNumber(height))
+			return 4
+		}))
+	case "InRect":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LBool(box.InRect(L.CheckInt(2), L.CheckInt(3))))
+			return 1
+		}))
+	case "SetInputCapture":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			box.SetInputCapture(tuiKeyCapture(L, L.CheckFunction(2)))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetMouseCapture":
+		// Containers pass mouse events to all their items; use InRect to
+		// check the event position
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			fn := L.CheckFunction(2)
+			box.SetMouseCapture(func(action tview.MouseAction, event *tcell.EventMouse) (tview.MouseAction, *tcell.EventMouse) {
+				event, action = tuiMouseCapture(L, fn, event, action)
+				if event == nil {
+					return tview.MouseConsumed, nil
+				}
+				return action, event
+			})
+			L.Push(ud)
+			return 1
+		}))
+	case "HasFocus":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			// Containers override HasFocus to include their items
+			L.Push(lua.LBool(ud.Value.(tview.Primitive).HasFocus()))
+			return 1
+		}))
+	case "SetFocusFunc":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			fn := L.CheckFunction(2)
+			box.SetFocusFunc(func() {
+				tuiCall(L, fn, 0)
+			})
+			L.Push(ud)
+			return 1
+		}))
+	case "SetBlurFunc":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			fn := L.CheckFunction(2)
+			box.SetBlurFunc(func() {
+				tuiCall(L, fn, 0)
+			})
+			L.Push(ud)
+			return 1
+		}))
+	case "SetClass":
+		// Style classes from tui.setClass, separated by spaces
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			tuiSetClasses(L, ud, L.OptString(2, ""))
+			L.Push(ud)
+			return 1
+		}))
+	case "GetClass":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LString(tuiGetClasses(ud)))
+			return 1
+		}))
+	default:
+		L.Push(lua.LNil)
+	}
+}
+
+// TUI Constructor Functions
+// tui.newApp({headless=, width=, height=}) creates an application. Headless
+// apps draw to a simulated screen for tests (see tui_headless_functions.go).
+func luaNewApp(L *lua.LState) int {
+	app := NewTUIApp()
+	opts := L.OptTable(1, nil)
+	if env := os.Getenv(tuiHeadlessEnv); env != "" {
+		width, height := tuiHeadlessSize(env)
+		app.newHeadless(width, height)
+		app.headless.print = true
+	} else if opts != nil && lua.LVAsBool(opts.RawGetString("headless")) {
+		width, height := 80, 24
+		if v, ok := opts.RawGetString("width").(lua.LNumber); ok {
+			width = int(v)
+		}
+		if v, ok := opts.RawGetString("height").(lua.LNumber); ok {
+			height = int(v)
+		}
+		app.newHeadless(width, height)
+	}
+	L.Push(tuiNewUserData(L, app))
+	return 1
+}
+
+func luaNewTextView(L *lua.LState) int {
+	text := L.OptString(1, "")
+	textView := tview.NewTextView().SetText(text).SetDynamicColors(true).SetWrap(true)
+	L.Push(tuiNewUserData(L, textView))
+	return 1
+}
+
+func luaNewInputField(L *lua.LState) int {
+	L.Push(tuiNewUserData(L, tview.NewInputField()))
+	return 1
+}
+
+func luaNewButton(L *lua.LState) int {
+	label := L.OptString(1, "")
+	L.Push(tuiNewUserData(L, tview.NewButton(label)))
+	return 1
+}
+
+func luaNewFlex(L *lua.LState) int {
+	L.Push(tuiNewUserData(L, tview.NewFlex()))
+	return 1
+}
+
+// TUI Method Handlers
+func appIndex(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	app := ud.Value.(*TUIApp)
+	method := L.CheckString(2)
+
+	switch method {
+	case "SetRoot":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			root := tuiCheckPrimitive(L, 2)
+			fullscreen := L.OptBool(3, true)
+			app.root = &tuiRoot{Primitive: root, app: app}
+			app.attach(root)
+			app.SetRoot(app.root, fullscreen)
+			L.Push(ud)
+			return 1
+		}))
+	case "Run":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			if app.headless != nil {
+				// Headless apps draw once; tests then drive them step by step
+				app.step(L)
+				app.ForceDraw()
+				if app.headless.print {
+					fmt.Println(app.screenText())
+				}
+				return 0
+			}
+			if err := app.run(L); err != nil {
+				L.Push(lua.LString(err.Error()))
+				return 1
+			}
+			if err, ok := app.failure().(*lua.ApiError); ok {
+				L.Error(err.Object, 0)
+			}
+			return 0
+		}))
+	case "Stop":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			if app.headless != nil {
+				app.headless.stopped = true
+			} else {
+				app.Stop()
+			}
+			return 0
+		}))
+	case "Draw":
+		// Redraws after the current event instead of waiting for the event
+		// loop, so it can be called from callbacks and before Run
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			app.queue(tuiUpdate{draw: true})
+			L.Push(ud)
+			return 1
+		}))
+	case "QueueUpdate", "QueueUpdateDraw":
+		// app:QueueUpdate(fn, ...) calls fn(...) on the event loop, where it
+		// may safely change widgets. It returns at once, so it can be called
+		// from HTTP and WebSocket handlers, callbacks and before Run.
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			update := tuiUpdate{fn: L.CheckFunction(2), draw: method == "QueueUpdateDraw"}
+			for i := 3; i <= L.GetTop(); i++ {
+				update.args = append(update.args, L.Get(i))
+			}
+			app.queue(update)
+			L.Push(ud)
+			return 1
+		}))
+	case "Find", "find":
+		// Returns the widget built by tui.build with the given id
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(app.find(L.CheckString(2)))
+			return 1
+		}))
+	case "Refresh":
+		// Recomputes the properties of the built root given as functions
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			app.queue(tuiUpdate{call: func(L *lua.LState) {
+				app.mu.Lock()
+				layout := app.layout
+				app.mu.Unlock()
+				if layout != nil {
+					layout.refresh(L)
+				}
+			}, draw: true})
+			L.Push(ud)
+			return 1
+		}))
+	case "SetFocus":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			app.SetFocus(tuiCheckPrimitive(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	case "GetFocus":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(tuiNewUserData(L, app.GetFocus()))
+			return 1
+		}))
+	case "SetInputCapture":
+		// Runs after the key bindings
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			capture := tuiKeyCapture(L, L.CheckFunction(2))
+			app.mu.Lock()
+			app.keyCapture = capture
+			app.mu.Unlock()
+			L.Push(ud)
+			return 1
+		}))
+	case "SetMouseCapture":
+		// fn(event, action) returns nil to consume the event
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			fn := L.CheckFunction(2)
+			app.SetMouseCapture(func(event *tcell.EventMouse, action tview.MouseAction) (*tcell.EventMouse, tview.MouseAction) {
+				return tuiMouseCapture(L, fn, event, action)
+			})
+			L.Push(ud)
+			return 1
+		}))
+	case "SetPasteCapture":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			capture := tuiPasteCapture(L, L.CheckFunction(2))
+			app.mu.Lock()
+			app.pasteCapture = capture
+			app.mu.Unlock()
+			L.Push(ud)
+			return 1
+		}))
+	case "EnableMouse":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			app.EnableMouse(L.OptBool(2, true))
+			L.Push(ud)
+			return 1
+		}))
+	case "EnablePaste":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			app.EnablePaste(L.OptBool(2, true))
+			L.Push(ud)
+			return 1
+		}))
+	default:
+		if !tuiHeadlessIndex(L, ud, app, method) && !tuiKeysIndex(L, ud, app, method) {
+			L.Push(lua.LNil)
+		}
+	}
+
+	return 1
+}
+
+func textViewIndex(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	textView := ud.Value.(*tview.TextView)
+	method := L.CheckString(2)
+
+	switch method {
+	case "SetText":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			textView.SetText(L.CheckString(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "GetText":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LString(textView.GetText(false)))
+			return 1
+		}))
+	case "Clear":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			textView.Clear()
+			L.Push(ud)
+			return 1
+		}))
+	case "SetWrap":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			textView.SetWrap(L.CheckBool(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetWordWrap":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			textView.SetWordWrap(L.CheckBool(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetTextAlign":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			textView.SetTextAlign(L.CheckInt(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetTextColor":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			textView.SetTextColor(tuiCheckColor(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetDynamicColors":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			textView.SetDynamicColors(L.CheckBool(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetRegions":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			textView.SetRegions(L.CheckBool(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetScrollable":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			textView.SetScrollable(L.CheckBool(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "ScrollToBeginning":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			textView.ScrollToBeginning()
+			L.Push(ud)
+			return 1
+		}))
+	case "ScrollToEnd":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			textView.ScrollToEnd()
+			L.Push(ud)
+			return 1
+		}))
+	case "SetChangedFunc":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			fn := L.CheckFunction(2)
+			textView.SetChangedFunc(func() {
+				tuiCall(L, fn, 0)
+			})
+			L.Push(ud)
+			return 1
+		}))
+	default:
+		tuiBoxIndex(L, ud, textView.Box, method)
+	}
+
+	return 1
+}
+
+func inputFieldIndex(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	inputField := ud.Value.(*tview.InputField)
+	method := L.CheckString(2)
+
+	switch method {
+	case "SetLabel":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			inputField.SetLabel(L.CheckString(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetPlaceholder":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			inputField.SetPlaceholder(L.CheckString(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "GetText":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LString(inputField.GetText()))
+			return 1
+		}))
+	case "SetText":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			inputField.SetText(L.CheckString(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetFieldWidth":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			inputField.SetFieldWidth(L.CheckInt(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetMaskCharacter":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			inputField.SetMaskCharacter(tuiOptRune(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetChangedFunc":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			fn := L.CheckFunction(2)
+			inputField.SetChangedFunc(func(text string) {
+				tuiCall(L, fn, 0, lua.LString(text))
+			})
+			L.Push(ud)
+			return 1
+		}))
+	case "SetDoneFunc":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			fn := L.CheckFunction(2)
+			inputField.SetDoneFunc(func(key tcell.Key) {
+				tuiCall(L, fn, 0, lua.LNumber(key))
+			})
+			L.Push(ud)
+			return 1
+		}))
+	case "SetLabelColor":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			inputField.SetLabelColor(tuiCheckColor(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetFieldBackgroundColor":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			inputField.SetFieldBackgroundColor(tuiCheckColor(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetFieldTextColor":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			inputField.SetFieldTextColor(tuiCheckColor(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	default:
+		tuiBoxIndex(L, ud, inputField.Box, method)
+	}
+
+	return 1
+}
+
+func buttonIndex(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	button := ud.Value.(*tview.Button)
+	method := L.CheckString(2)
+
+	switch method {
+	case "SetLabel":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			button.SetLabel(L.CheckString(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "GetLabel":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LString(button.GetLabel()))
+			return 1
+		}))
+	case "SetSelectedFunc":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			fn := L.CheckFunction(2)
+			button.SetSelectedFunc(func() {
+				tuiCall(L, fn, 0)
+			})
+			L.Push(ud)
+			return 1
+		}))
+	case "SetLabelColor":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			button.SetLabelColor(tuiCheckColor(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	default:
+		tuiBoxIndex(L, ud, button.Box, method)
+	}
+
+	return 1
+}
+
+func flexIndex(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	flex := ud.Value.(*tview.Flex)
+	method := L.CheckString(2)
+
+	switch method {
+	case "SetDirection":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			flex.SetDirection(L.CheckInt(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "AddItem":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			item := tuiCheckPrimitive(L, 2)
+			fixedSize := L.CheckInt(3)
+			proportion := L.CheckInt(4)
+			focus := L.OptBool(5, false)
+			flex.AddItem(item, fixedSize, proportion, focus)
+			L.Push(ud)
+			return 1
+		}))
+	case "RemoveItem":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			flex.RemoveItem(tuiCheckPrimitive(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	case "ResizeItem":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			flex.ResizeItem(tuiCheckPrimitive(L, 2), L.CheckInt(3), L.CheckInt(4))
+			L.Push(ud)
+			return 1
+		}))
+	case "Clear":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			flex.Clear()
+			L.Push(ud)
+			return 1
+		}))
+	case "GetItemCount":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LNumber(flex.GetItemCount()))
+			return 1
+		}))
+	default:
+		tuiBoxIndex(L, ud, flex.Box, method)
+	}
+
+	return 1
+}
@@ -0,0 +1,853 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+	"github.com/yuin/gopher-lua"
+)
+
+// runTUIScript runs a Lua script with the tui module and a press(widget,
+// key, rune) function that focuses a widget, the way the application
+// would, and sends a key event to its input handler
+func runTUIScript(t *testing.T, script string) {
+	t.Helper()
+	L := lua.NewState()
+	defer L.Close()
+	registerTUIFunctions(L)
+	L.SetGlobal("press", L.NewFunction(func(L *lua.LState) int {
+		p := tuiCheckPrimitive(L, 1)
+		key := tcell.Key(L.CheckInt(2))
+		event := tcell.NewEventKey(key, tuiOptRune(L, 3), tcell.ModNone)
+		var focus func(p tview.Primitive)
+		focus = func(p tview.Primitive) { p.Focus(focus) }
+		focus(p)
+		if handler := p.InputHandler(); handler != nil {
+			handler(event, focus)
+		}
+		return 0
+	}))
+
+	if err := L.DoString(script); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTUIList(t *testing.T) {
+	runTUIScript(t, `
+		local list = tui.newList()
+		local picked, changed, item = nil, nil, false
+		list:AddItem("one", "first", "a", function() item = true end)
+			:AddItem("two", "second", "b")
+			:SetSelectedFunc(function(i, main, secondary, shortcut) picked = {i, main, secondary, shortcut} end)
+			:SetChangedFunc(function(i) changed = i end)
+		assert(list:GetItemCount() == 2)
+
+		press(list, 256, "b")
+		assert(changed == 1, "changed")
+		assert(picked[1] == 1 and picked[2] == "two" and picked[3] == "second" and picked[4] == "b")
+
+		list:SetCurrentItem(0)
+		press(list, 13)
+		assert(item and picked[2] == "one")
+		local main, secondary = list:GetItemText(0)
+		assert(main == "one" and secondary == "first")
+		assert(list:SetTitle("items"):GetTitle() == "items")
+	`)
+}
+
+func TestTUITable(t *testing.T) {
+	runTUIScript(t, `
+		local tbl = tui.newTable()
+		tbl:SetCell(0, 0, "name"):SetCell(0, 1, {text = "age", color = "yellow", selectable = false})
+		tbl:SetCell(1, 0, "alice"):SetCell(1, 1, 42)
+		tbl:SetCell(2, 0, "bob"):SetCell(2, 1, 7)
+		assert(tbl:GetRowCount() == 3 and tbl:GetColumnCount() == 2)
+		assert(tbl:GetCell(1, 1) == "42")
+		assert(tbl:GetCell(9, 9) == "")
+
+		local selected, moved
+		tbl:SetSelectable(true, true):SetFixed(1, 0)
+			:SetSelectedFunc(function(row, col) selected = {row, col} end)
+			:SetSelectionChangedFunc(function(row, col) moved = {row, col} end)
+		tbl:Select(1, 0)
+		press(tbl, 258)
+		assert(moved[1] == 2 and moved[2] == 0)
+		press(tbl, 13)
+		assert(selected[1] == 2 and selected[2] == 0)
+		local row, col = tbl:GetSelection()
+		assert(row == 2 and col == 0)
+	`)
+}
+
+func TestTUITreeView(t *testing.T) {
+	runTUIScript(t, `
+		local root = tui.newTreeNode("root")
+		local child = tui.newTreeNode("child"):SetReference({id = 7})
+		root:AddChild(child):AddChild(tui.newTreeNode("other"))
+		assert(#root:GetChildren() == 2)
+		assert(root:GetChildren()[1] == child, "node identity")
+
+		local tree = tui.newTreeView():SetRoot(root)
+		local selected, changed
+		tree:SetSelectedFunc(function(node) selected = node end)
+		tree:SetChangedFunc(function(node) changed = node end)
+		press(tree, 258)
+		assert(changed == child and tree:GetCurrentNode() == child)
+		press(tree, 13)
+		assert(selected == child and selected:GetReference().id == 7)
+
+		child:AddChild(tui.newTreeNode("leaf"))
+		child:Collapse()
+		assert(not child:IsExpanded())
+	`)
+}
+
+func TestTUIForm(t *testing.T) {
+	runTUIScript(t, `
+		local form = tui.newForm()
+		local saved, typed, checked = false, nil, nil
+		form:AddInputField("Name", "ada", 20, function(text) typed = text end)
+			:AddDropDown("Role", {"admin", "user"}, 1)
+			:AddCheckbox("Active", false, function(c) checked = c end)
+			:AddButton("Save", function() saved = true end)
+		assert(form:GetFormItemCount() == 3 and form:GetButtonCount() == 1)
+
+		local name = form:GetFormItem(0)
+		name:SetText("grace")
+		assert(typed == "grace")
+		press(form:GetFormItemByLabel("Active"), 13)
+		assert(checked == true)
+		press(form:GetButton(0), 13)
+		assert(saved)
+
+		local values = form:GetValues()
+		assert(values.Name == "grace" and values.Role == "user" and values.Active == true)
+		assert(form:GetFormItem(5) == nil)
+	`)
+}
+
+func TestTUIPagesModalAndGrid(t *testing.T) {
+	runTUIScript(t, `
+		local done
+		local modal = tui.newModal("Quit?"):AddButtons({"Yes", "No"})
+			:SetDoneFunc(function(i, label) done = {i, label} end)
+		local pages = tui.newPages()
+			:AddPage("main", tui.newTextView("hello"))
+			:AddPage("confirm", modal, false, false)
+		assert(pages:GetPageCount() == 2 and pages:HasPage("confirm"))
+		assert(pages:GetFrontPage() == "main")
+		pages:ShowPage("confirm")
+		local name, item = pages:GetFrontPage()
+		assert(name == "confirm" and item ~= nil)
+		press(modal, 13)
+		assert(done[1] == 0 and done[2] == "Yes")
+
+		local grid = tui.newGrid():SetRows(3, 0):SetColumns(20, 0):SetBorders(true)
+		grid:AddItem(tui.newTextView("header"), 0, 0, 1, 2)
+			:AddItem(tui.newList(), 1, 0)
+		assert(grid:SetBordersColor("red") == grid)
+	`)
+}
+
+func TestTUIDropDownCheckboxAndProgressBar(t *testing.T) {
+	runTUIScript(t, `
+		local picked
+		local dd = tui.newDropDown():SetLabel("Size")
+			:SetOptions({"s", "m", "l"}, function(text, index) picked = {text, index} end)
+		dd:SetCurrentOption(2)
+		assert(picked[1] == "l" and picked[2] == 2)
+		local index, text = dd:GetCurrentOption()
+		assert(index == 2 and text == "l" and dd:GetOptionCount() == 3)
+
+		local changed
+		local cb = tui.newCheckbox():SetLabel("Agree"):SetChangedFunc(function(c) changed = c end)
+		press(cb, 256, " ")
+		assert(changed == true and cb:IsChecked())
+
+		local seen
+		local bar = tui.newProgressBar():SetMax(10):SetChangedFunc(function(v) seen = v end)
+		bar:SetValue(4)
+		assert(seen == 4 and bar:GetValue() == 4)
+		bar:SetValue(50)
+		assert(bar:GetValue() == 10)
+		assert(not pcall(bar.SetMax, bar, 0))
+	`)
+}
+
+func TestTUIProgressBarDraw(t *testing.T) {
+	screen := tcell.NewSimulationScreen("")
+	if err := screen.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer screen.Fini()
+	screen.SetSize(20, 1)
+
+	bar := NewTUIProgressBar()
+	bar.label = "cpu"
+	bar.SetValue(50)
+	bar.SetRect(0, 0, 20, 1)
+	bar.Draw(screen)
+	screen.Show()
+
+	cells, width, _ := screen.GetContents()
+	var line []rune
+	for _, cell := range cells[:width] {
+		line = append(line, cell.Runes...)
+	}
+	if got, want := string(line), "cpu █████░░░░░░  50%"; got != want {
+		t.Errorf("drawn %q, want %q", got, want)
+	}
+}
+
+func TestTUIColors(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	for _, tt := range []struct {
+		value lua.LValue
+		want  tcell.Color
+	}{
+		{lua.LString("red"), tcell.ColorRed},
+		{lua.LString("Default"), tcell.ColorDefault},
+		{lua.LNumber(1), tcell.PaletteColor(1)},
+		{lua.LNumber(0xff8800), tcell.NewHexColor(0xff8800)},
+		{lua.LString("#FF8800"), tcell.NewHexColor(0xff8800)},
+		{lua.LString("#f80"), tcell.NewHexColor(0xff8800)},
+		{lua.LString("rgb(255, 136, 0)"), tcell.NewHexColor(0xff8800)},
+		{lua.LString("primary"), tview.Styles.PrimaryTextColor},
+	} {
+		L.SetTop(0)
+		L.Push(tt.value)
+		if got := tuiCheckColor(L, 1); got != tt.want {
+			t.Errorf("color %v = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestTUIThemes(t *testing.T) {
+	styles := tview.Styles
+	t.Cleanup(func() { tview.Styles = styles })
+
+	err := runTUIAppScript(t, `
+		tui.setTheme("light")
+		assert(tui.getTheme().background == "#FFFFFF")
+		assert(not pcall(tui.setTheme, {nope = "red"}))
+		assert(not pcall(tui.setTheme, "sepia"))
+		assert(not pcall(tui.newTextView().SetTextColor, tui.newTextView(), "#12345"))
+
+		tui.setClass("panel", {border = true, border_color = "secondary", text_color = "primary"})
+		tui.setClass("alert", {border_color = "#ff0000"})
+
+		local app = tui.newApp{headless = true, width = 20, height = 3}
+		local view = tui.newTextView("hi"):SetClass("panel")
+		assert(view:GetClass() == "panel")
+		app:SetRoot(view):Run()
+
+		local _, fg, bg = app:GetCell(0, 0)
+		assert(fg == "#0969DA" and bg == "#FFFFFF", fg .. " " .. bg)
+		_, fg = app:GetCell(1, 1)
+		assert(fg == "#24292F", fg)
+
+		-- Classes follow theme changes and redefinitions
+		tui.setTheme{secondary = "rgb(0, 128, 0)"}
+		_, fg = app:GetCell(0, 0)
+		assert(fg == "#008000", fg)
+		view:SetClass("panel alert")
+		_, fg = app:GetCell(0, 0)
+		assert(fg == "#FF0000", fg)
+		tui.setClass("alert", {border_color = 0x3366ff})
+		_, fg = app:GetCell(0, 0)
+		assert(fg == "#3366FF", fg)
+
+		local built = tui.build{type = "text", class = "panel", text = "built"}
+		assert(built:GetClass() == "panel")
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// runTUIAppScript runs a Lua script with a simulation(app) function that
+// makes an application draw to a simulated 40x10 screen, and an
+// inject(events) function that sends events to that screen from another
+// goroutine once the application runs. Events are tables such as
+// {key=13}, {rune="a", mod=2}, {click={x, y}} or {paste="text"}.
+func runTUIAppScript(t *testing.T, script string, globals ...string) error {
+	t.Helper()
+	L := lua.NewState()
+	defer L.Close()
+	registerTUIFunctions(L)
+	for i := 0; i+1 < len(globals); i += 2 {
+		L.SetGlobal(globals[i], lua.LString(globals[i+1]))
+	}
+	var screen tcell.SimulationScreen
+	L.SetGlobal("simulation", L.NewFunction(func(L *lua.LState) int {
+		app := L.CheckUserData(1).Value.(*TUIApp)
+		screen = tcell.NewSimulationScreen("")
+		screen.SetSize(40, 10)
+		app.SetScreen(screen)
+		return 0
+	}))
+	L.SetGlobal("inject", L.NewFunction(func(L *lua.LState) int {
+		var events []func()
+		L.CheckTable(1).ForEach(func(_, v lua.LValue) {
+			e := v.(*lua.LTable)
+			mod := tcell.ModMask(lua.LVAsNumber(e.RawGetString("mod")))
+			switch {
+			case e.RawGetString("key") != lua.LNil:
+				key := tcell.Key(lua.LVAsNumber(e.RawGetString("key")))
+				events = append(events, func() { screen.InjectKey(key, 0, mod) })
+			case e.RawGetString("rune") != lua.LNil:
+				r := []rune(e.RawGetString("rune").String())[0]
+				events = append(events, func() { screen.InjectKey(tcell.KeyRune, r, mod) })
+			case e.RawGetString("click") != lua.LNil:
+				pos := e.RawGetString("click").(*lua.LTable)
+				x, y := int(lua.LVAsNumber(pos.RawGetInt(1))), int(lua.LVAsNumber(pos.RawGetInt(2)))
+				events = append(events, func() {
+					screen.InjectMouse(x, y, tcell.Button1, mod)
+					screen.InjectMouse(x, y, tcell.ButtonNone, mod)
+				})
+			case e.RawGetString("scroll") != lua.LNil:
+				pos := e.RawGetString("scroll").(*lua.LTable)
+				x, y := int(lua.LVAsNumber(pos.RawGetInt(1))), int(lua.LVAsNumber(pos.RawGetInt(2)))
+				events = append(events, func() { screen.InjectMouse(x, y, tcell.WheelDown, mod) })
+			case e.RawGetString("paste") != lua.LNil:
+				text := e.RawGetString("paste").String()
+				events = append(events, func() {
+					screen.PostEvent(tcell.NewEventPaste(true))
+					for _, r := range text {
+						screen.InjectKey(tcell.KeyRune, r, tcell.ModNone)
+					}
+					screen.PostEvent(tcell.NewEventPaste(false))
+				})
+			}
+		})
+		go func() {
+			for _, event := range events {
+				event()
+			}
+		}()
+		return 0
+	}))
+	return L.DoString(script)
+}
+
+func TestTUIQueueUpdate(t *testing.T) {
+	err := runTUIAppScript(t, `
+		local app = tui.newApp()
+		local view = tui.newTextView("")
+		app:SetRoot(view)
+		simulation(app)
+
+		-- Queued before Run, from a callback and with arguments
+		local order = {}
+		app:Draw()
+		app:QueueUpdate(function(text)
+			view:SetText(text)
+			table.insert(order, 1)
+			app:QueueUpdateDraw(function()
+				table.insert(order, 3)
+				app:Stop()
+			end)
+		end, "hello")
+		app:QueueUpdate(function() table.insert(order, 2) end)
+
+		assert(app:Run() == nil)
+		assert(view:GetText() == "hello")
+		assert(table.concat(order, ",") == "1,2,3", table.concat(order, ","))
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTUIQueueUpdateFromGoroutines(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	registerTUIFunctions(L)
+	if err := L.DoString(`
+		app = tui.newApp()
+		view = tui.newTextView("")
+		app:SetRoot(view)
+		count = 0
+		append = function(line)
+			view:SetText(view:GetText() .. line .. "\n")
+			count = count + 1
+			if count == 40 then app:Stop() end
+		end
+	`); err != nil {
+		t.Fatal(err)
+	}
+	app := L.GetGlobal("app").(*lua.LUserData).Value.(*TUIApp)
+	screen := tcell.NewSimulationScreen("")
+	screen.SetSize(40, 10)
+	app.SetScreen(screen)
+	fn := L.GetGlobal("append").(*lua.LFunction)
+
+	// Updates queued concurrently, as HTTP handlers would, all run on the
+	// event loop
+	for i := 0; i < 4; i++ {
+		go func(i int) {
+			for j := 0; j < 10; j++ {
+				app.queue(tuiUpdate{fn: fn, args: []lua.LValue{lua.LNumber(i*10 + j)}, draw: true})
+			}
+		}(i)
+	}
+	if err := app.run(L); err != nil {
+		t.Fatal(err)
+	}
+	if count := L.GetGlobal("count"); count != lua.LNumber(40) {
+		t.Errorf("ran %v updates, want 40", count)
+	}
+}
+
+func TestTUIEnterFromHandlers(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	registerTUIFunctions(L)
+	if err := L.DoString(`
+		app = tui.newApp()
+		view = tui.newTextView("")
+		app:SetRoot(view)
+		count = 0
+		handle = function()
+			count = count + 1
+			if count == 40 then app:Stop() end
+		end
+		keys = 0
+		app:SetInputCapture(function(event)
+			keys = keys + 1
+			return event
+		end)
+	`); err != nil {
+		t.Fatal(err)
+	}
+	app := L.GetGlobal("app").(*lua.LUserData).Value.(*TUIApp)
+	screen := tcell.NewSimulationScreen("")
+	screen.SetSize(40, 10)
+	app.SetScreen(screen)
+	fn := L.GetGlobal("handle").(*lua.LFunction)
+
+	// Handlers entering the state from their own goroutines take turns
+	// with the app's callbacks on the event loop
+	for i := 0; i < 4; i++ {
+		go func() {
+			for tuiRunningApp(L) == nil {
+				time.Sleep(time.Millisecond)
+			}
+			for j := 0; j < 10; j++ {
+				tuiEnter(L, func() {
+					if err := L.CallByParam(lua.P{Fn: fn, Protect: true}); err != nil {
+						t.Error(err)
+					}
+				})
+				screen.InjectKey(tcell.KeyRune, 'x', tcell.ModNone)
+			}
+		}()
+	}
+	if err := app.run(L); err != nil {
+		t.Fatal(err)
+	}
+	if count := L.GetGlobal("count"); count != lua.LNumber(40) {
+		t.Errorf("ran %v handlers, want 40", count)
+	}
+}
+
+func TestTUICallbackError(t *testing.T) {
+	err := runTUIAppScript(t, `
+		local app = tui.newApp()
+		local input = tui.newInputField()
+		input:SetChangedFunc(function(text) error("bad " .. text) end)
+		app:SetRoot(input)
+		simulation(app)
+		inject({{rune = "x"}})
+		app:Run()
+	`)
+	if err == nil || !strings.Contains(err.Error(), "bad x") {
+		t.Fatalf("error = %v, want bad x", err)
+	}
+}
+
+func TestTUIQueueUpdateError(t *testing.T) {
+	err := runTUIAppScript(t, `
+		local app = tui.newApp()
+		app:SetRoot(tui.newTextView(""))
+		simulation(app)
+		app:QueueUpdate(function() error("boom") end)
+		app:Run()
+	`)
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("error = %v, want boom", err)
+	}
+}
+
+func TestTUIMouseAndKeyEvents(t *testing.T) {
+	err := runTUIAppScript(t, `
+		local app = tui.newApp()
+		simulation(app)
+		app:EnableMouse(true)
+
+		local tbl = tui.newTable():SetSelectable(true, false)
+		for i = 0, 5 do tbl:SetCell(i, 0, "row " .. i) end
+		local changed
+		tbl:SetSelectionChangedFunc(function(row) changed = row end)
+		app:SetRoot(tbl)
+
+		local clicks, scrolls, keys = {}, 0, {}
+		app:SetMouseCapture(function(event, action)
+			if action == "left_click" then
+				local x, y = event:Position()
+				table.insert(clicks, {x, y, event:Ctrl()})
+			end
+			return event
+		end)
+		tbl:SetMouseCapture(function(event, action)
+			if action == "scroll_down" then
+				scrolls = scrolls + 1
+				return nil
+			end
+			return event
+		end)
+		tbl:SetInputCapture(function(event)
+			table.insert(keys, event:Name())
+			if event:Char() == "x" then return nil end
+			return event
+		end)
+		app:SetInputCapture(function(event)
+			if event:Char() == "q" then
+				app:Stop()
+				return nil
+			end
+			return event
+		end)
+
+		inject({{click = {2, 3}, mod = 2}, {scroll = {1, 1}}, {rune = "x"}, {key = 258}, {rune = "s", mod = 4}, {rune = "q"}})
+		assert(app:Run() == nil)
+
+		assert(#clicks == 1 and clicks[1][1] == 2 and clicks[1][2] == 3 and clicks[1][3], "click")
+		assert(scrolls == 1, "scroll")
+		assert(table.concat(keys, ",") == "Rune[x],Down,Alt+Rune[s]", table.concat(keys, ","))
+		-- The click selected row 3 and Down moved to row 4; x was consumed
+		assert(changed == 4, tostring(changed))
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTUIPaste(t *testing.T) {
+	err := runTUIAppScript(t, `
+		local app = tui.newApp()
+		simulation(app)
+		app:EnablePaste(true)
+		local input = tui.newInputField()
+		app:SetRoot(input)
+
+		local pasted
+		app:SetPasteCapture(function(text)
+			pasted = text
+			return text:upper()
+		end)
+		app:SetInputCapture(function(event)
+			if event:Key() == 27 then app:Stop() end
+			return event
+		end)
+
+		inject({{paste = "hello"}, {key = 27}})
+		app:Run()
+		assert(pasted == "hello")
+		assert(input:GetText() == "HELLO", input:GetText())
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTUIHeadless(t *testing.T) {
+	dir := t.TempDir()
+	err := runTUIAppScript(t, `
+		local app = tui.newApp{headless = true, width = 30, height = 6}
+		local list = tui.newList():ShowSecondaryText(false)
+			:AddItem("Apples"):AddItem("Pears"):AddItem("Plums")
+		local input = tui.newInputField():SetLabel("Name: ")
+		local status = tui.newTextView("ready")
+		local flex = tui.newFlex():SetDirection(0)
+			:AddItem(list, 3, 0, true)
+			:AddItem(input, 1, 0, false)
+			:AddItem(status, 1, 0, false)
+		app:SetRoot(flex)
+		list:SetSelectedFunc(function(i, main)
+			status:SetText("picked " .. main)
+			app:SetFocus(input)
+		end)
+		app:SetInputCapture(function(event)
+			if event:Name() == "Ctrl+Q" then app:Stop() return nil end
+			return event
+		end)
+		app:Run()
+
+		local text = app:GetScreenText()
+		assert(text:find("Apples") and text:find("ready"), text)
+		assert(select(2, app:GetScreenSize()) == 6)
+
+		app:Press("Down", "Enter")
+		assert(app:GetScreenText():find("picked Pears"))
+		app:Type("bob"):Press("Backspace")
+		assert(input:GetText() == "bo", input:GetText())
+
+		app:Click(1, 2)
+		assert(list:GetCurrentItem() == 2 and input:HasFocus())
+		assert(app:GetScreenText():find("picked Plums"))
+
+		-- Queued updates run at the next step
+		app:QueueUpdateDraw(function() status:SetText("queued") end)
+		assert(app:GetScreenText():find("queued"))
+
+		local char, fg, bg = app:GetCell(0, 4)
+		assert(char == "q" and fg ~= "" and bg ~= "")
+
+		local path = snapshot_dir .. "/screens/list.txt"
+		assert(app:MatchSnapshot(path))
+		assert(app:MatchSnapshot(path))
+		status:SetText("changed")
+		local ok, err = app:MatchSnapshot(path)
+		assert(ok == nil and err:find('line 5') and err:find('"changed"'), err)
+
+		app:Resize(20, 3)
+		assert(select(2, app:GetScreenText():gsub("\n", "")) == 2)
+
+		assert(not app:IsStopped())
+		app:Press("Ctrl+Q")
+		assert(app:IsStopped())
+		assert(not pcall(app.Press, app, "Hyper+X"))
+		assert(not pcall(tui.newApp().Press, tui.newApp(), "a"))
+	`, "snapshot_dir", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "screens", "list.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Apples\nPears\nPlums\nName: bo\nqueued\n"; !strings.HasPrefix(string(data), want) {
+		t.Errorf("snapshot = %q, want prefix %q", data, want)
+	}
+}
+
+func TestTUIDefaults(t *testing.T) {
+	// hype run and built executables share these defaults
+	err := runTUIAppScript(t, `
+		local app = tui.newApp{headless = true, width = 12, height = 3}
+		local view = tui.newTextView("[red]hot[-] and a long line")
+		app:SetRoot(view)
+		app:Run()
+
+		-- Color tags are parsed and long lines wrap
+		local text = app:GetScreenText()
+		assert(not text:find("[red]", 1, true), text)
+		assert(text:find("hot and a") and text:find("long line"), text)
+		local char, fg = app:GetCell(0, 0)
+		assert(char == "h" and fg:lower() == "#ff0000", fg)
+
+		-- The root fills the screen
+		local x, y, width, height = view:GetRect()
+		assert(x == 0 and y == 0 and width == 12 and height == 3)
+
+		view:SetDynamicColors(false):SetText("[red]x")
+		assert(app:GetScreenText():find("[red]x", 1, true))
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTUIBuild(t *testing.T) {
+	err := runTUIAppScript(t, `
+		local state = tui.state{count = 0, fruits = {"Apples", "Pears"}, panels = {"a"}}
+		local saved
+		local sidebar = tui.build{type = "list", id = "fruits", show_secondary_text = false,
+			items = function() return state.fruits end}
+		local root = tui.build{type = "flex", direction = "row", children = {
+			{type = "text", id = "status", size = 1, text = function() return "count " .. state.count end},
+			{type = "flex", direction = "column", children = {
+				sidebar,
+				{type = "form", id = "form", children = {
+					{type = "input", id = "name", label = "Name: "},
+					{type = "button", label = "Save", on_selected = function() saved = true end},
+				}},
+			}},
+			{type = "flex", id = "panels", size = 1, children = function()
+				local children = {}
+				for i, name in ipairs(state.panels) do
+					children[i] = {type = "text", id = "panel_" .. name, text = name}
+				end
+				return children
+			end},
+		}}
+		local app = tui.newApp{headless = true, width = 40, height = 8}
+		assert(app:find("status") == nil)
+		app:SetRoot(root):Run()
+
+		local status = app:find("status")
+		assert(status:GetText() == "count 0")
+		assert(app:Find("fruits") == sidebar and sidebar:GetItemCount() == 2)
+		assert(app:find("name"):GetText() == "")
+
+		state.count = 1
+		state.count = 2
+		assert(status:GetText() == "count 0", "recomputed before the next step")
+		assert(app:GetScreenText():find("count 2"))
+
+		state.fruits = {"Plums", "Figs", "Kiwis"}
+		assert(app:GetScreenText():find("Kiwis") and sidebar:GetItemCount() == 3)
+
+		assert(app:find("panel_a") and app:find("panel_b") == nil)
+		state.panels = {"b", "c"}
+		app:GetScreenText()
+		assert(app:find("panel_a") == nil and app:find("panel_c"):GetText() == "c")
+
+		status:SetText("changed")
+		app:Refresh()
+		assert(app:GetScreenText():find("count 2"))
+
+		app:SetFocus(app:find("form")):Press("Tab", "Enter")
+		assert(saved)
+
+		assert(not pcall(tui.build, {type = "nope"}))
+		assert(not pcall(tui.build, {type = "text", nope = 1}))
+		assert(not pcall(tui.build, {type = "text", items = {}}))
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTUIKeyBindings(t *testing.T) {
+	err := runTUIAppScript(t, `
+		local log, captured = {}, {}
+		local app = tui.newApp{headless = true, width = 60, height = 12}
+		local editor = tui.newTextView("editor")
+		local viewer = tui.newTextView("viewer")
+		local pages = tui.newPages()
+			:AddPage("editor", editor, true, true)
+			:AddPage("viewer", viewer, true, false)
+		app:SetRoot(pages):Run()
+
+		app:bind("ctrl+s", function(event)
+			table.insert(log, "save " .. event:Name())
+		end, "Save file")
+		app:Bind("Ctrl+X Ctrl+C", function() table.insert(log, "quit") end, "Quit")
+		app:Bind("x", function() table.insert(log, "cut") end, "Cut line", editor)
+		app:Bind("?", function() app:ShowHelp() end, "Show help")
+		app:Bind("Ctrl+P", function() app:ShowCommandPalette() end, "Command palette")
+		app:Bind(nil, function() table.insert(log, "reload") end, "Reload configuration")
+		app:SetInputCapture(function(event)
+			table.insert(captured, event:Name())
+			return event
+		end)
+
+		app:Press("Ctrl+S", "Ctrl+X", "Ctrl+C", "x", "Ctrl+X", "y", "z")
+		assert(table.concat(log, ",") == "save Ctrl+S,quit,cut", table.concat(log, ","))
+		assert(table.concat(captured, ",") == "Rune[z]", "a broken chord drops its key")
+		assert(not app:IsStopped())
+
+		-- Scoped bindings only apply while their page has focus
+		log = {}
+		pages:SwitchToPage("viewer")
+		app:SetFocus(viewer):Press("x")
+		assert(#log == 0 and captured[2] == "Rune[x]")
+		local bindings = app:GetBindings()
+		assert(#bindings == 5 and bindings[1].keys == "Ctrl+S" and bindings[2].keys == "Ctrl+X Ctrl+C")
+
+		pages:SwitchToPage("editor")
+		app:SetFocus(editor):Press("?")
+		local text = app:GetScreenText()
+		assert(app:HasOverlay() and text:find("Ctrl%+X Ctrl%+C Quit") and text:find("x%s+Cut line"), text)
+		assert(text:find("editor"), "overlay covers the root")
+		app:Press("Esc")
+		assert(not app:HasOverlay() and editor:HasFocus())
+
+		log = {}
+		app:Press("Ctrl+P"):Type("rlcfg")
+		text = app:GetScreenText()
+		assert(text:find("Reload configuration") and not text:find("Save file"), text)
+		app:Press("Enter")
+		assert(table.concat(log, ",") == "reload" and not app:HasOverlay())
+
+		-- "Cut line" matches "li" better than "Reload configuration"
+		app:Press("Ctrl+P"):Type("li"):Press("Down", "Enter")
+		assert(table.concat(log, ",") == "reload,reload", table.concat(log, ","))
+		app:Press("Ctrl+P"):Type("li"):Press("Enter")
+		assert(table.concat(log, ",") == "reload,reload,cut", table.concat(log, ","))
+
+		app:Unbind("ctrl+s")
+		log, captured = {}, {}
+		app:Press("Ctrl+S")
+		assert(#log == 0 and captured[1] == "Ctrl+S")
+		assert(not pcall(app.Bind, app, "Hyper+X", function() end))
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTUIFuzzyScore(t *testing.T) {
+	for _, tt := range []struct {
+		pattern, text string
+		ok            bool
+	}{
+		{"", "Save", true},
+		{"sv", "Save file", true},
+		{"save f", "Save file", true},
+		{"fs", "Save file", false},
+		{"RLC", "reload config", true},
+	} {
+		if _, ok := tuiFuzzyScore(tt.pattern, tt.text); ok != tt.ok {
+			t.Errorf("tuiFuzzyScore(%q, %q) = %v, want %v", tt.pattern, tt.text, ok, tt.ok)
+		}
+	}
+	prefix, _ := tuiFuzzyScore("sa", "Save")
+	scattered, _ := tuiFuzzyScore("sa", "Show all")
+	if prefix <= scattered {
+		t.Errorf("prefix match scored %d, scattered match %d", prefix, scattered)
+	}
+}
+
+func TestTUIParseKey(t *testing.T) {
+	for _, tt := range []struct{ key, name string }{
+		{"a", "Rune[a]"},
+		{"A", "Rune[A]"},
+		{"Enter", "Enter"},
+		{"esc", "Esc"},
+		{"Escape", "Esc"},
+		{"ctrl+s", "Ctrl+S"},
+		{"Ctrl-S", "Ctrl+S"},
+		{"Alt+x", "Alt+Rune[x]"},
+		{"Shift+Tab", "Backtab"},
+		{"Ctrl++", "Ctrl+Rune[+]"},
+		{"+", "Rune[+]"},
+		{"space", "Rune[ ]"},
+		{"F5", "F5"},
+		{"alt+left", "Alt+Left"},
+		{"Backspace", "Backspace2"},
+	} {
+		event, err := tuiParseKey(tt.key)
+		if err != nil {
+			t.Errorf("tuiParseKey(%q): %v", tt.key, err)
+			continue
+		}
+		if got := event.Name(); got != tt.name {
+			t.Errorf("tuiParseKey(%q) = %s, want %s", tt.key, got, tt.name)
+		}
+	}
+	for _, key := range []string{"", "Hyper+a", "Ctrl+", "Nope"} {
+		if _, err := tuiParseKey(key); err == nil {
+			t.Errorf("tuiParseKey(%q) succeeded", key)
+		}
+	}
+}
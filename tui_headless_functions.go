@@ -0,0 +1,436 @@
+// tui_headless_functions.go - Testing tui apps against a simulated screen
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+	"github.com/yuin/gopher-lua"
+)
+
+// Apps created with tui.newApp{headless=true}, or any app when
+// HYPE_TUI_HEADLESS is set, draw to a tcell simulation screen instead of
+// the terminal. They have no event loop: Press, Click and the other test
+// methods deliver events the way tview's loop would, run queued updates
+// and redraw before returning, so scripts can check the screen right
+// after each step.
+
+// tuiHeadlessEnv is set to 1 or to a size such as 100x30 to make every
+// app headless. app:Run() then draws once, prints the screen and returns.
+const tuiHeadlessEnv = "HYPE_TUI_HEADLESS"
+
+// tuiUpdateSnapshotsEnv makes app:MatchSnapshot rewrite snapshot files
+const tuiUpdateSnapshotsEnv = "HYPE_UPDATE_SNAPSHOTS"
+
+// tuiHeadless is the simulated screen of a headless app
+type tuiHeadless struct {
+	screen  tcell.SimulationScreen
+	print   bool // print the screen when Run returns
+	stopped bool
+}
+
+// tuiHeadlessSize parses the HYPE_TUI_HEADLESS value, defaulting to 80x24
+func tuiHeadlessSize(value string) (int, int) {
+	if w, h, ok := strings.Cut(strings.ToLower(value), "x"); ok {
+		width, errW := strconv.Atoi(w)
+		height, errH := strconv.Atoi(h)
+		if errW == nil && errH == nil && width > 0 && height > 0 {
+			return width, height
+		}
+	}
+	return 80, 24
+}
+
+// newHeadless switches the app to a simulated screen of the given size
+func (a *TUIApp) newHeadless(width, height int) {
+	screen := tcell.NewSimulationScreen("UTF-8")
+	a.headless = &tuiHeadless{screen: screen}
+	a.SetScreen(screen)
+	screen.SetSize(width, height)
+}
+
+// step runs the updates queued for the app in L, the state of the script
+// driving it
+func (a *TUIApp) step(L *lua.LState) {
+	a.mu.Lock()
+	a.L = L
+	a.mu.Unlock()
+	a.runPending()
+}
+
+func (a *TUIApp) setFocus(p tview.Primitive) {
+	a.SetFocus(p)
+}
+
+// pressKey delivers a key event like tview's event loop: the input capture
+// function sees it first, Ctrl+C stops the app and the focused widget
+// handles the rest
+func (a *TUIApp) pressKey(L *lua.LState, event *tcell.EventKey) {
+	a.step(L)
+	defer a.ForceDraw()
+
+	original := event
+	if capture := a.GetInputCapture(); capture != nil {
+		if event = capture(event); event == nil {
+			return
+		}
+	}
+	if event == original && event.Key() == tcell.KeyCtrlC {
+		a.headless.stopped = true
+		return
+	}
+	if a.root != nil && a.root.HasFocus() {
+		if handler := a.root.InputHandler(); handler != nil {
+			handler(event, a.setFocus)
+		}
+	}
+}
+
+// fireMouse delivers mouse actions at a position through the mouse capture
+// function to the widgets
+func (a *TUIApp) fireMouse(L *lua.LState, event *tcell.EventMouse, actions ...tview.MouseAction) {
+	a.step(L)
+	defer a.ForceDraw()
+
+	for _, action := range actions {
+		event := event
+		if capture := a.GetMouseCapture(); capture != nil {
+			if event, action = capture(event, action); event == nil {
+				continue
+			}
+		}
+		if a.root != nil {
+			if handler := a.root.MouseHandler(); handler != nil {
+				handler(action, event, a.setFocus)
+			}
+		}
+	}
+}
+
+// paste delivers pasted text to the root, which hands it to the paste
+// capture function and the focused widget
+func (a *TUIApp) paste(L *lua.LState, text string) {
+	a.step(L)
+	defer a.ForceDraw()
+
+	if a.root != nil && a.root.HasFocus() {
+		if handler := a.root.PasteHandler(); handler != nil {
+			handler(text, a.setFocus)
+		}
+	}
+}
+
+// screenText returns the screen as lines without trailing spaces
+func (a *TUIApp) screenText() string {
+	screen := a.headless.screen
+	width, height := screen.Size()
+	lines := make([]string, height)
+	for y := 0; y < height; y++ {
+		var line strings.Builder
+		for x := 0; x < width; x++ {
+			primary, combining, _, w := screen.GetContent(x, y)
+			if primary == 0 {
+				primary = ' '
+			}
+			line.WriteRune(primary)
+			for _, r := range combining {
+				line.WriteRune(r)
+			}
+			if w > 1 {
+				x += w - 1
+			}
+		}
+		lines[y] = strings.TrimRight(line.String(), " ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// tuiColorName names a color for tests: "default" or a CSS hex value
+func tuiColorName(c tcell.Color) string {
+	if !c.Valid() {
+		return "default"
+	}
+	return c.CSS()
+}
+
+// tuiParseKey parses a key such as "Enter", "a", "Ctrl+S", "Alt+Left" or
+// "Shift+Tab". Modifiers are Ctrl, Alt, Shift and Meta; key names are
+// tcell's, such as Esc, Backspace, Delete, PgUp, Home and F1.
+func tuiParseKey(name string) (*tcell.EventKey, error) {
+	// The last + separates the key, which may itself be "+"
+	key, prefix := name, ""
+	if i := strings.LastIndex(strings.TrimSuffix(name, "+"), "+"); i >= 0 {
+		prefix, key = name[:i], name[i+1:]
+	}
+
+	var mods tcell.ModMask
+	for _, mod := range strings.Split(prefix, "+") {
+		switch strings.ToLower(strings.TrimSpace(mod)) {
+		case "":
+			if prefix != "" {
+				return nil, fmt.Errorf("empty modifier in key %q", name)
+			}
+		case "ctrl", "control":
+			mods |= tcell.ModCtrl
+		case "alt":
+			mods |= tcell.ModAlt
+		case "shift":
+			mods |= tcell.ModShift
+		case "meta", "cmd":
+			mods |= tcell.ModMeta
+		default:
+			return nil, fmt.Errorf("unknown modifier %q in key %q", mod, name)
+		}
+	}
+
+	if key == "" {
+		return nil, fmt.Errorf("missing key in %q", name)
+	}
+	if utf8.RuneCountInString(key) == 1 {
+		r, _ := utf8.DecodeRuneInString(key)
+		lower := []rune(strings.ToLower(key))[0]
+		if mods&tcell.ModCtrl != 0 && lower >= 'a' && lower <= 'z' {
+			// Terminals send Ctrl+letter as a control key
+			k := tcell.KeyCtrlA + tcell.Key(lower-'a')
+			return tcell.NewEventKey(k, rune(k), mods), nil
+		}
+		return tcell.NewEventKey(tcell.KeyRune, r, mods), nil
+	}
+
+	switch strings.ToLower(key) {
+	case "space":
+		return tcell.NewEventKey(tcell.KeyRune, ' ', mods), nil
+	case "escape":
+		return tcell.NewEventKey(tcell.KeyEscape, 0, mods), nil
+	case "backspace":
+		return tcell.NewEventKey(tcell.KeyBackspace2, 0, mods), nil
+	case "return":
+		return tcell.NewEventKey(tcell.KeyEnter, 0, mods), nil
+	case "pageup":
+		return tcell.NewEventKey(tcell.KeyPgUp, 0, mods), nil
+	case "pagedown":
+		return tcell.NewEventKey(tcell.KeyPgDn, 0, mods), nil
+	case "tab":
+		if mods&tcell.ModShift != 0 {
+			return tcell.NewEventKey(tcell.KeyBacktab, 0, mods&^tcell.ModShift), nil
+		}
+	}
+	for k, n := range tcell.KeyNames {
+		if strings.EqualFold(n, key) {
+			if strings.HasPrefix(n, "Ctrl-") {
+				return tcell.NewEventKey(k, rune(k), mods|tcell.ModCtrl), nil
+			}
+			return tcell.NewEventKey(k, 0, mods), nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key %q", name)
+}
+
+// tuiSnapshotDiff lists the lines that differ between a snapshot and the
+// screen
+func tuiSnapshotDiff(want, got string) string {
+	wantLines, gotLines := strings.Split(want, "\n"), strings.Split(got, "\n")
+	var diff strings.Builder
+	for i := 0; i < max(len(wantLines), len(gotLines)); i++ {
+		var w, g string
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if w != g {
+			fmt.Fprintf(&diff, "line %d:\n  want: %q\n  got:  %q\n", i+1, w, g)
+		}
+	}
+	return diff.String()
+}
+
+// matchSnapshot compares the screen with a snapshot file. Missing files are
+// written, as are all files when HYPE_UPDATE_SNAPSHOTS is set.
+func (a *TUIApp) matchSnapshot(path string) error {
+	got := a.screenText() + "\n"
+	want, err := os.ReadFile(path)
+	if os.IsNotExist(err) || (err == nil && os.Getenv(tuiUpdateSnapshotsEnv) != "") {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		return os.WriteFile(path, []byte(got), 0644)
+	}
+	if err != nil {
+		return err
+	}
+	if string(want) != got {
+		return fmt.Errorf("screen does not match snapshot %s (set %s=1 to update it):\n%s",
+			path, tuiUpdateSnapshotsEnv, tuiSnapshotDiff(string(want), got))
+	}
+	return nil
+}
+
+// tuiCheckHeadless returns the simulated screen of a headless app or raises
+// an error for apps drawing to the terminal
+func tuiCheckHeadless(L *lua.LState, app *TUIApp, method string) *tuiHeadless {
+	if app.headless == nil {
+		L.RaiseError("%s needs an app created with tui.newApp{headless=true}", method)
+	}
+	return app.headless
+}
+
+// tuiHeadlessIndex pushes the test methods of an app and reports whether
+// method was one of them
+func tuiHeadlessIndex(L *lua.LState, ud *lua.LUserData, app *TUIApp, method string) bool {
+	switch method {
+	case "Press":
+		// app:Press(key, ...) presses each key in turn
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			tuiCheckHeadless(L, app, method)
+			for i := 2; i <= L.GetTop(); i++ {
+				event, err := tuiParseKey(L.CheckString(i))
+				if err != nil {
+					L.ArgError(i, err.Error())
+				}
+				app.pressKey(L, event)
+			}
+			L.Push(ud)
+			return 1
+		}))
+	case "Type":
+		// app:Type(text) types each character; newlines press Enter
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			tuiCheckHeadless(L, app, method)
+			for _, r := range L.CheckString(2) {
+				if r == '\n' {
+					app.pressKey(L, tcell.NewEventKey(tcell.KeyEnter, 0, tcell.ModNone))
+				} else {
+					app.pressKey(L, tcell.NewEventKey(tcell.KeyRune, r, tcell.ModNone))
+				}
+			}
+			L.Push(ud)
+			return 1
+		}))
+	case "Click":
+		// app:Click(x, y, button) with button "left" (default), "middle"
+		// or "right"
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			tuiCheckHeadless(L, app, method)
+			x, y := L.CheckInt(2), L.CheckInt(3)
+			var button tcell.ButtonMask
+			var actions []tview.MouseAction
+			switch L.OptString(4, "left") {
+			case "left":
+				button = tcell.ButtonPrimary
+				actions = []tview.MouseAction{tview.MouseLeftDown, tview.MouseLeftUp, tview.MouseLeftClick}
+			case "middle":
+				button = tcell.ButtonMiddle
+				actions = []tview.MouseAction{tview.MouseMiddleDown, tview.MouseMiddleUp, tview.MouseMiddleClick}
+			case "right":
+				button = tcell.ButtonSecondary
+				actions = []tview.MouseAction{tview.MouseRightDown, tview.MouseRightUp, tview.MouseRightClick}
+			default:
+				L.ArgError(4, "button must be left, middle or right")
+			}
+			app.fireMouse(L, tcell.NewEventMouse(x, y, button, tcell.ModNone), actions...)
+			L.Push(ud)
+			return 1
+		}))
+	case "Scroll":
+		// app:Scroll(x, y, direction) with direction "up", "down" (default),
+		// "left" or "right"
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			tuiCheckHeadless(L, app, method)
+			x, y := L.CheckInt(2), L.CheckInt(3)
+			var button tcell.ButtonMask
+			var action tview.MouseAction
+			switch L.OptString(4, "down") {
+			case "up":
+				button, action = tcell.WheelUp, tview.MouseScrollUp
+			case "down":
+				button, action = tcell.WheelDown, tview.MouseScrollDown
+			case "left":
+				button, action = tcell.WheelLeft, tview.MouseScrollLeft
+			case "right":
+				button, action = tcell.WheelRight, tview.MouseScrollRight
+			default:
+				L.ArgError(4, "direction must be up, down, left or right")
+			}
+			app.fireMouse(L, tcell.NewEventMouse(x, y, button, tcell.ModNone), action)
+			L.Push(ud)
+			return 1
+		}))
+	case "Paste":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			tuiCheckHeadless(L, app, method)
+			app.paste(L, L.CheckString(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "Resize":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			headless := tuiCheckHeadless(L, app, method)
+			headless.screen.SetSize(L.CheckInt(2), L.CheckInt(3))
+			app.step(L)
+			app.ForceDraw()
+			L.Push(ud)
+			return 1
+		}))
+	case "GetScreenText":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			tuiCheckHeadless(L, app, method)
+			app.step(L)
+			app.ForceDraw()
+			L.Push(lua.LString(app.screenText()))
+			return 1
+		}))
+	case "GetScreenSize":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			width, height := tuiCheckHeadless(L, app, method).screen.Size()
+			L.Push(lua.LNumber(width))
+			L.Push(lua.LNumber(height))
+			return 2
+		}))
+	case "GetCell":
+		// app:GetCell(x, y) returns the character and its foreground and
+		// background colors
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			headless := tuiCheckHeadless(L, app, method)
+			app.step(L)
+			app.ForceDraw()
+			primary, combining, style, _ := headless.screen.GetContent(L.CheckInt(2), L.CheckInt(3))
+			if primary == 0 {
+				primary = ' '
+			}
+			fg, bg, _ := style.Decompose()
+			L.Push(lua.LString(string(append([]rune{primary}, combining...))))
+			L.Push(lua.LString(tuiColorName(fg)))
+			L.Push(lua.LString(tuiColorName(bg)))
+			return 3
+		}))
+	case "MatchSnapshot":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			tuiCheckHeadless(L, app, method)
+			app.step(L)
+			app.ForceDraw()
+			if err := app.matchSnapshot(L.CheckString(2)); err != nil {
+				L.Push(lua.LNil)
+				L.Push(lua.LString(err.Error()))
+				return 2
+			}
+			L.Push(lua.LTrue)
+			return 1
+		}))
+	case "IsStopped":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LBool(tuiCheckHeadless(L, app, method).stopped))
+			return 1
+		}))
+	default:
+		return false
+	}
+	return true
+}
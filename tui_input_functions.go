@@ -0,0 +1,216 @@
+// tui_input_functions.go - Key, mouse and paste events for the tui module
+package main
+
+import (
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+	"github.com/yuin/gopher-lua"
+)
+
+// tuiMouseActions names tview's mouse actions for Lua
+var tuiMouseActions = map[tview.MouseAction]string{
+	tview.MouseMove:              "move",
+	tview.MouseLeftDown:          "left_down",
+	tview.MouseLeftUp:            "left_up",
+	tview.MouseLeftClick:         "left_click",
+	tview.MouseLeftDoubleClick:   "left_double_click",
+	tview.MouseMiddleDown:        "middle_down",
+	tview.MouseMiddleUp:          "middle_up",
+	tview.MouseMiddleClick:       "middle_click",
+	tview.MouseMiddleDoubleClick: "middle_double_click",
+	tview.MouseRightDown:         "right_down",
+	tview.MouseRightUp:           "right_up",
+	tview.MouseRightClick:        "right_click",
+	tview.MouseRightDoubleClick:  "right_double_click",
+	tview.MouseScrollUp:          "scroll_up",
+	tview.MouseScrollDown:        "scroll_down",
+	tview.MouseScrollLeft:        "scroll_left",
+	tview.MouseScrollRight:       "scroll_right",
+}
+
+// tuiMouseAction converts an action name returned by a mouse capture
+// function, keeping action when the name is missing or unknown
+func tuiMouseAction(name lua.LValue, action tview.MouseAction) tview.MouseAction {
+	if s, ok := name.(lua.LString); ok {
+		for a, n := range tuiMouseActions {
+			if n == string(s) {
+				return a
+			}
+		}
+	}
+	return action
+}
+
+// tuiKeyCapture adapts a Lua input capture function. The function receives
+// the event and returns it, or another event, to pass it on; returning nil
+// consumes it.
+func tuiKeyCapture(L *lua.LState, fn *lua.LFunction) func(*tcell.EventKey) *tcell.EventKey {
+	return func(event *tcell.EventKey) *tcell.EventKey {
+		result := tuiCall(L, fn, 1, tuiNewUserData(L, event))
+		if result == lua.LNil {
+			return nil
+		}
+		if ud, ok := result.(*lua.LUserData); ok {
+			if other, ok := ud.Value.(*tcell.EventKey); ok {
+				return other
+			}
+		}
+		return event
+	}
+}
+
+// tuiMouseCapture calls a Lua mouse capture function with the event and
+// action name. It returns nil when the function consumed the event, and
+// otherwise the event and the action, which the function may rename by
+// returning a second value.
+func tuiMouseCapture(L *lua.LState, fn *lua.LFunction, event *tcell.EventMouse, action tview.MouseAction) (*tcell.EventMouse, tview.MouseAction) {
+	L.Push(fn)
+	L.Push(tuiNewUserData(L, event))
+	L.Push(lua.LString(tuiMouseActions[action]))
+	if !tuiPCall(L, 2, 2) {
+		return event, action
+	}
+	result, name := L.Get(-2), L.Get(-1)
+	L.Pop(2)
+	if result == lua.LNil {
+		return nil, action
+	}
+	return event, tuiMouseAction(name, action)
+}
+
+// tuiModifierIndex pushes the modifier methods shared by key and mouse
+// events and reports whether method was one of them
+func tuiModifierIndex(L *lua.LState, mods tcell.ModMask, method string) bool {
+	var mask tcell.ModMask
+	switch method {
+	case "Modifiers":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LNumber(mods))
+			return 1
+		}))
+		return true
+	case "Shift":
+		mask = tcell.ModShift
+	case "Ctrl":
+		mask = tcell.ModCtrl
+	case "Alt":
+		mask = tcell.ModAlt
+	case "Meta":
+		mask = tcell.ModMeta
+	default:
+		return false
+	}
+	L.Push(L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LBool(mods&mask != 0))
+		return 1
+	}))
+	return true
+}
+
+func eventIndex(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	event := ud.Value.(*tcell.EventKey)
+	method := L.CheckString(2)
+
+	switch method {
+	case "Key":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LNumber(event.Key()))
+			return 1
+		}))
+	case "Rune":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LNumber(event.Rune()))
+			return 1
+		}))
+	case "Char":
+		// The typed character as a string, or "" for special keys
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			if event.Key() != tcell.KeyRune {
+				L.Push(lua.LString(""))
+			} else {
+				L.Push(lua.LString(string(event.Rune())))
+			}
+			return 1
+		}))
+	case "Name":
+		// A readable name such as "Ctrl+S", "Enter" or "Rune[a]"
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LString(event.Name()))
+			return 1
+		}))
+	default:
+		if !tuiModifierIndex(L, event.Modifiers(), method) {
+			L.Push(lua.LNil)
+		}
+	}
+
+	return 1
+}
+
+func mouseEventIndex(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	event := ud.Value.(*tcell.EventMouse)
+	method := L.CheckString(2)
+
+	switch method {
+	case "Position":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			x, y := event.Position()
+			L.Push(lua.LNumber(x))
+			L.Push(lua.LNumber(y))
+			return 2
+		}))
+	case "Buttons":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LNumber(event.Buttons()))
+			return 1
+		}))
+	default:
+		if !tuiModifierIndex(L, event.Modifiers(), method) {
+			L.Push(lua.LNil)
+		}
+	}
+
+	return 1
+}
+
+// tuiRoot wraps the root primitive of an application. tview hands pasted
+// text to the root only, so this is where app:SetPasteCapture hooks in.
+type tuiRoot struct {
+	tview.Primitive
+	app *TUIApp
+}
+
+// PasteHandler runs the paste capture function before the root's handler
+func (r *tuiRoot) PasteHandler() func(string, func(tview.Primitive)) {
+	handler := r.Primitive.PasteHandler()
+	r.app.mu.Lock()
+	capture := r.app.pasteCapture
+	r.app.mu.Unlock()
+	if capture == nil {
+		return handler
+	}
+	return func(text string, setFocus func(tview.Primitive)) {
+		text, ok := capture(text)
+		if ok && handler != nil {
+			handler(text, setFocus)
+		}
+	}
+}
+
+// tuiPasteCapture adapts a Lua paste capture function. The function
+// receives the pasted text and returns it, or other text, to pass it to the
+// focused widget; returning nil consumes it.
+func tuiPasteCapture(L *lua.LState, fn *lua.LFunction) func(string) (string, bool) {
+	return func(text string) (string, bool) {
+		result := tuiCall(L, fn, 1, lua.LString(text))
+		if result == lua.LNil {
+			return "", false
+		}
+		if s, ok := result.(lua.LString); ok {
+			return string(s), true
+		}
+		return text, true
+	}
+}
@@ -0,0 +1,401 @@
+// tui_keys_functions.go - Key bindings, help overlay and command palette
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+	"github.com/yuin/gopher-lua"
+)
+
+// app:Bind(keys, fn, description, scope) binds keys such as "Ctrl+S" or
+// the chord "Ctrl+X Ctrl+S". Bindings run before the app's input capture
+// function and consume their keys. Scoped bindings only apply while the
+// scope widget, such as a page, has focus, and win over global ones.
+
+// tuiKeyBinding is a key sequence bound to a Lua function. Bindings without
+// keys only appear in the command palette.
+type tuiKeyBinding struct {
+	keys        []string // tcell event names, e.g. "Ctrl+X", "Rune[s]"
+	label       string   // keys for people, e.g. "Ctrl+X s"
+	description string
+	scope       tview.Primitive
+	L           *lua.LState
+	fn          *lua.LFunction
+}
+
+// tuiOverlay is a help overlay or command palette shown over the root
+type tuiOverlay struct {
+	main  tview.Primitive
+	focus tview.Primitive
+}
+
+// tuiKeyLabel names a key the way help screens do: "Ctrl+S", "Enter", "s"
+func tuiKeyLabel(event *tcell.EventKey) string {
+	if event.Key() != tcell.KeyRune {
+		return event.Name()
+	}
+	var sb strings.Builder
+	mods := event.Modifiers()
+	for _, m := range []struct {
+		mask tcell.ModMask
+		name string
+	}{{tcell.ModCtrl, "Ctrl+"}, {tcell.ModAlt, "Alt+"}, {tcell.ModMeta, "Meta+"}, {tcell.ModShift, "Shift+"}} {
+		if mods&m.mask != 0 {
+			sb.WriteString(m.name)
+		}
+	}
+	if event.Rune() == ' ' {
+		sb.WriteString("Space")
+	} else {
+		sb.WriteRune(event.Rune())
+	}
+	return sb.String()
+}
+
+// tuiParseKeys parses a key sequence separated by spaces
+func tuiParseKeys(keys string) (names []string, label string, err error) {
+	var labels []string
+	for _, field := range strings.Fields(keys) {
+		event, err := tuiParseKey(field)
+		if err != nil {
+			return nil, "", err
+		}
+		names = append(names, event.Name())
+		labels = append(labels, tuiKeyLabel(event))
+	}
+	return names, strings.Join(labels, " "), nil
+}
+
+// bind adds a binding, replacing one with the same keys and scope
+func (a *TUIApp) bind(binding *tuiKeyBinding) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, b := range a.keys {
+		if len(b.keys) > 0 && b.label == binding.label && b.scope == binding.scope {
+			a.keys[i] = binding
+			return
+		}
+	}
+	a.keys = append(a.keys, binding)
+}
+
+func (a *TUIApp) unbind(label string, scope tview.Primitive) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, b := range a.keys {
+		if len(b.keys) > 0 && b.label == label && b.scope == scope {
+			a.keys = append(a.keys[:i], a.keys[i+1:]...)
+			return
+		}
+	}
+}
+
+// activeBindings returns the bindings whose scope has focus, scoped ones
+// first
+func (a *TUIApp) activeBindings() []*tuiKeyBinding {
+	a.mu.Lock()
+	keys := append([]*tuiKeyBinding(nil), a.keys...)
+	a.mu.Unlock()
+
+	var scoped, global []*tuiKeyBinding
+	for _, b := range keys {
+		switch {
+		case b.scope == nil:
+			global = append(global, b)
+		case b.scope.HasFocus():
+			scoped = append(scoped, b)
+		}
+	}
+	return append(scoped, global...)
+}
+
+// captureKey is the app's input capture function. It runs key bindings,
+// then the function set with app:SetInputCapture.
+func (a *TUIApp) captureKey(event *tcell.EventKey) *tcell.EventKey {
+	if a.dispatchKey(event) {
+		return nil
+	}
+	a.mu.Lock()
+	capture := a.keyCapture
+	a.mu.Unlock()
+	if capture != nil {
+		return capture(event)
+	}
+	return event
+}
+
+// dispatchKey matches the key, after the keys of an unfinished chord,
+// against the active bindings and reports whether it was consumed. A key
+// that doesn't continue a chord cancels it and is dropped.
+func (a *TUIApp) dispatchKey(event *tcell.EventKey) bool {
+	a.mu.Lock()
+	pending := a.chord
+	a.chord = nil
+	a.mu.Unlock()
+	sequence := append(append([]string(nil), pending...), event.Name())
+
+	prefix := false
+	for _, b := range a.activeBindings() {
+		if len(b.keys) < len(sequence) || !tuiKeysPrefix(sequence, b.keys) {
+			continue
+		}
+		if len(b.keys) == len(sequence) {
+			tuiCall(b.L, b.fn, 0, tuiNewUserData(b.L, event))
+			return true
+		}
+		prefix = true
+	}
+	if prefix {
+		a.mu.Lock()
+		a.chord = sequence
+		a.mu.Unlock()
+		return true
+	}
+	return len(pending) > 0
+}
+
+func tuiKeysPrefix(prefix, keys []string) bool {
+	for i, key := range prefix {
+		if keys[i] != key {
+			return false
+		}
+	}
+	return true
+}
+
+// tuiCenter places p in the middle of the screen at the given size
+func tuiCenter(p tview.Primitive, width, height int) tview.Primitive {
+	return tview.NewFlex().
+		AddItem(nil, 0, 1, false).
+		AddItem(tview.NewFlex().SetDirection(tview.FlexRow).
+			AddItem(nil, 0, 1, false).
+			AddItem(p, height, 0, true).
+			AddItem(nil, 0, 1, false), width, 0, true).
+		AddItem(nil, 0, 1, false)
+}
+
+// showOverlay shows p over the root and focuses it. Overlays replace each
+// other; hideOverlay restores the root and its focus.
+func (a *TUIApp) showOverlay(p tview.Primitive, width, height int) {
+	a.hideOverlay()
+	if a.root == nil {
+		return
+	}
+	main := a.root.Primitive
+	a.overlay = &tuiOverlay{main: main, focus: a.GetFocus()}
+	pages := tview.NewPages().
+		AddPage("main", main, true, true).
+		AddPage("overlay", tuiCenter(p, width, height), true, true)
+	pages.SetRect(main.GetRect())
+	a.root.Primitive = pages
+	a.SetFocus(p)
+}
+
+func (a *TUIApp) hideOverlay() {
+	if a.overlay == nil {
+		return
+	}
+	a.root.Primitive = a.overlay.main
+	focus := a.overlay.focus
+	a.overlay = nil
+	if focus == nil {
+		focus = a.root.Primitive
+	}
+	a.SetFocus(focus)
+}
+
+// showHelp lists the active bindings with their descriptions
+func (a *TUIApp) showHelp() {
+	table := tview.NewTable().SetSelectable(false, false)
+	table.SetBorder(true).SetTitle(" Keys ")
+	keysWidth, descriptionWidth := 0, 0
+	for _, b := range a.activeBindings() {
+		if len(b.keys) == 0 {
+			continue
+		}
+		row := table.GetRowCount()
+		table.SetCell(row, 0, tview.NewTableCell(b.label).SetTextColor(tview.Styles.SecondaryTextColor))
+		table.SetCell(row, 1, tview.NewTableCell(b.description))
+		keysWidth = max(keysWidth, tview.TaggedStringWidth(b.label))
+		descriptionWidth = max(descriptionWidth, tview.TaggedStringWidth(b.description))
+	}
+	table.SetDoneFunc(func(tcell.Key) {
+		a.hideOverlay()
+	})
+	// Columns are separated by a space, and the border takes two more
+	a.showOverlay(table, keysWidth+descriptionWidth+3, table.GetRowCount()+2)
+}
+
+// tuiFuzzyScore reports whether the letters of pattern appear in text in
+// order, ignoring case and spaces, and scores the match: consecutive
+// letters and letters starting a word count more
+func tuiFuzzyScore(pattern, text string) (int, bool) {
+	p := []rune(strings.ToLower(strings.ReplaceAll(pattern, " ", "")))
+	t := []rune(strings.ToLower(text))
+	score, matched, previous := 0, 0, -2
+	for i := 0; i < len(t) && matched < len(p); i++ {
+		if t[i] != p[matched] {
+			continue
+		}
+		score++
+		if i == previous+1 {
+			score += 3
+		}
+		if i == 0 || !unicode.IsLetter(t[i-1]) && !unicode.IsDigit(t[i-1]) {
+			score += 2
+		}
+		previous = i
+		matched++
+	}
+	return score, matched == len(p)
+}
+
+// showPalette shows a command palette listing the active bindings with a
+// description, best fuzzy matches for the typed text first
+func (a *TUIApp) showPalette() {
+	var commands []*tuiKeyBinding
+	for _, b := range a.activeBindings() {
+		if b.description != "" {
+			commands = append(commands, b)
+		}
+	}
+
+	input := tview.NewInputField().SetLabel("> ")
+	list := tview.NewList().ShowSecondaryText(false).SetHighlightFullLine(true)
+	var shown []*tuiKeyBinding
+	filter := func(text string) {
+		type match struct {
+			binding *tuiKeyBinding
+			score   int
+		}
+		var matches []match
+		for _, b := range commands {
+			if score, ok := tuiFuzzyScore(text, b.description); ok {
+				matches = append(matches, match{b, score})
+			}
+		}
+		sort.SliceStable(matches, func(i, j int) bool {
+			return matches[i].score > matches[j].score
+		})
+		list.Clear()
+		shown = shown[:0]
+		for _, m := range matches {
+			label := m.binding.description
+			if m.binding.label != "" {
+				label = fmt.Sprintf("%s (%s)", label, m.binding.label)
+			}
+			list.AddItem(label, "", 0, nil)
+			shown = append(shown, m.binding)
+		}
+	}
+	filter("")
+
+	input.SetChangedFunc(filter)
+	input.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		switch event.Key() {
+		case tcell.KeyUp, tcell.KeyDown, tcell.KeyPgUp, tcell.KeyPgDn:
+			list.InputHandler()(event, nil)
+			return nil
+		}
+		return event
+	})
+	input.SetDoneFunc(func(key tcell.Key) {
+		a.hideOverlay()
+		if key != tcell.KeyEnter || list.GetItemCount() == 0 {
+			return
+		}
+		b := shown[list.GetCurrentItem()]
+		tuiCall(b.L, b.fn, 0)
+	})
+
+	flex := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(input, 1, 0, true).
+		AddItem(list, 0, 1, false)
+	flex.SetBorder(true).SetTitle(" Commands ")
+	a.showOverlay(flex, 50, min(len(commands), 10)+3)
+	a.SetFocus(input)
+}
+
+// tuiKeysIndex pushes the key binding methods of the app and reports
+// whether method was one of them
+func tuiKeysIndex(L *lua.LState, ud *lua.LUserData, app *TUIApp, method string) bool {
+	switch method {
+	case "Bind", "bind":
+		// app:Bind(keys, fn, description, scope); keys may be nil or "" for
+		// commands that only appear in the command palette
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			names, label, err := tuiParseKeys(L.OptString(2, ""))
+			if err != nil {
+				L.ArgError(2, err.Error())
+			}
+			binding := &tuiKeyBinding{
+				keys:        names,
+				label:       label,
+				fn:          L.CheckFunction(3),
+				description: L.OptString(4, ""),
+				L:           L,
+			}
+			if L.Get(5) != lua.LNil {
+				binding.scope = tuiCheckPrimitive(L, 5)
+			}
+			app.bind(binding)
+			L.Push(ud)
+			return 1
+		}))
+	case "Unbind":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			_, label, err := tuiParseKeys(L.CheckString(2))
+			if err != nil {
+				L.ArgError(2, err.Error())
+			}
+			var scope tview.Primitive
+			if L.Get(3) != lua.LNil {
+				scope = tuiCheckPrimitive(L, 3)
+			}
+			app.unbind(label, scope)
+			L.Push(ud)
+			return 1
+		}))
+	case "GetBindings":
+		// Returns the active bindings as {keys=, description=} tables
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			bindings := L.NewTable()
+			for _, b := range app.activeBindings() {
+				binding := L.NewTable()
+				binding.RawSetString("keys", lua.LString(b.label))
+				binding.RawSetString("description", lua.LString(b.description))
+				bindings.Append(binding)
+			}
+			L.Push(bindings)
+			return 1
+		}))
+	case "ShowHelp", "ShowCommandPalette", "HideOverlay":
+		// Overlays must be shown and hidden on the event loop, e.g. from
+		// a binding
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			switch method {
+			case "ShowHelp":
+				app.showHelp()
+			case "ShowCommandPalette":
+				app.showPalette()
+			default:
+				app.hideOverlay()
+			}
+			L.Push(ud)
+			return 1
+		}))
+	case "HasOverlay":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LBool(app.overlay != nil))
+			return 1
+		}))
+	default:
+		return false
+	}
+	return true
+}
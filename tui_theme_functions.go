@@ -0,0 +1,309 @@
+// tui_theme_functions.go - Themes, style classes and colors for the tui module
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+	"github.com/yuin/gopher-lua"
+)
+
+// Theme colors live in tview.Styles, which widgets read when they are
+// created. Theme color names such as "primary" may be used wherever a color
+// is accepted, and style classes applied with widget:SetClass are applied
+// again when the theme changes, which is how apps switch between light and
+// dark at runtime.
+
+// tuiThemeColors names the colors of tview.Styles
+var tuiThemeColors = []struct {
+	name  string
+	color *tcell.Color
+}{
+	{"background", &tview.Styles.PrimitiveBackgroundColor},
+	{"contrast", &tview.Styles.ContrastBackgroundColor},
+	{"more_contrast", &tview.Styles.MoreContrastBackgroundColor},
+	{"border", &tview.Styles.BorderColor},
+	{"title", &tview.Styles.TitleColor},
+	{"graphics", &tview.Styles.GraphicsColor},
+	{"primary", &tview.Styles.PrimaryTextColor},
+	{"secondary", &tview.Styles.SecondaryTextColor},
+	{"tertiary", &tview.Styles.TertiaryTextColor},
+	{"inverse", &tview.Styles.InverseTextColor},
+	{"contrast_secondary", &tview.Styles.ContrastSecondaryTextColor},
+}
+
+// tuiThemes are the themes tui.setTheme accepts by name. dark is tview's
+// default theme.
+var tuiThemes = map[string]map[string]string{
+	"dark": {
+		"background":         "black",
+		"contrast":           "blue",
+		"more_contrast":      "green",
+		"border":             "white",
+		"title":              "white",
+		"graphics":           "white",
+		"primary":            "white",
+		"secondary":          "yellow",
+		"tertiary":           "green",
+		"inverse":            "blue",
+		"contrast_secondary": "navy",
+	},
+	"light": {
+		"background":         "#ffffff",
+		"contrast":           "#d0d7de",
+		"more_contrast":      "#8c959f",
+		"border":             "#57606a",
+		"title":              "#24292f",
+		"graphics":           "#57606a",
+		"primary":            "#24292f",
+		"secondary":          "#0969da",
+		"tertiary":           "#1a7f37",
+		"inverse":            "#ffffff",
+		"contrast_secondary": "#0550ae",
+	},
+}
+
+// tuiStyles guards tview.Styles, the style classes and the widgets using
+// them
+var tuiStyles struct {
+	sync.Mutex
+	classes map[string]map[string]lua.LValue
+	widgets map[interface{}]*tuiClassed
+}
+
+// tuiClassed is a widget with style classes
+type tuiClassed struct {
+	ud      lua.LValue
+	classes []string
+}
+
+// tuiParseColor parses a theme color name, a tcell color name, "default",
+// "#rgb", "#rrggbb" or "rgb(r, g, b)"
+func tuiParseColor(s string) (tcell.Color, bool) {
+	name := strings.ToLower(strings.TrimSpace(s))
+	tuiStyles.Lock()
+	for _, c := range tuiThemeColors {
+		if c.name == name {
+			color := *c.color
+			tuiStyles.Unlock()
+			return color, true
+		}
+	}
+	tuiStyles.Unlock()
+
+	switch {
+	case name == "default":
+		return tcell.ColorDefault, true
+	case strings.HasPrefix(name, "#"):
+		hex := name[1:]
+		if len(hex) == 3 {
+			hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+		}
+		if len(hex) != 6 {
+			return tcell.ColorDefault, false
+		}
+		v, err := strconv.ParseInt(hex, 16, 32)
+		if err != nil {
+			return tcell.ColorDefault, false
+		}
+		return tcell.NewHexColor(int32(v)), true
+	case strings.HasPrefix(name, "rgb(") && strings.HasSuffix(name, ")"):
+		parts := strings.Split(name[4:len(name)-1], ",")
+		if len(parts) != 3 {
+			return tcell.ColorDefault, false
+		}
+		var rgb [3]int32
+		for i, part := range parts {
+			v, err := strconv.Atoi(strings.TrimSpace(part))
+			if err != nil || v < 0 || v > 255 {
+				return tcell.ColorDefault, false
+			}
+			rgb[i] = int32(v)
+		}
+		return tcell.NewRGBColor(rgb[0], rgb[1], rgb[2]), true
+	}
+	color, ok := tcell.ColorNames[name]
+	return color, ok
+}
+
+// tuiApplyClasses applies style classes to a widget in order. Class keys
+// call the widget's setters like tui.build properties do; setters the
+// widget lacks are skipped, so one class can style several widget types.
+func tuiApplyClasses(L *lua.LState, ud lua.LValue, classes []string) {
+	for _, class := range classes {
+		tuiStyles.Lock()
+		props := tuiStyles.classes[class]
+		tuiStyles.Unlock()
+
+		keys := make([]string, 0, len(props))
+		for key := range props {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			method := "Set" + tuiPascalCase(key)
+			fn, ok := L.GetField(ud, method).(*lua.LFunction)
+			if !ok {
+				continue
+			}
+			L.Push(fn)
+			L.Push(ud)
+			args := tuiBuildArgs(key, method, props[key])
+			for _, arg := range args {
+				L.Push(arg)
+			}
+			L.Call(len(args)+1, 0)
+		}
+	}
+}
+
+// tuiRestyle applies the classes again to the widgets using any of names,
+// or to all classed widgets when names is empty
+func tuiRestyle(L *lua.LState, names ...string) {
+	tuiStyles.Lock()
+	var widgets []*tuiClassed
+	for _, w := range tuiStyles.widgets {
+		if len(names) == 0 || tuiHasClass(w.classes, names) {
+			widgets = append(widgets, w)
+		}
+	}
+	tuiStyles.Unlock()
+	for _, w := range widgets {
+		tuiApplyClasses(L, w.ud, w.classes)
+	}
+}
+
+func tuiHasClass(classes, names []string) bool {
+	for _, class := range classes {
+		for _, name := range names {
+			if class == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tuiSetClasses sets the style classes of a widget, given as names separated
+// by spaces, and applies them
+func tuiSetClasses(L *lua.LState, ud *lua.LUserData, names string) {
+	classes := strings.Fields(names)
+	tuiStyles.Lock()
+	if tuiStyles.widgets == nil {
+		tuiStyles.widgets = map[interface{}]*tuiClassed{}
+	}
+	if len(classes) == 0 {
+		delete(tuiStyles.widgets, ud.Value)
+	} else {
+		tuiStyles.widgets[ud.Value] = &tuiClassed{ud: ud, classes: classes}
+	}
+	tuiStyles.Unlock()
+	tuiApplyClasses(L, ud, classes)
+}
+
+// tuiGetClasses returns the style classes of a widget
+func tuiGetClasses(ud *lua.LUserData) string {
+	tuiStyles.Lock()
+	defer tuiStyles.Unlock()
+	if w, ok := tuiStyles.widgets[ud.Value]; ok {
+		return strings.Join(w.classes, " ")
+	}
+	return ""
+}
+
+// tuiForgetClasses drops widgets that are no longer shown, so they are not
+// restyled or kept alive by their classes
+func tuiForgetClasses(widgets []interface{}) {
+	if len(widgets) == 0 {
+		return
+	}
+	tuiStyles.Lock()
+	defer tuiStyles.Unlock()
+	for _, widget := range widgets {
+		delete(tuiStyles.widgets, widget)
+	}
+}
+
+// luaTUISetTheme sets theme colors from a table, or from a theme name such
+// as "light" or "dark". Colors missing from the table keep their value.
+func luaTUISetTheme(L *lua.LState) int {
+	colors := map[string]tcell.Color{}
+	switch v := L.Get(1).(type) {
+	case lua.LString:
+		theme, ok := tuiThemes[string(v)]
+		if !ok {
+			L.ArgError(1, "unknown theme "+string(v))
+		}
+		for name, value := range theme {
+			colors[name], _ = tuiParseColor(value)
+		}
+	case *lua.LTable:
+		v.ForEach(func(k, value lua.LValue) {
+			L.Push(value)
+			colors[k.String()] = tuiCheckColor(L, L.GetTop())
+			L.Pop(1)
+		})
+	default:
+		L.ArgError(1, "theme table or name expected")
+	}
+
+	tuiStyles.Lock()
+	for name := range colors {
+		known := false
+		for _, c := range tuiThemeColors {
+			known = known || c.name == name
+		}
+		if !known {
+			tuiStyles.Unlock()
+			L.ArgError(1, fmt.Sprintf("unknown theme color %s", name))
+		}
+	}
+	for _, c := range tuiThemeColors {
+		if color, ok := colors[c.name]; ok {
+			*c.color = color
+		}
+	}
+	tuiStyles.Unlock()
+
+	tuiRestyle(L)
+	return 0
+}
+
+// luaTUIGetTheme returns the theme colors as "#rrggbb" values
+func luaTUIGetTheme(L *lua.LState) int {
+	theme := L.NewTable()
+	tuiStyles.Lock()
+	for _, c := range tuiThemeColors {
+		theme.RawSetString(c.name, lua.LString(tuiColorName(*c.color)))
+	}
+	tuiStyles.Unlock()
+	L.Push(theme)
+	return 1
+}
+
+// luaTUISetClass defines a style class, such as
+// tui.setClass("danger", {text_color = "red", border_color = "#ff5555"}),
+// and applies it again to the widgets using it
+func luaTUISetClass(L *lua.LState) int {
+	name := L.CheckString(1)
+	table := L.CheckTable(2)
+	props := map[string]lua.LValue{}
+	table.ForEach(func(k, v lua.LValue) {
+		props[k.String()] = v
+	})
+
+	tuiStyles.Lock()
+	if tuiStyles.classes == nil {
+		tuiStyles.classes = map[string]map[string]lua.LValue{}
+	}
+	tuiStyles.classes[name] = props
+	tuiStyles.Unlock()
+
+	tuiRestyle(L, name)
+	return 0
+}
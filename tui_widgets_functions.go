@@ -0,0 +1,1448 @@
+// tui_widgets_functions.go - Lists, tables, trees, forms and other tui widgets
+package main
+
+import (
+	"fmt"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+	"github.com/yuin/gopher-lua"
+)
+
+// TUIProgressBar is a horizontal bar showing progress towards a maximum.
+// tview has no progress bar of its own.
+type TUIProgressBar struct {
+	*tview.Box
+	value       float64
+	max         float64
+	label       string
+	showPercent bool
+	filledColor tcell.Color
+	emptyColor  tcell.Color
+	changed     func(value float64)
+}
+
+// NewTUIProgressBar returns an empty progress bar with a maximum of 100
+func NewTUIProgressBar() *TUIProgressBar {
+	return &TUIProgressBar{
+		Box:         tview.NewBox(),
+		max:         100,
+		showPercent: true,
+		filledColor: tview.Styles.TertiaryTextColor,
+		emptyColor:  tview.Styles.PrimaryTextColor,
+	}
+}
+
+// SetValue sets the progress, clamped to the range from zero to the maximum
+func (p *TUIProgressBar) SetValue(value float64) *TUIProgressBar {
+	value = max(0, min(value, p.max))
+	if value != p.value {
+		p.value = value
+		if p.changed != nil {
+			p.changed(value)
+		}
+	}
+	return p
+}
+
+// Draw draws the label, the bar and the percentage
+func (p *TUIProgressBar) Draw(screen tcell.Screen) {
+	p.Box.DrawForSubclass(screen, p)
+	x, y, width, height := p.GetInnerRect()
+	if width <= 0 || height <= 0 {
+		return
+	}
+
+	if p.label != "" {
+		_, used := tview.Print(screen, p.label+" ", x, y, width, tview.AlignLeft, tview.Styles.SecondaryTextColor)
+		x, width = x+used, width-used
+	}
+	fraction := 0.0
+	if p.max > 0 {
+		fraction = p.value / p.max
+	}
+	percent := ""
+	if p.showPercent {
+		percent = fmt.Sprintf(" %3d%%", int(fraction*100))
+	}
+
+	bar := width - len(percent)
+	if bar < 0 {
+		return
+	}
+	filled := int(fraction * float64(bar))
+	style := tcell.StyleDefault.Background(p.GetBackgroundColor())
+	for i := 0; i < bar; i++ {
+		if i < filled {
+			screen.SetContent(x+i, y, '█', nil, style.Foreground(p.filledColor))
+		} else {
+			screen.SetContent(x+i, y, '░', nil, style.Foreground(p.emptyColor))
+		}
+	}
+	tview.Print(screen, percent, x+bar, y, len(percent), tview.AlignLeft, tview.Styles.PrimaryTextColor)
+}
+
+// tuiTreeNodeRef is stored as the reference of every tree node created from
+// Lua. It keeps the node's userdata, so callbacks receive the object the
+// script created, and the value set with SetReference.
+type tuiTreeNodeRef struct {
+	ud    *lua.LUserData
+	value lua.LValue
+}
+
+func tuiTreeNodeUserData(L *lua.LState, node *tview.TreeNode) lua.LValue {
+	ref, ok := node.GetReference().(*tuiTreeNodeRef)
+	if !ok {
+		ref = &tuiTreeNodeRef{value: lua.LNil}
+		node.SetReference(ref)
+	}
+	if ref.ud == nil {
+		ud := L.NewUserData()
+		ud.Value = node
+		L.SetMetatable(ud, L.GetTypeMetatable("TreeNode"))
+		ref.ud = ud
+	}
+	return ref.ud
+}
+
+// tuiCheckTreeNode returns the tree node passed as argument n
+func tuiCheckTreeNode(L *lua.LState, n int) *tview.TreeNode {
+	node, ok := L.CheckUserData(n).Value.(*tview.TreeNode)
+	if !ok {
+		L.ArgError(n, "tree node expected")
+	}
+	return node
+}
+
+// tuiShortcut converts a list shortcut to the string passed to Lua
+func tuiShortcut(r rune) lua.LValue {
+	if r == 0 {
+		return lua.LString("")
+	}
+	return lua.LString(string(r))
+}
+
+// tuiSetCell applies a cell given as text or as a table of cell options
+func tuiSetCell(L *lua.LState, n int, cell *tview.TableCell) {
+	switch v := L.Get(n).(type) {
+	case lua.LString, lua.LNumber:
+		cell.SetText(v.String())
+		return
+	case *lua.LTable:
+		if text := v.RawGetString("text"); text != lua.LNil {
+			cell.SetText(text.String())
+		}
+		if align, ok := v.RawGetString("align").(lua.LNumber); ok {
+			cell.SetAlign(int(align))
+		}
+		if expansion, ok := v.RawGetString("expansion").(lua.LNumber); ok {
+			cell.SetExpansion(int(expansion))
+		}
+		if width, ok := v.RawGetString("max_width").(lua.LNumber); ok {
+			cell.SetMaxWidth(int(width))
+		}
+		if selectable := v.RawGetString("selectable"); selectable != lua.LNil {
+			cell.SetSelectable(lua.LVAsBool(selectable))
+		}
+		L.Push(v)
+		defer L.Pop(1)
+		top := L.GetTop()
+		if v.RawGetString("color") != lua.LNil {
+			L.Push(v.RawGetString("color"))
+			cell.SetTextColor(tuiCheckColor(L, top+1))
+			L.Pop(1)
+		}
+		if v.RawGetString("background") != lua.LNil {
+			L.Push(v.RawGetString("background"))
+			cell.SetBackgroundColor(tuiCheckColor(L, top+1))
+			L.Pop(1)
+		}
+		return
+	}
+	L.ArgError(n, "cell text or table expected")
+}
+
+func luaNewList(L *lua.LState) int {
+	L.Push(tuiNewUserData(L, tview.NewList()))
+	return 1
+}
+
+func luaNewTable(L *lua.LState) int {
+	L.Push(tuiNewUserData(L, tview.NewTable()))
+	return 1
+}
+
+func luaNewTreeView(L *lua.LState) int {
+	L.Push(tuiNewUserData(L, tview.NewTreeView()))
+	return 1
+}
+
+func luaNewTreeNode(L *lua.LState) int {
+	L.Push(tuiNewUserData(L, tview.NewTreeNode(L.OptString(1, ""))))
+	return 1
+}
+
+func luaNewForm(L *lua.LState) int {
+	L.Push(tuiNewUserData(L, tview.NewForm()))
+	return 1
+}
+
+func luaNewModal(L *lua.LState) int {
+	modal := tview.NewModal().SetText(L.OptString(1, ""))
+	L.Push(tuiNewUserData(L, modal))
+	return 1
+}
+
+func luaNewPages(L *lua.LState) int {
+	L.Push(tuiNewUserData(L, tview.NewPages()))
+	return 1
+}
+
+func luaNewGrid(L *lua.LState) int {
+	L.Push(tuiNewUserData(L, tview.NewGrid()))
+	return 1
+}
+
+func luaNewDropDown(L *lua.LState) int {
+	L.Push(tuiNewUserData(L, tview.NewDropDown()))
+	return 1
+}
+
+func luaNewCheckbox(L *lua.LState) int {
+	L.Push(tuiNewUserData(L, tview.NewCheckbox()))
+	return 1
+}
+
+func luaNewProgressBar(L *lua.LState) int {
+	L.Push(tuiNewUserData(L, NewTUIProgressBar()))
+	return 1
+}
+
+func listIndex(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	list := ud.Value.(*tview.List)
+	method := L.CheckString(2)
+
+	// selected wraps an optional per-item callback
+	selected := func(L *lua.LState, n int) func() {
+		fn := L.OptFunction(n, nil)
+		if fn == nil {
+			return nil
+		}
+		return func() { tuiCall(L, fn, 0) }
+	}
+	// handler adapts a list-wide callback receiving the item
+	handler := func(fn *lua.LFunction) func(int, string, string, rune) {
+		return func(index int, main, secondary string, shortcut rune) {
+			tuiCall(L, fn, 0, lua.LNumber(index), lua.LString(main), lua.LString(secondary), tuiShortcut(shortcut))
+		}
+	}
+
+	switch method {
+	case "AddItem":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			list.AddItem(L.CheckString(2), L.OptString(3, ""), tuiOptRune(L, 4), selected(L, 5))
+			L.Push(ud)
+			return 1
+		}))
+	case "InsertItem":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			list.InsertItem(L.CheckInt(2), L.CheckString(3), L.OptString(4, ""), tuiOptRune(L, 5), selected(L, 6))
+			L.Push(ud)
+			return 1
+		}))
+	case "RemoveItem":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			list.RemoveItem(L.CheckInt(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "Clear":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			list.Clear()
+			L.Push(ud)
+			return 1
+		}))
+	case "GetItemCount":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LNumber(list.GetItemCount()))
+			return 1
+		}))
+	case "GetItemText":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			main, secondary := list.GetItemText(L.CheckInt(2))
+			L.Push(lua.LString(main))
+			L.Push(lua.LString(secondary))
+			return 2
+		}))
+	case "SetItemText":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			list.SetItemText(L.CheckInt(2), L.CheckString(3), L.OptString(4, ""))
+			L.Push(ud)
+			return 1
+		}))
+	case "GetCurrentItem":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LNumber(list.GetCurrentItem()))
+			return 1
+		}))
+	case "SetCurrentItem":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			list.SetCurrentItem(L.CheckInt(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "ShowSecondaryText":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			list.ShowSecondaryText(L.CheckBool(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetHighlightFullLine":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			list.SetHighlightFullLine(L.CheckBool(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetWrapAround":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			list.SetWrapAround(L.CheckBool(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetMainTextColor":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			list.SetMainTextColor(tuiCheckColor(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetSecondaryTextColor":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			list.SetSecondaryTextColor(tuiCheckColor(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetShortcutColor":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			list.SetShortcutColor(tuiCheckColor(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetSelectedTextColor":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			list.SetSelectedTextColor(tuiCheckColor(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetSelectedBackgroundColor":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			list.SetSelectedBackgroundColor(tuiCheckColor(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetSelectedFunc":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			list.SetSelectedFunc(handler(L.CheckFunction(2)))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetChangedFunc":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			list.SetChangedFunc(handler(L.CheckFunction(2)))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetDoneFunc":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			fn := L.CheckFunction(2)
+			list.SetDoneFunc(func() {
+				tuiCall(L, fn, 0)
+			})
+			L.Push(ud)
+			return 1
+		}))
+	default:
+		tuiBoxIndex(L, ud, list.Box, method)
+	}
+
+	return 1
+}
+
+func tableIndex(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	table := ud.Value.(*tview.Table)
+	method := L.CheckString(2)
+
+	// cellHandler adapts a callback receiving a row and column
+	cellHandler := func(fn *lua.LFunction) func(int, int) {
+		return func(row, column int) {
+			tuiCall(L, fn, 0, lua.LNumber(row), lua.LNumber(column))
+		}
+	}
+
+	switch method {
+	case "SetCell":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			cell := tview.NewTableCell("")
+			tuiSetCell(L, 4, cell)
+			table.SetCell(L.CheckInt(2), L.CheckInt(3), cell)
+			L.Push(ud)
+			return 1
+		}))
+	case "GetCell":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LString(table.GetCell(L.CheckInt(2), L.CheckInt(3)).Text))
+			return 1
+		}))
+	case "Clear":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			table.Clear()
+			L.Push(ud)
+			return 1
+		}))
+	case "InsertRow":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			table.InsertRow(L.CheckInt(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "RemoveRow":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			table.RemoveRow(L.CheckInt(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "InsertColumn":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			table.InsertColumn(L.CheckInt(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "RemoveColumn":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			table.RemoveColumn(L.CheckInt(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "GetRowCount":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LNumber(table.GetRowCount()))
+			return 1
+		}))
+	case "GetColumnCount":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LNumber(table.GetColumnCount()))
+			return 1
+		}))
+	case "SetBorders":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			table.SetBorders(L.CheckBool(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetBordersColor":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			table.SetBordersColor(tuiCheckColor(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetSeparator":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			table.SetSeparator(tuiOptRune(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetFixed":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			table.SetFixed(L.CheckInt(2), L.CheckInt(3))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetSelectable":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			table.SetSelectable(L.CheckBool(2), L.CheckBool(3))
+			L.Push(ud)
+			return 1
+		}))
+	case "Select":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			table.Select(L.CheckInt(2), L.CheckInt(3))
+			L.Push(ud)
+			return 1
+		}))
+	case "GetSelection":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			row, column := table.GetSelection()
+			L.Push(lua.LNumber(row))
+			L.Push(lua.LNumber(column))
+			return 2
+		}))
+	case "ScrollToBeginning":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			table.ScrollToBeginning()
+			L.Push(ud)
+			return 1
+		}))
+	case "ScrollToEnd":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			table.ScrollToEnd()
+			L.Push(ud)
+			return 1
+		}))
+	case "SetSelectedFunc":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			table.SetSelectedFunc(cellHandler(L.CheckFunction(2)))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetSelectionChangedFunc":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			table.SetSelectionChangedFunc(cellHandler(L.CheckFunction(2)))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetDoneFunc":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			fn := L.CheckFunction(2)
+			table.SetDoneFunc(func(key tcell.Key) {
+				tuiCall(L, fn, 0, lua.LNumber(key))
+			})
+			L.Push(ud)
+			return 1
+		}))
+	default:
+		tuiBoxIndex(L, ud, table.Box, method)
+	}
+
+	return 1
+}
+
+func treeViewIndex(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	tree := ud.Value.(*tview.TreeView)
+	method := L.CheckString(2)
+
+	// nodeHandler adapts a callback receiving a node
+	nodeHandler := func(fn *lua.LFunction) func(*tview.TreeNode) {
+		return func(node *tview.TreeNode) {
+			tuiCall(L, fn, 0, tuiNewUserData(L, node))
+		}
+	}
+
+	switch method {
+	case "SetRoot":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			root := tuiCheckTreeNode(L, 2)
+			tree.SetRoot(root).SetCurrentNode(root)
+			L.Push(ud)
+			return 1
+		}))
+	case "GetRoot":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(tuiNewUserData(L, tree.GetRoot()))
+			return 1
+		}))
+	case "SetCurrentNode":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			tree.SetCurrentNode(tuiCheckTreeNode(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	case "GetCurrentNode":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(tuiNewUserData(L, tree.GetCurrentNode()))
+			return 1
+		}))
+	case "GetRowCount":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LNumber(tree.GetRowCount()))
+			return 1
+		}))
+	case "SetTopLevel":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			tree.SetTopLevel(L.CheckInt(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetGraphics":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			tree.SetGraphics(L.CheckBool(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetGraphicsColor":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			tree.SetGraphicsColor(tuiCheckColor(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetAlign":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			tree.SetAlign(L.CheckBool(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetPrefixes":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			tree.SetPrefixes(tuiCheckStrings(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetSelectedFunc":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			tree.SetSelectedFunc(nodeHandler(L.CheckFunction(2)))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetChangedFunc":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			tree.SetChangedFunc(nodeHandler(L.CheckFunction(2)))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetDoneFunc":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			fn := L.CheckFunction(2)
+			tree.SetDoneFunc(func(key tcell.Key) {
+				tuiCall(L, fn, 0, lua.LNumber(key))
+			})
+			L.Push(ud)
+			return 1
+		}))
+	default:
+		tuiBoxIndex(L, ud, tree.Box, method)
+	}
+
+	return 1
+}
+
+func treeNodeIndex(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	node := ud.Value.(*tview.TreeNode)
+	method := L.CheckString(2)
+
+	switch method {
+	case "AddChild":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			node.AddChild(tuiCheckTreeNode(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	case "RemoveChild":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			node.RemoveChild(tuiCheckTreeNode(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	case "ClearChildren":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			node.ClearChildren()
+			L.Push(ud)
+			return 1
+		}))
+	case "GetChildren":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			children := L.NewTable()
+			for _, child := range node.GetChildren() {
+				children.Append(tuiNewUserData(L, child))
+			}
+			L.Push(children)
+			return 1
+		}))
+	case "GetText":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LString(node.GetText()))
+			return 1
+		}))
+	case "SetText":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			node.SetText(L.CheckString(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "GetLevel":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LNumber(node.GetLevel()))
+			return 1
+		}))
+	case "SetColor":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			node.SetColor(tuiCheckColor(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetSelectable":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			node.SetSelectable(L.CheckBool(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetExpanded":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			node.SetExpanded(L.CheckBool(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "IsExpanded":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LBool(node.IsExpanded()))
+			return 1
+		}))
+	case "Expand", "Collapse", "ExpandAll", "CollapseAll":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			switch method {
+			case "Expand":
+				node.Expand()
+			case "Collapse":
+				node.Collapse()
+			case "ExpandAll":
+				node.ExpandAll()
+			case "CollapseAll":
+				node.CollapseAll()
+			}
+			L.Push(ud)
+			return 1
+		}))
+	case "SetReference":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			tuiTreeNodeUserData(L, node)
+			node.GetReference().(*tuiTreeNodeRef).value = L.Get(2)
+			L.Push(ud)
+			return 1
+		}))
+	case "GetReference":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			if ref, ok := node.GetReference().(*tuiTreeNodeRef); ok {
+				L.Push(ref.value)
+			} else {
+				L.Push(lua.LNil)
+			}
+			return 1
+		}))
+	case "SetSelectedFunc":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			fn := L.CheckFunction(2)
+			node.SetSelectedFunc(func() {
+				tuiCall(L, fn, 0, ud)
+			})
+			L.Push(ud)
+			return 1
+		}))
+	default:
+		L.Push(lua.LNil)
+	}
+
+	return 1
+}
+
+func formIndex(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	form := ud.Value.(*tview.Form)
+	method := L.CheckString(2)
+
+	// textHandler wraps an optional callback receiving the new text
+	textHandler := func(L *lua.LState, n int) func(string) {
+		fn := L.OptFunction(n, nil)
+		if fn == nil {
+			return nil
+		}
+		return func(text string) { tuiCall(L, fn, 0, lua.LString(text)) }
+	}
+
+	switch method {
+	case "AddInputField":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			form.AddInputField(L.CheckString(2), L.OptString(3, ""), L.OptInt(4, 0), nil, textHandler(L, 5))
+			L.Push(ud)
+			return 1
+		}))
+	case "AddPasswordField":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			form.AddPasswordField(L.CheckString(2), L.OptString(3, ""), L.OptInt(4, 0), '*', textHandler(L, 5))
+			L.Push(ud)
+			return 1
+		}))
+	case "AddTextArea":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			form.AddTextArea(L.CheckString(2), L.OptString(3, ""), L.OptInt(4, 0), L.OptInt(5, 0), 0, textHandler(L, 6))
+			L.Push(ud)
+			return 1
+		}))
+	case "AddDropDown":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			var selected func(string, int)
+			if fn := L.OptFunction(5, nil); fn != nil {
+				selected = func(option string, index int) {
+					tuiCall(L, fn, 0, lua.LString(option), lua.LNumber(index))
+				}
+			}
+			form.AddDropDown(L.CheckString(2), tuiCheckStrings(L, 3), L.OptInt(4, 0), selected)
+			L.Push(ud)
+			return 1
+		}))
+	case "AddCheckbox":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			var changed func(bool)
+			if fn := L.OptFunction(4, nil); fn != nil {
+				changed = func(checked bool) {
+					tuiCall(L, fn, 0, lua.LBool(checked))
+				}
+			}
+			form.AddCheckbox(L.CheckString(2), L.OptBool(3, false), changed)
+			L.Push(ud)
+			return 1
+		}))
+	case "AddButton":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			var selected func()
+			if fn := L.OptFunction(3, nil); fn != nil {
+				selected = func() { tuiCall(L, fn, 0) }
+			}
+			form.AddButton(L.CheckString(2), selected)
+			L.Push(ud)
+			return 1
+		}))
+	case "AddFormItem":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			item, ok := L.CheckUserData(2).Value.(tview.FormItem)
+			if !ok {
+				L.ArgError(2, "form item expected")
+			}
+			form.AddFormItem(item)
+			L.Push(ud)
+			return 1
+		}))
+	case "GetFormItem":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			index := L.CheckInt(2)
+			if index < 0 || index >= form.GetFormItemCount() {
+				L.Push(lua.LNil)
+				return 1
+			}
+			L.Push(tuiNewUserData(L, form.GetFormItem(index)))
+			return 1
+		}))
+	case "GetFormItemByLabel":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(tuiNewUserData(L, form.GetFormItemByLabel(L.CheckString(2))))
+			return 1
+		}))
+	case "GetFormItemCount":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LNumber(form.GetFormItemCount()))
+			return 1
+		}))
+	case "GetButton":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			index := L.CheckInt(2)
+			if index < 0 || index >= form.GetButtonCount() {
+				L.Push(lua.LNil)
+				return 1
+			}
+			L.Push(tuiNewUserData(L, form.GetButton(index)))
+			return 1
+		}))
+	case "GetButtonCount":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LNumber(form.GetButtonCount()))
+			return 1
+		}))
+	case "GetValues":
+		// Values of the input fields, text areas, drop-downs and checkboxes
+		// by label
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			values := L.NewTable()
+			for i := 0; i < form.GetFormItemCount(); i++ {
+				switch item := form.GetFormItem(i).(type) {
+				case *tview.InputField:
+					values.RawSetString(item.GetLabel(), lua.LString(item.GetText()))
+				case *tview.TextArea:
+					values.RawSetString(item.GetLabel(), lua.LString(item.GetText()))
+				case *tview.DropDown:
+					_, option := item.GetCurrentOption()
+					values.RawSetString(item.GetLabel(), lua.LString(option))
+				case *tview.Checkbox:
+					values.RawSetString(item.GetLabel(), lua.LBool(item.IsChecked()))
+				}
+			}
+			L.Push(values)
+			return 1
+		}))
+	case "Clear":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			form.Clear(L.OptBool(2, false))
+			L.Push(ud)
+			return 1
+		}))
+	case "ClearButtons":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			form.ClearButtons()
+			L.Push(ud)
+			return 1
+		}))
+	case "SetFocus":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			form.SetFocus(L.CheckInt(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetHorizontal":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			form.SetHorizontal(L.CheckBool(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetItemPadding":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			form.SetItemPadding(L.CheckInt(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetButtonsAlign":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			form.SetButtonsAlign(L.CheckInt(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetLabelColor":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			form.SetLabelColor(tuiCheckColor(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetFieldBackgroundColor":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			form.SetFieldBackgroundColor(tuiCheckColor(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetFieldTextColor":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			form.SetFieldTextColor(tuiCheckColor(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetButtonBackgroundColor":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			form.SetButtonBackgroundColor(tuiCheckColor(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetButtonTextColor":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			form.SetButtonTextColor(tuiCheckColor(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetCancelFunc":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			fn := L.CheckFunction(2)
+			form.SetCancelFunc(func() {
+				tuiCall(L, fn, 0)
+			})
+			L.Push(ud)
+			return 1
+		}))
+	default:
+		tuiBoxIndex(L, ud, form.Box, method)
+	}
+
+	return 1
+}
+
+func modalIndex(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	modal := ud.Value.(*tview.Modal)
+	method := L.CheckString(2)
+
+	switch method {
+	case "SetText":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			modal.SetText(L.CheckString(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "AddButtons":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			modal.AddButtons(tuiCheckStrings(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	case "ClearButtons":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			modal.ClearButtons()
+			L.Push(ud)
+			return 1
+		}))
+	case "SetFocus":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			modal.SetFocus(L.CheckInt(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetDoneFunc":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			fn := L.CheckFunction(2)
+			modal.SetDoneFunc(func(index int, label string) {
+				tuiCall(L, fn, 0, lua.LNumber(index), lua.LString(label))
+			})
+			L.Push(ud)
+			return 1
+		}))
+	case "SetBackgroundColor":
+		// The modal's frame has its own background
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			modal.SetBackgroundColor(tuiCheckColor(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetTextColor":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			modal.SetTextColor(tuiCheckColor(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetButtonBackgroundColor":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			modal.SetButtonBackgroundColor(tuiCheckColor(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetButtonTextColor":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			modal.SetButtonTextColor(tuiCheckColor(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	default:
+		tuiBoxIndex(L, ud, modal.Box, method)
+	}
+
+	return 1
+}
+
+func pagesIndex(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	pages := ud.Value.(*tview.Pages)
+	method := L.CheckString(2)
+
+	switch method {
+	case "AddPage":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			pages.AddPage(L.CheckString(2), tuiCheckPrimitive(L, 3), L.OptBool(4, true), L.OptBool(5, true))
+			L.Push(ud)
+			return 1
+		}))
+	case "AddAndSwitchToPage":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			pages.AddAndSwitchToPage(L.CheckString(2), tuiCheckPrimitive(L, 3), L.OptBool(4, true))
+			L.Push(ud)
+			return 1
+		}))
+	case "RemovePage", "ShowPage", "HidePage", "SwitchToPage", "SendToFront", "SendToBack":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			name := L.CheckString(2)
+			switch method {
+			case "RemovePage":
+				pages.RemovePage(name)
+			case "ShowPage":
+				pages.ShowPage(name)
+			case "HidePage":
+				pages.HidePage(name)
+			case "SwitchToPage":
+				pages.SwitchToPage(name)
+			case "SendToFront":
+				pages.SendToFront(name)
+			case "SendToBack":
+				pages.SendToBack(name)
+			}
+			L.Push(ud)
+			return 1
+		}))
+	case "HasPage":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LBool(pages.HasPage(L.CheckString(2))))
+			return 1
+		}))
+	case "GetFrontPage":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			name, item := pages.GetFrontPage()
+			if item == nil {
+				L.Push(lua.LNil)
+				return 1
+			}
+			L.Push(lua.LString(name))
+			L.Push(tuiNewUserData(L, item))
+			return 2
+		}))
+	case "GetPageCount":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LNumber(pages.GetPageCount()))
+			return 1
+		}))
+	case "GetPageNames":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			names := L.NewTable()
+			for _, name := range pages.GetPageNames(L.OptBool(2, false)) {
+				names.Append(lua.LString(name))
+			}
+			L.Push(names)
+			return 1
+		}))
+	case "SetChangedFunc":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			fn := L.CheckFunction(2)
+			pages.SetChangedFunc(func() {
+				tuiCall(L, fn, 0)
+			})
+			L.Push(ud)
+			return 1
+		}))
+	default:
+		tuiBoxIndex(L, ud, pages.Box, method)
+	}
+
+	return 1
+}
+
+func gridIndex(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	grid := ud.Value.(*tview.Grid)
+	method := L.CheckString(2)
+
+	// sizes reads the row or column sizes passed as arguments
+	sizes := func(L *lua.LState) []int {
+		var sizes []int
+		for i := 2; i <= L.GetTop(); i++ {
+			sizes = append(sizes, L.CheckInt(i))
+		}
+		return sizes
+	}
+
+	switch method {
+	case "SetRows":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			grid.SetRows(sizes(L)...)
+			L.Push(ud)
+			return 1
+		}))
+	case "SetColumns":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			grid.SetColumns(sizes(L)...)
+			L.Push(ud)
+			return 1
+		}))
+	case "SetGap":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			grid.SetGap(L.CheckInt(2), L.CheckInt(3))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetMinSize":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			grid.SetMinSize(L.CheckInt(2), L.CheckInt(3))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetBorders":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			grid.SetBorders(L.CheckBool(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetBordersColor":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			grid.SetBordersColor(tuiCheckColor(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	case "AddItem":
+		// grid:AddItem(item, row, column, rowSpan, colSpan, minHeight, minWidth, focus)
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			item := tuiCheckPrimitive(L, 2)
+			grid.AddItem(item, L.CheckInt(3), L.CheckInt(4), L.OptInt(5, 1), L.OptInt(6, 1),
+				L.OptInt(7, 0), L.OptInt(8, 0), L.OptBool(9, false))
+			L.Push(ud)
+			return 1
+		}))
+	case "RemoveItem":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			grid.RemoveItem(tuiCheckPrimitive(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	case "Clear":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			grid.Clear()
+			L.Push(ud)
+			return 1
+		}))
+	default:
+		tuiBoxIndex(L, ud, grid.Box, method)
+	}
+
+	return 1
+}
+
+func dropDownIndex(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	dropDown := ud.Value.(*tview.DropDown)
+	method := L.CheckString(2)
+
+	// optionHandler adapts a callback receiving the option text and index
+	optionHandler := func(fn *lua.LFunction) func(string, int) {
+		if fn == nil {
+			return nil
+		}
+		return func(text string, index int) {
+			tuiCall(L, fn, 0, lua.LString(text), lua.LNumber(index))
+		}
+	}
+
+	switch method {
+	case "SetLabel":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			dropDown.SetLabel(L.CheckString(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "GetLabel":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LString(dropDown.GetLabel()))
+			return 1
+		}))
+	case "SetOptions":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			dropDown.SetOptions(tuiCheckStrings(L, 2), optionHandler(L.OptFunction(3, nil)))
+			L.Push(ud)
+			return 1
+		}))
+	case "AddOption":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			var selected func()
+			if fn := L.OptFunction(3, nil); fn != nil {
+				selected = func() { tuiCall(L, fn, 0) }
+			}
+			dropDown.AddOption(L.CheckString(2), selected)
+			L.Push(ud)
+			return 1
+		}))
+	case "RemoveOption":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			dropDown.RemoveOption(L.CheckInt(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "GetOptionCount":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LNumber(dropDown.GetOptionCount()))
+			return 1
+		}))
+	case "SetCurrentOption":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			dropDown.SetCurrentOption(L.CheckInt(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "GetCurrentOption":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			index, text := dropDown.GetCurrentOption()
+			L.Push(lua.LNumber(index))
+			L.Push(lua.LString(text))
+			return 2
+		}))
+	case "SetFieldWidth":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			dropDown.SetFieldWidth(L.CheckInt(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetLabelColor":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			dropDown.SetLabelColor(tuiCheckColor(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetFieldBackgroundColor":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			dropDown.SetFieldBackgroundColor(tuiCheckColor(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetFieldTextColor":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			dropDown.SetFieldTextColor(tuiCheckColor(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetSelectedFunc":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			dropDown.SetSelectedFunc(optionHandler(L.CheckFunction(2)))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetDoneFunc":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			fn := L.CheckFunction(2)
+			dropDown.SetDoneFunc(func(key tcell.Key) {
+				tuiCall(L, fn, 0, lua.LNumber(key))
+			})
+			L.Push(ud)
+			return 1
+		}))
+	default:
+		tuiBoxIndex(L, ud, dropDown.Box, method)
+	}
+
+	return 1
+}
+
+func checkboxIndex(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	checkbox := ud.Value.(*tview.Checkbox)
+	method := L.CheckString(2)
+
+	switch method {
+	case "SetLabel":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			checkbox.SetLabel(L.CheckString(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "GetLabel":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LString(checkbox.GetLabel()))
+			return 1
+		}))
+	case "SetChecked":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			checkbox.SetChecked(L.CheckBool(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "IsChecked":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LBool(checkbox.IsChecked()))
+			return 1
+		}))
+	case "SetCheckedString":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			checkbox.SetCheckedString(L.CheckString(2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetLabelColor":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			checkbox.SetLabelColor(tuiCheckColor(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetFieldBackgroundColor":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			checkbox.SetFieldBackgroundColor(tuiCheckColor(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetFieldTextColor":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			checkbox.SetFieldTextColor(tuiCheckColor(L, 2))
+			L.Push(ud)
+			return 1
+		}))
+	case "SetChangedFunc":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			fn := L.CheckFunction(2)
+			checkbox.SetChangedFunc(func(checked bool) {
+				tuiCall(L, fn, 0, lua.LBool(checked))
+			})
+			L.Push(ud)
+			return 1
+		}))
+	case "SetDoneFunc":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			fn := L.CheckFunction(2)
+			checkbox.SetDoneFunc(func(key tcell.Key) {
+				tuiCall(L, fn, 0, lua.LNumber(key))
+			})
+			L.Push(ud)
+			return 1
+		}))
+	default:
+		tuiBoxIndex(L, ud, checkbox.Box, method)
+	}
+
+	return 1
+}
+
+func progressBarIndex(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	bar := ud.Value.(*TUIProgressBar)
+	method := L.CheckString(2)
+
+	switch method {
+	case "SetValue":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			bar.SetValue(float64(L.CheckNumber(2)))
+			L.Push(ud)
+			return 1
+		}))
+	case "GetValue":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LNumber(bar.value))
+			return 1
+		}))
+	case "SetMax":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			max := float64(L.CheckNumber(2))
+			if max <= 0 {
+				L.ArgError(2, "maximum must be positive")
+			}
+			bar.max = max
+			bar.SetValue(bar.value)
+			L.Push(ud)
+			return 1
+		}))
+	case "GetMax":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LNumber(bar.max))
+			return 1
+		}))
+	case "SetLabel":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			bar.label = L.CheckString(2)
+			L.Push(ud)
+			return 1
+		}))
+	case "SetShowPercent":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			bar.showPercent = L.CheckBool(2)
+			L.Push(ud)
+			return 1
+		}))
+	case "SetFilledColor":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			bar.filledColor = tuiCheckColor(L, 2)
+			L.Push(ud)
+			return 1
+		}))
+	case "SetEmptyColor":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			bar.emptyColor = tuiCheckColor(L, 2)
+			L.Push(ud)
+			return 1
+		}))
+	case "SetChangedFunc":
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			fn := L.CheckFunction(2)
+			bar.changed = func(value float64) {
+				tuiCall(L, fn, 0, lua.LNumber(value))
+			}
+			L.Push(ud)
+			return 1
+		}))
+	default:
+		tuiBoxIndex(L, ud, bar.Box, method)
+	}
+
+	return 1
+}
@@ -0,0 +1,56 @@
+// yaml_functions.go - YAML module implementation for Hype
+package main
+
+import (
+	"github.com/yuin/gopher-lua"
+	"gopkg.in/yaml.v2"
+)
+
+// registerYAMLModule adds YAML encoding and decoding to Lua
+func registerYAMLModule(L *lua.LState) {
+	L.PreloadModule("yaml", func(L *lua.LState) int {
+		yamlModule := L.NewTable()
+
+		L.SetField(yamlModule, "encode", L.NewFunction(yamlEncode))
+		L.SetField(yamlModule, "decode", L.NewFunction(yamlDecode))
+		L.SetField(yamlModule, "null", jsonNullSentinel(L))
+
+		L.Push(yamlModule)
+		return 1
+	})
+}
+
+// yamlEncode converts a Lua value to a YAML document
+func yamlEncode(L *lua.LState) int {
+	value, err := luaValueToGo(L, L.CheckAny(1))
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString("cannot encode YAML: " + err.Error()))
+		return 2
+	}
+
+	data, err := yaml.Marshal(value)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString("cannot encode YAML: " + err.Error()))
+		return 2
+	}
+
+	L.Push(lua.LString(string(data)))
+	return 1
+}
+
+// yamlDecode parses a YAML document into Lua values
+func yamlDecode(L *lua.LState) int {
+	data := L.CheckString(1)
+
+	var value interface{}
+	if err := yaml.Unmarshal([]byte(data), &value); err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	L.Push(goValueToLua(L, value))
+	return 1
+}